@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AdminConfig contains configuration for the admin API
+type AdminConfig struct {
+	// Address the admin HTTP server listens on (the admin API is disabled when empty)
+	ListenAddr string
+	// Bearer token required on every admin request
+	Token string
+}
+
+// AdminServer exposes plugin state to operators over an authenticated HTTP API
+type AdminServer struct {
+	// Handler serving requests, replaced when the configuration is reloaded
+	source handlerSource
+	config AdminConfig
+}
+
+// HookView is the admin representation of a registered hook
+type HookView struct {
+	Name         string            `json:"name"`
+	Types        []string          `json:"types"`
+	ConfigSchema []HookConfigField `json:"config_schema"`
+	Steps        []string          `json:"steps,omitempty"`
+}
+
+// IdempotencyEntryView is the admin representation of an idempotency entry
+type IdempotencyEntryView struct {
+	ClientID       string    `json:"client_id"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	RequestHash    string    `json:"request_hash"`
+	StatusCode     int32     `json:"status_code"`
+	Status         string    `json:"status"`
+	CreatedAt      time.Time `json:"created_at"`
+	AgeSeconds     int64     `json:"age_seconds"`
+	ExpiresAt      time.Time `json:"expires_at"`
+}
+
+// NewAdminServer creates a new admin server for the given handler
+func NewAdminServer(source handlerSource, config AdminConfig) *AdminServer {
+	return &AdminServer{
+		source: source,
+		config: config,
+	}
+}
+
+// handler returns the handler currently serving requests
+func (a *AdminServer) handler() *DPoPHandler {
+	return a.source.Handler()
+}
+
+// Routes returns the HTTP handler serving the admin API
+func (a *AdminServer) Routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/idempotency", a.listEntries)
+	mux.HandleFunc("GET /admin/idempotency/{clientId}/{idempotencyKey}", a.getEntry)
+	mux.HandleFunc("DELETE /admin/idempotency/{clientId}/{idempotencyKey}", a.purgeEntry)
+	mux.HandleFunc("DELETE /admin/idempotency/{clientId}", a.purgeClient)
+	mux.HandleFunc("GET /admin/metrics", a.getMetrics)
+	mux.HandleFunc("GET /admin/metrics/circuit-breakers", a.getCircuitBreakerMetrics)
+	mux.HandleFunc("GET /admin/hooks", a.listHooks)
+	mux.HandleFunc("GET /admin/deliveries", a.listDeliveries)
+	mux.HandleFunc("GET /admin/deliveries/{eventId}", a.getDelivery)
+	mux.HandleFunc("GET /admin/dead-letters", a.listDeadLetters)
+	mux.HandleFunc("GET /admin/dead-letters/{id}", a.getDeadLetter)
+	mux.HandleFunc("POST /admin/dead-letters/{id}/replay", a.replayDeadLetter)
+	mux.HandleFunc("DELETE /admin/dead-letters/{id}", a.purgeDeadLetter)
+	return a.authenticate(mux)
+}
+
+// ListenAndServe serves the admin API until the context is cancelled
+func (a *AdminServer) ListenAndServe(ctx context.Context) error {
+	log.Infof("Starting admin API on %s", a.config.ListenAddr)
+	server := &http.Server{
+		Addr:              a.config.ListenAddr,
+		Handler:           a.Routes(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return serveHTTP(ctx, server)
+}
+
+// authenticate rejects requests that do not carry the configured bearer token
+func (a *AdminServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.config.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) != 1 {
+			a.audit(r, "authenticate", "denied", nil)
+			writeAdminError(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listEntries lists the idempotency entries stored for a client
+func (a *AdminServer) listEntries(w http.ResponseWriter, r *http.Request) {
+	clientID := r.URL.Query().Get("client_id")
+	if clientID == "" {
+		a.audit(r, "list_entries", "rejected", nil)
+		writeAdminError(w, "client_id query parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	// Client IDs may contain the key separator, so entries are matched on
+	// the client they were stored for rather than on a key prefix
+	entries := []IdempotencyEntryView{}
+	idempotencyStore.Range(func(_, value interface{}) bool {
+		if entry := value.(IdempotencyEntry); entry.ClientID == clientID {
+			entries = append(entries, a.entryView(clientID, entry.IdempotencyKey, entry))
+		}
+		return true
+	})
+
+	// Oldest entries first
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	a.audit(r, "list_entries", "success", logrus.Fields{"client_id": clientID, "count": len(entries)})
+	writeAdminJSON(w, entries, http.StatusOK)
+}
+
+// getEntry returns a single idempotency entry
+func (a *AdminServer) getEntry(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("clientId")
+	idempotencyKey := r.PathValue("idempotencyKey")
+	fields := logrus.Fields{"client_id": clientID, "idempotency_key": idempotencyKey}
+
+	val, found := idempotencyStore.Load(idempotencyCacheKey(clientID, idempotencyKey))
+	if !found {
+		a.audit(r, "get_entry", "not_found", fields)
+		writeAdminError(w, "Idempotency entry not found", http.StatusNotFound)
+		return
+	}
+
+	a.audit(r, "get_entry", "success", fields)
+	writeAdminJSON(w, a.entryView(clientID, idempotencyKey, val.(IdempotencyEntry)), http.StatusOK)
+}
+
+// purgeEntry removes a single idempotency entry
+func (a *AdminServer) purgeEntry(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("clientId")
+	idempotencyKey := r.PathValue("idempotencyKey")
+	fields := logrus.Fields{"client_id": clientID, "idempotency_key": idempotencyKey}
+
+	if _, found := idempotencyStore.LoadAndDelete(idempotencyCacheKey(clientID, idempotencyKey)); !found {
+		a.audit(r, "purge_entry", "not_found", fields)
+		writeAdminError(w, "Idempotency entry not found", http.StatusNotFound)
+		return
+	}
+
+	a.audit(r, "purge_entry", "success", fields)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeClient removes every idempotency entry stored for a client
+func (a *AdminServer) purgeClient(w http.ResponseWriter, r *http.Request) {
+	clientID := r.PathValue("clientId")
+
+	removed := 0
+	idempotencyStore.Range(func(key, value interface{}) bool {
+		if value.(IdempotencyEntry).ClientID == clientID {
+			idempotencyStore.Delete(key)
+			removed++
+		}
+		return true
+	})
+
+	a.audit(r, "purge_client", "success", logrus.Fields{"client_id": clientID, "removed": removed})
+	writeAdminJSON(w, map[string]int{"removed": removed}, http.StatusOK)
+}
+
+// getMetrics returns the idempotency store metrics
+func (a *AdminServer) getMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := a.handler().GetMetrics()
+	a.audit(r, "get_metrics", "success", nil)
+	writeAdminJSON(w, &metrics, http.StatusOK)
+}
+
+// getCircuitBreakerMetrics returns the circuit breaker state changes and the state of every target host
+func (a *AdminServer) getCircuitBreakerMetrics(w http.ResponseWriter, r *http.Request) {
+	metrics := a.handler().breakers.Snapshot()
+	a.audit(r, "get_circuit_breaker_metrics", "success", nil)
+	writeAdminJSON(w, &metrics, http.StatusOK)
+}
+
+// listHooks lists the registered hooks with their hook types and config fields
+func (a *AdminServer) listHooks(w http.ResponseWriter, r *http.Request) {
+	hooks := []HookView{}
+	for _, hook := range a.handler().hookRegistry().Hooks() {
+		view := HookView{Name: hook.Name, Types: []string{}, ConfigSchema: hook.ConfigSchema, Steps: hook.Steps}
+		for _, hookType := range hook.Types {
+			view.Types = append(view.Types, hookType.String())
+		}
+		if view.ConfigSchema == nil {
+			view.ConfigSchema = []HookConfigField{}
+		}
+		hooks = append(hooks, view)
+	}
+
+	a.audit(r, "list_hooks", "success", logrus.Fields{"count": len(hooks)})
+	writeAdminJSON(w, hooks, http.StatusOK)
+}
+
+// listDeliveries lists the queued deliveries, optionally filtered by state
+func (a *AdminServer) listDeliveries(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	deliveries := a.handler().deliveryQueue.List(state)
+	a.audit(r, "list_deliveries", "success", logrus.Fields{"state": state, "count": len(deliveries)})
+	writeAdminJSON(w, deliveries, http.StatusOK)
+}
+
+// getDelivery returns the delivery status and attempt history of an event
+func (a *AdminServer) getDelivery(w http.ResponseWriter, r *http.Request) {
+	eventID := r.PathValue("eventId")
+	fields := logrus.Fields{"event_id": eventID}
+
+	status, found := a.handler().deliveryQueue.Status(eventID)
+	if !found {
+		a.audit(r, "get_delivery", "not_found", fields)
+		writeAdminError(w, "Delivery not found", http.StatusNotFound)
+		return
+	}
+
+	a.audit(r, "get_delivery", "success", fields)
+	writeAdminJSON(w, &status, http.StatusOK)
+}
+
+// listDeadLetters lists the requests whose delivery failed
+func (a *AdminServer) listDeadLetters(w http.ResponseWriter, r *http.Request) {
+	letters := a.handler().deadLetters.List()
+	for i := range letters {
+		letters[i] = a.redactDeadLetter(letters[i])
+	}
+	a.audit(r, "list_dead_letters", "success", logrus.Fields{"count": len(letters)})
+	writeAdminJSON(w, letters, http.StatusOK)
+}
+
+// getDeadLetter returns a single dead letter with its delivery attempts
+func (a *AdminServer) getDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	fields := logrus.Fields{"dead_letter_id": id}
+
+	letter, found := a.handler().deadLetters.Get(id)
+	if !found {
+		a.audit(r, "get_dead_letter", "not_found", fields)
+		writeAdminError(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	letter = a.redactDeadLetter(letter)
+	a.audit(r, "get_dead_letter", "success", fields)
+	writeAdminJSON(w, &letter, http.StatusOK)
+}
+
+// replayDeadLetter redelivers a dead letter, removing it once delivered
+func (a *AdminServer) replayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	fields := logrus.Fields{"dead_letter_id": id}
+
+	letter, err := a.handler().ReplayDeadLetter(r.Context(), id)
+	if errors.Is(err, errDeadLetterNotFound) {
+		a.audit(r, "replay_dead_letter", "not_found", fields)
+		writeAdminError(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+	redacted := a.redactDeadLetter(*letter)
+	if err != nil {
+		fields["error"] = err.Error()
+		a.audit(r, "replay_dead_letter", "failed", fields)
+		status := http.StatusBadGateway
+		// The target policy changed since the request was dead-lettered
+		if errors.Is(err, errTargetNotAllowed) {
+			status = http.StatusForbidden
+		}
+		writeAdminJSON(w, &redacted, status)
+		return
+	}
+
+	a.audit(r, "replay_dead_letter", "success", fields)
+	writeAdminJSON(w, &redacted, http.StatusOK)
+}
+
+// redactDeadLetter masks the sensitive headers and body fields of a dead
+// letter's request, as they are in the logs, and its sealed credentials
+func (a *AdminServer) redactDeadLetter(letter DeadLetter) DeadLetter {
+	if letter.Credentials != "" {
+		letter.Credentials = redactedValue
+	}
+	if letter.Request == nil {
+		return letter
+	}
+	redactor := a.handler().logRedactor()
+	request := *letter.Request
+	request.Headers = redactor.Headers(request.Headers)
+	request.Body = redactor.Body(request.Body)
+	letter.Request = &request
+	return letter
+}
+
+// purgeDeadLetter removes a dead letter without replaying it
+func (a *AdminServer) purgeDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	fields := logrus.Fields{"dead_letter_id": id}
+
+	if !a.handler().deadLetters.Delete(id) {
+		a.audit(r, "purge_dead_letter", "not_found", fields)
+		writeAdminError(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	a.audit(r, "purge_dead_letter", "success", fields)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// entryView converts a stored entry to its admin representation
+func (a *AdminServer) entryView(clientID, idempotencyKey string, entry IdempotencyEntry) IdempotencyEntryView {
+	now := time.Now()
+	expiresAt := entry.expiresAt(a.handler().config.ExpirationTime)
+
+	status := "active"
+	if now.After(expiresAt) {
+		status = "expired"
+	}
+
+	return IdempotencyEntryView{
+		ClientID:       clientID,
+		IdempotencyKey: idempotencyKey,
+		RequestHash:    entry.RequestHash,
+		StatusCode:     entry.StatusCode,
+		Status:         status,
+		CreatedAt:      entry.CreatedAt,
+		AgeSeconds:     int64(now.Sub(entry.CreatedAt).Seconds()),
+		ExpiresAt:      expiresAt,
+	}
+}
+
+// audit records an admin action in the audit log
+func (a *AdminServer) audit(r *http.Request, action, outcome string, fields logrus.Fields) {
+	entry := log.WithFields(logrus.Fields{
+		"audit":       true,
+		"action":      action,
+		"outcome":     outcome,
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"remote_addr": r.RemoteAddr,
+	})
+	if fields != nil {
+		entry = entry.WithFields(fields)
+	}
+	entry.Info("Admin API action")
+}
+
+// writeAdminJSON writes a JSON response
+func writeAdminJSON(w http.ResponseWriter, body interface{}, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Errorf("Failed to write admin response: %v", err)
+	}
+}
+
+// writeAdminError writes a JSON error response
+func writeAdminError(w http.ResponseWriter, message string, statusCode int) {
+	writeAdminJSON(w, map[string]string{"error": message}, statusCode)
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAdminServer creates an admin server backed by a fresh idempotency store
+func newTestAdminServer(t *testing.T) *httptest.Server {
+	// Reset the global idempotency store
+	idempotencyStore.Clear()
+	t.Cleanup(idempotencyStore.Clear)
+
+	handler := &DPoPHandler{
+		metrics: &IdempotencyMetrics{},
+		config:  defaultConfig,
+	}
+
+	server := httptest.NewServer(NewAdminServer(handler, AdminConfig{Token: "admin-token"}).Routes())
+	t.Cleanup(server.Close)
+	return server
+}
+
+// adminRequest sends an authenticated request to the admin API
+func adminRequest(t *testing.T, method, url string) *http.Response {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer admin-token")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// TestAdminRequiresToken tests that requests without the admin token are rejected
+func TestAdminRequiresToken(t *testing.T) {
+	server := newTestAdminServer(t)
+
+	resp, err := http.Get(server.URL + "/admin/metrics")
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+}
+
+// TestAdminListAndGetEntries tests listing and inspecting idempotency entries
+func TestAdminListAndGetEntries(t *testing.T) {
+	server := newTestAdminServer(t)
+
+	createdAt := time.Now().Add(-time.Hour)
+	idempotencyStore.Store(idempotencyCacheKey("client-a", "key-1"), IdempotencyEntry{
+		ClientID:       "client-a",
+		IdempotencyKey: "key-1",
+		RequestHash:    "hash-1",
+		StatusCode:     http.StatusCreated,
+		CreatedAt:      createdAt,
+	})
+	idempotencyStore.Store(idempotencyCacheKey("client-b", "key-2"), IdempotencyEntry{
+		ClientID:       "client-b",
+		IdempotencyKey: "key-2",
+		RequestHash:    "hash-2",
+		CreatedAt:      createdAt,
+	})
+	// A client whose ID starts with the ID of client-a and the key separator
+	idempotencyStore.Store(idempotencyCacheKey("client-a:tpp", "key-3"), IdempotencyEntry{
+		ClientID:       "client-a:tpp",
+		IdempotencyKey: "key-3",
+		RequestHash:    "hash-3",
+		CreatedAt:      createdAt,
+	})
+
+	// List entries for client-a only
+	resp := adminRequest(t, http.MethodGet, server.URL+"/admin/idempotency?client_id=client-a")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var entries []IdempotencyEntryView
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(entries) != 1 || entries[0].IdempotencyKey != "key-1" {
+		t.Fatalf("Expected only key-1 for client-a, got %+v", entries)
+	}
+
+	// Get a single entry
+	resp = adminRequest(t, http.MethodGet, server.URL+"/admin/idempotency/client-a/key-1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var entry IdempotencyEntryView
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if entry.RequestHash != "hash-1" {
+		t.Errorf("Expected request hash hash-1, got %s", entry.RequestHash)
+	}
+	if entry.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status code %d, got %d", http.StatusCreated, entry.StatusCode)
+	}
+	if entry.Status != "active" {
+		t.Errorf("Expected status active, got %s", entry.Status)
+	}
+	if entry.AgeSeconds < 3600 {
+		t.Errorf("Expected age of at least 3600 seconds, got %d", entry.AgeSeconds)
+	}
+
+	// Unknown entries return 404
+	resp = adminRequest(t, http.MethodGet, server.URL+"/admin/idempotency/client-a/missing")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+// TestAdminPurge tests purging entries by key and by client
+func TestAdminPurge(t *testing.T) {
+	server := newTestAdminServer(t)
+
+	for _, entry := range []IdempotencyEntry{
+		{ClientID: "client-a", IdempotencyKey: "key-1"},
+		{ClientID: "client-a", IdempotencyKey: "key-2"},
+		{ClientID: "client-b", IdempotencyKey: "key-3"},
+		{ClientID: "client-a:tpp", IdempotencyKey: "key-4"},
+	} {
+		entry.CreatedAt = time.Now()
+		idempotencyStore.Store(idempotencyCacheKey(entry.ClientID, entry.IdempotencyKey), entry)
+	}
+
+	// Purge a single key
+	resp := adminRequest(t, http.MethodDelete, server.URL+"/admin/idempotency/client-a/key-1")
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if _, found := idempotencyStore.Load(idempotencyCacheKey("client-a", "key-1")); found {
+		t.Error("Entry key-1 was not purged")
+	}
+
+	// Purge the remaining entries of client-a
+	resp = adminRequest(t, http.MethodDelete, server.URL+"/admin/idempotency/client-a")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var result map[string]int
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if result["removed"] != 1 {
+		t.Errorf("Expected 1 entry removed, got %d", result["removed"])
+	}
+
+	// Entries of other clients are untouched
+	if _, found := idempotencyStore.Load(idempotencyCacheKey("client-b", "key-3")); !found {
+		t.Error("Entry of client-b was purged")
+	}
+	if _, found := idempotencyStore.Load(idempotencyCacheKey("client-a:tpp", "key-4")); !found {
+		t.Error("Entry of client-a:tpp was purged")
+	}
+}
+
+// TestAdminMetrics tests that the store metrics are exposed
+func TestAdminMetrics(t *testing.T) {
+	server := newTestAdminServer(t)
+
+	idempotencyStore.Store(idempotencyCacheKey("client-a", "key-1"), IdempotencyEntry{CreatedAt: time.Now()})
+
+	resp := adminRequest(t, http.MethodGet, server.URL+"/admin/metrics")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var metrics map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if metrics["current_entries"] != float64(1) {
+		t.Errorf("Expected 1 current entry, got %v", metrics["current_entries"])
+	}
+}
+
+// TestAdminDeadLetters tests inspecting and purging dead letters
+func TestAdminDeadLetters(t *testing.T) {
+	store, err := NewDeadLetterStore(defaultDeadLetterConfig)
+	if err != nil {
+		t.Fatalf("NewDeadLetterStore returned an error: %v", err)
+	}
+	store.Add(&DeadLetter{ID: "letter-1", Request: &outboundRequest{
+		URL:     "https://tpp.example.com/callback",
+		Headers: map[string]string{"Authorization": "Bearer secret-access-token", "X-Jws-Signature": "signature"},
+		Body:    `{"Data":{"DebtorAccount":{"Identification":"12345678"}}}`,
+	}, Credentials: "sealed-credentials", CreatedAt: time.Now()})
+
+	handler := &DPoPHandler{metrics: &IdempotencyMetrics{}, deadLetters: store}
+	server := httptest.NewServer(NewAdminServer(handler, AdminConfig{Token: "admin-token"}).Routes())
+	defer server.Close()
+
+	resp := adminRequest(t, http.MethodGet, server.URL+"/admin/dead-letters/letter-1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	var letter DeadLetter
+	if err := json.NewDecoder(resp.Body).Decode(&letter); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if letter.Request == nil || letter.Request.URL != "https://tpp.example.com/callback" {
+		t.Errorf("Expected the dead letter request, got %+v", letter.Request)
+	}
+	// Dead letters stored before credentials were stripped are still masked
+	if letter.Request.Headers["Authorization"] != redactedValue || letter.Request.Headers["X-Jws-Signature"] != "signature" {
+		t.Errorf("Expected the credentials to be masked, got %v", letter.Request.Headers)
+	}
+	if strings.Contains(letter.Request.Body, "12345678") {
+		t.Errorf("Expected the account to be masked, got %s", letter.Request.Body)
+	}
+	if letter.Credentials != redactedValue {
+		t.Errorf("Expected the sealed credentials to be masked, got %q", letter.Credentials)
+	}
+
+	if resp := adminRequest(t, http.MethodDelete, server.URL+"/admin/dead-letters/letter-1"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if resp := adminRequest(t, http.MethodPost, server.URL+"/admin/dead-letters/letter-1/replay"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// apiConfigData is the raw form of the hook settings in the API config data.
+// Other fields are ignored, as the config data may also configure other plugins.
+type apiConfigData struct {
+	JWSProfile      string   `json:"jws_profile"`
+	JWSKeyID        string   `json:"jws_key_id"`
+	IdempotencyTTL  string   `json:"idempotency_ttl"`
+	DPoPRequired    *bool    `json:"dpop_required"`
+	DPoPProofMaxAge string   `json:"dpop_proof_max_age"`
+	RequiredScopes  []string `json:"required_scopes"`
+}
+
+// APIConfig holds the hook settings an API chooses in its config data, so APIs
+// served by the same plugin can sign, replay and authorise differently
+type APIConfig struct {
+	// JWS header profile (default: the plugin-wide profile)
+	JWSProfile JWSProfile
+	// Key ID of the signing key (default: the active key)
+	JWSKeyID string
+	// How long idempotent responses are replayed (default: the plugin-wide expiration time)
+	IdempotencyTTL time.Duration
+	// Reject requests without a DPoP proof; with false, plain Bearer tokens
+	// are accepted, while DPoP proofs sent are still validated (default: true)
+	DPoPRequired bool
+	// Maximum age of a DPoP proof by its iat claim (default: 0, not checked)
+	DPoPProofMaxAge time.Duration
+	// Scopes the access token must carry in its scope claim (default: none)
+	RequiredScopes []string
+}
+
+// parseAPIConfig validates the API config data. Settings left out are zero and
+// receive their defaults from the handler.
+func parseAPIConfig(configData string) (*APIConfig, error) {
+	config := &APIConfig{DPoPRequired: true}
+	if configData == "" {
+		return config, nil
+	}
+
+	var data apiConfigData
+	if err := json.Unmarshal([]byte(configData), &data); err != nil {
+		return nil, fmt.Errorf("failed to parse API config data: %w", err)
+	}
+
+	if data.JWSProfile != "" {
+		profile, err := parseJWSProfile(data.JWSProfile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jws_profile: %w", err)
+		}
+		config.JWSProfile = profile
+	}
+	config.JWSKeyID = data.JWSKeyID
+
+	var err error
+	if config.IdempotencyTTL, err = parseAPIDuration("idempotency_ttl", data.IdempotencyTTL); err != nil {
+		return nil, err
+	}
+	if config.DPoPProofMaxAge, err = parseAPIDuration("dpop_proof_max_age", data.DPoPProofMaxAge); err != nil {
+		return nil, err
+	}
+	if data.DPoPRequired != nil {
+		config.DPoPRequired = *data.DPoPRequired
+	}
+
+	for _, scope := range data.RequiredScopes {
+		if scope == "" || strings.ContainsAny(scope, " \t") {
+			return nil, fmt.Errorf("invalid required_scopes entry: %q", scope)
+		}
+	}
+	config.RequiredScopes = data.RequiredScopes
+
+	return config, nil
+}
+
+// parseAPIDuration parses an optional positive duration setting such as "10m"
+func parseAPIDuration(name, value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be positive, got %s", name, value)
+	}
+	return duration, nil
+}
+
+// apiConfigEntry is the parsed config data of one version of an API
+type apiConfigEntry struct {
+	version string
+	config  *APIConfig
+	err     error
+}
+
+// APIConfigCache holds the parsed config data of each API, so it is parsed
+// once per API definition version rather than on every request
+type APIConfigCache struct {
+	mu      sync.Mutex
+	entries map[string]apiConfigEntry
+}
+
+// NewAPIConfigCache creates an empty API config cache
+func NewAPIConfigCache() *APIConfigCache {
+	return &APIConfigCache{entries: map[string]apiConfigEntry{}}
+}
+
+// configDataVersion identifies a version of the config data by its hash, as
+// Tyk does not send the version of the API definition
+func configDataVersion(configData string) string {
+	sum := sha256.Sum256([]byte(configData))
+	return hex.EncodeToString(sum[:])
+}
+
+// Get returns the parsed config data of the API, parsing it when the API is
+// new or its config data changed. Invalid config data is cached too, so it is
+// reported once per version.
+func (c *APIConfigCache) Get(ctx context.Context, apiID, configData string) (*APIConfig, error) {
+	if c == nil {
+		return parseAPIConfig(configData)
+	}
+
+	version := configDataVersion(configData)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[apiID]; ok && entry.version == version {
+		return entry.config, entry.err
+	}
+
+	config, err := parseAPIConfig(configData)
+	if err != nil {
+		logger(ctx).WithFields(logrus.Fields{"api_id": apiID, "version": version[:12]}).Errorf("Invalid API config data: %v", err)
+	} else {
+		logger(ctx).WithFields(logrus.Fields{"api_id": apiID, "version": version[:12]}).Info("Loaded API config data")
+	}
+	c.entries[apiID] = apiConfigEntry{version: version, config: config, err: err}
+	return config, err
+}
+
+// Len returns the number of APIs cached
+func (c *APIConfigCache) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// apiConfig returns the settings of the API calling the hook, with the
+// plugin-wide defaults filled in
+func (d *DPoPHandler) apiConfig(ctx context.Context, object *pb.Object) (APIConfig, error) {
+	spec := object.GetSpec()
+	parsed, err := d.apiConfigs.Get(ctx, spec["APIID"], spec["config_data"])
+	if err != nil {
+		return APIConfig{}, err
+	}
+
+	config := *parsed
+	if config.JWSProfile == "" {
+		config.JWSProfile = d.jwsConfig.Profile
+	}
+	if config.IdempotencyTTL == 0 {
+		config.IdempotencyTTL = d.config.ExpirationTime
+	}
+	return config, nil
+}
+
+// missingScopes returns the required scopes not granted by a space-separated scope claim
+func (c *APIConfig) missingScopes(scopeClaim string) []string {
+	granted := strings.Fields(scopeClaim)
+	var missing []string
+	for _, scope := range c.RequiredScopes {
+		if !slices.Contains(granted, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// TestParseAPIConfig tests validating and defaulting the API config data
+func TestParseAPIConfig(t *testing.T) {
+	config, err := parseAPIConfig(`{"jws_profile":"fapi","jws_key_id":"k1","idempotency_ttl":"10m","dpop_required":false,"dpop_proof_max_age":"30s","required_scopes":["payments"],"other_plugin":1}`)
+	if err != nil {
+		t.Fatalf("parseAPIConfig returned an error: %v", err)
+	}
+	expected := &APIConfig{
+		JWSProfile:      JWSProfileFAPI,
+		JWSKeyID:        "k1",
+		IdempotencyTTL:  10 * time.Minute,
+		DPoPRequired:    false,
+		DPoPProofMaxAge: 30 * time.Second,
+		RequiredScopes:  []string{"payments"},
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, config)
+	}
+
+	// DPoP is required unless the API opts out
+	config, err = parseAPIConfig("")
+	if err != nil || !config.DPoPRequired {
+		t.Errorf("Expected DPoP to be required by default, got %+v, %v", config, err)
+	}
+
+	for _, configData := range []string{
+		`not json`,
+		`{"jws_profile":"jades"}`,
+		`{"idempotency_ttl":"tomorrow"}`,
+		`{"idempotency_ttl":"-1h"}`,
+		`{"dpop_proof_max_age":"0s"}`,
+		`{"required_scopes":["accounts payments"]}`,
+		`{"dpop_required":"yes"}`,
+	} {
+		if _, err := parseAPIConfig(configData); err == nil {
+			t.Errorf("Expected an error for %s", configData)
+		}
+	}
+}
+
+// TestAPIConfigCache tests that config data is parsed once per API version
+func TestAPIConfigCache(t *testing.T) {
+	cache := NewAPIConfigCache()
+
+	first, err := cache.Get(context.Background(), "payments", `{"jws_profile":"obuk"}`)
+	if err != nil {
+		t.Fatalf("Get returned an error: %v", err)
+	}
+	if again, _ := cache.Get(context.Background(), "payments", `{"jws_profile":"obuk"}`); again != first {
+		t.Error("Expected the cached config to be returned")
+	}
+
+	// A changed API definition replaces the cached version
+	updated, err := cache.Get(context.Background(), "payments", `{"jws_profile":"fapi"}`)
+	if err != nil || updated.JWSProfile != JWSProfileFAPI {
+		t.Errorf("Expected the updated config, got %+v, %v", updated, err)
+	}
+	if _, err := cache.Get(context.Background(), "events", `{"jws_profile":"jades"}`); err == nil {
+		t.Error("Expected an error for invalid config data")
+	}
+	if _, err := cache.Get(context.Background(), "events", `{"jws_profile":"jades"}`); err == nil {
+		t.Error("Expected the error to be cached")
+	}
+	if cache.Len() != 2 {
+		t.Errorf("Expected 2 cached APIs, got %d", cache.Len())
+	}
+}
+
+// newAPITestObject creates a hook object for an API with the given config data
+func newAPITestObject(apiID, configData string) *pb.Object {
+	return &pb.Object{
+		Request: &pb.MiniRequestObject{
+			Headers:    map[string]string{},
+			SetHeaders: map[string]string{},
+			Method:     "POST",
+			Url:        "/domestic-payments",
+			Body:       `{"amount":"10.00"}`,
+		},
+		Session: &pb.SessionState{OauthClientId: "client-a"},
+		Spec:    map[string]string{"APIID": apiID, "config_data": configData},
+	}
+}
+
+// TestAPIConfigDefaults tests that the plugin-wide settings apply when an API sets none
+func TestAPIConfigDefaults(t *testing.T) {
+	handler := &DPoPHandler{
+		apiConfigs: NewAPIConfigCache(),
+		config:     defaultConfig,
+		jwsConfig:  JWSConfig{Profile: JWSProfileOBUK},
+	}
+
+	config, err := handler.apiConfig(context.Background(), newAPITestObject("events", ""))
+	if err != nil {
+		t.Fatalf("apiConfig returned an error: %v", err)
+	}
+	if config.JWSProfile != JWSProfileOBUK || config.IdempotencyTTL != defaultConfig.ExpirationTime {
+		t.Errorf("Expected the plugin-wide defaults, got %+v", config)
+	}
+
+	config, _ = handler.apiConfig(context.Background(), newAPITestObject("payments", `{"jws_profile":"fapi","idempotency_ttl":"1h"}`))
+	if config.JWSProfile != JWSProfileFAPI || config.IdempotencyTTL != time.Hour {
+		t.Errorf("Expected the API settings, got %+v", config)
+	}
+}
+
+// TestIdempotencyTTLPerAPI tests that responses are replayed for the API's TTL only
+func TestIdempotencyTTLPerAPI(t *testing.T) {
+	handler := &DPoPHandler{apiConfigs: NewAPIConfigCache(), config: defaultConfig, metrics: &IdempotencyMetrics{}}
+	t.Cleanup(func() { idempotencyStore.Delete(idempotencyCacheKey("client-a", "ttl-key")) })
+
+	object := newAPITestObject("payments", `{"idempotency_ttl":"1m"}`)
+	object.Request.Headers["X-Idempotency-Key"] = "ttl-key"
+	object.Request.ReturnOverrides = &pb.ReturnOverrides{ResponseCode: http.StatusCreated}
+	if _, err := handler.IdempotencyResponse(context.Background(), object); err != nil {
+		t.Fatalf("IdempotencyResponse returned an error: %v", err)
+	}
+
+	value, ok := idempotencyStore.Load(idempotencyCacheKey("client-a", "ttl-key"))
+	if !ok {
+		t.Fatal("Expected the response to be cached")
+	}
+	entry := value.(IdempotencyEntry)
+	if ttl := entry.ExpiresAt.Sub(entry.CreatedAt); ttl != time.Minute {
+		t.Errorf("Expected the API's TTL, got %v", ttl)
+	}
+
+	// Once expired, the entry is no longer replayed
+	entry.CreatedAt = time.Now().Add(-2 * time.Minute)
+	entry.ExpiresAt = time.Now().Add(-time.Minute)
+	idempotencyStore.Store(idempotencyCacheKey("client-a", "ttl-key"), entry)
+
+	check := newAPITestObject("payments", `{"idempotency_ttl":"1m"}`)
+	check.Request.Headers["X-Idempotency-Key"] = "ttl-key"
+	result, err := handler.IdempotencyCheck(context.Background(), check)
+	if err != nil {
+		t.Fatalf("IdempotencyCheck returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides != nil {
+		t.Errorf("Expected the expired response not to be replayed, got %+v", result.Request.ReturnOverrides)
+	}
+	if _, ok := idempotencyStore.Load(idempotencyCacheKey("client-a", "ttl-key")); ok {
+		t.Error("Expected the expired entry to be removed")
+	}
+}
+
+// newDPoPTestRequest creates a DPoP-bound access token with the given scope and
+// a proof issued at iat for the test request
+func newDPoPTestRequest(t *testing.T, scope string, iat time.Time) (accessToken, proof string) {
+	privateKey, _ := generateTestKey(t)
+	jwkBytes, err := json.Marshal(testECJWK(privateKey, ""))
+	if err != nil {
+		t.Fatalf("Failed to marshal JWK: %v", err)
+	}
+	var jwk map[string]interface{}
+	if err := json.Unmarshal(jwkBytes, &jwk); err != nil {
+		t.Fatalf("Failed to unmarshal JWK: %v", err)
+	}
+	jkt, err := calculateJKT(jwk)
+	if err != nil {
+		t.Fatalf("calculateJKT returned an error: %v", err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"scope": scope, "cnf": map[string]string{"jkt": jkt}})
+	if accessToken, err = token.SignedString(privateKey); err != nil {
+		t.Fatalf("Failed to sign access token: %v", err)
+	}
+
+	dpop := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"htm": "POST", "htu": "https://api.example.com/domestic-payments", "jti": "proof-1", "iat": iat.Unix()})
+	dpop.Header["typ"] = "dpop+jwt"
+	dpop.Header["jwk"] = jwk
+	if proof, err = dpop.SignedString(privateKey); err != nil {
+		t.Fatalf("Failed to sign DPoP proof: %v", err)
+	}
+	return accessToken, proof
+}
+
+// TestDPoPPolicyPerAPI tests the DPoP and scope policies chosen by each API
+func TestDPoPPolicyPerAPI(t *testing.T) {
+	handler := &DPoPHandler{apiConfigs: NewAPIConfigCache()}
+	accessToken, proof := newDPoPTestRequest(t, "accounts payments", time.Now().Add(-time.Minute))
+	unboundToken, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"scope": "accounts payments"}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign access token: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		configData string
+		auth       string
+		proof      string
+		expected   int32
+	}{
+		{"DPoP proof accepted", "", "DPoP " + accessToken, proof, 0},
+		{"proof required by default", "", "Bearer " + accessToken, "", http.StatusUnauthorized},
+		{"Bearer allowed", `{"dpop_required":false}`, "Bearer " + unboundToken, "", 0},
+		{"bound token as Bearer needs a proof", `{"dpop_required":false}`, "Bearer " + accessToken, "", http.StatusUnauthorized},
+		{"DPoP token still needs a proof", `{"dpop_required":false}`, "DPoP " + accessToken, "", http.StatusUnauthorized},
+		{"proof too old", `{"dpop_proof_max_age":"30s"}`, "DPoP " + accessToken, proof, http.StatusUnauthorized},
+		{"scopes granted", `{"required_scopes":["payments"]}`, "DPoP " + accessToken, proof, 0},
+		{"scope missing", `{"required_scopes":["fundsconfirmations"]}`, "DPoP " + accessToken, proof, http.StatusForbidden},
+		{"invalid config data", `{"dpop_proof_max_age":"soon"}`, "DPoP " + accessToken, proof, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := newAPITestObject(tt.name, tt.configData)
+			object.Request.Headers["Authorization"] = tt.auth
+			if tt.proof != "" {
+				object.Request.Headers["DPoP"] = tt.proof
+			}
+
+			result, err := handler.DPoPCheck(context.Background(), object)
+			if err != nil {
+				t.Fatalf("DPoPCheck returned an error: %v", err)
+			}
+			var status int32
+			if result.Request.ReturnOverrides != nil {
+				status = result.Request.ReturnOverrides.ResponseCode
+			}
+			if status != tt.expected {
+				t.Errorf("Expected status %d, got %d", tt.expected, status)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errCircuitOpen is returned when requests to a target host are refused by its circuit breaker
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// CircuitBreakerConfig contains configuration for the per-host circuit breakers
+type CircuitBreakerConfig struct {
+	// Period over which failures are counted (default: 1 minute)
+	Window time.Duration
+	// Requests needed in a window before the breaker can open (default: 10)
+	MinRequests int
+	// Share of failed requests in a window that opens the breaker (default: 0.5)
+	FailureRatio float64
+	// Requests taking longer are counted as failures (default: 10 seconds, 0 disables)
+	SlowCallThreshold time.Duration
+	// How long an open breaker refuses requests before letting trial requests through (default: 30 seconds)
+	OpenDuration time.Duration
+	// Trial requests let through at the same time while half-open (default: 1)
+	HalfOpenRequests int
+}
+
+// Default circuit breaker configuration values
+var defaultCircuitBreakerConfig = CircuitBreakerConfig{
+	Window:            time.Minute,
+	MinRequests:       10,
+	FailureRatio:      0.5,
+	SlowCallThreshold: 10 * time.Second,
+	OpenDuration:      30 * time.Second,
+	HalfOpenRequests:  1,
+}
+
+// hostBreaker is the circuit breaker state of one target host
+type hostBreaker struct {
+	state       string
+	windowStart time.Time
+	requests    int
+	failures    int
+	openedAt    time.Time
+	// Trial requests in flight while half-open
+	trials int
+	// Changes on every state change, so outcomes of requests let through
+	// in an earlier state can be told apart
+	generation uint64
+	// Last time a request was let through, for pruning idle breakers
+	lastUsed time.Time
+}
+
+// breakerTicket identifies a request let through by a breaker
+type breakerTicket struct {
+	generation uint64
+	// Whether the request is a trial of a half-open breaker
+	trial bool
+}
+
+// CircuitBreakerHostView is the admin representation of a host's breaker
+type CircuitBreakerHostView struct {
+	Host     string    `json:"host"`
+	State    string    `json:"state"`
+	Requests int       `json:"requests"`
+	Failures int       `json:"failures"`
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+}
+
+// CircuitBreakerMetrics counts state changes and refused requests
+type CircuitBreakerMetrics struct {
+	Opened     int                      `json:"opened"`
+	HalfOpened int                      `json:"half_opened"`
+	Closed     int                      `json:"closed"`
+	Rejected   int                      `json:"rejected"`
+	Hosts      []CircuitBreakerHostView `json:"hosts"`
+}
+
+// CircuitBreakers holds a circuit breaker per target host. While a host's
+// breaker is open, requests to it fail fast instead of waiting for a target
+// that is known to be down.
+type CircuitBreakers struct {
+	config CircuitBreakerConfig
+	// Current time (default: time.Now)
+	now func() time.Time
+
+	mu      sync.Mutex
+	hosts   map[string]*hostBreaker
+	metrics CircuitBreakerMetrics
+	// Last generation handed out, shared by every host
+	generation uint64
+	// Last time idle breakers were pruned
+	prunedAt time.Time
+}
+
+// NewCircuitBreakers creates the per-host circuit breakers
+func NewCircuitBreakers(config CircuitBreakerConfig) *CircuitBreakers {
+	config.MinRequests = max(config.MinRequests, 1)
+	config.HalfOpenRequests = max(config.HalfOpenRequests, 1)
+	return &CircuitBreakers{config: config, now: time.Now, hosts: map[string]*hostBreaker{}}
+}
+
+// Allow reports whether a request to the host may be sent, returning the
+// ticket its outcome is recorded with. A nil CircuitBreakers allows every
+// request.
+func (c *CircuitBreakers) Allow(host string) (breakerTicket, error) {
+	if c == nil {
+		return breakerTicket{}, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	c.prune(now)
+	breaker := c.breaker(host)
+	breaker.lastUsed = now
+
+	if breaker.state == breakerOpen {
+		if remaining := breaker.openedAt.Add(c.config.OpenDuration).Sub(now); remaining > 0 {
+			c.metrics.Rejected++
+			return breakerTicket{}, fmt.Errorf("%w for %s, retry in %s", errCircuitOpen, host, remaining.Round(time.Second))
+		}
+		c.transition(host, breaker, breakerHalfOpen)
+	}
+
+	if breaker.state == breakerHalfOpen {
+		if breaker.trials >= c.config.HalfOpenRequests {
+			c.metrics.Rejected++
+			return breakerTicket{}, fmt.Errorf("%w for %s, trial request in progress", errCircuitOpen, host)
+		}
+		breaker.trials++
+		return breakerTicket{generation: breaker.generation, trial: true}, nil
+	}
+	return breakerTicket{generation: breaker.generation}, nil
+}
+
+// Record records the outcome of a request let through with the ticket.
+// Requests slower than the threshold count as failures even when they
+// succeed. Outcomes of requests let through before the breaker last changed
+// state are ignored, so a late answer cannot decide a half-open breaker.
+func (c *CircuitBreakers) Record(host string, ticket breakerTicket, failed bool, latency time.Duration) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	breaker, ok := c.hosts[host]
+	if !ok || ticket.generation != breaker.generation {
+		return
+	}
+	now := c.now()
+	if c.config.SlowCallThreshold > 0 && latency > c.config.SlowCallThreshold {
+		failed = true
+	}
+
+	switch breaker.state {
+	case breakerHalfOpen:
+		// The trial request decides whether the host has recovered
+		if !ticket.trial {
+			return
+		}
+		breaker.trials = max(breaker.trials-1, 0)
+		if failed {
+			breaker.openedAt = now
+			c.transition(host, breaker, breakerOpen)
+		} else {
+			c.transition(host, breaker, breakerClosed)
+		}
+	case breakerClosed:
+		if now.Sub(breaker.windowStart) > c.config.Window {
+			breaker.windowStart = now
+			breaker.requests = 0
+			breaker.failures = 0
+		}
+		breaker.requests++
+		if failed {
+			breaker.failures++
+		}
+		if breaker.requests >= c.config.MinRequests && float64(breaker.failures)/float64(breaker.requests) >= c.config.FailureRatio {
+			breaker.openedAt = now
+			c.transition(host, breaker, breakerOpen)
+		}
+	}
+}
+
+// Abandon releases the trial slot of a request cancelled before the host
+// answered, without counting it as a success or a failure
+func (c *CircuitBreakers) Abandon(host string, ticket breakerTicket) {
+	if c == nil || !ticket.trial {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if breaker, ok := c.hosts[host]; ok && breaker.generation == ticket.generation {
+		breaker.trials = max(breaker.trials-1, 0)
+	}
+}
+
+// retryAfter returns how long the host's breaker stays open
+func (c *CircuitBreakers) retryAfter(host string) time.Duration {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	breaker, ok := c.hosts[host]
+	if !ok || breaker.state != breakerOpen {
+		return 0
+	}
+	return max(breaker.openedAt.Add(c.config.OpenDuration).Sub(c.now()), 0)
+}
+
+// Snapshot returns the state change counters and the state of every host
+func (c *CircuitBreakers) Snapshot() CircuitBreakerMetrics {
+	if c == nil {
+		return CircuitBreakerMetrics{Hosts: []CircuitBreakerHostView{}}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hosts := []CircuitBreakerHostView{}
+	for host, breaker := range c.hosts {
+		view := CircuitBreakerHostView{Host: host, State: breaker.state, Requests: breaker.requests, Failures: breaker.failures}
+		if breaker.state != breakerClosed {
+			view.OpenedAt = breaker.openedAt
+		}
+		hosts = append(hosts, view)
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Host < hosts[j].Host
+	})
+
+	return CircuitBreakerMetrics{
+		Opened:     c.metrics.Opened,
+		HalfOpened: c.metrics.HalfOpened,
+		Closed:     c.metrics.Closed,
+		Rejected:   c.metrics.Rejected,
+		Hosts:      hosts,
+	}
+}
+
+// breaker returns the host's breaker, creating a closed one; the caller holds the lock
+func (c *CircuitBreakers) breaker(host string) *hostBreaker {
+	breaker, ok := c.hosts[host]
+	if !ok {
+		c.generation++
+		breaker = &hostBreaker{state: breakerClosed, windowStart: c.now(), generation: c.generation}
+		c.hosts[host] = breaker
+	}
+	return breaker
+}
+
+// prune removes the breakers of hosts no request was sent to for a window,
+// at most once per window, so hosts named by clients do not accumulate.
+// Breakers that are not closed are kept until their open duration has also
+// passed and no trial is in flight; the caller holds the lock.
+func (c *CircuitBreakers) prune(now time.Time) {
+	if c.prunedAt.IsZero() {
+		c.prunedAt = now
+	}
+	if now.Sub(c.prunedAt) < c.config.Window {
+		return
+	}
+	c.prunedAt = now
+	for host, breaker := range c.hosts {
+		idle := now.Sub(breaker.lastUsed)
+		if breaker.state != breakerClosed {
+			idle -= c.config.OpenDuration
+		}
+		if idle > c.config.Window && breaker.trials == 0 {
+			delete(c.hosts, host)
+		}
+	}
+}
+
+// transition moves a breaker to a new state, counting and logging the change;
+// the caller holds the lock
+func (c *CircuitBreakers) transition(host string, breaker *hostBreaker, state string) {
+	fields := logrus.Fields{
+		"target_host": host,
+		"from":        breaker.state,
+		"to":          state,
+		"requests":    breaker.requests,
+		"failures":    breaker.failures,
+	}
+	breaker.state = state
+	c.generation++
+	breaker.generation = c.generation
+
+	switch state {
+	case breakerOpen:
+		c.metrics.Opened++
+		log.WithFields(fields).Warnf("Circuit breaker opened, refusing requests for %s", c.config.OpenDuration)
+	case breakerHalfOpen:
+		c.metrics.HalfOpened++
+		breaker.trials = 0
+		log.WithFields(fields).Info("Circuit breaker half-open, sending trial requests")
+	case breakerClosed:
+		c.metrics.Closed++
+		breaker.windowStart = c.now()
+		breaker.requests = 0
+		breaker.failures = 0
+		log.WithFields(fields).Info("Circuit breaker closed")
+	}
+}
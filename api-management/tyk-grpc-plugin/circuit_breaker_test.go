@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestBreakers creates circuit breakers on a clock the test controls
+func newTestBreakers(config CircuitBreakerConfig) (*CircuitBreakers, *time.Time) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	breakers := NewCircuitBreakers(config)
+	breakers.now = func() time.Time { return now }
+	return breakers, &now
+}
+
+// TestCircuitBreakerStates tests opening, half-opening and closing a host's breaker
+func TestCircuitBreakerStates(t *testing.T) {
+	config := CircuitBreakerConfig{Window: time.Minute, MinRequests: 4, FailureRatio: 0.5, OpenDuration: 30 * time.Second, HalfOpenRequests: 1}
+	breakers, now := newTestBreakers(config)
+	host := "tpp.example.com"
+
+	// Failures below the minimum number of requests keep the breaker closed
+	for _, failed := range []bool{true, false, true} {
+		ticket, err := breakers.Allow(host)
+		if err != nil {
+			t.Fatalf("Allow returned an error: %v", err)
+		}
+		breakers.Record(host, ticket, failed, time.Millisecond)
+	}
+	if state := breakers.Snapshot().Hosts[0].State; state != breakerClosed {
+		t.Fatalf("Expected a closed breaker, got %s", state)
+	}
+
+	// Reaching the failure ratio opens it
+	ticket, _ := breakers.Allow(host)
+	breakers.Record(host, ticket, true, time.Millisecond)
+	if _, err := breakers.Allow(host); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Expected errCircuitOpen, got %v", err)
+	}
+	if retryAfter := breakers.retryAfter(host); retryAfter != 30*time.Second {
+		t.Errorf("Expected retry after 30s, got %v", retryAfter)
+	}
+
+	// After the open duration a single trial request is let through
+	*now = now.Add(31 * time.Second)
+	trial, err := breakers.Allow(host)
+	if err != nil {
+		t.Fatalf("Expected a trial request, got %v", err)
+	}
+	if _, err := breakers.Allow(host); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected a second trial request to be refused, got %v", err)
+	}
+
+	// A failed trial opens the breaker again
+	breakers.Record(host, trial, true, time.Millisecond)
+	if _, err := breakers.Allow(host); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Expected errCircuitOpen, got %v", err)
+	}
+
+	// A successful trial closes it
+	*now = now.Add(31 * time.Second)
+	trial, _ = breakers.Allow(host)
+	breakers.Record(host, trial, false, time.Millisecond)
+	if _, err := breakers.Allow(host); err != nil {
+		t.Errorf("Expected a closed breaker, got %v", err)
+	}
+
+	metrics := breakers.Snapshot()
+	if metrics.Opened != 2 || metrics.HalfOpened != 2 || metrics.Closed != 1 || metrics.Rejected != 3 {
+		t.Errorf("Unexpected metrics: %+v", metrics)
+	}
+}
+
+// TestCircuitBreakerThresholds tests slow calls, the counting window and separate hosts
+func TestCircuitBreakerThresholds(t *testing.T) {
+	config := CircuitBreakerConfig{Window: time.Minute, MinRequests: 2, FailureRatio: 1, SlowCallThreshold: time.Second, OpenDuration: time.Minute}
+
+	t.Run("slow calls", func(t *testing.T) {
+		breakers, _ := newTestBreakers(config)
+		for range 2 {
+			ticket, _ := breakers.Allow("slow.example.com")
+			breakers.Record("slow.example.com", ticket, false, 2*time.Second)
+		}
+		if _, err := breakers.Allow("slow.example.com"); !errors.Is(err, errCircuitOpen) {
+			t.Errorf("Expected slow calls to open the breaker, got %v", err)
+		}
+		if _, err := breakers.Allow("other.example.com"); err != nil {
+			t.Errorf("Expected other hosts to be unaffected, got %v", err)
+		}
+	})
+
+	t.Run("window", func(t *testing.T) {
+		breakers, now := newTestBreakers(config)
+		ticket, _ := breakers.Allow("tpp.example.com")
+		breakers.Record("tpp.example.com", ticket, true, time.Millisecond)
+		*now = now.Add(2 * time.Minute)
+		ticket, _ = breakers.Allow("tpp.example.com")
+		breakers.Record("tpp.example.com", ticket, true, time.Millisecond)
+		if _, err := breakers.Allow("tpp.example.com"); err != nil {
+			t.Errorf("Expected failures of an earlier window to be forgotten, got %v", err)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var breakers *CircuitBreakers
+		breakers.Record("tpp.example.com", breakerTicket{}, true, time.Millisecond)
+		if _, err := breakers.Allow("tpp.example.com"); err != nil {
+			t.Errorf("Expected nil breakers to allow every request, got %v", err)
+		}
+	})
+}
+
+// TestCircuitBreakerLateResults tests that requests sent before a breaker
+// opened cannot decide it once it is half-open
+func TestCircuitBreakerLateResults(t *testing.T) {
+	config := CircuitBreakerConfig{Window: time.Minute, MinRequests: 1, FailureRatio: 1, OpenDuration: 30 * time.Second, HalfOpenRequests: 1}
+	breakers, now := newTestBreakers(config)
+	host := "tpp.example.com"
+
+	late, _ := breakers.Allow(host)
+	failing, _ := breakers.Allow(host)
+	breakers.Record(host, failing, true, time.Millisecond)
+
+	// The slow request answers while the trial is still in flight
+	*now = now.Add(31 * time.Second)
+	trial, err := breakers.Allow(host)
+	if err != nil {
+		t.Fatalf("Expected a trial request, got %v", err)
+	}
+	breakers.Record(host, late, false, time.Millisecond)
+	if state := breakers.Snapshot().Hosts[0].State; state != breakerHalfOpen {
+		t.Fatalf("Expected the late result to be ignored, got %s", state)
+	}
+	if _, err := breakers.Allow(host); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected the trial slot to stay taken, got %v", err)
+	}
+
+	// Abandoning a request of an earlier state does not free the trial slot
+	breakers.Abandon(host, late)
+	if _, err := breakers.Allow(host); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Expected the trial slot to stay taken, got %v", err)
+	}
+
+	breakers.Record(host, trial, false, time.Millisecond)
+	if state := breakers.Snapshot().Hosts[0].State; state != breakerClosed {
+		t.Errorf("Expected the trial to close the breaker, got %s", state)
+	}
+}
+
+// TestCircuitBreakerPrunesIdleHosts tests that breakers of hosts no longer
+// forwarded to are dropped
+func TestCircuitBreakerPrunesIdleHosts(t *testing.T) {
+	config := CircuitBreakerConfig{Window: time.Minute, MinRequests: 1, FailureRatio: 1, OpenDuration: 30 * time.Second}
+	breakers, now := newTestBreakers(config)
+
+	ticket, _ := breakers.Allow("down.example.com")
+	breakers.Record("down.example.com", ticket, true, time.Millisecond)
+	for i := range 100 {
+		breakers.Allow(fmt.Sprintf("tpp-%d.example.com", i))
+	}
+
+	// Open breakers outlive closed ones by their open duration
+	*now = now.Add(61 * time.Second)
+	breakers.Allow("tpp.example.com")
+	if hosts := breakers.Snapshot().Hosts; len(hosts) != 2 || hosts[0].Host != "down.example.com" {
+		t.Fatalf("Expected the idle closed breakers to be pruned, got %+v", hosts)
+	}
+
+	*now = now.Add(61 * time.Second)
+	breakers.Allow("tpp.example.com")
+	if hosts := breakers.Snapshot().Hosts; len(hosts) != 1 || hosts[0].Host != "tpp.example.com" {
+		t.Errorf("Expected the idle open breaker to be pruned, got %+v", hosts)
+	}
+}
+
+// TestCircuitBreakerFailsFast tests that forwarding to a failing host stops reaching it
+func TestCircuitBreakerFailsFast(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 5, InitialBackoff: time.Second})
+	handler.breakers = NewCircuitBreakers(CircuitBreakerConfig{Window: time.Minute, MinRequests: 2, FailureRatio: 0.5, OpenDuration: 30 * time.Second})
+
+	// The breaker opens during the retries of the first request
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected 2 requests before the breaker opened, got %d", calls.Load())
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, result.Request.ReturnOverrides.ResponseCode)
+	}
+
+	// Later requests fail fast without reaching the target
+	result, err = handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected no further requests, got %d", calls.Load())
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, result.Request.ReturnOverrides.ResponseCode)
+	}
+	if retryAfter := result.Request.ReturnOverrides.Headers["Retry-After"]; retryAfter != "30" {
+		t.Errorf("Expected Retry-After 30, got %q", retryAfter)
+	}
+	if handler.deadLetters.Len() != 2 {
+		t.Errorf("Expected both requests to be dead-lettered, got %d", handler.deadLetters.Len())
+	}
+}
@@ -0,0 +1,687 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+	"github.com/sirupsen/logrus"
+)
+
+// errDeadLetterNotFound is returned for unknown dead letter IDs
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// RetryConfig contains configuration for retrying forwarded requests
+type RetryConfig struct {
+	// Maximum number of delivery attempts, including the first (default: 3)
+	MaxAttempts int
+	// Delay before the first retry (default: 1 second)
+	InitialBackoff time.Duration
+	// Upper bound of the delay between attempts (default: 30 seconds)
+	MaxBackoff time.Duration
+	// Time allowed for a single attempt (default: 30 seconds)
+	AttemptTimeout time.Duration
+	// Longest Retry-After honoured; a target asking to wait longer is not retried (default: 60 seconds)
+	MaxRetryAfter time.Duration
+}
+
+// Default retry configuration values
+var defaultRetryConfig = RetryConfig{
+	MaxAttempts:    3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	AttemptTimeout: 30 * time.Second,
+	MaxRetryAfter:  time.Minute,
+}
+
+// outboundRequest is a request forwarded to a rewrite target
+type outboundRequest struct {
+	Method         string            `json:"method"`
+	URL            string            `json:"url"`
+	Headers        map[string]string `json:"headers"`
+	Body           string            `json:"body"`
+	SubscriptionID string            `json:"subscription_id,omitempty"`
+}
+
+// targetResponse is the response of a rewrite target
+type targetResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// DeliveryAttempt records the outcome of one delivery attempt
+type DeliveryAttempt struct {
+	Attempt    int       `json:"attempt"`
+	Time       time.Time `json:"time"`
+	DurationMs int64     `json:"duration_ms"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// newOutboundRequest builds the request forwarded to the target from the hook object
+func newOutboundRequest(targetURL string, object *pb.Object, headerPolicy *HeaderPolicyConfig) *outboundRequest {
+	return &outboundRequest{
+		Method:         object.Request.Method,
+		URL:            targetURL,
+		Headers:        headerPolicy.requestHeaders(object),
+		Body:           object.Request.Body,
+		SubscriptionID: getHeader(object.Request.Headers, subscriptionIDHeader),
+	}
+}
+
+// targetHost returns the host of a target URL, or the URL itself when it does not parse
+func targetHost(targetURL string) string {
+	if target, err := url.Parse(targetURL); err == nil {
+		return target.Host
+	}
+	return targetURL
+}
+
+// send makes a single attempt to deliver the request through the circuit
+// breaker of the target host
+func (d *DPoPHandler) send(ctx context.Context, request *outboundRequest) (*targetResponse, error) {
+	host := targetHost(request.URL)
+	hostLabel := d.targetPolicy.hostLabel(host)
+	// Queued and dead-lettered requests can be sent after a reload narrowed
+	// the target policy, so the target is checked again on every attempt
+	if err := d.checkOutboundTarget(request); err != nil {
+		d.pluginMetrics.observeForward(hostLabel, nil, err, 0)
+		return nil, err
+	}
+	ticket, err := d.breakers.Allow(host)
+	if err != nil {
+		d.pluginMetrics.observeForward(hostLabel, nil, err, 0)
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := d.roundTrip(ctx, request)
+	// A cancelled request says nothing about the health of the target
+	if err != nil && ctx.Err() != nil {
+		d.breakers.Abandon(host, ticket)
+		return nil, err
+	}
+	// Requests refused by the target policy never reached the target
+	failed := (err != nil && !errors.Is(err, errTargetNotAllowed)) || (err == nil && isRetryableStatus(resp.StatusCode))
+	d.breakers.Record(host, ticket, failed, time.Since(start))
+	d.pluginMetrics.observeForward(hostLabel, resp, err, time.Since(start))
+	return resp, err
+}
+
+// checkOutboundTarget checks the target of the request against the current target policy
+func (d *DPoPHandler) checkOutboundTarget(request *outboundRequest) error {
+	target, err := url.Parse(request.URL)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errTargetNotAllowed, err)
+	}
+	return d.targetPolicy.checkTarget(target, request.SubscriptionID)
+}
+
+// roundTrip sends the request to the target and reads the response
+func (d *DPoPHandler) roundTrip(ctx context.Context, request *outboundRequest) (*targetResponse, error) {
+	timeout := d.retryConfig.AttemptTimeout
+	if timeout <= 0 {
+		timeout = defaultRetryConfig.AttemptTimeout
+	}
+	transport := d.targetTransport.get(&d.targetPolicy, d.outboundTLS.TLSConfig())
+	client := d.targetPolicy.httpClient(timeout, request.SubscriptionID, transport)
+
+	req, err := http.NewRequestWithContext(ctx, request.Method, request.URL, strings.NewReader(request.Body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	for k, v := range request.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return &targetResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}, nil
+}
+
+// deliver sends the request, retrying failures with exponential backoff and
+// jitter, until delivered or ctx is done. It returns the last response or
+// error along with every attempt.
+func (d *DPoPHandler) deliver(ctx context.Context, request *outboundRequest) (*targetResponse, []DeliveryAttempt, error) {
+	maxAttempts := max(d.retryConfig.MaxAttempts, 1)
+	host := targetHost(request.URL)
+
+	var attempts []DeliveryAttempt
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		resp, err := d.send(ctx, request)
+
+		record := DeliveryAttempt{Attempt: attempt, Time: start, DurationMs: time.Since(start).Milliseconds()}
+		fields := logrus.Fields{"target_host": host, "attempt": attempt, "max_attempts": maxAttempts}
+		if err != nil {
+			record.Error = err.Error()
+			fields["error"] = err.Error()
+		} else {
+			record.StatusCode = resp.StatusCode
+			fields["status"] = resp.StatusCode
+		}
+		attempts = append(attempts, record)
+
+		if err == nil && !isRetryableStatus(resp.StatusCode) {
+			if resp.StatusCode < 400 {
+				log.WithFields(fields).Info("Delivery attempt succeeded")
+			} else {
+				log.WithFields(fields).Warn("Delivery attempt rejected by target, not retrying")
+			}
+			return resp, attempts, nil
+		}
+		// Requests refused by the target policy would be refused again
+		if errors.Is(err, errTargetNotAllowed) {
+			log.WithFields(fields).Warn("Delivery attempt refused by target policy, not retrying")
+			return nil, attempts, err
+		}
+		// An open circuit breaker keeps refusing until it lets trial requests through
+		if errors.Is(err, errCircuitOpen) {
+			log.WithFields(fields).Warn("Delivery attempt refused by circuit breaker, not retrying")
+			return nil, attempts, err
+		}
+
+		if attempt >= maxAttempts {
+			log.WithFields(fields).Warn("Delivery attempt failed, no attempts left")
+			return resp, attempts, err
+		}
+
+		delay := d.retryDelay(attempt)
+		if resp != nil {
+			if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				if retryAfter > d.retryConfig.MaxRetryAfter {
+					fields["retry_after"] = retryAfter.String()
+					log.WithFields(fields).Warn("Delivery attempt failed, target asked to wait longer than allowed")
+					return resp, attempts, err
+				}
+				delay = retryAfter
+			}
+		}
+
+		fields["retry_in"] = delay.String()
+		log.WithFields(fields).Warn("Delivery attempt failed, retrying")
+		if err := d.sleep(ctx, delay); err != nil {
+			log.WithFields(fields).Warn("Delivery cancelled while waiting to retry")
+			return resp, attempts, err
+		}
+	}
+}
+
+// sleep waits between delivery attempts, returning the context's error when
+// it is done first
+func (d *DPoPHandler) sleep(ctx context.Context, delay time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if d.sleepFunc != nil {
+		d.sleepFunc(delay)
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// retryDelay returns the backoff before the given retry: exponential growth
+// capped at the maximum, with the upper half randomised to spread out retries
+func (d *DPoPHandler) retryDelay(attempt int) time.Duration {
+	delay := d.retryConfig.InitialBackoff
+	for i := 1; i < attempt && delay < d.retryConfig.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if d.retryConfig.MaxBackoff > 0 && delay > d.retryConfig.MaxBackoff {
+		delay = d.retryConfig.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// isRetryableStatus reports whether a response status indicates a temporary failure
+func isRetryableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooEarly, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// DeadLetter is a request whose delivery failed after the final attempt
+type DeadLetter struct {
+	ID        string            `json:"id"`
+	Request   *outboundRequest  `json:"request"`
+	Attempts  []DeliveryAttempt `json:"attempts"`
+	CreatedAt time.Time         `json:"created_at"`
+	// Number of times the request was replayed
+	Replays int `json:"replays"`
+	// Credential headers of the request, sealed with the credentials key
+	Credentials string `json:"credentials,omitempty"`
+	// Credential headers not kept because no credentials key is configured
+	DroppedHeaders []string `json:"dropped_headers,omitempty"`
+}
+
+// DeadLetterConfig contains configuration for the dead letter store
+type DeadLetterConfig struct {
+	// Maximum number of dead letters kept; the oldest are evicted (default: 10000)
+	MaxEntries int
+	// File the dead letters are persisted to (optional)
+	Path string
+	// AES-256 key sealing the credential headers of dead letters, so replays
+	// can send them (optional; without it they are not kept)
+	CredentialsKey []byte
+}
+
+// Default dead letter configuration values
+var defaultDeadLetterConfig = DeadLetterConfig{
+	MaxEntries: 10000,
+}
+
+// DeadLetterStore holds requests whose delivery failed, for inspection and replay
+type DeadLetterStore struct {
+	config  DeadLetterConfig
+	mu      sync.Mutex
+	letters map[string]*DeadLetter
+	// Seals credential headers, nil when no credentials key is configured
+	credentials cipher.AEAD
+	// Error of the last attempt to persist the dead letters
+	persistErr error
+}
+
+// errNoCredentialsKey is returned when credential headers cannot be sealed
+var errNoCredentialsKey = errors.New("no dead letter credentials key configured")
+
+// decodeCredentialsKey decodes a base64-encoded AES-256 key
+func decodeCredentialsKey(encoded string) ([]byte, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// NewDeadLetterStore creates a dead letter store, loading persisted dead letters
+func NewDeadLetterStore(config DeadLetterConfig) (*DeadLetterStore, error) {
+	store := &DeadLetterStore{config: config, letters: map[string]*DeadLetter{}}
+	if len(config.CredentialsKey) > 0 {
+		block, err := aes.NewCipher(config.CredentialsKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials key: %w", err)
+		}
+		if store.credentials, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("invalid credentials key: %w", err)
+		}
+	}
+	if config.Path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dead letters: %w", err)
+	}
+
+	var letters []*DeadLetter
+	if err := json.Unmarshal(data, &letters); err != nil {
+		return nil, fmt.Errorf("failed to parse dead letters: %w", err)
+	}
+	for _, letter := range letters {
+		store.letters[letter.ID] = letter
+	}
+	return store, nil
+}
+
+// Add stores a dead letter, evicting the oldest ones beyond the limit
+func (s *DeadLetterStore) Add(letter *DeadLetter) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.letters[letter.ID] = letter
+	if s.config.MaxEntries > 0 {
+		for len(s.letters) > s.config.MaxEntries {
+			oldest := s.sortedLocked()[0]
+			delete(s.letters, oldest.ID)
+			log.Warnf("Dead letter store full, evicted %s", oldest.ID)
+		}
+	}
+	s.persistLocked()
+}
+
+// Err returns the error of the last attempt to persist the dead letters, or
+// nil when it succeeded
+func (s *DeadLetterStore) Err() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persistErr
+}
+
+// Flush persists the dead letters again, so a write that failed earlier is
+// retried before the plugin exits, and returns the error of the write
+func (s *DeadLetterStore) Flush() error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.persistLocked()
+	return s.persistErr
+}
+
+// Get returns a copy of the dead letter with the given ID
+func (s *DeadLetterStore) Get(id string) (DeadLetter, bool) {
+	if s == nil {
+		return DeadLetter{}, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letter, ok := s.letters[id]
+	if !ok {
+		return DeadLetter{}, false
+	}
+	return *letter, true
+}
+
+// List returns copies of all dead letters, oldest first
+func (s *DeadLetterStore) List() []DeadLetter {
+	if s == nil {
+		return []DeadLetter{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := []DeadLetter{}
+	for _, letter := range s.sortedLocked() {
+		letters = append(letters, *letter)
+	}
+	return letters
+}
+
+// Delete removes a dead letter, reporting whether it existed
+func (s *DeadLetterStore) Delete(id string) bool {
+	if s == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.letters[id]; !ok {
+		return false
+	}
+	delete(s.letters, id)
+	s.persistLocked()
+	return true
+}
+
+// Len returns the number of dead letters
+func (s *DeadLetterStore) Len() int {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.letters)
+}
+
+// update applies a change to a stored dead letter
+func (s *DeadLetterStore) update(id string, change func(*DeadLetter)) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if letter, ok := s.letters[id]; ok {
+		change(letter)
+		s.persistLocked()
+	}
+}
+
+// sealCredentials encrypts the credential headers of a dead letter, bound to its ID
+func (s *DeadLetterStore) sealCredentials(id string, headers map[string]string) (string, error) {
+	if s.credentials == nil {
+		return "", errNoCredentialsKey
+	}
+	plaintext, err := json.Marshal(headers)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, s.credentials.NonceSize())
+	if _, err := cryptorand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := s.credentials.Seal(nonce, nonce, plaintext, []byte(id))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openCredentials decrypts the credential headers of a dead letter
+func (s *DeadLetterStore) openCredentials(id, sealed string) (map[string]string, error) {
+	if s.credentials == nil {
+		return nil, errNoCredentialsKey
+	}
+	nonceSize := s.credentials.NonceSize()
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < nonceSize {
+		return nil, errors.New("invalid sealed credentials")
+	}
+	plaintext, err := s.credentials.Open(nil, data[:nonceSize], data[nonceSize:], []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credentials: %w", err)
+	}
+	var headers map[string]string
+	if err := json.Unmarshal(plaintext, &headers); err != nil {
+		return nil, fmt.Errorf("invalid sealed credentials: %w", err)
+	}
+	return headers, nil
+}
+
+// sortedLocked returns the dead letters oldest first; the caller holds the lock
+func (s *DeadLetterStore) sortedLocked() []*DeadLetter {
+	letters := make([]*DeadLetter, 0, len(s.letters))
+	for _, letter := range s.letters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].CreatedAt.Before(letters[j].CreatedAt)
+	})
+	return letters
+}
+
+// persistLocked writes the dead letters to the configured file; the caller holds the lock
+func (s *DeadLetterStore) persistLocked() {
+	if s.config.Path == "" {
+		return
+	}
+
+	data, err := json.Marshal(s.sortedLocked())
+	if err != nil {
+		log.Errorf("Failed to marshal dead letters: %v", err)
+		s.persistErr = err
+		return
+	}
+
+	// Write to a temporary file first so a crash cannot leave a truncated store
+	tmpPath := s.config.Path + ".tmp"
+	if err = os.WriteFile(tmpPath, data, 0o600); err == nil {
+		err = os.Rename(tmpPath, s.config.Path)
+	}
+	if err != nil {
+		log.Errorf("Failed to persist dead letters: %v", err)
+	}
+	s.persistErr = err
+}
+
+// deliverOrDeadLetter delivers the request and dead-letters it when the last
+// attempt fails, returning the ID of the dead letter
+func (d *DPoPHandler) deliverOrDeadLetter(ctx context.Context, request *outboundRequest) (*targetResponse, []DeliveryAttempt, string, error) {
+	resp, attempts, err := d.deliver(ctx, request)
+	deadLetterID := ""
+	// Requests refused by the target policy cannot be replayed successfully
+	if deliveryFailed(resp, err) && !errors.Is(err, errTargetNotAllowed) {
+		deadLetterID = d.deadLetter(request, attempts)
+	}
+	return resp, attempts, deadLetterID, err
+}
+
+// deadLetter stores a request whose final delivery attempt failed and returns
+// its ID. Credential headers are kept sealed with the credentials key, so they
+// can be replayed but are never readable on disk or through the admin API.
+// Without a key they are not kept, and the dead letter records which were left out.
+func (d *DPoPHandler) deadLetter(request *outboundRequest, attempts []DeliveryAttempt) string {
+	if d.deadLetters == nil {
+		return ""
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		log.Errorf("Failed to dead-letter request to %s: %v", targetHost(request.URL), err)
+		return ""
+	}
+
+	stored := *request
+	stored.Headers = d.logRedactor().StripHeaders(request.Headers)
+	letter := &DeadLetter{
+		ID:        id,
+		Request:   &stored,
+		Attempts:  attempts,
+		CreatedAt: time.Now(),
+	}
+	if credentials := d.logRedactor().SensitiveHeaders(request.Headers); len(credentials) > 0 {
+		sealed, err := d.deadLetters.sealCredentials(id, credentials)
+		if err != nil {
+			letter.DroppedHeaders = slices.Sorted(maps.Keys(credentials))
+			log.WithField("dead_letter_id", id).
+				Warnf("Credential headers %s not kept, a replay is sent without them: %v", strings.Join(letter.DroppedHeaders, ", "), err)
+		} else {
+			letter.Credentials = sealed
+		}
+	}
+	d.deadLetters.Add(letter)
+	log.WithFields(logrus.Fields{"dead_letter_id": id, "target_host": targetHost(request.URL), "attempts": len(attempts)}).
+		Error("Delivery failed, request dead-lettered")
+	return id
+}
+
+// deliveryFailed reports whether a delivery ended without the target accepting the request
+func deliveryFailed(resp *targetResponse, err error) bool {
+	return err != nil || resp.StatusCode >= 400
+}
+
+// ReplayDeadLetter redelivers a dead letter. It is removed from the store once
+// delivered, otherwise the new attempts are added to it.
+func (d *DPoPHandler) ReplayDeadLetter(ctx context.Context, id string) (*DeadLetter, error) {
+	letter, ok := d.deadLetters.Get(id)
+	if !ok {
+		return nil, errDeadLetterNotFound
+	}
+
+	// Restore the credential headers that were sealed when the request was dead-lettered
+	request := *letter.Request
+	if letter.Credentials != "" {
+		credentials, err := d.deadLetters.openCredentials(id, letter.Credentials)
+		if err != nil {
+			return &letter, fmt.Errorf("failed to restore the credential headers: %w", err)
+		}
+		request.Headers = maps.Clone(request.Headers)
+		if request.Headers == nil {
+			request.Headers = map[string]string{}
+		}
+		maps.Copy(request.Headers, credentials)
+	} else if len(letter.DroppedHeaders) > 0 {
+		log.WithField("dead_letter_id", id).
+			Warnf("Replaying without the credential headers %s, which were not kept", strings.Join(letter.DroppedHeaders, ", "))
+	}
+
+	resp, attempts, err := d.deliver(ctx, &request)
+	letter.Replays++
+	letter.Attempts = append(letter.Attempts, attempts...)
+
+	if !deliveryFailed(resp, err) {
+		d.deadLetters.Delete(id)
+		log.WithField("dead_letter_id", id).Info("Dead letter replayed successfully")
+		return &letter, nil
+	}
+
+	d.deadLetters.update(id, func(stored *DeadLetter) {
+		stored.Replays = letter.Replays
+		stored.Attempts = letter.Attempts
+	})
+	if err == nil {
+		err = fmt.Errorf("target responded with status %d", resp.StatusCode)
+	}
+	return &letter, fmt.Errorf("replay failed: %w", err)
+}
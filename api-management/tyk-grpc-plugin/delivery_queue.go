@@ -0,0 +1,432 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Delivery states reported for queued requests
+const (
+	deliveryStatePending   = "pending"
+	deliveryStateDelivered = "delivered"
+	deliveryStateFailed    = "failed"
+)
+
+var (
+	// errQueueFull is returned when the delivery queue cannot take more requests
+	errQueueFull = errors.New("delivery queue full")
+	// errDeliveryPending is returned when a request with the same event ID is still queued
+	errDeliveryPending = errors.New("delivery already pending")
+)
+
+// DeliveryQueueConfig contains configuration for asynchronous delivery
+type DeliveryQueueConfig struct {
+	// Number of requests delivered at the same time (default: 8)
+	Workers int
+	// Number of requests delivered to the same host at the same time (default: 2)
+	PerHostConcurrency int
+	// Maximum number of requests waiting or being delivered (default: 1000)
+	QueueSize int
+	// How long the status of finished deliveries is kept (default: 24 hours)
+	StatusRetention time.Duration
+}
+
+// Default delivery queue configuration values
+var defaultDeliveryQueueConfig = DeliveryQueueConfig{
+	Workers:            8,
+	PerHostConcurrency: 2,
+	QueueSize:          1000,
+	StatusRetention:    24 * time.Hour,
+}
+
+// DeliveryStatus is the state of a queued delivery
+type DeliveryStatus struct {
+	EventID string `json:"event_id"`
+	Target  string `json:"target"`
+	// One of pending, delivered or failed
+	State string `json:"state"`
+	// Status code of the last response
+	StatusCode   int               `json:"status_code,omitempty"`
+	Attempts     []DeliveryAttempt `json:"attempts"`
+	DeadLetterID string            `json:"dead_letter_id,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+}
+
+// deliveryJob is a request waiting to be delivered
+type deliveryJob struct {
+	eventID string
+	host    string
+	request *outboundRequest
+}
+
+// hostQueue holds the requests waiting for a free slot of their target host
+type hostQueue struct {
+	active  int
+	waiting []*deliveryJob
+}
+
+// DeliveryQueue delivers forwarded requests in the background with a pool of
+// workers. Requests only reach the workers while their host has a free slot,
+// so a slow host cannot occupy every worker.
+type DeliveryQueue struct {
+	config DeliveryQueueConfig
+	// Handler delivering the requests, replaced when the configuration is reloaded
+	source handlerSource
+	ready  chan *deliveryJob
+	// Workers delivering requests, waited for by Drain
+	workers sync.WaitGroup
+	// Context of the deliveries in progress, outliving the workers' context
+	// so Drain can let them finish
+	deliveries       context.Context
+	cancelDeliveries context.CancelFunc
+
+	mu       sync.Mutex
+	hosts    map[string]*hostQueue
+	queued   int
+	statuses map[string]*DeliveryStatus
+}
+
+// NewDeliveryQueue creates a delivery queue for the handler. Start must be
+// called for requests to be delivered.
+func NewDeliveryQueue(source handlerSource, config DeliveryQueueConfig) *DeliveryQueue {
+	config.Workers = max(config.Workers, 1)
+	config.PerHostConcurrency = max(config.PerHostConcurrency, 1)
+	config.QueueSize = max(config.QueueSize, 1)
+
+	deliveries, cancelDeliveries := context.WithCancel(context.Background())
+	return &DeliveryQueue{
+		config:           config,
+		source:           source,
+		ready:            make(chan *deliveryJob, config.QueueSize),
+		deliveries:       deliveries,
+		cancelDeliveries: cancelDeliveries,
+		hosts:            map[string]*hostQueue{},
+		statuses:         map[string]*DeliveryStatus{},
+	}
+}
+
+// Start runs the workers and the pruning of finished statuses until the context is cancelled
+func (q *DeliveryQueue) Start(ctx context.Context) {
+	log.Infof("Starting delivery queue (workers: %d, per host: %d, size: %d)",
+		q.config.Workers, q.config.PerHostConcurrency, q.config.QueueSize)
+
+	for i := 0; i < q.config.Workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			q.work(ctx)
+		}()
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				q.prune(now)
+			}
+		}
+	}()
+}
+
+// Enqueue queues a request for delivery under the given event ID
+func (q *DeliveryQueue) Enqueue(eventID string, request *outboundRequest) error {
+	host := targetHost(request.URL)
+	job := &deliveryJob{eventID: eventID, host: host, request: request}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if status, ok := q.statuses[eventID]; ok && status.State == deliveryStatePending {
+		return errDeliveryPending
+	}
+	if q.queued >= q.config.QueueSize {
+		return errQueueFull
+	}
+
+	now := time.Now()
+	q.statuses[eventID] = &DeliveryStatus{
+		EventID:   eventID,
+		Target:    request.URL,
+		State:     deliveryStatePending,
+		Attempts:  []DeliveryAttempt{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	q.queued++
+
+	hq, ok := q.hosts[host]
+	if !ok {
+		hq = &hostQueue{}
+		q.hosts[host] = hq
+	}
+	if hq.active < q.config.PerHostConcurrency {
+		hq.active++
+		// Never blocks: the channel holds QueueSize jobs and at most that many are queued
+		q.ready <- job
+	} else {
+		hq.waiting = append(hq.waiting, job)
+	}
+	return nil
+}
+
+// work delivers ready requests until the context is cancelled
+func (q *DeliveryQueue) work(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-q.ready:
+			if ctx.Err() != nil {
+				// Leave the job to Drain; the channel has room for every queued job
+				q.ready <- job
+				return
+			}
+			q.process(job)
+		}
+	}
+}
+
+// Drain waits until the workers, stopped by cancelling the context passed to
+// Start, finish the deliveries in progress. When ctx is done first, the
+// deliveries in progress are cancelled and dead-lettered by their workers.
+// The requests no worker picked up are dead-lettered too, so they can be
+// replayed after a restart. It returns the number of requests dead-lettered
+// by Drain itself.
+func (q *DeliveryQueue) Drain(ctx context.Context) int {
+	if q == nil {
+		return 0
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("Drain timeout reached, cancelling the deliveries in progress")
+		q.cancelDeliveries()
+		<-done
+	}
+	q.cancelDeliveries()
+
+	q.mu.Lock()
+	var jobs []*deliveryJob
+	for len(q.ready) > 0 {
+		jobs = append(jobs, <-q.ready)
+	}
+	for _, hq := range q.hosts {
+		jobs = append(jobs, hq.waiting...)
+		hq.waiting = nil
+	}
+	now := time.Now()
+	for _, job := range jobs {
+		if status, ok := q.statuses[job.eventID]; ok {
+			status.State = deliveryStateFailed
+			status.UpdatedAt = now
+		}
+		q.queued--
+	}
+	q.mu.Unlock()
+
+	handler := q.source.Handler()
+	for _, job := range jobs {
+		id := handler.deadLetter(job.request, []DeliveryAttempt{})
+		q.mu.Lock()
+		if status, ok := q.statuses[job.eventID]; ok {
+			status.DeadLetterID = id
+		}
+		q.mu.Unlock()
+	}
+	if len(jobs) > 0 {
+		log.Warnf("Dead-lettered %d queued requests not delivered before shutdown", len(jobs))
+	}
+	return len(jobs)
+}
+
+// process delivers a request, records the outcome and releases the host slot
+func (q *DeliveryQueue) process(job *deliveryJob) {
+	resp, attempts, deadLetterID, err := q.source.Handler().deliverOrDeadLetter(q.deliveries, job.request)
+
+	fields := logrus.Fields{"event_id": job.eventID, "target_host": job.host, "attempts": len(attempts)}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if status, ok := q.statuses[job.eventID]; ok {
+		status.Attempts = attempts
+		status.DeadLetterID = deadLetterID
+		status.UpdatedAt = time.Now()
+		if resp != nil {
+			status.StatusCode = resp.StatusCode
+		}
+		if deliveryFailed(resp, err) {
+			status.State = deliveryStateFailed
+		} else {
+			status.State = deliveryStateDelivered
+		}
+		fields["state"] = status.State
+	}
+	log.WithFields(fields).Info("Queued delivery finished")
+
+	q.queued--
+	hq := q.hosts[job.host]
+	if len(hq.waiting) > 0 {
+		next := hq.waiting[0]
+		hq.waiting = hq.waiting[1:]
+		q.ready <- next
+		return
+	}
+	hq.active--
+	if hq.active == 0 {
+		delete(q.hosts, job.host)
+	}
+}
+
+// Status returns a copy of the delivery status of an event
+func (q *DeliveryQueue) Status(eventID string) (DeliveryStatus, bool) {
+	if q == nil {
+		return DeliveryStatus{}, false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status, ok := q.statuses[eventID]
+	if !ok {
+		return DeliveryStatus{}, false
+	}
+	copied := *status
+	copied.Attempts = append([]DeliveryAttempt{}, status.Attempts...)
+	return copied, true
+}
+
+// List returns copies of the delivery statuses in the given state (all when
+// empty), oldest first
+func (q *DeliveryQueue) List(state string) []DeliveryStatus {
+	statuses := []DeliveryStatus{}
+	if q == nil {
+		return statuses
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, status := range q.statuses {
+		if state == "" || status.State == state {
+			copied := *status
+			copied.Attempts = append([]DeliveryAttempt{}, status.Attempts...)
+			statuses = append(statuses, copied)
+		}
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].CreatedAt.Before(statuses[j].CreatedAt)
+	})
+	return statuses
+}
+
+// Len returns the number of requests waiting or being delivered
+func (q *DeliveryQueue) Len() int {
+	if q == nil {
+		return 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued
+}
+
+// Full reports whether the queue refuses new requests
+func (q *DeliveryQueue) Full() bool {
+	if q == nil {
+		return false
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.queued >= q.config.QueueSize
+}
+
+// prune removes the statuses of deliveries that finished before the retention period
+func (q *DeliveryQueue) prune(now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	removed := 0
+	for eventID, status := range q.statuses {
+		if status.State != deliveryStatePending && now.Sub(status.UpdatedAt) > q.config.StatusRetention {
+			delete(q.statuses, eventID)
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Infof("Removed %d expired delivery statuses", removed)
+	}
+}
+
+// enqueueTargetRequest queues the request for delivery and answers 202 with
+// the event ID under which the delivery status can be queried
+func (d *DPoPHandler) enqueueTargetRequest(ctx context.Context, targetURL string, object *pb.Object, eventID string) (*pb.Object, error) {
+	if eventID == "" {
+		var err error
+		if eventID, err = newUUID(); err != nil {
+			logger(ctx).Errorf("Failed to assign event ID: %v", err)
+			return d.respondWithError(object, "Failed to queue request", http.StatusInternalServerError)
+		}
+	}
+
+	ctx, span := tracer().Start(ctx, "delivery_queue.enqueue", trace.WithAttributes(
+		attrEventID.String(eventID), attrServerAddress.String(targetHost(targetURL))))
+	defer span.End()
+
+	// The target receives the trace context of the request that queued the delivery
+	request := newOutboundRequest(targetURL, object, &d.headerPolicy)
+	injectTraceContext(ctx, request.Headers)
+	err := d.deliveryQueue.Enqueue(eventID, request)
+	if err != nil {
+		failSpan(span, err)
+	}
+	if errors.Is(err, errDeliveryPending) {
+		logger(ctx).Warnf("Delivery of event %s already pending", eventID)
+		return d.reject(object, reasonDeliveryPending, "Delivery already pending", http.StatusConflict)
+	}
+	if err != nil {
+		logger(ctx).Errorf("Failed to queue delivery of event %s: %v", eventID, err)
+		return d.reject(object, reasonQueueFull, "Delivery queue full", http.StatusServiceUnavailable)
+	}
+
+	body, err := json.Marshal(map[string]string{"event_id": eventID, "state": deliveryStatePending})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal response: %w", err)
+	}
+
+	if object.Request.ReturnOverrides == nil {
+		object.Request.ReturnOverrides = &pb.ReturnOverrides{}
+	}
+	object.Request.ReturnOverrides.ResponseCode = http.StatusAccepted
+	object.Request.ReturnOverrides.ResponseBody = string(body)
+	if object.Request.ReturnOverrides.Headers == nil {
+		object.Request.ReturnOverrides.Headers = make(map[string]string)
+	}
+	object.Request.ReturnOverrides.Headers["Content-Type"] = "application/json"
+
+	logger(ctx).WithFields(logrus.Fields{"event_id": eventID, "target_host": targetHost(targetURL)}).Info("Request queued for delivery")
+	logger(ctx).WithFields(logrus.Fields{"event_id": eventID, "target": targetURL}).Debug("Queued request target URL")
+	return object, nil
+}
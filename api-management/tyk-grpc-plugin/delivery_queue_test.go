@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newQueueTestHandler creates a signing handler delivering through a started queue
+func newQueueTestHandler(t *testing.T, config DeliveryQueueConfig) *DPoPHandler {
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 2})
+	handler.deliveryQueue = NewDeliveryQueue(handler, config)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler.deliveryQueue.Start(ctx)
+	return handler
+}
+
+// waitForDelivery waits until the delivery of an event is no longer pending
+func waitForDelivery(t *testing.T, queue *DeliveryQueue, eventID string) DeliveryStatus {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, ok := queue.Status(eventID); ok && status.State != deliveryStatePending {
+			return status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Delivery of %s did not finish", eventID)
+	return DeliveryStatus{}
+}
+
+// queuedEventID returns the event ID of a request answered with 202
+func queuedEventID(t *testing.T, handler *DPoPHandler) string {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(server.Close)
+
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	return decodeQueuedResponse(t, result.Request.ReturnOverrides.ResponseCode, result.Request.ReturnOverrides.ResponseBody)
+}
+
+// decodeQueuedResponse checks a 202 response and returns its event ID
+func decodeQueuedResponse(t *testing.T, statusCode int32, body string) string {
+	if statusCode != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, statusCode)
+	}
+	var response map[string]string
+	if err := json.Unmarshal([]byte(body), &response); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if response["event_id"] == "" || response["state"] != deliveryStatePending {
+		t.Fatalf("Unexpected response: %s", body)
+	}
+	return response["event_id"]
+}
+
+// TestAsyncDelivery tests that the hook answers before the target and the outcome is tracked
+func TestAsyncDelivery(t *testing.T) {
+	release := make(chan struct{})
+	var signature atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		signature.Store(r.Header.Get("x-jws-signature"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	defer close(release)
+
+	handler := newQueueTestHandler(t, defaultDeliveryQueueConfig)
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	eventID := decodeQueuedResponse(t, result.Request.ReturnOverrides.ResponseCode, result.Request.ReturnOverrides.ResponseBody)
+
+	// The target has not answered yet
+	if status, ok := handler.deliveryQueue.Status(eventID); !ok || status.State != deliveryStatePending {
+		t.Fatalf("Expected a pending delivery, got %+v", status)
+	}
+
+	release <- struct{}{}
+	status := waitForDelivery(t, handler.deliveryQueue, eventID)
+	if status.State != deliveryStateDelivered || status.StatusCode != http.StatusOK || len(status.Attempts) != 1 {
+		t.Errorf("Expected a delivered status with 1 attempt, got %+v", status)
+	}
+	if signature.Load() == "" {
+		t.Error("Expected the queued request to carry the signature")
+	}
+}
+
+// TestAsyncDeliveryFailure tests that failed deliveries report their attempts and dead letter
+func TestAsyncDeliveryFailure(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	handler := newQueueTestHandler(t, defaultDeliveryQueueConfig)
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	eventID := decodeQueuedResponse(t, result.Request.ReturnOverrides.ResponseCode, result.Request.ReturnOverrides.ResponseBody)
+
+	status := waitForDelivery(t, handler.deliveryQueue, eventID)
+	if status.State != deliveryStateFailed || len(status.Attempts) != 2 {
+		t.Errorf("Expected a failed status with 2 attempts, got %+v", status)
+	}
+	if _, ok := handler.deadLetters.Get(status.DeadLetterID); !ok {
+		t.Errorf("Expected dead letter %q to exist", status.DeadLetterID)
+	}
+}
+
+// TestAsyncDeliveryPerHostConcurrency tests that a slow host cannot hold back other hosts
+func TestAsyncDeliveryPerHostConcurrency(t *testing.T) {
+	release := make(chan struct{})
+	var active, peak atomic.Int32
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := active.Add(1)
+		defer active.Add(-1)
+		for {
+			previous := peak.Load()
+			if current <= previous || peak.CompareAndSwap(previous, current) {
+				break
+			}
+		}
+		<-release
+	}))
+	defer slow.Close()
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	handler := newQueueTestHandler(t, DeliveryQueueConfig{Workers: 4, PerHostConcurrency: 1, QueueSize: 10})
+
+	var slowEvents []string
+	for i := 0; i < 3; i++ {
+		result, _ := handler.JWSSign(context.Background(), newTargetTestObject(slow.URL))
+		slowEvents = append(slowEvents, decodeQueuedResponse(t, result.Request.ReturnOverrides.ResponseCode, result.Request.ReturnOverrides.ResponseBody))
+	}
+	result, _ := handler.JWSSign(context.Background(), newTargetTestObject(fast.URL))
+	fastEvent := decodeQueuedResponse(t, result.Request.ReturnOverrides.ResponseCode, result.Request.ReturnOverrides.ResponseBody)
+
+	// The other host is served while the slow host holds its only slot
+	if status := waitForDelivery(t, handler.deliveryQueue, fastEvent); status.State != deliveryStateDelivered {
+		t.Errorf("Expected the fast host to be delivered, got %+v", status)
+	}
+
+	for range slowEvents {
+		release <- struct{}{}
+	}
+	for _, eventID := range slowEvents {
+		waitForDelivery(t, handler.deliveryQueue, eventID)
+	}
+	if peak.Load() != 1 {
+		t.Errorf("Expected at most 1 concurrent delivery to the slow host, got %d", peak.Load())
+	}
+	if handler.deliveryQueue.Len() != 0 {
+		t.Errorf("Expected an empty queue, got %d", handler.deliveryQueue.Len())
+	}
+}
+
+// TestDeliveryQueueLimits tests that full queues and duplicate event IDs are refused
+func TestDeliveryQueueLimits(t *testing.T) {
+	// Without started workers nothing leaves the queue
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{})
+	handler.deliveryQueue = NewDeliveryQueue(handler, DeliveryQueueConfig{QueueSize: 1})
+
+	queuedEventID(t, handler)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, result.Request.ReturnOverrides.ResponseCode)
+	}
+
+	// A pending event ID cannot be queued twice
+	queue := NewDeliveryQueue(handler, DeliveryQueueConfig{QueueSize: 10})
+	request := &outboundRequest{Method: "POST", URL: server.URL}
+	if err := queue.Enqueue("event-1", request); err != nil {
+		t.Fatalf("Enqueue returned an error: %v", err)
+	}
+	if err := queue.Enqueue("event-1", request); err != errDeliveryPending {
+		t.Errorf("Expected errDeliveryPending, got %v", err)
+	}
+}
+
+// TestDeliveryQueuePrune tests that finished statuses expire after the retention period
+func TestDeliveryQueuePrune(t *testing.T) {
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{})
+	queue := NewDeliveryQueue(handler, DeliveryQueueConfig{StatusRetention: time.Hour})
+
+	now := time.Now()
+	queue.statuses["delivered"] = &DeliveryStatus{State: deliveryStateDelivered, UpdatedAt: now.Add(-2 * time.Hour)}
+	queue.statuses["recent"] = &DeliveryStatus{State: deliveryStateFailed, UpdatedAt: now}
+	queue.statuses["pending"] = &DeliveryStatus{State: deliveryStatePending, UpdatedAt: now.Add(-2 * time.Hour)}
+
+	queue.prune(now)
+
+	for eventID, expected := range map[string]bool{"delivered": false, "recent": true, "pending": true} {
+		if _, ok := queue.Status(eventID); ok != expected {
+			t.Errorf("Expected status of %s kept: %v", eventID, expected)
+		}
+	}
+}
+
+// TestDeliveryQueueDrain tests that requests no worker picked up are dead-lettered on shutdown
+func TestDeliveryQueueDrain(t *testing.T) {
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 1})
+	queue := NewDeliveryQueue(handler, DeliveryQueueConfig{PerHostConcurrency: 1, QueueSize: 10})
+	handler.deliveryQueue = queue
+
+	// Without started workers, one request waits on the channel and one for its host
+	for _, eventID := range []string{"event-1", "event-2"} {
+		if err := queue.Enqueue(eventID, &outboundRequest{URL: "https://tpp.example.com/events"}); err != nil {
+			t.Fatalf("Enqueue returned an error: %v", err)
+		}
+	}
+
+	if drained := queue.Drain(context.Background()); drained != 2 {
+		t.Fatalf("Expected 2 requests dead-lettered, got %d", drained)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("Expected an empty queue, got %d requests", queue.Len())
+	}
+	for _, eventID := range []string{"event-1", "event-2"} {
+		status, _ := queue.Status(eventID)
+		if status.State != deliveryStateFailed {
+			t.Errorf("Expected %s to have failed, got %s", eventID, status.State)
+		}
+		if _, ok := handler.deadLetters.Get(status.DeadLetterID); !ok {
+			t.Errorf("Expected %s to be dead-lettered", eventID)
+		}
+	}
+}
+
+// TestDeliveryQueueDrainTimeout tests that deliveries still in progress when
+// the drain times out are cancelled and dead-lettered
+func TestDeliveryQueueDrainTimeout(t *testing.T) {
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 1, AttemptTimeout: time.Hour})
+	queue := NewDeliveryQueue(handler, DeliveryQueueConfig{})
+	workers, stopWorkers := context.WithCancel(context.Background())
+	queue.Start(workers)
+	if err := queue.Enqueue("event-1", &outboundRequest{Method: "POST", URL: server.URL}); err != nil {
+		t.Fatalf("Enqueue returned an error: %v", err)
+	}
+	<-started
+
+	stopWorkers()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	queue.Drain(ctx)
+
+	status, _ := queue.Status("event-1")
+	if status.State != deliveryStateFailed {
+		t.Errorf("Expected the cancelled delivery to have failed, got %s", status.State)
+	}
+	if _, ok := handler.deadLetters.Get(status.DeadLetterID); !ok {
+		t.Error("Expected the cancelled delivery to be dead-lettered")
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newDeliveryTestHandler creates a signing handler that retries without waiting
+// and records the delays it would have waited
+func newDeliveryTestHandler(t *testing.T, retryConfig RetryConfig) (*DPoPHandler, *[]time.Duration) {
+	privateKey, _ := generateTestKey(t)
+	store, err := NewDeadLetterStore(defaultDeadLetterConfig)
+	if err != nil {
+		t.Fatalf("NewDeadLetterStore returned an error: %v", err)
+	}
+
+	var delays []time.Duration
+	handler := &DPoPHandler{
+		privateKey:  privateKey,
+		retryConfig: retryConfig,
+		deadLetters: store,
+		sleepFunc:   func(delay time.Duration) { delays = append(delays, delay) },
+	}
+	return handler, &delays
+}
+
+// TestDeliveryRetriesTemporaryFailures tests that temporary failures are retried until delivered
+func TestDeliveryRetriesTemporaryFailures(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	retryConfig := RetryConfig{MaxAttempts: 3, InitialBackoff: time.Second, MaxBackoff: 30 * time.Second, MaxRetryAfter: time.Minute}
+	handler, delays := newDeliveryTestHandler(t, retryConfig)
+
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusAccepted {
+		t.Errorf("Expected status %d, got %d", http.StatusAccepted, result.Request.ReturnOverrides.ResponseCode)
+	}
+	if calls.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", calls.Load())
+	}
+
+	// The backoff doubles, with jitter in the upper half of each delay
+	if len(*delays) != 2 {
+		t.Fatalf("Expected 2 delays, got %v", *delays)
+	}
+	if d := (*delays)[0]; d < 500*time.Millisecond || d > time.Second {
+		t.Errorf("Expected the first delay between 0.5s and 1s, got %v", d)
+	}
+	if d := (*delays)[1]; d < time.Second || d > 2*time.Second {
+		t.Errorf("Expected the second delay between 1s and 2s, got %v", d)
+	}
+	if handler.deadLetters.Len() != 0 {
+		t.Errorf("Expected no dead letters, got %d", handler.deadLetters.Len())
+	}
+}
+
+// TestDeliveryHonoursRetryAfter tests that Retry-After replaces the backoff, up to the allowed maximum
+func TestDeliveryHonoursRetryAfter(t *testing.T) {
+	tests := []struct {
+		name           string
+		retryAfter     string
+		expectedCalls  int32
+		expectedDelays []time.Duration
+	}{
+		{"seconds", "7", 2, []time.Duration{7 * time.Second}},
+		{"too long", "3600", 1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if calls.Add(1) == 1 {
+					w.Header().Set("Retry-After", tt.retryAfter)
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			defer server.Close()
+
+			handler, delays := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 3, InitialBackoff: time.Second, MaxRetryAfter: time.Minute})
+			if _, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL)); err != nil {
+				t.Fatalf("JWSSign returned an error: %v", err)
+			}
+
+			if calls.Load() != tt.expectedCalls {
+				t.Errorf("Expected %d attempts, got %d", tt.expectedCalls, calls.Load())
+			}
+			if len(*delays) != len(tt.expectedDelays) || (len(*delays) > 0 && (*delays)[0] != tt.expectedDelays[0]) {
+				t.Errorf("Expected delays %v, got %v", tt.expectedDelays, *delays)
+			}
+		})
+	}
+}
+
+// TestDeliveryDoesNotRetryRejections tests that client errors other than throttling are not retried
+func TestDeliveryDoesNotRetryRejections(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 3, InitialBackoff: time.Second})
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusBadRequest {
+		t.Errorf("Expected the target status to be returned, got %d", result.Request.ReturnOverrides.ResponseCode)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Expected 1 attempt, got %d", calls.Load())
+	}
+}
+
+// TestDeliveryDeadLetterAndReplay tests that exhausted deliveries are dead-lettered and can be replayed
+func TestDeliveryDeadLetterAndReplay(t *testing.T) {
+	var healthy atomic.Bool
+	var received atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received.Store(r.Header.Get("x-jws-signature"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 2, InitialBackoff: time.Second})
+	object := newTargetTestObject(server.URL)
+	object.Request.Headers["Authorization"] = "Bearer secret-access-token"
+	result, err := handler.JWSSign(context.Background(), object)
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusBadGateway {
+		t.Errorf("Expected the last target status to be returned, got %d", result.Request.ReturnOverrides.ResponseCode)
+	}
+
+	letters := handler.deadLetters.List()
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(letters))
+	}
+	letter := letters[0]
+	if len(letter.Attempts) != 2 || letter.Attempts[1].StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 2 recorded attempts, got %+v", letter.Attempts)
+	}
+	signature := letter.Request.Headers["X-Jws-Signature"]
+	if signature == "" {
+		t.Error("Expected the dead letter to keep the signature")
+	}
+	if _, ok := letter.Request.Headers["Authorization"]; ok {
+		t.Error("Expected the dead letter not to store credentials")
+	}
+
+	// A failed replay keeps the dead letter with the new attempts
+	if _, err := handler.ReplayDeadLetter(context.Background(), letter.ID); err == nil {
+		t.Error("Expected the replay to fail")
+	}
+	stored, ok := handler.deadLetters.Get(letter.ID)
+	if !ok || stored.Replays != 1 || len(stored.Attempts) != 4 {
+		t.Errorf("Expected the failed replay to be recorded, got %+v", stored)
+	}
+
+	// A successful replay delivers the signed request and removes the dead letter
+	healthy.Store(true)
+	if _, err := handler.ReplayDeadLetter(context.Background(), letter.ID); err != nil {
+		t.Fatalf("ReplayDeadLetter returned an error: %v", err)
+	}
+	if received.Load() != signature {
+		t.Errorf("Expected the replay to carry the original signature")
+	}
+	if handler.deadLetters.Len() != 0 {
+		t.Errorf("Expected the dead letter to be removed, got %d", handler.deadLetters.Len())
+	}
+	if _, err := handler.ReplayDeadLetter(context.Background(), letter.ID); err != errDeadLetterNotFound {
+		t.Errorf("Expected errDeadLetterNotFound, got %v", err)
+	}
+}
+
+// TestDeliveryReplayCredentials tests that credential headers are sealed in the
+// dead letter and sent again on replay
+func TestDeliveryReplayCredentials(t *testing.T) {
+	var healthy atomic.Bool
+	var received atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		received.Store(r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "dead-letters.json")
+	store, err := NewDeadLetterStore(DeadLetterConfig{Path: path, CredentialsKey: bytes.Repeat([]byte{7}, 32)})
+	if err != nil {
+		t.Fatalf("NewDeadLetterStore returned an error: %v", err)
+	}
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 1})
+	handler.deadLetters = store
+
+	object := newTargetTestObject(server.URL)
+	object.Request.Headers["Authorization"] = "Bearer secret-access-token"
+	if _, err := handler.JWSSign(context.Background(), object); err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	letters := handler.deadLetters.List()
+	if len(letters) != 1 || letters[0].Credentials == "" {
+		t.Fatalf("Expected 1 dead letter with sealed credentials, got %+v", letters)
+	}
+
+	// The credentials are not readable on disk
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read dead letters: %v", err)
+	}
+	if strings.Contains(string(data), "secret-access-token") {
+		t.Error("Expected the dead letter file not to contain the credentials")
+	}
+
+	// A replay restores them
+	healthy.Store(true)
+	if _, err := handler.ReplayDeadLetter(context.Background(), letters[0].ID); err != nil {
+		t.Fatalf("ReplayDeadLetter returned an error: %v", err)
+	}
+	if received.Load() != "Bearer secret-access-token" {
+		t.Errorf("Expected the replay to carry the credentials, got %v", received.Load())
+	}
+
+	// Without a key the credentials are left out and the dead letter says so
+	handler.deadLetters, _ = NewDeadLetterStore(defaultDeadLetterConfig)
+	healthy.Store(false)
+	if _, err := handler.JWSSign(context.Background(), object); err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	letters = handler.deadLetters.List()
+	if len(letters) != 1 || letters[0].Credentials != "" || !slices.Equal(letters[0].DroppedHeaders, []string{"Authorization"}) {
+		t.Errorf("Expected the dropped credential headers to be recorded, got %+v", letters)
+	}
+}
+
+// TestDeliveryReplayChecksTargetPolicy tests that a replay is refused once the
+// target policy no longer allows the dead letter's target
+func TestDeliveryReplayChecksTargetPolicy(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 1})
+	if _, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL)); err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	letters := handler.deadLetters.List()
+	if len(letters) != 1 {
+		t.Fatalf("Expected 1 dead letter, got %d", len(letters))
+	}
+
+	// A reload narrows the policy to another host
+	handler.targetPolicy.AllowedHosts = []string{"tpp.example.com"}
+	_, err := handler.ReplayDeadLetter(context.Background(), letters[0].ID)
+	if !errors.Is(err, errTargetNotAllowed) {
+		t.Errorf("Expected errTargetNotAllowed, got %v", err)
+	}
+	if requests.Load() != 1 {
+		t.Errorf("Expected the replay not to reach the target, got %d requests", requests.Load())
+	}
+	if _, ok := handler.deadLetters.Get(letters[0].ID); !ok {
+		t.Error("Expected the refused dead letter to be kept")
+	}
+}
+
+// TestDeliveryCancelled tests that cancelling the context ends both a request
+// in progress and the wait before a retry, dead-lettering the request
+func TestDeliveryCancelled(t *testing.T) {
+	tests := []struct {
+		name  string
+		block bool
+	}{
+		{"request in progress", true},
+		{"waiting to retry", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.block {
+					cancel()
+					<-r.Context().Done()
+				} else {
+					// Cancel once the response has been read and the retry is waiting
+					time.AfterFunc(100*time.Millisecond, cancel)
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}))
+			defer server.Close()
+
+			handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 3, InitialBackoff: time.Hour, AttemptTimeout: time.Hour})
+			handler.sleepFunc = nil
+
+			done := make(chan error, 1)
+			go func() {
+				_, _, _, err := handler.deliverOrDeadLetter(ctx, &outboundRequest{Method: "POST", URL: server.URL})
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Expected context.Canceled, got %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Expected the delivery to end when cancelled")
+			}
+			if handler.deadLetters.Len() != 1 {
+				t.Errorf("Expected the cancelled delivery to be dead-lettered, got %d", handler.deadLetters.Len())
+			}
+		})
+	}
+}
+
+// TestDeadLetterStorePersistence tests that dead letters survive a restart and are bounded
+func TestDeadLetterStorePersistence(t *testing.T) {
+	config := DeadLetterConfig{MaxEntries: 2, Path: filepath.Join(t.TempDir(), "dead-letters.json")}
+	store, err := NewDeadLetterStore(config)
+	if err != nil {
+		t.Fatalf("NewDeadLetterStore returned an error: %v", err)
+	}
+
+	now := time.Now()
+	for i, id := range []string{"first", "second", "third"} {
+		store.Add(&DeadLetter{ID: id, Request: &outboundRequest{URL: "https://tpp.example.com/callback"}, CreatedAt: now.Add(time.Duration(i) * time.Second)})
+	}
+
+	reloaded, err := NewDeadLetterStore(config)
+	if err != nil {
+		t.Fatalf("NewDeadLetterStore returned an error: %v", err)
+	}
+	letters := reloaded.List()
+	if len(letters) != 2 || letters[0].ID != "second" || letters[1].ID != "third" {
+		t.Errorf("Expected the two newest dead letters, got %+v", letters)
+	}
+}
+
+// TestParseRetryAfter tests parsing Retry-After as seconds and as an HTTP date
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value    string
+		expected time.Duration
+		ok       bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		delay, ok := parseRetryAfter(tt.value, now)
+		if ok != tt.ok || delay != tt.expected {
+			t.Errorf("parseRetryAfter(%q) = %v, %v; expected %v, %v", tt.value, delay, ok, tt.expected, tt.ok)
+		}
+	}
+}
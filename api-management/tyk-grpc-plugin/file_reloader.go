@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// loadedFiles is a value loaded from files, with the fingerprint of the files it was loaded from
+type loadedFiles[T any] struct {
+	value       T
+	fingerprint string
+}
+
+// fileReloader holds a value loaded from files and reloads it when they change.
+// Reloads swap in the new value atomically, so users keep the value they
+// started with; on failure the previously loaded value stays in use.
+type fileReloader[T any] struct {
+	// What is loaded, used in log messages
+	name string
+	// How often the files are checked for changes (0 disables)
+	interval time.Duration
+	// Summarises the files, changing whenever they change
+	fingerprint func() (string, error)
+	load        func() (T, error)
+	// Called with every value swapped in (optional)
+	loaded func(T)
+
+	current atomic.Pointer[loadedFiles[T]]
+}
+
+// Load returns the current value
+func (f *fileReloader[T]) Load() T {
+	return f.current.Load().value
+}
+
+// Reload loads the value from the files and swaps it in
+func (f *fileReloader[T]) Reload() error {
+	// Fingerprint first, so changes made while loading trigger another reload
+	fingerprint, err := f.fingerprint()
+	if err != nil {
+		return err
+	}
+	value, err := f.load()
+	if err != nil {
+		return err
+	}
+	f.current.Store(&loadedFiles[T]{value: value, fingerprint: fingerprint})
+
+	if f.loaded != nil {
+		f.loaded(value)
+	}
+	return nil
+}
+
+// Watch reloads the value whenever the files change, until the context is cancelled
+func (f *fileReloader[T]) Watch(ctx context.Context) {
+	if f.interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fingerprint, err := f.fingerprint()
+			if err != nil {
+				log.Errorf("Failed to check %s files: %v", f.name, err)
+				continue
+			}
+			if fingerprint == f.current.Load().fingerprint {
+				continue
+			}
+
+			log.Infof("%s files changed, reloading", f.name)
+			if err := f.Reload(); err != nil {
+				log.Errorf("Failed to reload %s files, keeping the loaded ones: %v", f.name, err)
+			}
+		}
+	}
+}
+
+// fileFingerprint summarises the size and modification time of the files, skipping empty paths
+func fileFingerprint(paths ...string) string {
+	var parts []string
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			parts = append(parts, path+":missing")
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s:%d:%d", path, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(parts, "|")
+}
+
+// loadCertificate reads a certificate and its private key (PEM format),
+// refusing expired certificates. The description names the certificate in errors.
+func loadCertificate(certPath, keyPath, description string) (*tls.Certificate, error) {
+	certificate, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", description, err)
+	}
+	if time.Now().After(certificate.Leaf.NotAfter) {
+		return nil, fmt.Errorf("%s %s expired on %s", description, certificate.Leaf.Subject, certificate.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return &certificate, nil
+}
+
+// loadCertPool reads a PEM CA bundle. The description names the bundle in errors.
+func loadCertPool(path, description string) (*x509.CertPool, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", description, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificates found in %s %s", description, path)
+	}
+	return pool, nil
+}
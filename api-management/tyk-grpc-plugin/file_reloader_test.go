@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFileReloader tests that file changes are reloaded and failed loads keep the loaded value
+func TestFileReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "value.txt")
+	if err := os.WriteFile(path, []byte("first"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	files := &fileReloader[string]{
+		name:     "test",
+		interval: 10 * time.Millisecond,
+		fingerprint: func() (string, error) {
+			return fileFingerprint(path), nil
+		},
+		load: func() (string, error) {
+			data, err := os.ReadFile(path)
+			if strings.TrimSpace(string(data)) == "broken" {
+				return "", errors.New("broken file")
+			}
+			return string(data), err
+		},
+	}
+	if err := files.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %v", err)
+	}
+
+	// A failed load keeps the loaded value
+	if err := os.WriteFile(path, []byte("broken"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	if err := files.Reload(); err == nil {
+		t.Error("Expected the reload of a broken file to fail")
+	}
+	if value := files.Load(); value != "first" {
+		t.Errorf("Expected first to stay loaded, got %q", value)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go files.Watch(ctx)
+
+	// The fingerprint changes with the size of the file
+	if err := os.WriteFile(path, []byte("second value"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for files.Load() != "second value" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the changed file to be reloaded, got %q", files.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
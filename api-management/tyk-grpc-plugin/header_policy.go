@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// hopByHopHeaders apply to a single connection and are never forwarded (RFC 9110 section 7.6.1)
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// forwardedHeaders describe the client and proxies of the original request
+var forwardedHeaders = []string{
+	"Forwarded",
+	"X-Real-Ip",
+}
+
+// HeaderPolicyConfig controls which headers are forwarded to and returned from targets
+type HeaderPolicyConfig struct {
+	// Request headers forwarded to targets (all when empty). Headers set by
+	// the hooks, such as the signature, are always forwarded.
+	AllowedRequestHeaders []string
+	// Target response headers returned to the caller (all when empty)
+	AllowedResponseHeaders []string
+	// Remove the X-Forwarded-*, Forwarded and X-Real-IP headers of the
+	// original request instead of forwarding them (default: false)
+	StripForwardedHeaders bool
+}
+
+// connectionHeaders returns the canonical names of the hop-by-hop headers,
+// including those named in the Connection header
+func connectionHeaders(connection []string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range hopByHopHeaders {
+		names[name] = true
+	}
+	for _, value := range connection {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names[textproto.CanonicalMIMEHeaderKey(name)] = true
+			}
+		}
+	}
+	return names
+}
+
+// isForwardedHeader reports whether a canonical header name describes the original client
+func isForwardedHeader(name string) bool {
+	return strings.HasPrefix(name, "X-Forwarded-") || containsFold(forwardedHeaders, name)
+}
+
+// requestHeaders returns the headers of the hook request to forward to the target
+func (p *HeaderPolicyConfig) requestHeaders(object *pb.Object) map[string]string {
+	excluded := connectionHeaders([]string{getHeader(object.Request.Headers, "Connection")})
+	// The target has its own host, and the hooks may have rewritten the body
+	excluded["Host"] = true
+	excluded["Content-Length"] = true
+	excluded["X-Rewrite-Target"] = true
+	for _, name := range object.Request.DeleteHeaders {
+		excluded[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+
+	headers := map[string]string{}
+	for k, v := range object.Request.Headers {
+		name := textproto.CanonicalMIMEHeaderKey(k)
+		if excluded[name] || (isForwardedHeader(name) && p.StripForwardedHeaders) {
+			continue
+		}
+		if len(p.AllowedRequestHeaders) > 0 && !containsFold(p.AllowedRequestHeaders, name) {
+			continue
+		}
+		headers[name] = v
+	}
+
+	// Add the headers set by the hook, such as the JWS signature
+	for k, v := range object.Request.SetHeaders {
+		headers[textproto.CanonicalMIMEHeaderKey(k)] = v
+	}
+	return headers
+}
+
+// responseHeaders returns the target response headers to return to the caller
+func (p *HeaderPolicyConfig) responseHeaders(header http.Header) http.Header {
+	excluded := connectionHeaders(header.Values("Connection"))
+	// The caller's gateway sets the length of the body it returns
+	excluded["Content-Length"] = true
+
+	filtered := http.Header{}
+	for name, values := range header {
+		if excluded[name] {
+			continue
+		}
+		if len(p.AllowedResponseHeaders) > 0 && !containsFold(p.AllowedResponseHeaders, name) {
+			continue
+		}
+		filtered[name] = append([]string{}, values...)
+	}
+	return filtered
+}
+
+// setTargetResponse returns the target response as the hook response. Tyk
+// only applies the return overrides of request hooks, and they hold one value
+// per header, so list values are combined with commas (RFC 9110 section 5.3).
+// Set-Cookie cannot be combined: only its first value reaches the client. The
+// response object lists every value, but Tyk ignores it for request hooks.
+func setTargetResponse(ctx context.Context, object *pb.Object, statusCode int, header http.Header, body []byte) {
+	if object.Request.ReturnOverrides == nil {
+		object.Request.ReturnOverrides = &pb.ReturnOverrides{}
+	}
+	overrides := object.Request.ReturnOverrides
+	overrides.ResponseCode = int32(statusCode)
+	overrides.ResponseBody = string(body)
+	if overrides.Headers == nil {
+		overrides.Headers = make(map[string]string)
+	}
+
+	response := &pb.ResponseObject{
+		StatusCode: int32(statusCode),
+		Body:       string(body),
+		RawBody:    body,
+		Headers:    map[string]string{},
+	}
+
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := header[name]
+		if len(values) == 0 {
+			continue
+		}
+		value := values[0]
+		if name != "Set-Cookie" {
+			value = strings.Join(values, ", ")
+		} else if len(values) > 1 {
+			logger(ctx).Warnf("Target returned %d Set-Cookie headers, only the first is returned to the client", len(values))
+		}
+		overrides.Headers[name] = value
+		response.Headers[name] = value
+		response.MultivalueHeaders = append(response.MultivalueHeaders, &pb.Header{Key: name, Values: append([]string{}, values...)})
+	}
+	object.Response = response
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// newHeaderTestObject creates a hook object carrying proxy and connection headers
+func newHeaderTestObject() *pb.Object {
+	return &pb.Object{
+		Request: &pb.MiniRequestObject{
+			Headers: map[string]string{
+				"Content-Type":          "application/json",
+				"X-Fapi-Interaction-Id": "interaction-1",
+				"Connection":            "keep-alive, X-Internal-Hop",
+				"X-Internal-Hop":        "secret",
+				"Transfer-Encoding":     "chunked",
+				"Te":                    "trailers",
+				"Host":                  "gateway.internal",
+				"X-Forwarded-For":       "10.0.0.7",
+				"X-Forwarded-Proto":     "https",
+				"Forwarded":             "for=10.0.0.7",
+				"x-rewrite-target":      "https://tpp.example.com/events",
+				"X-Removed":             "by hook",
+			},
+			SetHeaders:    map[string]string{"x-jws-signature": "signature"},
+			DeleteHeaders: []string{"x-removed"},
+		},
+	}
+}
+
+// TestRequestHeaders tests the headers forwarded to targets
+func TestRequestHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   HeaderPolicyConfig
+		expected map[string]string
+	}{
+		{
+			name: "default",
+			expected: map[string]string{
+				"Content-Type":          "application/json",
+				"X-Fapi-Interaction-Id": "interaction-1",
+				"X-Forwarded-For":       "10.0.0.7",
+				"X-Forwarded-Proto":     "https",
+				"Forwarded":             "for=10.0.0.7",
+				"X-Jws-Signature":       "signature",
+			},
+		},
+		{
+			name:   "forwarded headers stripped",
+			policy: HeaderPolicyConfig{StripForwardedHeaders: true},
+			expected: map[string]string{
+				"Content-Type":          "application/json",
+				"X-Fapi-Interaction-Id": "interaction-1",
+				"X-Jws-Signature":       "signature",
+			},
+		},
+		{
+			name:   "allow-list",
+			policy: HeaderPolicyConfig{AllowedRequestHeaders: []string{"content-type"}},
+			expected: map[string]string{
+				"Content-Type":    "application/json",
+				"X-Jws-Signature": "signature",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := tt.policy.requestHeaders(newHeaderTestObject())
+			if !reflect.DeepEqual(headers, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, headers)
+			}
+		})
+	}
+}
+
+// TestResponseHeaders tests that hop-by-hop headers are removed and every value is kept
+func TestResponseHeaders(t *testing.T) {
+	header := http.Header{
+		"Set-Cookie":        {"a=1; Secure", "b=2; Secure"},
+		"Link":              {"</a>; rel=next", "</b>; rel=prev"},
+		"Content-Type":      {"application/json"},
+		"Connection":        {"close, X-Hop"},
+		"X-Hop":             {"internal"},
+		"Transfer-Encoding": {"chunked"},
+		"Content-Length":    {"2"},
+	}
+
+	var policy HeaderPolicyConfig
+	object := &pb.Object{Request: &pb.MiniRequestObject{}}
+	setTargetResponse(context.Background(), object, http.StatusOK, policy.responseHeaders(header), []byte("{}"))
+
+	expected := map[string]string{
+		"Set-Cookie":   "a=1; Secure",
+		"Link":         "</a>; rel=next, </b>; rel=prev",
+		"Content-Type": "application/json",
+	}
+	if !reflect.DeepEqual(object.Request.ReturnOverrides.Headers, expected) {
+		t.Errorf("Expected override headers %v, got %v", expected, object.Request.ReturnOverrides.Headers)
+	}
+
+	multivalue := map[string][]string{}
+	for _, h := range object.Response.MultivalueHeaders {
+		multivalue[h.Key] = h.Values
+	}
+	if !reflect.DeepEqual(multivalue["Set-Cookie"], []string{"a=1; Secure", "b=2; Secure"}) {
+		t.Errorf("Expected both cookies, got %v", multivalue["Set-Cookie"])
+	}
+	if len(multivalue) != 3 {
+		t.Errorf("Expected 3 multi-value headers, got %v", multivalue)
+	}
+	if object.Response.StatusCode != http.StatusOK || object.Response.Body != "{}" {
+		t.Errorf("Unexpected response object: %+v", object.Response)
+	}
+
+	// The allow-list limits the headers returned
+	policy.AllowedResponseHeaders = []string{"Content-Type"}
+	if filtered := policy.responseHeaders(header); len(filtered) != 1 || filtered.Get("Content-Type") == "" {
+		t.Errorf("Expected only Content-Type, got %v", filtered)
+	}
+}
+
+// TestForwardingHeaders tests the headers seen by the target and returned to the caller
+func TestForwardingHeaders(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{privateKey: privateKey}
+
+	object := newHeaderTestObject()
+	object.Request.Headers["x-rewrite-target"] = server.URL
+	object.Request.SetHeaders = nil
+	object.Request.Body = "{}"
+	object.Request.Method = "POST"
+
+	result, err := handler.JWSSign(context.Background(), object)
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+
+	for _, name := range []string{"X-Internal-Hop", "X-Removed", "X-Rewrite-Target"} {
+		if value := received.Get(name); value != "" {
+			t.Errorf("Expected %s not to be forwarded, got %q", name, value)
+		}
+	}
+	if received.Get("X-Jws-Signature") == "" || received.Get("X-Fapi-Interaction-Id") != "interaction-1" || received.Get("X-Forwarded-For") != "10.0.0.7" {
+		t.Errorf("Expected the signature, interaction ID and forwarded headers to be forwarded, got %v", received)
+	}
+
+	// Tyk applies one value per header from the return overrides
+	if cookie := result.Request.ReturnOverrides.Headers["Set-Cookie"]; cookie != "a=1" {
+		t.Errorf("Expected the first cookie in the return overrides, got %q", cookie)
+	}
+	var cookies []string
+	for _, h := range result.Response.MultivalueHeaders {
+		if h.Key == "Set-Cookie" {
+			cookies = h.Values
+		}
+	}
+	if len(cookies) != 2 {
+		t.Errorf("Expected both cookies to be returned, got %v", cookies)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// Capabilities reported by the health service, each under its own service
+// name. The empty service name reports the readiness of the plugin as a whole,
+// and the Dispatcher service name its liveness.
+const (
+	capabilitySigning  = "signing"
+	capabilityStores   = "stores"
+	capabilityDelivery = "delivery"
+	capabilityJWKS     = "jwks"
+)
+
+// capabilities lists the reported capabilities in the order they are checked
+var capabilities = []string{capabilitySigning, capabilityStores, capabilityDelivery, capabilityJWKS}
+
+// readinessCapabilities are the local prerequisites the plugin is not ready
+// without. The other capabilities depend on TPPs and traffic, which every
+// replica shares, so they are reported without taking replicas out of rotation.
+var readinessCapabilities = map[string]bool{capabilitySigning: true, capabilityStores: true}
+
+// HealthConfig configures health reporting
+type HealthConfig struct {
+	// Address the HTTP liveness and readiness endpoints bind to (disabled when empty)
+	ListenAddr string
+	// Interval between checks of the capabilities (default: 5 seconds)
+	CheckInterval time.Duration
+}
+
+// Default health configuration values
+var defaultHealthConfig = HealthConfig{
+	CheckInterval: 5 * time.Second,
+}
+
+// CapabilityHealth is the state of a capability
+type CapabilityHealth struct {
+	// SERVING, NOT_SERVING, or SERVICE_UNKNOWN when the capability is not configured
+	Status string `json:"status"`
+	// Why the capability is not serving
+	Reason string `json:"reason,omitempty"`
+}
+
+// HealthReporter checks the capabilities of the handler currently serving
+// requests and reports them through the grpc.health.v1 service
+type HealthReporter struct {
+	config HealthConfig
+	source handlerSource
+	server *health.Server
+
+	mu       sync.Mutex
+	ready    bool
+	shutdown bool
+	statuses map[string]CapabilityHealth
+}
+
+// NewHealthReporter creates a health reporter and runs a first check, so the
+// status is known before the first request. Run keeps it up to date.
+func NewHealthReporter(source handlerSource, config HealthConfig) *HealthReporter {
+	if config.CheckInterval <= 0 {
+		config.CheckInterval = defaultHealthConfig.CheckInterval
+	}
+
+	h := &HealthReporter{config: config, source: source, server: health.NewServer()}
+	h.server.SetServingStatus(pb.Dispatcher_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	h.Refresh()
+	return h
+}
+
+// Register adds the grpc.health.v1 service to the gRPC server
+func (h *HealthReporter) Register(s *grpc.Server) {
+	healthpb.RegisterHealthServer(s, h.server)
+}
+
+// Run checks the capabilities at the configured interval until the context is cancelled
+func (h *HealthReporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.config.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.Refresh()
+		}
+	}
+}
+
+// Refresh checks the capabilities and updates the reported statuses. The
+// plugin is ready unless a configured readiness capability is not serving.
+func (h *HealthReporter) Refresh() {
+	handler := h.source.Handler()
+	checks := map[string]func() (healthpb.HealthCheckResponse_ServingStatus, string){
+		capabilitySigning:  handler.signingHealth,
+		capabilityStores:   handler.storesHealth,
+		capabilityDelivery: handler.deliveryHealth,
+		capabilityJWKS:     handler.jwksHealth,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return
+	}
+
+	statuses := make(map[string]CapabilityHealth, len(capabilities))
+	ready := true
+	for _, capability := range capabilities {
+		status, reason := checks[capability]()
+		previous := h.statuses[capability].Status
+		switch {
+		case status == healthpb.HealthCheckResponse_NOT_SERVING:
+			if readinessCapabilities[capability] {
+				ready = false
+			}
+			if previous != status.String() {
+				log.Warnf("Capability %s not serving: %s", capability, reason)
+			}
+		case previous == healthpb.HealthCheckResponse_NOT_SERVING.String():
+			log.Infof("Capability %s recovered", capability)
+		}
+		statuses[capability] = CapabilityHealth{Status: status.String(), Reason: reason}
+		h.server.SetServingStatus(capability, status)
+	}
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	if !ready {
+		overall = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	h.server.SetServingStatus("", overall)
+	h.ready = ready
+	h.statuses = statuses
+}
+
+// Status reports whether the plugin is ready and the state of each capability
+func (h *HealthReporter) Status() (bool, map[string]CapabilityHealth) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.ready, h.statuses
+}
+
+// Shutdown reports every capability as not serving, so callers stop sending
+// requests while the plugin drains
+func (h *HealthReporter) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = false
+	h.shutdown = true
+	h.server.Shutdown()
+}
+
+// Handler returns the HTTP handler of the liveness and readiness endpoints
+func (h *HealthReporter) Handler() http.Handler {
+	mux := http.NewServeMux()
+	// The plugin is live while it answers
+	mux.HandleFunc("GET /livez", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"SERVING"}`))
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		ready, statuses := h.Status()
+		status, code := "SERVING", http.StatusOK
+		if !ready {
+			status, code = "NOT_SERVING", http.StatusServiceUnavailable
+		}
+
+		body, err := json.Marshal(map[string]interface{}{"status": status, "capabilities": statuses})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		w.Write(body)
+	})
+	return mux
+}
+
+// ListenAndServe serves the liveness and readiness endpoints until the context is cancelled
+func (h *HealthReporter) ListenAndServe(ctx context.Context) error {
+	log.Infof("Serving health checks on %s/livez and %s/readyz", h.config.ListenAddr, h.config.ListenAddr)
+	server := &http.Server{
+		Addr:              h.config.ListenAddr,
+		Handler:           h.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return serveHTTP(ctx, server)
+}
+
+// signingHealth reports whether a signing key is available when signing is configured
+func (d *DPoPHandler) signingHealth() (healthpb.HealthCheckResponse_ServingStatus, string) {
+	configured := d.jwsConfig.PrivateKeyPath != "" || d.jwsConfig.PrivateKeyString != ""
+	if d.settings != nil {
+		keys := d.settings.Keys
+		configured = configured || keys.Signer.URL != "" || keys.Directory != "" || len(keys.Keys) > 0
+	}
+	if !configured {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, "signing not configured"
+	}
+
+	if _, err := d.defaultSigningKey(); err != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING, err.Error()
+	}
+	return healthpb.HealthCheckResponse_SERVING, ""
+}
+
+// storesHealth reports whether dead letters are persisted
+func (d *DPoPHandler) storesHealth() (healthpb.HealthCheckResponse_ServingStatus, string) {
+	if err := d.deadLetters.Err(); err != nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING, "dead letters not persisted: " + err.Error()
+	}
+	return healthpb.HealthCheckResponse_SERVING, ""
+}
+
+// deliveryHealth reports whether the delivery queue accepts requests when
+// delivery is asynchronous
+func (d *DPoPHandler) deliveryHealth() (healthpb.HealthCheckResponse_ServingStatus, string) {
+	if d.deliveryQueue == nil {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, "asynchronous delivery not enabled"
+	}
+	if d.deliveryQueue.Full() {
+		return healthpb.HealthCheckResponse_NOT_SERVING, "delivery queue full"
+	}
+	return healthpb.HealthCheckResponse_SERVING, ""
+}
+
+// jwksHealth reports whether the keys of TPPs can be resolved when JWS
+// verification is configured
+func (d *DPoPHandler) jwksHealth() (healthpb.HealthCheckResponse_ServingStatus, string) {
+	if d.jwsVerifyConfig.JWKSRegistryPath == "" && d.jwsVerifyConfig.JWKSDirectory == "" {
+		return healthpb.HealthCheckResponse_SERVICE_UNKNOWN, "JWS verification not configured"
+	}
+	if d.keyResolver == nil {
+		return healthpb.HealthCheckResponse_NOT_SERVING, "JWKS registry or directory failed to load"
+	}
+
+	if fetcher, ok := d.keyResolver.(interface{ fetchError() error }); ok {
+		if err := fetcher.fetchError(); err != nil {
+			return healthpb.HealthCheckResponse_NOT_SERVING, err.Error()
+		}
+	}
+	return healthpb.HealthCheckResponse_SERVING, ""
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// checkHealth returns the status the grpc.health.v1 service reports for a service
+func checkHealth(t *testing.T, reporter *HealthReporter, service string) healthpb.HealthCheckResponse_ServingStatus {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	reporter.Register(server)
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatalf("Check(%q) returned an error: %v", service, err)
+	}
+	return resp.Status
+}
+
+// TestHealthSigning tests that a configured signing key that failed to load makes the plugin unready
+func TestHealthSigning(t *testing.T) {
+	handler := &DPoPHandler{}
+	reporter := NewHealthReporter(handler, HealthConfig{})
+	if status := checkHealth(t, reporter, capabilitySigning); status != healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+		t.Errorf("Expected signing to be unknown when not configured, got %v", status)
+	}
+	if status := checkHealth(t, reporter, ""); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the plugin to be ready, got %v", status)
+	}
+
+	handler.jwsConfig.PrivateKeyPath = "/keys/missing.pem"
+	reporter.Refresh()
+	if status := checkHealth(t, reporter, capabilitySigning); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected signing not to serve without a key, got %v", status)
+	}
+	if status := checkHealth(t, reporter, ""); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected the plugin not to be ready, got %v", status)
+	}
+	if status := checkHealth(t, reporter, "coprocess.Dispatcher"); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the plugin to stay live, got %v", status)
+	}
+
+	handler.privateKey, _ = generateTestKey(t)
+	reporter.Refresh()
+	if status := checkHealth(t, reporter, capabilitySigning); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected signing to serve with a key, got %v", status)
+	}
+}
+
+// TestHealthStores tests that a full delivery queue or unpersisted dead letters are reported
+func TestHealthStores(t *testing.T) {
+	handler := &DPoPHandler{}
+	if status, _ := handler.deliveryHealth(); status != healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+		t.Errorf("Expected delivery to be unknown when synchronous, got %v", status)
+	}
+	handler.deliveryQueue = NewDeliveryQueue(handler, DeliveryQueueConfig{QueueSize: 1})
+	if status, reason := handler.storesHealth(); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the stores to serve, got %v: %s", status, reason)
+	}
+	if status, reason := handler.deliveryHealth(); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected delivery to serve, got %v: %s", status, reason)
+	}
+
+	if err := handler.deliveryQueue.Enqueue("event-1", &outboundRequest{URL: "https://tpp.example.com/events"}); err != nil {
+		t.Fatalf("Enqueue returned an error: %v", err)
+	}
+	if status, reason := handler.deliveryHealth(); status != healthpb.HealthCheckResponse_NOT_SERVING || reason != "delivery queue full" {
+		t.Errorf("Expected a full queue to be reported, got %v: %s", status, reason)
+	}
+
+	// A full queue is shared by every replica, so it does not make the plugin unready
+	reporter := NewHealthReporter(handler, HealthConfig{})
+	if status := checkHealth(t, reporter, capabilityDelivery); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected delivery not to serve, got %v", status)
+	}
+	if status := checkHealth(t, reporter, ""); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the plugin to stay ready with a full queue, got %v", status)
+	}
+
+	handler.deliveryQueue = nil
+	store, err := NewDeadLetterStore(DeadLetterConfig{Path: filepath.Join(t.TempDir(), "missing", "dead-letters.json")})
+	if err != nil {
+		t.Fatalf("NewDeadLetterStore returned an error: %v", err)
+	}
+	handler.deadLetters = store
+	store.Add(&DeadLetter{ID: "letter-1"})
+	if status, _ := handler.storesHealth(); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected unpersisted dead letters to be reported, got %v", status)
+	}
+	reporter.Refresh()
+	if status := checkHealth(t, reporter, ""); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected unpersisted dead letters to make the plugin unready, got %v", status)
+	}
+}
+
+// TestHealthJWKS tests that JWKS fetching is reported unhealthy only while every fetch fails
+func TestHealthJWKS(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tpp-a" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer server.Close()
+
+	registry := filepath.Join(t.TempDir(), "registry.json")
+	data, _ := json.Marshal(map[string]string{"tpp-a": server.URL + "/tpp-a", "tpp-b": server.URL + "/tpp-b"})
+	if err := os.WriteFile(registry, data, 0o600); err != nil {
+		t.Fatalf("Failed to write registry: %v", err)
+	}
+
+	handler := &DPoPHandler{}
+	if status, _ := handler.jwksHealth(); status != healthpb.HealthCheckResponse_SERVICE_UNKNOWN {
+		t.Errorf("Expected JWKS to be unknown when not configured, got %v", status)
+	}
+	handler.jwsVerifyConfig.JWKSRegistryPath = registry
+	if status, _ := handler.jwksHealth(); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected a registry that failed to load to be reported, got %v", status)
+	}
+
+	resolver, err := newKeyResolver(handler.jwsVerifyConfig)
+	if err != nil {
+		t.Fatalf("newKeyResolver returned an error: %v", err)
+	}
+	handler.keyResolver = resolver
+	resolver.ResolveKey("tpp-a", "kid", "sig")
+	if status, _ := handler.jwksHealth(); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected failing fetches to be reported, got %v", status)
+	}
+	// TPP endpoints failing do not take the plugin out of rotation
+	reporter := NewHealthReporter(handler, HealthConfig{})
+	if status := checkHealth(t, reporter, ""); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected the plugin to stay ready while JWKS fetches fail, got %v", status)
+	}
+
+	// One TPP's broken JWKS URI does not make the plugin unready
+	resolver.ResolveKey("tpp-b", "kid", "sig")
+	if status, reason := handler.jwksHealth(); status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected JWKS to serve while some fetches succeed, got %v: %s", status, reason)
+	}
+}
+
+// TestHealthHTTPEndpoints tests the liveness and readiness endpoints
+func TestHealthHTTPEndpoints(t *testing.T) {
+	handler := &DPoPHandler{}
+	reporter := NewHealthReporter(handler, HealthConfig{})
+	server := httptest.NewServer(reporter.Handler())
+	defer server.Close()
+
+	readiness := func() (int, map[string]CapabilityHealth) {
+		resp, err := http.Get(server.URL + "/readyz")
+		if err != nil {
+			t.Fatalf("Failed to call /readyz: %v", err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Capabilities map[string]CapabilityHealth `json:"capabilities"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatalf("Failed to decode /readyz: %v", err)
+		}
+		return resp.StatusCode, body.Capabilities
+	}
+
+	if code, _ := readiness(); code != http.StatusOK {
+		t.Errorf("Expected a ready plugin to answer 200, got %d", code)
+	}
+
+	handler.jwsConfig.PrivateKeyPath = "/keys/missing.pem"
+	reporter.Refresh()
+	code, capabilities := readiness()
+	if code != http.StatusServiceUnavailable || capabilities[capabilitySigning].Status != "NOT_SERVING" {
+		t.Errorf("Expected 503 with signing not serving, got %d and %+v", code, capabilities)
+	}
+
+	resp, err := http.Get(server.URL + "/livez")
+	if err != nil {
+		t.Fatalf("Failed to call /livez: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected an unready plugin to stay live, got %d", resp.StatusCode)
+	}
+}
+
+// TestHealthShutdown tests that shutting down reports the plugin as not serving for good
+func TestHealthShutdown(t *testing.T) {
+	reporter := NewHealthReporter(&DPoPHandler{}, HealthConfig{})
+	reporter.Shutdown()
+	reporter.Refresh()
+
+	if ready, _ := reporter.Status(); ready {
+		t.Error("Expected the plugin not to be ready after shutdown")
+	}
+	if status := checkHealth(t, reporter, ""); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected NOT_SERVING after shutdown, got %v", status)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// HookFunc runs a hook on the object received from Tyk
+type HookFunc func(d *DPoPHandler, ctx context.Context, object *pb.Object) (*pb.Object, error)
+
+// HookConfigField describes a field a hook reads from the API config data
+type HookConfigField struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// HookDefinition describes a hook that can be named in an API definition
+type HookDefinition struct {
+	Name string
+	// Hook types the hook can run as, e.g. Pre for prePlugins
+	Types []pb.HookType
+	// Fields the hook reads from the API config data
+	ConfigSchema []HookConfigField
+	// Hooks run in order by a composite hook (empty for simple hooks)
+	Steps []string
+	Run   HookFunc
+}
+
+// supports reports whether the hook can run as the given hook type. Requests
+// that do not state their type are accepted.
+func (h *HookDefinition) supports(hookType pb.HookType) bool {
+	return hookType == pb.HookType_Unknown || slices.Contains(h.Types, hookType)
+}
+
+// HookRegistry holds the hooks Dispatch can run, by name
+type HookRegistry struct {
+	mu    sync.RWMutex
+	hooks map[string]*HookDefinition
+}
+
+// NewHookRegistry creates an empty hook registry
+func NewHookRegistry() *HookRegistry {
+	return &HookRegistry{hooks: map[string]*HookDefinition{}}
+}
+
+// Register adds a hook to the registry
+func (r *HookRegistry) Register(hook HookDefinition) error {
+	if hook.Name == "" {
+		return errors.New("hook has no name")
+	}
+	if len(hook.Types) == 0 {
+		return fmt.Errorf("hook %s supports no hook types", hook.Name)
+	}
+	if hook.Run == nil {
+		return fmt.Errorf("hook %s has no function", hook.Name)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.hooks[hook.Name]; ok {
+		return fmt.Errorf("hook %s already registered", hook.Name)
+	}
+	r.hooks[hook.Name] = &hook
+	return nil
+}
+
+// RegisterComposite adds a hook running the given registered hooks in order
+// within one call. It supports the hook types all steps support, and reads the
+// config fields of every step. The steps stop at the first one that answers
+// the request itself, e.g. with an error or a cached response.
+func (r *HookRegistry) RegisterComposite(name string, steps []string) error {
+	if len(steps) < 2 {
+		return fmt.Errorf("composite hook %s needs at least two steps", name)
+	}
+
+	var types []pb.HookType
+	var schema []HookConfigField
+	var stepHooks []*HookDefinition
+	for i, step := range steps {
+		hook, ok := r.Lookup(step)
+		if !ok {
+			return fmt.Errorf("composite hook %s: unknown step %s", name, step)
+		}
+		stepHooks = append(stepHooks, hook)
+
+		if i == 0 {
+			types = append(types, hook.Types...)
+		} else {
+			types = slices.DeleteFunc(types, func(t pb.HookType) bool { return !slices.Contains(hook.Types, t) })
+		}
+		for _, field := range hook.ConfigSchema {
+			if !slices.ContainsFunc(schema, func(f HookConfigField) bool { return f.Name == field.Name }) {
+				schema = append(schema, field)
+			}
+		}
+	}
+	if len(types) == 0 {
+		return fmt.Errorf("composite hook %s: steps %s share no hook type", name, strings.Join(steps, ", "))
+	}
+
+	return r.Register(HookDefinition{
+		Name:         name,
+		Types:        types,
+		ConfigSchema: schema,
+		Steps:        steps,
+		Run: func(d *DPoPHandler, ctx context.Context, object *pb.Object) (*pb.Object, error) {
+			upstream := object.Response
+			for _, step := range stepHooks {
+				var err error
+				if object, err = step.Run(d, ctx, object); err != nil {
+					return object, err
+				}
+				if answeredStatus(object, upstream) != 0 {
+					logger(ctx).Infof("Composite hook %s stopped after %s", name, step.Name)
+					break
+				}
+			}
+			return object, nil
+		},
+	})
+}
+
+// answeredStatus returns the status of the answer a hook gave itself, so later
+// hooks must not run, or 0 when the request continues. Request hooks answer
+// with return overrides; response hooks by replacing the upstream response,
+// which is the response the object held before the hook ran.
+func answeredStatus(object *pb.Object, upstream *pb.ResponseObject) int {
+	if object.Request != nil && object.Request.ReturnOverrides != nil && object.Request.ReturnOverrides.ResponseCode != 0 {
+		return int(object.Request.ReturnOverrides.ResponseCode)
+	}
+	if object.HookType == pb.HookType_Response && object.Response != nil && object.Response != upstream {
+		return int(object.Response.StatusCode)
+	}
+	return 0
+}
+
+// Lookup returns the hook registered under the name
+func (r *HookRegistry) Lookup(name string) (*HookDefinition, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hook, ok := r.hooks[name]
+	return hook, ok
+}
+
+// Hooks returns every registered hook, ordered by name
+func (r *HookRegistry) Hooks() []*HookDefinition {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	hooks := make([]*HookDefinition, 0, len(r.hooks))
+	for _, hook := range r.hooks {
+		hooks = append(hooks, hook)
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Name < hooks[j].Name
+	})
+	return hooks
+}
+
+// loadCompositeHooks reads composite hook definitions, a JSON object mapping
+// each composite name to its steps, and registers them
+func (r *HookRegistry) loadCompositeHooks(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read composite hooks: %w", err)
+	}
+
+	composites := map[string][]string{}
+	if err := json.Unmarshal(data, &composites); err != nil {
+		return fmt.Errorf("failed to parse composite hooks: %w", err)
+	}
+
+	names := make([]string, 0, len(composites))
+	for name := range composites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := r.RegisterComposite(name, composites[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jwsSigningSchema lists the config data fields of the signing hooks
+var jwsSigningSchema = []HookConfigField{
+	{Name: "jws_profile", Type: "string", Description: "JWS header profile: rfc7797, obuk or fapi"},
+	{Name: "jws_key_id", Type: "string", Description: "Key ID of the signing key, overriding the active key"},
+}
+
+// idempotencySchema lists the config data fields of the idempotency hooks
+var idempotencySchema = []HookConfigField{
+	{Name: "idempotency_ttl", Type: "duration", Description: "How long responses are replayed, e.g. 10m (default: 24h)"},
+}
+
+// dpopSchema lists the config data fields of the DPoP hook
+var dpopSchema = []HookConfigField{
+	{Name: "dpop_required", Type: "bool", Description: "Reject requests without a DPoP proof (default: true)"},
+	{Name: "dpop_proof_max_age", Type: "duration", Description: "Maximum age of a DPoP proof by its iat claim"},
+	{Name: "required_scopes", Type: "[]string", Description: "Scopes the access token must carry"},
+}
+
+// requestHookTypes are the hook types that run before the upstream is called
+var requestHookTypes = []pb.HookType{pb.HookType_Pre, pb.HookType_PostKeyAuth, pb.HookType_Post}
+
+// newBuiltinHookRegistry creates a registry holding the hooks of this plugin
+func newBuiltinHookRegistry() *HookRegistry {
+	registry := NewHookRegistry()
+	for _, hook := range []HookDefinition{
+		{Name: "DPoPCheck", Types: []pb.HookType{pb.HookType_Pre}, ConfigSchema: dpopSchema, Run: (*DPoPHandler).DPoPCheck},
+		{Name: "IdempotencyCheck", Types: []pb.HookType{pb.HookType_PostKeyAuth, pb.HookType_Post}, ConfigSchema: idempotencySchema, Run: (*DPoPHandler).IdempotencyCheck},
+		{Name: "IdempotencyResponse", Types: []pb.HookType{pb.HookType_Response}, ConfigSchema: idempotencySchema, Run: (*DPoPHandler).IdempotencyResponse},
+		{Name: "JWSSign", Types: requestHookTypes, ConfigSchema: jwsSigningSchema, Run: (*DPoPHandler).JWSSign},
+		{Name: "SETSign", Types: requestHookTypes, ConfigSchema: jwsSigningSchema, Run: (*DPoPHandler).SETSign},
+		{Name: "JWSSignResponse", Types: []pb.HookType{pb.HookType_Response}, ConfigSchema: jwsSigningSchema, Run: (*DPoPHandler).JWSSignResponse},
+		{Name: "JWSVerify", Types: requestHookTypes, Run: (*DPoPHandler).JWSVerify},
+		{Name: "JWKS", Types: requestHookTypes, Run: (*DPoPHandler).JWKS},
+	} {
+		if err := registry.Register(hook); err != nil {
+			panic(err)
+		}
+	}
+	return registry
+}
+
+// builtinHooks is the registry used by handlers without their own
+var builtinHooks = newBuiltinHookRegistry()
+
+// hookRegistry returns the handler's hook registry
+func (d *DPoPHandler) hookRegistry() *HookRegistry {
+	if d.hooks != nil {
+		return d.hooks
+	}
+	return builtinHooks
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// recordingHook returns a hook that records its name in the request headers,
+// answering the request with the given status when it is not zero
+func recordingHook(name string, types []pb.HookType, status int32) HookDefinition {
+	return HookDefinition{
+		Name:         name,
+		Types:        types,
+		ConfigSchema: []HookConfigField{{Name: name + "_setting", Type: "string"}},
+		Run: func(d *DPoPHandler, ctx context.Context, object *pb.Object) (*pb.Object, error) {
+			object.Request.SetHeaders["x-ran"] += name + ";"
+			if status != 0 {
+				object.Request.ReturnOverrides = &pb.ReturnOverrides{ResponseCode: status}
+			}
+			return object, nil
+		},
+	}
+}
+
+// newHookTestObject creates an object calling the named hook
+func newHookTestObject(name string, hookType pb.HookType) *pb.Object {
+	return &pb.Object{
+		HookName: name,
+		HookType: hookType,
+		Request:  &pb.MiniRequestObject{Headers: map[string]string{}, SetHeaders: map[string]string{}},
+	}
+}
+
+// TestDispatchHookTypes tests that hooks only run as the hook types they support
+func TestDispatchHookTypes(t *testing.T) {
+	handler := &DPoPHandler{}
+
+	// Unknown hooks pass the request through unchanged
+	result, err := handler.Dispatch(context.Background(), newHookTestObject("Missing", pb.HookType_Pre))
+	if err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides != nil {
+		t.Error("Expected an unknown hook to leave the request unchanged")
+	}
+
+	// A response hook configured as a pre hook fails closed
+	result, err = handler.Dispatch(context.Background(), newHookTestObject("IdempotencyResponse", pb.HookType_Pre))
+	if err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides == nil || result.Request.ReturnOverrides.ResponseCode != http.StatusInternalServerError {
+		t.Error("Expected a misconfigured hook to fail with status 500")
+	}
+
+	// Every built-in hook is registered
+	for _, name := range []string{"DPoPCheck", "IdempotencyCheck", "IdempotencyResponse", "JWSSign", "SETSign", "JWSSignResponse", "JWSVerify", "JWKS"} {
+		if _, ok := handler.hookRegistry().Lookup(name); !ok {
+			t.Errorf("Expected hook %s to be registered", name)
+		}
+	}
+}
+
+// TestHookRegistryRegister tests that invalid and duplicate hooks are refused
+func TestHookRegistryRegister(t *testing.T) {
+	registry := NewHookRegistry()
+	pre := []pb.HookType{pb.HookType_Pre}
+
+	if err := registry.Register(recordingHook("First", pre, 0)); err != nil {
+		t.Fatalf("Register returned an error: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		hook HookDefinition
+	}{
+		{"duplicate", recordingHook("First", pre, 0)},
+		{"no name", recordingHook("", pre, 0)},
+		{"no types", recordingHook("Second", nil, 0)},
+		{"no function", HookDefinition{Name: "Third", Types: pre}},
+	}
+	for _, tt := range tests {
+		if err := registry.Register(tt.hook); err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+		}
+	}
+}
+
+// TestCompositeHooks tests running several hooks in one call
+func TestCompositeHooks(t *testing.T) {
+	registry := NewHookRegistry()
+	for _, hook := range []HookDefinition{
+		recordingHook("Verify", []pb.HookType{pb.HookType_Pre, pb.HookType_PostKeyAuth}, 0),
+		recordingHook("Check", []pb.HookType{pb.HookType_PostKeyAuth, pb.HookType_Post}, 0),
+		recordingHook("Replay", []pb.HookType{pb.HookType_PostKeyAuth}, http.StatusCreated),
+		recordingHook("Respond", []pb.HookType{pb.HookType_Response}, 0),
+	} {
+		if err := registry.Register(hook); err != nil {
+			t.Fatalf("Register returned an error: %v", err)
+		}
+	}
+
+	if err := registry.RegisterComposite("VerifyAndCheck", []string{"Verify", "Check"}); err != nil {
+		t.Fatalf("RegisterComposite returned an error: %v", err)
+	}
+	composite, _ := registry.Lookup("VerifyAndCheck")
+	if !reflect.DeepEqual(composite.Types, []pb.HookType{pb.HookType_PostKeyAuth}) {
+		t.Errorf("Expected the shared hook type only, got %v", composite.Types)
+	}
+	if len(composite.ConfigSchema) != 2 {
+		t.Errorf("Expected the config fields of both steps, got %v", composite.ConfigSchema)
+	}
+
+	handler := &DPoPHandler{hooks: registry}
+	result, err := handler.Dispatch(context.Background(), newHookTestObject("VerifyAndCheck", pb.HookType_PostKeyAuth))
+	if err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	if ran := result.Request.SetHeaders["x-ran"]; ran != "Verify;Check;" {
+		t.Errorf("Expected both steps to run in order, got %q", ran)
+	}
+
+	// A step answering the request stops the composite
+	if err := registry.RegisterComposite("ReplayFirst", []string{"Replay", "Verify"}); err != nil {
+		t.Fatalf("RegisterComposite returned an error: %v", err)
+	}
+	result, _ = handler.Dispatch(context.Background(), newHookTestObject("ReplayFirst", pb.HookType_PostKeyAuth))
+	if ran := result.Request.SetHeaders["x-ran"]; ran != "Replay;" {
+		t.Errorf("Expected the composite to stop after Replay, got %q", ran)
+	}
+
+	// Steps must share a hook type and exist
+	if err := registry.RegisterComposite("Mixed", []string{"Verify", "Respond"}); err == nil {
+		t.Error("Expected an error for steps without a shared hook type")
+	}
+	if err := registry.RegisterComposite("Unknown", []string{"Verify", "Missing"}); err == nil {
+		t.Error("Expected an error for an unknown step")
+	}
+}
+
+// TestLoadCompositeHooks tests registering composite hooks from a file
+func TestLoadCompositeHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "composites.json")
+	if err := os.WriteFile(path, []byte(`{"VerifyAndCheckIdempotency": ["JWSVerify", "IdempotencyCheck"]}`), 0o600); err != nil {
+		t.Fatalf("Failed to write composites: %v", err)
+	}
+
+	registry := newBuiltinHookRegistry()
+	if err := registry.loadCompositeHooks(path); err != nil {
+		t.Fatalf("loadCompositeHooks returned an error: %v", err)
+	}
+	composite, ok := registry.Lookup("VerifyAndCheckIdempotency")
+	if !ok {
+		t.Fatal("Expected the composite hook to be registered")
+	}
+	if !reflect.DeepEqual(composite.Types, []pb.HookType{pb.HookType_PostKeyAuth, pb.HookType_Post}) {
+		t.Errorf("Unexpected hook types: %v", composite.Types)
+	}
+}
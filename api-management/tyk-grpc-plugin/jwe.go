@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// Supported JWE key management and content encryption algorithms
+const (
+	jweAlgECDHESA256KW = "ECDH-ES+A256KW"
+	jweAlgRSAOAEP256   = "RSA-OAEP-256"
+	jweEncA256GCM      = "A256GCM"
+)
+
+// Headers identifying the recipient of an outbound notification
+const (
+	subscriptionIDHeader = "x-subscription-id"
+	tppClientIDHeader    = "x-tpp-client-id"
+)
+
+// JWERecipient describes a TPP that receives its notifications encrypted
+type JWERecipient struct {
+	// Client ID of the TPP whose JWKS holds the encryption key
+	// (default: the client or subscription ID the entry is listed under)
+	ClientID string `json:"client_id,omitempty"`
+	// Key management algorithm (default: ECDH-ES+A256KW for EC keys, RSA-OAEP-256 for RSA keys)
+	Algorithm string `json:"alg,omitempty"`
+	// Key ID of the encryption key (default: the first key with use "enc")
+	KeyID string `json:"kid,omitempty"`
+}
+
+// JWEConfig contains configuration for encrypting outbound notifications
+type JWEConfig struct {
+	// Recipients keyed by subscription ID or TPP client ID
+	Recipients map[string]JWERecipient
+}
+
+// loadJWERecipients reads the recipients from a JSON file
+func loadJWERecipients(path string) (map[string]JWERecipient, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWE recipients: %w", err)
+	}
+
+	recipients := map[string]JWERecipient{}
+	if err := json.Unmarshal(data, &recipients); err != nil {
+		return nil, fmt.Errorf("failed to parse JWE recipients: %w", err)
+	}
+	for id, recipient := range recipients {
+		switch recipient.Algorithm {
+		case "", jweAlgECDHESA256KW, jweAlgRSAOAEP256:
+		default:
+			return nil, fmt.Errorf("recipient %s: unsupported algorithm %q", id, recipient.Algorithm)
+		}
+	}
+	return recipients, nil
+}
+
+// jweRecipient finds the encryption settings for the request, looking up the
+// subscription first and then the TPP client. It returns false when the
+// notification is not to be encrypted.
+func (d *DPoPHandler) jweRecipient(object *pb.Object) (JWERecipient, bool) {
+	candidates := []string{
+		getHeader(object.Request.Headers, subscriptionIDHeader),
+		getHeader(object.Request.Headers, tppClientIDHeader),
+		getHeader(object.Request.Headers, setAudienceHeader),
+	}
+	if object.Session != nil {
+		candidates = append(candidates, object.Session.OauthClientId)
+	}
+
+	for _, id := range candidates {
+		if id == "" {
+			continue
+		}
+		if recipient, ok := d.jweConfig.Recipients[id]; ok {
+			if recipient.ClientID == "" {
+				recipient.ClientID = id
+			}
+			return recipient, true
+		}
+	}
+	return JWERecipient{}, false
+}
+
+// encryptForRecipient encrypts a signed JWT to the recipient's encryption key,
+// producing a nested JWT
+func (d *DPoPHandler) encryptForRecipient(jwt string, recipient JWERecipient) (string, error) {
+	if d.keyResolver == nil {
+		return "", errors.New("no JWKS source configured for encryption keys")
+	}
+
+	jwk, err := d.keyResolver.ResolveKey(recipient.ClientID, recipient.KeyID, "enc")
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve encryption key for %s: %w", recipient.ClientID, err)
+	}
+
+	return encryptJWE([]byte(jwt), jwk, recipient.Algorithm, "JWT")
+}
+
+// encryptJWE encrypts the plaintext to the key as a compact JWE using A256GCM.
+// An empty algorithm is chosen from the key type.
+func encryptJWE(plaintext []byte, jwk *JWK, alg, cty string) (string, error) {
+	publicKey, err := jwk.PublicKey()
+	if err != nil {
+		return "", fmt.Errorf("invalid encryption key: %w", err)
+	}
+	if alg == "" {
+		alg = jwk.Alg
+	}
+
+	header := map[string]interface{}{
+		"enc": jweEncA256GCM,
+	}
+	if jwk.Kid != "" {
+		header["kid"] = jwk.Kid
+	}
+	if cty != "" {
+		header["cty"] = cty
+	}
+
+	// Content encryption key
+	cek := make([]byte, 32)
+	if _, err := rand.Read(cek); err != nil {
+		return "", fmt.Errorf("failed to generate content encryption key: %w", err)
+	}
+
+	var encryptedKey []byte
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		if alg == "" {
+			alg = jweAlgECDHESA256KW
+		}
+		if alg != jweAlgECDHESA256KW {
+			return "", fmt.Errorf("EC key cannot be used with %s", alg)
+		}
+		epk, kek, err := ecdhESKeyAgreement(key, alg)
+		if err != nil {
+			return "", err
+		}
+		header["epk"] = epk
+		if encryptedKey, err = aesKeyWrap(kek, cek); err != nil {
+			return "", err
+		}
+
+	case *rsa.PublicKey:
+		if alg == "" {
+			alg = jweAlgRSAOAEP256
+		}
+		if alg != jweAlgRSAOAEP256 {
+			return "", fmt.Errorf("RSA key cannot be used with %s", alg)
+		}
+		if key.N.BitLen() < minRSAKeyBits {
+			return "", fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+		if encryptedKey, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, key, cek, nil); err != nil {
+			return "", fmt.Errorf("failed to encrypt content encryption key: %w", err)
+		}
+
+	default:
+		return "", fmt.Errorf("unsupported encryption key type %T", publicKey)
+	}
+	header["alg"] = alg
+
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal header: %w", err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerBytes)
+
+	// Encrypt the content, authenticating the protected header
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to generate IV: %w", err)
+	}
+	sealed := gcm.Seal(nil, iv, plaintext, []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	encode := base64.RawURLEncoding.EncodeToString
+	return protected + "." + encode(encryptedKey) + "." + encode(iv) + "." + encode(ciphertext) + "." + encode(tag), nil
+}
+
+// ecdhESKeyAgreement generates an ephemeral key on the recipient's curve and
+// derives the key encryption key (RFC 7518 section 4.6)
+func ecdhESKeyAgreement(recipient *ecdsa.PublicKey, alg string) (JWK, []byte, error) {
+	recipientECDH, err := recipient.ECDH()
+	if err != nil {
+		return JWK{}, nil, fmt.Errorf("invalid EC encryption key: %w", err)
+	}
+
+	ephemeral, err := ecdsa.GenerateKey(recipient.Curve, rand.Reader)
+	if err != nil {
+		return JWK{}, nil, fmt.Errorf("failed to generate ephemeral key: %w", err)
+	}
+	ephemeralECDH, err := ephemeral.ECDH()
+	if err != nil {
+		return JWK{}, nil, err
+	}
+
+	sharedSecret, err := ephemeralECDH.ECDH(recipientECDH)
+	if err != nil {
+		return JWK{}, nil, fmt.Errorf("key agreement failed: %w", err)
+	}
+
+	epk, err := NewJWK(ephemeral.Public(), "", "")
+	if err != nil {
+		return JWK{}, nil, err
+	}
+	epk.Use = ""
+
+	return epk, concatKDF(sharedSecret, alg, nil, nil, 256), nil
+}
+
+// concatKDF derives a key from the ECDH shared secret with the Concat KDF of
+// NIST SP 800-56A, as profiled by RFC 7518 section 4.6.2. The party infos are
+// the decoded apu and apv headers; notifications are encrypted without them.
+func concatKDF(sharedSecret []byte, alg string, partyUInfo, partyVInfo []byte, keyBits int) []byte {
+	lengthPrefixed := func(data []byte) []byte {
+		out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+		return append(out, data...)
+	}
+
+	var otherInfo []byte
+	otherInfo = append(otherInfo, lengthPrefixed([]byte(alg))...)
+	otherInfo = append(otherInfo, lengthPrefixed(partyUInfo)...)
+	otherInfo = append(otherInfo, lengthPrefixed(partyVInfo)...)
+	otherInfo = binary.BigEndian.AppendUint32(otherInfo, uint32(keyBits))
+
+	var key []byte
+	for counter := uint32(1); len(key) < keyBits/8; counter++ {
+		hash := sha256.New()
+		hash.Write(binary.BigEndian.AppendUint32(nil, counter))
+		hash.Write(sharedSecret)
+		hash.Write(otherInfo)
+		key = hash.Sum(key)
+	}
+	return key[:keyBits/8]
+}
+
+// aesKeyWrap wraps a key with the AES Key Wrap algorithm (RFC 3394)
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key)%8 != 0 || len(key) < 16 {
+		return nil, errors.New("key to wrap must be a multiple of 64 bits")
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	a := []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+	r := make([]byte, len(key))
+	copy(r, key)
+
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(buf[:8], a)
+			copy(buf[8:], r[i*8:(i+1)*8])
+			block.Encrypt(buf, buf)
+
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(r[i*8:(i+1)*8], buf[8:])
+		}
+	}
+
+	return append(a, r...), nil
+}
+
+// signAndEncrypt signs the request body as a JWT and encrypts it to the
+// recipient, replacing the body with the nested JWT
+func (d *DPoPHandler) signAndEncrypt(ctx context.Context, object *pb.Object, key *SigningKey, profile JWSProfile, recipient JWERecipient) (*pb.Object, error) {
+	if err := checkProfileAlgorithm(profile, key.Algorithm); err != nil {
+		logger(ctx).Errorf("Invalid JWS signing configuration: %v", err)
+		return d.respondWithError(object, "JWS signing misconfigured", http.StatusInternalServerError)
+	}
+
+	header := map[string]interface{}{
+		"alg": key.Algorithm,
+		"kid": key.KeyID,
+		"typ": "JWT",
+	}
+	jwt, err := d.signCompactJWS(ctx, header, []byte(object.Request.Body), key)
+	if err != nil {
+		logger(ctx).Errorf("Failed to create JWS signature: %v", err)
+		return d.respondWithError(object, "Failed to create JWS signature", signErrorStatus(err))
+	}
+
+	return d.encryptRequestBody(ctx, object, jwt, recipient, "")
+}
+
+// encryptRequestBody encrypts a signed JWT to the recipient, replaces the
+// request body with the nested JWT and delivers it under the event ID
+func (d *DPoPHandler) encryptRequestBody(ctx context.Context, object *pb.Object, jwt string, recipient JWERecipient, eventID string) (*pb.Object, error) {
+	jwe, err := d.encryptForRecipient(jwt, recipient)
+	if err != nil {
+		logger(ctx).Errorf("Failed to encrypt notification: %v", err)
+		return d.respondWithError(object, "Failed to encrypt notification", http.StatusInternalServerError)
+	}
+
+	object.Request.Body = jwe
+	object.Request.RawBody = []byte(jwe)
+	if object.Request.SetHeaders == nil {
+		object.Request.SetHeaders = map[string]string{}
+	}
+	object.Request.SetHeaders["Content-Type"] = "application/jwt"
+	object.Request.DeleteHeaders = append(object.Request.DeleteHeaders, subscriptionIDHeader, tppClientIDHeader)
+
+	logger(ctx).Infof("Notification encrypted to %s", recipient.ClientID)
+	return d.forwardToRewriteTarget(ctx, object, eventID)
+}
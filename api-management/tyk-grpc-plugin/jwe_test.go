@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// aesKeyUnwrap reverses aesKeyWrap (RFC 3394)
+func aesKeyUnwrap(t *testing.T, kek, wrapped []byte) []byte {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		t.Fatalf("Failed to create cipher: %v", err)
+	}
+
+	n := len(wrapped)/8 - 1
+	a := append([]byte{}, wrapped[:8]...)
+	r := append([]byte{}, wrapped[8:]...)
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^uint64(n*j+i+1))
+			copy(buf[8:], r[i*8:(i+1)*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(r[i*8:(i+1)*8], buf[8:])
+		}
+	}
+
+	if !bytes.Equal(a, []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}) {
+		t.Fatal("Key unwrap integrity check failed")
+	}
+	return r
+}
+
+// decryptTestJWE decrypts a compact JWE with the recipient's private key
+func decryptTestJWE(t *testing.T, token string, privateKey interface{}) (map[string]interface{}, []byte) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		t.Fatalf("Expected a compact JWE, got %d parts", len(parts))
+	}
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("Failed to decode JWE part: %v", err)
+		}
+		return b
+	}
+
+	var header map[string]interface{}
+	if err := json.Unmarshal(decode(parts[0]), &header); err != nil {
+		t.Fatalf("Failed to decode JWE header: %v", err)
+	}
+
+	var cek []byte
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if cek, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key, decode(parts[1]), nil); err != nil {
+			t.Fatalf("Failed to decrypt CEK: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		epkBytes, _ := json.Marshal(header["epk"])
+		var epk JWK
+		json.Unmarshal(epkBytes, &epk)
+		epkPublic, err := epk.PublicKey()
+		if err != nil {
+			t.Fatalf("Invalid epk: %v", err)
+		}
+		epkECDH, _ := epkPublic.(*ecdsa.PublicKey).ECDH()
+		keyECDH, _ := key.ECDH()
+		sharedSecret, err := keyECDH.ECDH(epkECDH)
+		if err != nil {
+			t.Fatalf("Key agreement failed: %v", err)
+		}
+		cek = aesKeyUnwrap(t, concatKDF(sharedSecret, header["alg"].(string), nil, nil, 256), decode(parts[1]))
+	}
+
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, decode(parts[2]), append(decode(parts[3]), decode(parts[4])...), []byte(parts[0]))
+	if err != nil {
+		t.Fatalf("Failed to decrypt content: %v", err)
+	}
+	return header, plaintext
+}
+
+// TestAESKeyWrap tests the key wrap against the RFC 3394 section 4.6 test vector
+func TestAESKeyWrap(t *testing.T) {
+	kek, _ := hex.DecodeString("000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F")
+	key, _ := hex.DecodeString("00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F")
+	expected, _ := hex.DecodeString("28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21")
+
+	wrapped, err := aesKeyWrap(kek, key)
+	if err != nil {
+		t.Fatalf("aesKeyWrap returned an error: %v", err)
+	}
+	if !bytes.Equal(wrapped, expected) {
+		t.Errorf("Expected %X, got %X", expected, wrapped)
+	}
+}
+
+// TestConcatKDF tests the key derivation against the ECDH-ES example of RFC 7518 appendix C
+func TestConcatKDF(t *testing.T) {
+	decode := func(value string) []byte {
+		data, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			t.Fatalf("Failed to decode %s: %v", value, err)
+		}
+		return data
+	}
+
+	// Alice's ephemeral private key and Bob's public key
+	alice, err := ecdh.P256().NewPrivateKey(decode("0_NxaRPUMQoAJt50Gz8YiTr8gRTwyEaCumd-MToTmIo"))
+	if err != nil {
+		t.Fatalf("Failed to load Alice's key: %v", err)
+	}
+	bobPoint := append([]byte{4}, decode("weNJy2HscCSM6AEDTDg04biOvhFhyyWvOHQfeF_PxMQ")...)
+	bobPoint = append(bobPoint, decode("e8lnCO-AlStT-NJVX-crhB7QRYhiix03illJOVAOyck")...)
+	bob, err := ecdh.P256().NewPublicKey(bobPoint)
+	if err != nil {
+		t.Fatalf("Failed to load Bob's key: %v", err)
+	}
+
+	sharedSecret, err := alice.ECDH(bob)
+	if err != nil {
+		t.Fatalf("ECDH failed: %v", err)
+	}
+	expectedZ := []byte{158, 86, 217, 29, 129, 113, 53, 211, 114, 131, 66, 131, 191, 132, 38, 156,
+		251, 49, 110, 163, 218, 128, 106, 72, 246, 218, 167, 121, 140, 254, 144, 196}
+	if !bytes.Equal(sharedSecret, expectedZ) {
+		t.Fatalf("Expected Z %v, got %v", expectedZ, sharedSecret)
+	}
+
+	key := concatKDF(sharedSecret, "A128GCM", []byte("Alice"), []byte("Bob"), 128)
+	if encoded := base64.RawURLEncoding.EncodeToString(key); encoded != "VqqN6vgjbSBcIijNcacQGg" {
+		t.Errorf("Expected VqqN6vgjbSBcIijNcacQGg, got %s", encoded)
+	}
+}
+
+// newJWETestHandler creates a signing handler for a TPP that publishes an
+// encryption key and receives its notifications encrypted
+func newJWETestHandler(t *testing.T, encryptionKey crypto.Signer) *DPoPHandler {
+	signingKey, _ := generateTestKey(t)
+	sigJWK := testECJWK(signingKey, "tpp-sig")
+	encJWK, err := NewJWK(encryptionKey.Public(), "tpp-enc", "")
+	if err != nil {
+		t.Fatalf("Failed to build JWK: %v", err)
+	}
+	encJWK.Use = "enc"
+
+	dir := t.TempDir()
+	jwksBytes, _ := json.Marshal(JWKS{Keys: []JWK{sigJWK, encJWK}})
+	if err := os.WriteFile(filepath.Join(dir, "tpp-client.json"), jwksBytes, 0o600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+	resolver, err := newKeyResolver(JWSVerifyConfig{JWKSDirectory: dir})
+	if err != nil {
+		t.Fatalf("Failed to create key resolver: %v", err)
+	}
+
+	bankKey, _ := generateTestKey(t)
+	return &DPoPHandler{
+		privateKey:  bankKey,
+		jwsConfig:   JWSConfig{KeyID: "bank-kid", Issuer: "https://bank.example.com"},
+		keyResolver: resolver,
+		jweConfig: JWEConfig{Recipients: map[string]JWERecipient{
+			"sub-123": {ClientID: "tpp-client"},
+		}},
+	}
+}
+
+// TestJWSSignEncrypted tests the nested JWT mode for EC and RSA encryption keys
+func TestJWSSignEncrypted(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		privateKey  crypto.Signer
+		expectedAlg string
+	}{
+		{"EC", ecKey, jweAlgECDHESA256KW},
+		{"RSA", rsaKey, jweAlgRSAOAEP256},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newJWETestHandler(t, tt.privateKey)
+			body := `{"iss":"https://bank.example.com","events":{}}`
+			object := &pb.Object{
+				HookName: "JWSSign",
+				Request: &pb.MiniRequestObject{
+					Headers: map[string]string{"X-Subscription-Id": "sub-123"},
+					Body:    body,
+					Method:  "POST",
+				},
+			}
+
+			result, err := handler.JWSSign(context.Background(), object)
+			if err != nil {
+				t.Fatalf("JWSSign returned an error: %v", err)
+			}
+			if result.Request.ReturnOverrides != nil && result.Request.ReturnOverrides.ResponseCode != 0 {
+				t.Fatalf("Expected the request to continue, got %d: %s",
+					result.Request.ReturnOverrides.ResponseCode, result.Request.ReturnOverrides.ResponseError)
+			}
+			if result.Request.SetHeaders["Content-Type"] != "application/jwt" {
+				t.Errorf("Expected Content-Type application/jwt, got %s", result.Request.SetHeaders["Content-Type"])
+			}
+
+			// The TPP decrypts the body with its encryption key
+			header, plaintext := decryptTestJWE(t, result.Request.Body, tt.privateKey)
+			if header["alg"] != tt.expectedAlg || header["enc"] != jweEncA256GCM || header["cty"] != "JWT" || header["kid"] != "tpp-enc" {
+				t.Errorf("Unexpected JWE header: %v", header)
+			}
+
+			// and finds the bank-signed JWT inside
+			parts := strings.Split(string(plaintext), ".")
+			if len(parts) != 3 {
+				t.Fatalf("Expected a signed JWT inside the JWE, got %q", plaintext)
+			}
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			if err := verifyJWSSignature("ES256", handler.privateKey.Public(), []byte(parts[0]+"."+parts[1]), signature); err != nil {
+				t.Errorf("Inner JWT signature did not verify: %v", err)
+			}
+			payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+			if string(payload) != body {
+				t.Errorf("Expected the inner payload %s, got %s", body, payload)
+			}
+		})
+	}
+}
+
+// TestSETSignEncrypted tests that SETs are encrypted to TPPs configured by client ID
+func TestSETSignEncrypted(t *testing.T) {
+	encryptionKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	handler := newJWETestHandler(t, encryptionKey)
+	handler.jweConfig.Recipients = map[string]JWERecipient{"tpp-client": {}}
+	handler.setConfig.ResourceLinkBase = "https://bank.example.com/pisp"
+
+	object := &pb.Object{
+		HookName: "SETSign",
+		Request: &pb.MiniRequestObject{
+			Headers: map[string]string{"X-Set-Audience": "tpp-client"},
+			Body:    testBankEvent,
+			Method:  "POST",
+		},
+	}
+
+	result, err := handler.SETSign(context.Background(), object)
+	if err != nil {
+		t.Fatalf("SETSign returned an error: %v", err)
+	}
+
+	_, plaintext := decryptTestJWE(t, result.Request.Body, encryptionKey)
+	_, claims := decodeSETClaims(t, handler, string(plaintext))
+	if claims["aud"] != "tpp-client" {
+		t.Errorf("Expected aud tpp-client, got %v", claims["aud"])
+	}
+}
+
+// TestJWSSignEncryptionFailures tests that notifications are not sent in the clear when encryption fails
+func TestJWSSignEncryptionFailures(t *testing.T) {
+	encryptionKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	tests := []struct {
+		name      string
+		recipient JWERecipient
+	}{
+		{"unknown TPP", JWERecipient{ClientID: "other-client"}},
+		{"unknown key", JWERecipient{ClientID: "tpp-client", KeyID: "missing"}},
+		{"algorithm not matching the key", JWERecipient{ClientID: "tpp-client", Algorithm: jweAlgRSAOAEP256}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := newJWETestHandler(t, encryptionKey)
+			handler.jweConfig.Recipients = map[string]JWERecipient{"sub-123": tt.recipient}
+
+			object := &pb.Object{
+				HookName: "JWSSign",
+				Request: &pb.MiniRequestObject{
+					Headers: map[string]string{"X-Subscription-Id": "sub-123"},
+					Body:    `{"events":{}}`,
+					Method:  "POST",
+				},
+			}
+			result, err := handler.JWSSign(context.Background(), object)
+			if err != nil {
+				t.Fatalf("JWSSign returned an error: %v", err)
+			}
+			if result.Request.ReturnOverrides == nil || result.Request.ReturnOverrides.ResponseCode != http.StatusInternalServerError {
+				t.Errorf("Expected the request to fail with %d", http.StatusInternalServerError)
+			}
+		})
+	}
+}
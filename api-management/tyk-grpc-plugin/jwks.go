@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// jwksPath is where the public signing keys are published
+const jwksPath = "/.well-known/jwks.json"
+
+// JWKSConfig contains configuration for publishing the public signing keys
+type JWKSConfig struct {
+	// Address the JWKS HTTP listener binds to (the listener is disabled when empty)
+	ListenAddr string
+	// How long clients may cache the key set (default: 5 minutes)
+	CacheMaxAge time.Duration
+	// How long keys stay published after their validity period ends (default: 24 hours)
+	RetiredKeyGracePeriod time.Duration
+}
+
+// Default JWKS configuration values
+var defaultJWKSConfig = JWKSConfig{
+	CacheMaxAge:           5 * time.Minute,
+	RetiredKeyGracePeriod: 24 * time.Hour,
+}
+
+// publicJWKS builds the key set of the public signing keys. Besides the active
+// key it contains keys that become valid in the future, so TPPs can fetch them
+// ahead of a rotation, and keys that retired less than the grace period ago, so
+// signatures made just before a rotation can still be verified.
+func (d *DPoPHandler) publicJWKS(now time.Time) (*JWKS, error) {
+	var keys []*SigningKey
+	if d.keyRing != nil {
+		keys = d.keyRing.Keys()
+	} else if d.privateKey != nil {
+		key, err := d.defaultSigningKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = []*SigningKey{key}
+	}
+
+	jwks := &JWKS{Keys: []JWK{}}
+	for _, key := range keys {
+		if !key.NotAfter.IsZero() && now.After(key.NotAfter.Add(d.jwksConfig.RetiredKeyGracePeriod)) {
+			continue
+		}
+
+		jwk, err := NewJWK(key.PrivateKey.Public(), key.KeyID, key.Algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("failed to build JWK for key %s: %w", key.KeyID, err)
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	return jwks, nil
+}
+
+// jwksResponse renders the key set with its caching headers
+func (d *DPoPHandler) jwksResponse() ([]byte, map[string]string, error) {
+	jwks, err := d.publicJWKS(time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := json.Marshal(jwks)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal JWKS: %w", err)
+	}
+
+	hash := sha256.Sum256(body)
+	headers := map[string]string{
+		"Content-Type":  "application/jwk-set+json",
+		"Cache-Control": fmt.Sprintf("public, max-age=%d", int(d.jwksConfig.CacheMaxAge.Seconds())),
+		"ETag":          fmt.Sprintf(`"%x"`, hash[:16]),
+	}
+	return body, headers, nil
+}
+
+// JWKS implements the hook answering a Tyk virtual endpoint with the public signing keys
+func (d *DPoPHandler) JWKS(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running JWKS hook")
+
+	body, headers, err := d.jwksResponse()
+	if err != nil {
+		logger(ctx).Errorf("Failed to build JWKS: %v", err)
+		return d.respondWithError(object, "Failed to build JWKS", http.StatusInternalServerError)
+	}
+
+	if object.Request.ReturnOverrides == nil {
+		object.Request.ReturnOverrides = &pb.ReturnOverrides{}
+	}
+	object.Request.ReturnOverrides.Headers = headers
+
+	if ifNoneMatch := getHeader(object.Request.Headers, "If-None-Match"); ifNoneMatch != "" && ifNoneMatch == headers["ETag"] {
+		object.Request.ReturnOverrides.ResponseCode = http.StatusNotModified
+		return object, nil
+	}
+
+	object.Request.ReturnOverrides.ResponseCode = http.StatusOK
+	object.Request.ReturnOverrides.ResponseBody = string(body)
+	return object, nil
+}
+
+// JWKSHandler returns the HTTP handler publishing the public signing keys
+func (d *DPoPHandler) JWKSHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+jwksPath, func(w http.ResponseWriter, r *http.Request) {
+		body, headers, err := d.jwksResponse()
+		if err != nil {
+			log.Errorf("Failed to build JWKS: %v", err)
+			http.Error(w, "Failed to build JWKS", http.StatusInternalServerError)
+			return
+		}
+
+		for k, v := range headers {
+			w.Header().Set(k, v)
+		}
+
+		if r.Header.Get("If-None-Match") == headers["ETag"] {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		w.Write(body)
+	})
+	return mux
+}
+
+// serveJWKS publishes the public signing keys until the context is cancelled
+func (d *DPoPHandler) serveJWKS(ctx context.Context) error {
+	log.Infof("Publishing JWKS on %s%s", d.jwksConfig.ListenAddr, jwksPath)
+	server := &http.Server{
+		Addr:              d.jwksConfig.ListenAddr,
+		Handler:           d.JWKSHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return serveHTTP(ctx, server)
+}
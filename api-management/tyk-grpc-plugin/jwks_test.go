@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// TestPublicJWKSRotation tests which keys of the ring are published
+func TestPublicJWKSRotation(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	writeTestKey(t, dir, "retired-long-ago", &KeyConfig{NotBefore: now.Add(-96 * time.Hour), NotAfter: now.Add(-72 * time.Hour)})
+	writeTestKey(t, dir, "retiring", &KeyConfig{NotBefore: now.Add(-48 * time.Hour), NotAfter: now.Add(-time.Hour)})
+	writeTestKey(t, dir, "active", &KeyConfig{NotBefore: now.Add(-time.Hour)})
+	writeTestKey(t, dir, "next", &KeyConfig{NotBefore: now.Add(24 * time.Hour)})
+
+	ring, err := NewKeyRing(KeyRingConfig{Directory: dir})
+	if err != nil {
+		t.Fatalf("NewKeyRing returned an error: %v", err)
+	}
+	handler := &DPoPHandler{keyRing: ring, jwksConfig: defaultJWKSConfig}
+
+	jwks, err := handler.publicJWKS(now)
+	if err != nil {
+		t.Fatalf("publicJWKS returned an error: %v", err)
+	}
+
+	published := map[string]bool{}
+	for _, key := range jwks.Keys {
+		published[key.Kid] = true
+
+		// Only public key material is published
+		if key.Kty != "EC" || key.X == "" || key.Y == "" || key.Use != "sig" {
+			t.Errorf("Unexpected JWK: %+v", key)
+		}
+	}
+
+	for _, kid := range []string{"retiring", "active", "next"} {
+		if !published[kid] {
+			t.Errorf("Expected key %s to be published", kid)
+		}
+	}
+	if published["retired-long-ago"] {
+		t.Error("Expected key retired-long-ago not to be published")
+	}
+}
+
+// TestJWKSHandler tests the HTTP listener and its caching headers
+func TestJWKSHandler(t *testing.T) {
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{
+		privateKey: privateKey,
+		jwsConfig:  JWSConfig{KeyID: "test-key-id"},
+		jwksConfig: defaultJWKSConfig,
+	}
+
+	server := httptest.NewServer(handler.JWKSHandler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + jwksPath)
+	if err != nil {
+		t.Fatalf("Failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+	}
+	if resp.Header.Get("Cache-Control") != "public, max-age=300" {
+		t.Errorf("Unexpected Cache-Control header: %s", resp.Header.Get("Cache-Control"))
+	}
+
+	var jwks JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		t.Fatalf("Failed to decode JWKS: %v", err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "test-key-id" {
+		t.Fatalf("Unexpected JWKS: %+v", jwks)
+	}
+
+	// The published key verifies our signatures
+	signature, err := handler.createDetachedJWS([]byte(`{"test":"payload"}`))
+	if err != nil {
+		t.Fatalf("createDetachedJWS returned an error: %v", err)
+	}
+	verifier := newVerifyTestHandler(t, "aspsp", jwks.Keys[0])
+	if err := verifier.verifyDetachedJWS(signature, []byte(`{"test":"payload"}`), "aspsp"); err != nil {
+		t.Errorf("Expected the signature to verify with the published key, got: %v", err)
+	}
+
+	// Conditional requests are answered with 304
+	req, _ := http.NewRequest(http.MethodGet, server.URL+jwksPath, nil)
+	req.Header.Set("If-None-Match", resp.Header.Get("ETag"))
+	conditional, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to fetch JWKS: %v", err)
+	}
+	conditional.Body.Close()
+	if conditional.StatusCode != http.StatusNotModified {
+		t.Errorf("Expected status %d, got %d", http.StatusNotModified, conditional.StatusCode)
+	}
+}
+
+// TestJWKSHook tests answering a Tyk virtual endpoint with the key set
+func TestJWKSHook(t *testing.T) {
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{
+		privateKey: privateKey,
+		jwsConfig:  JWSConfig{KeyID: "test-key-id"},
+		jwksConfig: defaultJWKSConfig,
+	}
+
+	object := &pb.Object{
+		HookName: "JWKS",
+		Request: &pb.MiniRequestObject{
+			Method: "GET",
+			Url:    jwksPath,
+		},
+	}
+
+	result, err := handler.JWKS(context.Background(), object)
+	if err != nil {
+		t.Fatalf("JWKS returned an error: %v", err)
+	}
+
+	overrides := result.Request.ReturnOverrides
+	if overrides == nil || overrides.ResponseCode != http.StatusOK {
+		t.Fatalf("Expected a %d response override, got %+v", http.StatusOK, overrides)
+	}
+	if overrides.Headers["Content-Type"] != "application/jwk-set+json" {
+		t.Errorf("Unexpected Content-Type: %s", overrides.Headers["Content-Type"])
+	}
+
+	var jwks JWKS
+	if err := json.Unmarshal([]byte(overrides.ResponseBody), &jwks); err != nil {
+		t.Fatalf("Failed to decode JWKS: %v", err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != "test-key-id" {
+		t.Errorf("Unexpected JWKS: %+v", jwks)
+	}
+}
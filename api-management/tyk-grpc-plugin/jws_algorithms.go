@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// minRSAKeyBits is the smallest RSA modulus accepted for signing
+const minRSAKeyBits = 2048
+
+// jwsHashes maps the supported JWS algorithms to their hash functions
+var jwsHashes = map[string]crypto.Hash{
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// profileAlgorithms lists the algorithms each profile may sign with.
+// Profiles without an entry accept every supported algorithm.
+var profileAlgorithms = map[JWSProfile][]string{
+	JWSProfileOBUK: {"PS256", "ES256"},
+	JWSProfileFAPI: {"PS256", "ES256", "EdDSA"},
+}
+
+// parsePrivateKeyPEM parses a PEM encoded SEC1, PKCS#1 or PKCS#8 private key
+func parsePrivateKeyPEM(keyData []byte) (crypto.Signer, error) {
+	// Parse PEM encoded private key
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, errors.New("failed to parse PEM block containing private key")
+	}
+
+	// Parse the key according to its encoding
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type: %s", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if _, err := jwsAlgorithmForKey(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// jwsAlgorithmForKey picks the JWS algorithm from the key type and curve
+func jwsAlgorithmForKey(publicKey crypto.PublicKey) (string, error) {
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve.Params().Name {
+		case "P-256":
+			return "ES256", nil
+		case "P-384":
+			return "ES384", nil
+		case "P-521":
+			return "ES512", nil
+		default:
+			return "", fmt.Errorf("unsupported EC curve: %s", key.Curve.Params().Name)
+		}
+	case *rsa.PublicKey:
+		if key.N.BitLen() < minRSAKeyBits {
+			return "", fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+		return "PS256", nil
+	case ed25519.PublicKey:
+		return "EdDSA", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", publicKey)
+	}
+}
+
+// checkKeyAlgorithm checks that the key can sign with the algorithm
+func checkKeyAlgorithm(publicKey crypto.PublicKey, alg string) error {
+	if _, ok := jwsHashes[alg]; !ok {
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	switch key := publicKey.(type) {
+	case *ecdsa.PublicKey:
+		// ECDSA algorithms are bound to a single curve
+		expected, err := jwsAlgorithmForKey(key)
+		if err != nil {
+			return err
+		}
+		if alg != expected {
+			return fmt.Errorf("%s key cannot sign %s", key.Curve.Params().Name, alg)
+		}
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "PS") && !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("RSA key cannot sign %s", alg)
+		}
+		if key.N.BitLen() < minRSAKeyBits {
+			return fmt.Errorf("RSA keys must be at least %d bits", minRSAKeyBits)
+		}
+	case ed25519.PublicKey:
+		if alg != "EdDSA" {
+			return fmt.Errorf("Ed25519 key cannot sign %s", alg)
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", publicKey)
+	}
+	return nil
+}
+
+// checkProfileAlgorithm refuses algorithms that are unsafe under the profile
+func checkProfileAlgorithm(profile JWSProfile, alg string) error {
+	allowed, restricted := profileAlgorithms[profile]
+	if !restricted {
+		return nil
+	}
+	for _, a := range allowed {
+		if a == alg {
+			return nil
+		}
+	}
+	return fmt.Errorf("algorithm %s is not allowed by the %s profile (allowed: %s)", alg, profile, strings.Join(allowed, ", "))
+}
+
+// signJWS signs the JWS signing input and returns the raw JWS signature.
+// Signers that support it stop signing when ctx is done.
+func signJWS(ctx context.Context, signer crypto.Signer, alg string, signingInput []byte) ([]byte, error) {
+	hash, ok := jwsHashes[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	// EdDSA signs the message itself, every other algorithm signs its digest
+	if alg == "EdDSA" {
+		return signWithContext(ctx, signer, signingInput, crypto.Hash(0))
+	}
+
+	hasher := hash.New()
+	hasher.Write(signingInput)
+	digest := hasher.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "ES"):
+		der, err := signWithContext(ctx, signer, digest, hash)
+		if err != nil {
+			return nil, err
+		}
+		publicKey, ok := signer.Public().(*ecdsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s requires an EC key", alg)
+		}
+		return ecdsaSignatureToJWS(der, publicKey)
+	case strings.HasPrefix(alg, "PS"):
+		return signWithContext(ctx, signer, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: hash})
+	default:
+		return signWithContext(ctx, signer, digest, hash)
+	}
+}
+
+// signWithContext signs the digest, passing ctx to signers that can be cancelled
+func signWithContext(ctx context.Context, signer crypto.Signer, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if cancellable, ok := signer.(contextSigner); ok {
+		return cancellable.SignContext(ctx, digest, opts)
+	}
+	return signer.Sign(rand.Reader, digest, opts)
+}
+
+// ecdsaSignatureToJWS converts an ASN.1 ECDSA signature to the fixed-size
+// r || s form used by JWS
+func ecdsaSignatureToJWS(der []byte, publicKey *ecdsa.PublicKey) ([]byte, error) {
+	var sig struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &sig); err != nil {
+		return nil, fmt.Errorf("failed to parse ECDSA signature: %w", err)
+	}
+
+	keyBytes := (publicKey.Curve.Params().BitSize + 7) / 8
+	signature := make([]byte, keyBytes*2)
+	sig.R.FillBytes(signature[:keyBytes])
+	sig.S.FillBytes(signature[keyBytes:])
+	return signature, nil
+}
+
+// verifyJWSSignature verifies a JWS signature over the signing input
+func verifyJWSSignature(alg string, key crypto.PublicKey, signingInput, signature []byte) error {
+	// The key must suit the algorithm as it would for signing: ECDSA keys on
+	// the curve of the algorithm and RSA keys of the minimum size
+	if err := checkKeyAlgorithm(key, alg); err != nil {
+		return err
+	}
+	hash := jwsHashes[alg]
+
+	var digest []byte
+	if hash != 0 {
+		hasher := hash.New()
+		hasher.Write(signingInput)
+		digest = hasher.Sum(nil)
+	}
+
+	switch publicKey := key.(type) {
+	case *ecdsa.PublicKey:
+		keyBytes := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*keyBytes {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:keyBytes])
+		s := new(big.Int).SetBytes(signature[keyBytes:])
+		if !ecdsa.Verify(publicKey, digest, r, s) {
+			return errors.New("signature does not match")
+		}
+
+	case *rsa.PublicKey:
+		var err error
+		if strings.HasPrefix(alg, "PS") {
+			err = rsa.VerifyPSS(publicKey, hash, digest, signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			err = rsa.VerifyPKCS1v15(publicKey, hash, digest, signature)
+		}
+		if err != nil {
+			return errors.New("signature does not match")
+		}
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(publicKey, signingInput, signature) {
+			return errors.New("signature does not match")
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+// pkcs8PEM encodes a private key as a PKCS#8 PEM block
+func pkcs8PEM(t *testing.T, key crypto.Signer) []byte {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal private key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes})
+}
+
+// TestSignDetachedJWSAlgorithms tests signing with PKCS#8 keys of every supported type
+func TestSignDetachedJWSAlgorithms(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	p521, _ := ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name        string
+		key         crypto.Signer
+		expectedAlg string
+	}{
+		{"EC P-256", p256, "ES256"},
+		{"EC P-384", p384, "ES384"},
+		{"EC P-521", p521, "ES512"},
+		{"RSA", rsaKey, "PS256"},
+		{"Ed25519", edKey, "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Load the key the same way the plugin does
+			signer, err := parsePrivateKeyPEM(pkcs8PEM(t, tt.key))
+			if err != nil {
+				t.Fatalf("parsePrivateKeyPEM returned an error: %v", err)
+			}
+
+			handler := &DPoPHandler{privateKey: signer, jwsConfig: JWSConfig{KeyID: "test-kid"}}
+			payload := []byte(`{"test":"payload"}`)
+			jws, err := handler.createDetachedJWS(payload)
+			if err != nil {
+				t.Fatalf("createDetachedJWS returned an error: %v", err)
+			}
+
+			header := decodeJWSHeader(t, jws)
+			if header["alg"] != tt.expectedAlg {
+				t.Errorf("Expected alg %s, got %v", tt.expectedAlg, header["alg"])
+			}
+
+			// The signature verifies with the public key
+			parts := strings.Split(jws, ".")
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			if err != nil {
+				t.Fatalf("Failed to decode signature: %v", err)
+			}
+			signingInput := append([]byte(parts[0]+"."), payload...)
+			if err := verifyJWSSignature(tt.expectedAlg, signer.Public(), signingInput, signature); err != nil {
+				t.Errorf("Signature did not verify: %v", err)
+			}
+		})
+	}
+}
+
+// TestJWSAlgorithmRules tests the refusal of unsafe key, algorithm and profile combinations
+func TestJWSAlgorithmRules(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	// RS256 is a valid RSA algorithm but is refused by the Open Banking profile
+	handler := &DPoPHandler{
+		privateKey: rsaKey,
+		jwsConfig:  JWSConfig{KeyID: "test-kid", Algorithm: "RS256", Issuer: "tpp", TrustAnchor: defaultTrustAnchor},
+	}
+	if _, err := handler.createDetachedJWSWithProfile([]byte("{}"), JWSProfileOBUK); err == nil {
+		t.Error("Expected RS256 to be refused under the obuk profile")
+	}
+	if _, err := handler.createDetachedJWSWithProfile([]byte("{}"), JWSProfileRFC7797); err != nil {
+		t.Errorf("Expected RS256 to be allowed under the rfc7797 profile, got: %v", err)
+	}
+
+	// An algorithm that does not match the key is refused
+	handler = &DPoPHandler{privateKey: p256, jwsConfig: JWSConfig{Algorithm: "ES384"}}
+	if _, err := handler.defaultSigningKey(); err == nil {
+		t.Error("Expected ES384 to be refused for a P-256 key")
+	}
+
+	// RSA keys shorter than 2048 bits are refused
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	if _, err := parsePrivateKeyPEM(pkcs8PEM(t, weakKey)); err == nil {
+		t.Error("Expected a 1024-bit RSA key to be refused")
+	}
+}
+
+// TestVerifyJWSSignatureKeyRules tests that signatures are refused when the key
+// does not suit the algorithm, even when the signature itself is valid
+func TestVerifyJWSSignatureKeyRules(t *testing.T) {
+	signingInput := []byte("header.payload")
+	digest := crypto.SHA256.New()
+	digest.Write(signingInput)
+
+	// An ES256 signature made with a P-384 key
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, err := p384.Sign(rand.Reader, digest.Sum(nil), crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	ecSignature, err := ecdsaSignatureToJWS(der, &p384.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to convert signature: %v", err)
+	}
+	if err := verifyJWSSignature("ES256", p384.Public(), signingInput, ecSignature); err == nil {
+		t.Error("Expected ES256 to be refused for a P-384 key")
+	}
+
+	// A PS256 signature made with a 1024-bit RSA key
+	weakKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	rsaSignature, err := signJWS(context.Background(), weakKey, "PS256", signingInput)
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	if err := verifyJWSSignature("PS256", weakKey.Public(), signingInput, rsaSignature); err == nil {
+		t.Error("Expected a 1024-bit RSA key to be refused")
+	}
+}
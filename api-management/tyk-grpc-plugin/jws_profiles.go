@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// JWSProfile identifies the set of protected header claims emitted when signing
+type JWSProfile string
+
+const (
+	// JWSProfileRFC7797 emits a plain RFC 7797 unencoded-payload header
+	JWSProfileRFC7797 JWSProfile = "rfc7797"
+	// JWSProfileOBUK emits the UK Open Banking v3.1.x message signing header
+	JWSProfileOBUK JWSProfile = "obuk"
+	// JWSProfileFAPI emits the FAPI message signing header
+	JWSProfileFAPI JWSProfile = "fapi"
+)
+
+// defaultTrustAnchor is the trust anchor of the Open Banking directory
+const defaultTrustAnchor = "openbanking.org.uk"
+
+// parseJWSProfile validates a profile name, defaulting to RFC 7797
+func parseJWSProfile(name string) (JWSProfile, error) {
+	switch profile := JWSProfile(name); profile {
+	case "":
+		return JWSProfileRFC7797, nil
+	case JWSProfileRFC7797, JWSProfileOBUK, JWSProfileFAPI:
+		return profile, nil
+	default:
+		return "", fmt.Errorf("unknown JWS profile: %s", name)
+	}
+}
+
+// buildJWSHeader builds the protected header of a detached JWS for the given profile
+func (d *DPoPHandler) buildJWSHeader(profile JWSProfile, alg, keyID string, now time.Time) (map[string]interface{}, error) {
+	// Every profile signs the payload unencoded and detached
+	header := map[string]interface{}{
+		"alg": alg,
+		"typ": "JOSE",
+		"kid": keyID,
+		"b64": false,
+	}
+
+	switch profile {
+	case JWSProfileRFC7797, "":
+		header["crit"] = []string{"b64"}
+
+	case JWSProfileOBUK:
+		if d.jwsConfig.Issuer == "" {
+			return nil, errors.New("the OB UK profile requires an issuer")
+		}
+		trustAnchor := d.jwsConfig.TrustAnchor
+		if trustAnchor == "" {
+			trustAnchor = defaultTrustAnchor
+		}
+		header["cty"] = "application/json"
+		header[obHeaderIat] = now.Unix()
+		header[obHeaderIss] = d.jwsConfig.Issuer
+		header[obHeaderTan] = trustAnchor
+		header["crit"] = []string{"b64", obHeaderIat, obHeaderIss, obHeaderTan}
+
+	case JWSProfileFAPI:
+		header["cty"] = "application/json"
+		header["iat"] = now.Unix()
+		header["crit"] = []string{"b64"}
+
+	default:
+		return nil, fmt.Errorf("unknown JWS profile: %s", profile)
+	}
+
+	return header, nil
+}
+
+// apiJWSProfile returns the JWS profile configured for the API in its config data,
+// falling back to the plugin-wide profile
+func (d *DPoPHandler) apiJWSProfile(ctx context.Context, object *pb.Object) (JWSProfile, error) {
+	config, err := d.apiConfig(ctx, object)
+	if err != nil {
+		return "", err
+	}
+	return config.JWSProfile, nil
+}
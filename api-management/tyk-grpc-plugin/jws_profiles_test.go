@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// decodeJWSHeader decodes the protected header of a detached JWS
+func decodeJWSHeader(t *testing.T, signature string) map[string]interface{} {
+	headerBytes, err := base64.RawURLEncoding.DecodeString(strings.Split(signature, ".")[0])
+	if err != nil {
+		t.Fatalf("Failed to decode header: %v", err)
+	}
+
+	var header map[string]interface{}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		t.Fatalf("Failed to parse header: %v", err)
+	}
+	return header
+}
+
+// TestJWSProfileHeaders tests the protected header claims of each profile
+func TestJWSProfileHeaders(t *testing.T) {
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{
+		privateKey: privateKey,
+		jwsConfig: JWSConfig{
+			KeyID:  "test-key-id",
+			Issuer: "0015800001041REAAY/test-software-id",
+		},
+	}
+
+	tests := []struct {
+		profile  JWSProfile
+		crit     []string
+		present  []string
+		absent   []string
+		expected map[string]interface{}
+	}{
+		{
+			profile: JWSProfileRFC7797,
+			crit:    []string{"b64"},
+			absent:  []string{"cty", "iat", obHeaderIat},
+		},
+		{
+			profile: JWSProfileOBUK,
+			crit:    []string{"b64", obHeaderIat, obHeaderIss, obHeaderTan},
+			present: []string{obHeaderIat},
+			expected: map[string]interface{}{
+				"cty":       "application/json",
+				obHeaderIss: "0015800001041REAAY/test-software-id",
+				obHeaderTan: "openbanking.org.uk",
+			},
+		},
+		{
+			profile:  JWSProfileFAPI,
+			crit:     []string{"b64"},
+			present:  []string{"iat"},
+			absent:   []string{obHeaderIss},
+			expected: map[string]interface{}{"cty": "application/json"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.profile), func(t *testing.T) {
+			signature, err := handler.createDetachedJWSWithProfile([]byte(`{"test":"payload"}`), tt.profile)
+			if err != nil {
+				t.Fatalf("createDetachedJWSWithProfile returned an error: %v", err)
+			}
+			header := decodeJWSHeader(t, signature)
+
+			if header["alg"] != "ES256" || header["kid"] != "test-key-id" || header["b64"] != false {
+				t.Errorf("Unexpected base header: %v", header)
+			}
+
+			crit, _ := header["crit"].([]interface{})
+			if len(crit) != len(tt.crit) {
+				t.Fatalf("Expected crit %v, got %v", tt.crit, crit)
+			}
+			for i, name := range tt.crit {
+				if crit[i] != name {
+					t.Errorf("Expected crit %v, got %v", tt.crit, crit)
+				}
+			}
+
+			for _, name := range tt.present {
+				if _, ok := header[name]; !ok {
+					t.Errorf("Expected %s header to be present", name)
+				}
+			}
+			for _, name := range tt.absent {
+				if _, ok := header[name]; ok {
+					t.Errorf("Expected %s header to be absent", name)
+				}
+			}
+			for name, value := range tt.expected {
+				if header[name] != value {
+					t.Errorf("Expected %s to be %v, got %v", name, value, header[name])
+				}
+			}
+		})
+	}
+}
+
+// TestJWSProfileOBUKRequiresIssuer tests that the OB UK profile cannot be used without an issuer
+func TestJWSProfileOBUKRequiresIssuer(t *testing.T) {
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{privateKey: privateKey, jwsConfig: JWSConfig{KeyID: "test-key-id"}}
+
+	if _, err := handler.createDetachedJWSWithProfile([]byte(`{}`), JWSProfileOBUK); err == nil {
+		t.Error("Expected an error when signing with the OB UK profile without an issuer")
+	}
+}
+
+// TestJWSSignPerAPIProfile tests that the API config data selects the profile
+func TestJWSSignPerAPIProfile(t *testing.T) {
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{
+		privateKey: privateKey,
+		jwsConfig: JWSConfig{
+			KeyID:   "test-key-id",
+			Issuer:  "test-issuer",
+			Profile: JWSProfileRFC7797,
+		},
+	}
+
+	object := &pb.Object{
+		HookName: "JWSSign",
+		Request: &pb.MiniRequestObject{
+			Headers: map[string]string{"Content-Type": "application/json"},
+			Body:    `{"test":"payload"}`,
+			Method:  "POST",
+		},
+		Spec: map[string]string{"config_data": `{"jws_profile":"obuk"}`},
+	}
+
+	result, err := handler.JWSSign(context.Background(), object)
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+
+	header := decodeJWSHeader(t, result.Request.SetHeaders["x-jws-signature"])
+	if header[obHeaderIss] != "test-issuer" {
+		t.Errorf("Expected the OB UK profile to be used, got header %v", header)
+	}
+
+	// Signatures produced with the OB UK profile pass our own verification
+	verifier := newVerifyTestHandler(t, "test-issuer", testECJWK(privateKey, "test-key-id"))
+	if err := verifier.verifyDetachedJWS(result.Request.SetHeaders["x-jws-signature"], []byte(object.Request.Body), ""); err != nil {
+		t.Errorf("Expected the signature to verify, got: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// JWSResponseConfig controls which upstream responses JWSSignResponse signs
+type JWSResponseConfig struct {
+	// Media types that are never signed, e.g. text/html
+	ExcludedContentTypes []string
+	// Status codes that are never signed, either exact ("204") or a class ("5xx")
+	ExcludedStatusCodes []string
+}
+
+// Default response signing configuration values
+var defaultJWSResponseConfig = JWSResponseConfig{
+	ExcludedStatusCodes: []string{"204", "304"},
+}
+
+// validateStatusPatterns checks that every status pattern is a code or a class
+func validateStatusPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if len(pattern) == 3 && strings.HasSuffix(strings.ToLower(pattern), "xx") && pattern[0] >= '1' && pattern[0] <= '5' {
+			continue
+		}
+		if code, err := strconv.Atoi(pattern); err != nil || code < 100 || code > 599 {
+			return fmt.Errorf("invalid status code pattern: %q", pattern)
+		}
+	}
+	return nil
+}
+
+// matchesStatusPattern reports whether the status code matches any of the patterns
+func matchesStatusPattern(statusCode int32, patterns []string) bool {
+	code := strconv.Itoa(int(statusCode))
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == code || (strings.HasSuffix(pattern, "xx") && pattern[0] == code[0]) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldSignResponse reports whether the upstream response should be signed
+func (d *DPoPHandler) shouldSignResponse(response *pb.ResponseObject) (bool, string) {
+	if matchesStatusPattern(response.StatusCode, d.jwsResponseConfig.ExcludedStatusCodes) {
+		return false, fmt.Sprintf("status code %d is excluded", response.StatusCode)
+	}
+
+	contentType := getHeader(response.Headers, "Content-Type")
+	if contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			mediaType = contentType
+		}
+		for _, excluded := range d.jwsResponseConfig.ExcludedContentTypes {
+			if strings.EqualFold(mediaType, strings.TrimSpace(excluded)) {
+				return false, fmt.Sprintf("content type %s is excluded", mediaType)
+			}
+		}
+	}
+
+	if len(response.RawBody) == 0 && response.Body == "" {
+		return false, "response has no body"
+	}
+
+	return true, ""
+}
+
+// JWSSignResponse implements the response hook signing upstream response bodies
+func (d *DPoPHandler) JWSSignResponse(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running JWSSignResponse hook")
+
+	if object.Response == nil {
+		logger(ctx).Warn("No upstream response to sign")
+		return object, nil
+	}
+
+	if sign, reason := d.shouldSignResponse(object.Response); !sign {
+		logger(ctx).Infof("Not signing response: %s", reason)
+		return object, nil
+	}
+
+	// Select the signing key chosen by the API
+	key, err := d.apiSigningKey(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("No JWS signing key available: %v", err)
+		return d.rejectResponse(object, reasonSigningFailed, "JWS signing not configured", http.StatusInternalServerError)
+	}
+
+	// Use the header profile chosen by the API
+	profile, err := d.apiJWSProfile(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("Invalid JWS profile configuration: %v", err)
+		return d.rejectResponse(object, reasonSigningFailed, "JWS signing misconfigured", http.StatusInternalServerError)
+	}
+
+	// Sign the exact bytes sent to the client
+	payload := object.Response.RawBody
+	if len(payload) == 0 {
+		payload = []byte(object.Response.Body)
+	}
+
+	signature, err := d.signDetachedJWS(ctx, payload, key, profile)
+	if err != nil {
+		logger(ctx).Errorf("Failed to create JWS signature: %v", err)
+		return d.rejectResponse(object, reasonSigningFailed, "Failed to create JWS signature", signErrorStatus(err))
+	}
+
+	setResponseHeader(object.Response, "x-jws-signature", signature)
+
+	logger(ctx).Info("Upstream response signed")
+	return object, nil
+}
+
+// setResponseHeader sets a header on a response object, keeping the single
+// and multi-value header representations in sync
+func setResponseHeader(response *pb.ResponseObject, name, value string) {
+	if response.Headers == nil {
+		response.Headers = map[string]string{}
+	}
+	for k := range response.Headers {
+		if strings.EqualFold(k, name) {
+			delete(response.Headers, k)
+		}
+	}
+	response.Headers[name] = value
+
+	headers := response.MultivalueHeaders[:0]
+	for _, header := range response.MultivalueHeaders {
+		if !strings.EqualFold(header.Key, name) {
+			headers = append(headers, header)
+		}
+	}
+	response.MultivalueHeaders = append(headers, &pb.Header{Key: name, Values: []string{value}})
+}
+
+// respondWithResponseError replaces the upstream response with an error response
+func (d *DPoPHandler) respondWithResponseError(object *pb.Object, message string, statusCode int) (*pb.Object, error) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+
+	object.Response = &pb.ResponseObject{
+		StatusCode:        int32(statusCode),
+		Body:              string(body),
+		RawBody:           body,
+		Headers:           map[string]string{"Content-Type": "application/json"},
+		MultivalueHeaders: []*pb.Header{{Key: "Content-Type", Values: []string{"application/json"}}},
+	}
+	return object, nil
+}
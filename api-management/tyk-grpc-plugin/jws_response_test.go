@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// newResponseTestObject creates a response hook object
+func newResponseTestObject(statusCode int32, contentType, body string) *pb.Object {
+	return &pb.Object{
+		HookName: "JWSSignResponse",
+		HookType: pb.HookType_Response,
+		Request: &pb.MiniRequestObject{
+			Method: "GET",
+			Url:    "/domestic-payments/p-12345678",
+		},
+		Response: &pb.ResponseObject{
+			StatusCode: statusCode,
+			Body:       body,
+			RawBody:    []byte(body),
+			Headers:    map[string]string{"Content-Type": contentType},
+			MultivalueHeaders: []*pb.Header{
+				{Key: "Content-Type", Values: []string{contentType}},
+			},
+		},
+	}
+}
+
+// TestJWSSignResponse tests that upstream responses are signed
+func TestJWSSignResponse(t *testing.T) {
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{
+		privateKey:        privateKey,
+		jwsConfig:         JWSConfig{KeyID: "test-key-id"},
+		jwsResponseConfig: defaultJWSResponseConfig,
+	}
+
+	body := `{"Data":{"DomesticPaymentId":"p-12345678"}}`
+	result, err := handler.JWSSignResponse(context.Background(), newResponseTestObject(http.StatusOK, "application/json; charset=utf-8", body))
+	if err != nil {
+		t.Fatalf("JWSSignResponse returned an error: %v", err)
+	}
+
+	signature := result.Response.Headers["x-jws-signature"]
+	if signature == "" {
+		t.Fatal("JWSSignResponse did not add the x-jws-signature header")
+	}
+
+	found := false
+	for _, header := range result.Response.MultivalueHeaders {
+		if header.Key == "x-jws-signature" && len(header.Values) == 1 && header.Values[0] == signature {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("JWSSignResponse did not add the x-jws-signature multi-value header")
+	}
+
+	// The signature covers the response body
+	verifier := newVerifyTestHandler(t, "aspsp", testECJWK(privateKey, "test-key-id"))
+	if err := verifier.verifyDetachedJWS(signature, []byte(body), "aspsp"); err != nil {
+		t.Errorf("Expected the response signature to verify, got: %v", err)
+	}
+}
+
+// TestJWSSignResponseExclusions tests that excluded responses are not signed
+func TestJWSSignResponseExclusions(t *testing.T) {
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{
+		privateKey: privateKey,
+		jwsConfig:  JWSConfig{KeyID: "test-key-id"},
+		jwsResponseConfig: JWSResponseConfig{
+			ExcludedContentTypes: []string{"text/html"},
+			ExcludedStatusCodes:  []string{"204", "5xx"},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		statusCode  int32
+		contentType string
+		body        string
+		signed      bool
+	}{
+		{"json response", http.StatusCreated, "application/json", `{"Data":{}}`, true},
+		{"excluded content type", http.StatusOK, "text/html; charset=utf-8", "<html></html>", false},
+		{"excluded status code", http.StatusNoContent, "application/json", "", false},
+		{"excluded status class", http.StatusBadGateway, "application/json", `{"error":"upstream"}`, false},
+		{"empty body", http.StatusOK, "application/json", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := handler.JWSSignResponse(context.Background(), newResponseTestObject(tt.statusCode, tt.contentType, tt.body))
+			if err != nil {
+				t.Fatalf("JWSSignResponse returned an error: %v", err)
+			}
+			if signed := result.Response.Headers["x-jws-signature"] != ""; signed != tt.signed {
+				t.Errorf("Expected signed to be %v, got %v", tt.signed, signed)
+			}
+		})
+	}
+}
+
+// TestValidateStatusPatterns tests the validation of excluded status code patterns
+func TestValidateStatusPatterns(t *testing.T) {
+	if err := validateStatusPatterns([]string{"204", "304", "4xx", "5XX"}); err != nil {
+		t.Errorf("Expected valid patterns, got: %v", err)
+	}
+	for _, pattern := range []string{"abc", "99", "600", "6xx"} {
+		if err := validateStatusPatterns([]string{pattern}); err == nil {
+			t.Errorf("Expected pattern %q to be rejected", pattern)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -14,7 +15,7 @@ import (
 	"strings"
 	"testing"
 
-	pb "github.com/TykTechnologies/tyk-fapi/plugins/tyk-grpc-plugin/proto/gen"
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
 )
 
 // generateTestKey generates a test ECDSA key for testing
@@ -171,7 +172,7 @@ func TestJWSSignWithRewriteTarget(t *testing.T) {
 	}
 
 	// Call the JWSSign function
-	result, err := handler.JWSSign(object)
+	result, err := handler.JWSSign(context.Background(), object)
 	if err != nil {
 		t.Fatalf("JWSSign returned an error: %v", err)
 	}
@@ -249,7 +250,7 @@ func TestJWSSignWithoutRewriteTarget(t *testing.T) {
 	}
 
 	// Call the JWSSign function
-	result, err := handler.JWSSign(object)
+	result, err := handler.JWSSign(context.Background(), object)
 	if err != nil {
 		t.Fatalf("JWSSign returned an error: %v", err)
 	}
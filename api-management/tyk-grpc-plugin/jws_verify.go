@@ -0,0 +1,502 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// Open Banking JWS protected header parameters
+const (
+	obHeaderIat = "http://openbanking.org.uk/iat"
+	obHeaderIss = "http://openbanking.org.uk/iss"
+	obHeaderTan = "http://openbanking.org.uk/tan"
+)
+
+// understoodCritHeaders lists the critical header parameters this plugin can process
+var understoodCritHeaders = map[string]bool{
+	"b64":       true,
+	obHeaderIat: true,
+	obHeaderIss: true,
+	obHeaderTan: true,
+}
+
+// JWSVerifyConfig contains configuration for verifying TPP request signatures
+type JWSVerifyConfig struct {
+	// Path to a JSON file mapping TPP client IDs to their registered JWKS URIs
+	JWKSRegistryPath string
+	// Directory of JWKS files standing in for the Open Banking directory
+	JWKSDirectory string
+	// How long fetched JWKS documents are cached (default: 1 hour)
+	JWKSCacheTTL time.Duration
+	// Algorithms TPPs may sign with (default: PS256, ES256)
+	AllowedAlgorithms []string
+	// Allowed clock skew for the http://openbanking.org.uk/iat header (default: 5 minutes)
+	ClockSkew time.Duration
+	// Open Banking issuer (<org-id>/<software-statement-id>) registered per
+	// client ID, checked against the http://openbanking.org.uk/iss header (optional)
+	Issuers map[string]string
+}
+
+// Default JWS verification configuration values
+var defaultJWSVerifyConfig = JWSVerifyConfig{
+	JWKSCacheTTL:      time.Hour,
+	AllowedAlgorithms: []string{"PS256", "ES256"},
+	ClockSkew:         5 * time.Minute,
+}
+
+// KeyResolver resolves the public keys of a TPP
+type KeyResolver interface {
+	// ResolveKey returns the key with the given key ID and use ("sig" or "enc")
+	// registered for the client. An empty key ID selects the first key with that use.
+	ResolveKey(clientID, kid, use string) (*JWK, error)
+}
+
+// errKeyNotFound is returned when a resolver has no key for a client and key ID
+var errKeyNotFound = errors.New("key not found")
+
+// jwksURIResolver resolves keys from JWKS URIs registered per client
+type jwksURIResolver struct {
+	// Registered JWKS URI per client ID
+	registry map[string]string
+	cacheTTL time.Duration
+	client   *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cachedJWKS
+	// Outcome of the last fetch of each JWKS URI
+	fetchErrors map[string]error
+}
+
+// cachedJWKS is a JWKS document fetched from a JWKS URI
+type cachedJWKS struct {
+	jwks      *JWKS
+	fetchedAt time.Time
+}
+
+// minJWKSRefreshInterval limits how often a JWKS is refetched for unknown key IDs
+const minJWKSRefreshInterval = time.Minute
+
+// newJWKSURIResolver creates a resolver from a JSON registry file of client ID to JWKS URI
+func newJWKSURIResolver(registryPath string, cacheTTL time.Duration) (*jwksURIResolver, error) {
+	data, err := os.ReadFile(registryPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read JWKS registry: %w", err)
+	}
+
+	registry := map[string]string{}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS registry: %w", err)
+	}
+
+	return &jwksURIResolver{
+		registry:    registry,
+		cacheTTL:    cacheTTL,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		cache:       map[string]cachedJWKS{},
+		fetchErrors: map[string]error{},
+	}, nil
+}
+
+// ResolveKey implements KeyResolver
+func (r *jwksURIResolver) ResolveKey(clientID, kid, use string) (*JWK, error) {
+	jwksURI, ok := r.registry[clientID]
+	if !ok {
+		return nil, errKeyNotFound
+	}
+
+	r.mu.Lock()
+	cached, found := r.cache[jwksURI]
+	r.mu.Unlock()
+
+	// Use the cached JWKS while it is fresh and contains the key
+	if found && time.Since(cached.fetchedAt) < r.cacheTTL {
+		if key := cached.jwks.Find(kid, use); key != nil {
+			return key, nil
+		}
+		// The TPP may have rotated its keys, but do not hammer its JWKS URI
+		if time.Since(cached.fetchedAt) < minJWKSRefreshInterval {
+			return nil, errKeyNotFound
+		}
+	}
+
+	jwks, err := fetchJWKS(r.client, jwksURI)
+	r.mu.Lock()
+	r.fetchErrors[jwksURI] = err
+	if err == nil {
+		r.cache[jwksURI] = cachedJWKS{jwks: jwks, fetchedAt: time.Now()}
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if key := jwks.Find(kid, use); key != nil {
+		return key, nil
+	}
+	return nil, errKeyNotFound
+}
+
+// fetchError returns an error when the last fetch of every JWKS URI fetched so
+// far failed, which points at the plugin's network rather than a single TPP
+func (r *jwksURIResolver) fetchError() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var last error
+	for _, err := range r.fetchErrors {
+		if err == nil {
+			return nil
+		}
+		last = err
+	}
+	if last != nil {
+		return fmt.Errorf("every JWKS fetch failing (%d URIs), e.g. %w", len(r.fetchErrors), last)
+	}
+	return nil
+}
+
+// fetchJWKS downloads a JWKS document
+func fetchJWKS(client *http.Client, jwksURI string) (*JWKS, error) {
+	resp, err := client.Get(jwksURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	jwks := &JWKS{}
+	if err := json.NewDecoder(resp.Body).Decode(jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	return jwks, nil
+}
+
+// loadTPPIssuers reads a JSON file mapping TPP client IDs to their Open Banking issuers
+func loadTPPIssuers(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read issuers: %w", err)
+	}
+
+	issuers := map[string]string{}
+	if err := json.Unmarshal(data, &issuers); err != nil {
+		return nil, fmt.Errorf("failed to parse issuers: %w", err)
+	}
+	for clientID, issuer := range issuers {
+		if issuer == "" {
+			return nil, fmt.Errorf("empty issuer for client %s", clientID)
+		}
+	}
+	return issuers, nil
+}
+
+// jwksDirectoryResolver resolves keys from JWKS files laid out like the
+// Open Banking directory keystore: <directory>/<client ID>.json
+type jwksDirectoryResolver struct {
+	directory string
+}
+
+// ResolveKey implements KeyResolver
+func (r *jwksDirectoryResolver) ResolveKey(clientID, kid, use string) (*JWK, error) {
+	path := filepath.Join(r.directory, clientID+".json")
+
+	// Refuse client IDs that would escape the directory
+	rel, err := filepath.Rel(r.directory, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("invalid client ID: %s", clientID)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errKeyNotFound
+		}
+		return nil, fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+
+	jwks := &JWKS{}
+	if err := json.Unmarshal(data, jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS file: %w", err)
+	}
+
+	if key := jwks.Find(kid, use); key != nil {
+		return key, nil
+	}
+	return nil, errKeyNotFound
+}
+
+// chainResolver tries each resolver in turn until one finds the key
+type chainResolver []KeyResolver
+
+// ResolveKey implements KeyResolver
+func (c chainResolver) ResolveKey(clientID, kid, use string) (*JWK, error) {
+	for _, resolver := range c {
+		key, err := resolver.ResolveKey(clientID, kid, use)
+		if err == nil {
+			return key, nil
+		}
+		if !errors.Is(err, errKeyNotFound) {
+			return nil, err
+		}
+	}
+	return nil, errKeyNotFound
+}
+
+// fetchError returns the fetch error of the first resolver fetching JWKS URIs
+// that reports one
+func (c chainResolver) fetchError() error {
+	for _, resolver := range c {
+		if fetcher, ok := resolver.(interface{ fetchError() error }); ok {
+			if err := fetcher.fetchError(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newKeyResolver builds the key resolver for the given configuration
+func newKeyResolver(config JWSVerifyConfig) (KeyResolver, error) {
+	var resolvers chainResolver
+
+	if config.JWKSRegistryPath != "" {
+		resolver, err := newJWKSURIResolver(config.JWKSRegistryPath, config.JWKSCacheTTL)
+		if err != nil {
+			return nil, err
+		}
+		resolvers = append(resolvers, resolver)
+	}
+
+	if config.JWKSDirectory != "" {
+		resolvers = append(resolvers, &jwksDirectoryResolver{directory: config.JWKSDirectory})
+	}
+
+	if len(resolvers) == 0 {
+		return nil, errors.New("no JWKS registry or directory configured")
+	}
+	return resolvers, nil
+}
+
+// JWSVerify implements the hook verifying the x-jws-signature of TPP requests
+func (d *DPoPHandler) JWSVerify(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running JWSVerify hook")
+
+	// Only POST requests carry signed payloads
+	if strings.ToUpper(object.Request.Method) != http.MethodPost {
+		logger(ctx).Info("Skipping JWS verification for non-POST request")
+		return object, nil
+	}
+
+	if d.keyResolver == nil {
+		logger(ctx).Error("JWS verification key resolver not configured")
+		return d.respondWithError(object, "JWS verification not configured", http.StatusInternalServerError)
+	}
+
+	signature := getHeader(object.Request.Headers, "x-jws-signature")
+	if signature == "" {
+		logger(ctx).Error("x-jws-signature header is missing")
+		return d.reject(object, reasonMissingSignature, "x-jws-signature header is required", http.StatusBadRequest)
+	}
+
+	// Prefer the raw body so the signature is checked over the exact bytes sent
+	payload := object.Request.RawBody
+	if len(payload) == 0 {
+		payload = []byte(object.Request.Body)
+	}
+
+	if err := d.verifyDetachedJWS(signature, payload, object.GetSession().GetOauthClientId()); err != nil {
+		logger(ctx).Errorf("JWS signature verification failed: %v", err)
+		return d.reject(object, reasonInvalidSignature, fmt.Sprintf("Invalid x-jws-signature: %v", err), http.StatusBadRequest)
+	}
+
+	logger(ctx).Info("JWS signature verification successful")
+	return object, nil
+}
+
+// verifyDetachedJWS verifies a detached JWS over the payload, signed by the
+// authenticated client or, when the hook runs before authentication, by the
+// TPP the http://openbanking.org.uk/iss header names
+func (d *DPoPHandler) verifyDetachedJWS(signature string, payload []byte, clientID string) error {
+	parts := strings.Split(signature, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed JWS")
+	}
+	if parts[1] != "" {
+		return errors.New("JWS payload must be detached")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("failed to decode header: %w", err)
+	}
+
+	var header map[string]interface{}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return fmt.Errorf("failed to parse header: %w", err)
+	}
+
+	alg, _ := header["alg"].(string)
+	if !d.isAllowedVerifyAlgorithm(alg) {
+		return fmt.Errorf("algorithm %q is not allowed", alg)
+	}
+
+	kid, _ := header["kid"].(string)
+	if kid == "" {
+		return errors.New("missing kid header")
+	}
+
+	if err := d.checkCritHeaders(header); err != nil {
+		return err
+	}
+
+	clientID, err = d.signingClient(header, clientID)
+	if err != nil {
+		return err
+	}
+
+	jwk, err := d.keyResolver.ResolveKey(clientID, kid, "sig")
+	if err != nil {
+		return fmt.Errorf("failed to resolve key %s for %s: %w", kid, clientID, err)
+	}
+	if jwk.Alg != "" && jwk.Alg != alg {
+		return fmt.Errorf("key %s is registered for %s, not %s", kid, jwk.Alg, alg)
+	}
+
+	publicKey, err := jwk.PublicKey()
+	if err != nil {
+		return fmt.Errorf("invalid key %s: %w", kid, err)
+	}
+
+	signatureBytes, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+
+	// With b64=false the payload is signed as-is (RFC 7797), otherwise base64url-encoded
+	signingInput := []byte(parts[0] + ".")
+	if b64, ok := header["b64"].(bool); ok && !b64 {
+		signingInput = append(signingInput, payload...)
+	} else {
+		signingInput = append(signingInput, base64.RawURLEncoding.EncodeToString(payload)...)
+	}
+
+	return verifyJWSSignature(alg, publicKey, signingInput, signatureBytes)
+}
+
+// signingClient returns the client whose key verifies the signature. The
+// http://openbanking.org.uk/iss header names the TPP as <org-id>/<software-statement-id>
+// rather than by client ID, so it is only checked against the authenticated
+// client when an issuer is registered for it; before authentication it
+// identifies the TPP, through the registered issuers if it is one of them.
+func (d *DPoPHandler) signingClient(header map[string]interface{}, clientID string) (string, error) {
+	issuer, ok := header[obHeaderIss].(string)
+	if _, present := header[obHeaderIss]; present && !ok {
+		return "", fmt.Errorf("%s header must be a string", obHeaderIss)
+	}
+
+	if clientID != "" {
+		// A client may only sign as the TPP it is registered for
+		if registered, ok := d.jwsVerifyConfig.Issuers[clientID]; ok && issuer != "" && issuer != registered {
+			return "", fmt.Errorf("%s header %q does not match the issuer registered for client %q", obHeaderIss, issuer, clientID)
+		}
+		return clientID, nil
+	}
+
+	if issuer == "" {
+		return "", errors.New("unable to determine the signing TPP")
+	}
+	for registeredClient, registered := range d.jwsVerifyConfig.Issuers {
+		if registered == issuer {
+			return registeredClient, nil
+		}
+	}
+	return issuer, nil
+}
+
+// isAllowedVerifyAlgorithm reports whether TPPs may sign with the algorithm
+func (d *DPoPHandler) isAllowedVerifyAlgorithm(alg string) bool {
+	// Never accept unsigned or symmetric signatures, whatever the configuration says
+	if alg == "" || alg == "none" || strings.HasPrefix(alg, "HS") {
+		return false
+	}
+	for _, allowed := range d.jwsVerifyConfig.AllowedAlgorithms {
+		if alg == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCritHeaders enforces the crit header rules of RFC 7515 and RFC 7797
+func (d *DPoPHandler) checkCritHeaders(header map[string]interface{}) error {
+	crit := map[string]bool{}
+	if rawCrit, present := header["crit"]; present {
+		critList, ok := rawCrit.([]interface{})
+		if !ok || len(critList) == 0 {
+			return errors.New("crit header must be a non-empty array")
+		}
+		for _, item := range critList {
+			name, ok := item.(string)
+			if !ok {
+				return errors.New("crit header must contain strings")
+			}
+			if crit[name] {
+				return fmt.Errorf("duplicate crit header parameter %q", name)
+			}
+			if !understoodCritHeaders[name] {
+				return fmt.Errorf("unsupported crit header parameter %q", name)
+			}
+			if _, present := header[name]; !present {
+				return fmt.Errorf("crit header parameter %q is missing", name)
+			}
+			crit[name] = true
+		}
+	}
+
+	// An unencoded payload changes how the signature is computed, so b64 must be critical
+	if b64, present := header["b64"]; present {
+		if _, ok := b64.(bool); !ok {
+			return errors.New("b64 header must be a boolean")
+		}
+		if !crit["b64"] {
+			return errors.New("b64 header must be listed in crit")
+		}
+	}
+
+	// The Open Banking signing time must not be in the future
+	if rawIat, present := header[obHeaderIat]; present {
+		iat, ok := rawIat.(float64)
+		if !ok {
+			return fmt.Errorf("%s header must be a number", obHeaderIat)
+		}
+		if time.Unix(int64(iat), 0).After(time.Now().Add(d.jwsVerifyConfig.ClockSkew)) {
+			return fmt.Errorf("%s header is in the future", obHeaderIat)
+		}
+	}
+
+	return nil
+}
+
+// getHeader returns the value of a header regardless of its case
+func getHeader(headers map[string]string, name string) string {
+	for k, v := range headers {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// testECJWK builds the public JWK of a test key
+func testECJWK(privateKey *ecdsa.PrivateKey, kid string) JWK {
+	jwk, _ := NewJWK(privateKey.Public(), kid, "")
+	return jwk
+}
+
+// signTestJWS creates a detached ES256 JWS with an arbitrary protected header
+func signTestJWS(t *testing.T, privateKey *ecdsa.PrivateKey, header map[string]interface{}, payload []byte) string {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("Failed to marshal header: %v", err)
+	}
+	headerEncoded := base64.RawURLEncoding.EncodeToString(headerBytes)
+
+	signingInput := headerEncoded + "."
+	if b64, ok := header["b64"].(bool); ok && !b64 {
+		signingInput += string(payload)
+	} else {
+		signingInput += base64.RawURLEncoding.EncodeToString(payload)
+	}
+
+	hash := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, privateKey, hash[:])
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+
+	return headerEncoded + ".." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// newVerifyTestHandler creates a handler verifying against a JWKS directory holding the TPP key
+func newVerifyTestHandler(t *testing.T, clientID string, jwk JWK) *DPoPHandler {
+	dir := t.TempDir()
+	jwksBytes, err := json.Marshal(JWKS{Keys: []JWK{jwk}})
+	if err != nil {
+		t.Fatalf("Failed to marshal JWKS: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, clientID+".json"), jwksBytes, 0o600); err != nil {
+		t.Fatalf("Failed to write JWKS: %v", err)
+	}
+
+	config := defaultJWSVerifyConfig
+	config.JWKSDirectory = dir
+	resolver, err := newKeyResolver(config)
+	if err != nil {
+		t.Fatalf("Failed to create key resolver: %v", err)
+	}
+
+	return &DPoPHandler{
+		jwsVerifyConfig: config,
+		keyResolver:     resolver,
+	}
+}
+
+// newVerifyTestObject creates a signed POST request object
+func newVerifyTestObject(clientID, signature, body string) *pb.Object {
+	return &pb.Object{
+		HookName: "JWSVerify",
+		Request: &pb.MiniRequestObject{
+			Headers: map[string]string{
+				"Content-Type":    "application/json",
+				"X-Jws-Signature": signature,
+			},
+			Body:    body,
+			RawBody: []byte(body),
+			Method:  "POST",
+			Url:     "/domestic-payment-consents",
+		},
+		Session: &pb.SessionState{OauthClientId: clientID},
+	}
+}
+
+// TestJWSVerifyValidSignature tests that a valid detached signature is accepted
+func TestJWSVerifyValidSignature(t *testing.T) {
+	tppKey, _ := generateTestKey(t)
+	verifier := newVerifyTestHandler(t, "tpp-client", testECJWK(tppKey, "tpp-kid"))
+
+	// Sign the payload the same way the plugin does
+	signer := &DPoPHandler{privateKey: tppKey, jwsConfig: JWSConfig{KeyID: "tpp-kid"}}
+	body := `{"Data":{"Initiation":{"InstructedAmount":{"Amount":"10.00","Currency":"GBP"}}}}`
+	signature, err := signer.createDetachedJWS([]byte(body))
+	if err != nil {
+		t.Fatalf("createDetachedJWS returned an error: %v", err)
+	}
+
+	result, err := verifier.JWSVerify(context.Background(), newVerifyTestObject("tpp-client", signature, body))
+	if err != nil {
+		t.Fatalf("JWSVerify returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides != nil && result.Request.ReturnOverrides.ResponseCode != 0 {
+		t.Errorf("Expected the request to continue, got %d: %s",
+			result.Request.ReturnOverrides.ResponseCode, result.Request.ReturnOverrides.ResponseError)
+	}
+}
+
+// TestJWSVerifyRejectsInvalidRequests tests the rejection of unsigned, tampered and unknown-key requests
+func TestJWSVerifyRejectsInvalidRequests(t *testing.T) {
+	tppKey, _ := generateTestKey(t)
+	otherKey, _ := generateTestKey(t)
+	verifier := newVerifyTestHandler(t, "tpp-client", testECJWK(tppKey, "tpp-kid"))
+
+	body := `{"Data":{}}`
+	header := map[string]interface{}{"alg": "ES256", "kid": "tpp-kid", "b64": false, "crit": []string{"b64"}}
+
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+	}{
+		{"missing signature", "", body},
+		{"tampered body", signTestJWS(t, tppKey, header, []byte(body)), `{"Data":{"tampered":true}}`},
+		{"wrong key", signTestJWS(t, otherKey, header, []byte(body)), body},
+		{"attached payload", "eyJhbGciOiJFUzI1NiJ9.e30.c2ln", body},
+		{"whitespace in signature", " " + signTestJWS(t, tppKey, header, []byte(body)), body},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := verifier.JWSVerify(context.Background(), newVerifyTestObject("tpp-client", tt.signature, tt.body))
+			if err != nil {
+				t.Fatalf("JWSVerify returned an error: %v", err)
+			}
+			if result.Request.ReturnOverrides == nil || result.Request.ReturnOverrides.ResponseCode != http.StatusBadRequest {
+				t.Errorf("Expected the request to be rejected with %d", http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// TestJWSVerifyHeaderRules tests the crit and algorithm rules
+func TestJWSVerifyHeaderRules(t *testing.T) {
+	tppKey, _ := generateTestKey(t)
+	verifier := newVerifyTestHandler(t, "tpp-client", testECJWK(tppKey, "tpp-kid"))
+	verifier.jwsVerifyConfig.Issuers = map[string]string{"tpp-client": "org-id/software-id"}
+	payload := []byte(`{"Data":{}}`)
+
+	tests := []struct {
+		name    string
+		header  map[string]interface{}
+		wantErr bool
+	}{
+		{
+			name:   "unencoded payload",
+			header: map[string]interface{}{"alg": "ES256", "kid": "tpp-kid", "b64": false, "crit": []string{"b64"}},
+		},
+		{
+			name:   "encoded payload without b64",
+			header: map[string]interface{}{"alg": "ES256", "kid": "tpp-kid"},
+		},
+		{
+			name: "open banking claims",
+			header: map[string]interface{}{
+				"alg": "ES256", "kid": "tpp-kid",
+				obHeaderIat: time.Now().Unix(), obHeaderIss: "org-id/software-id", obHeaderTan: "openbanking.org.uk",
+				"crit": []string{obHeaderIat, obHeaderIss, obHeaderTan},
+			},
+		},
+		{
+			name: "issuer of another client",
+			header: map[string]interface{}{
+				"alg": "ES256", "kid": "tpp-kid", obHeaderIss: "org-id/other-software-id", "crit": []string{obHeaderIss},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "issuer not a string",
+			header:  map[string]interface{}{"alg": "ES256", "kid": "tpp-kid", obHeaderIss: 1, "crit": []string{obHeaderIss}},
+			wantErr: true,
+		},
+		{
+			name:    "b64 not critical",
+			header:  map[string]interface{}{"alg": "ES256", "kid": "tpp-kid", "b64": false},
+			wantErr: true,
+		},
+		{
+			name:    "unknown crit parameter",
+			header:  map[string]interface{}{"alg": "ES256", "kid": "tpp-kid", "crit": []string{"urn:example:unknown"}, "urn:example:unknown": 1},
+			wantErr: true,
+		},
+		{
+			name:    "crit parameter missing",
+			header:  map[string]interface{}{"alg": "ES256", "kid": "tpp-kid", "crit": []string{obHeaderTan}},
+			wantErr: true,
+		},
+		{
+			name:    "signing time in the future",
+			header:  map[string]interface{}{"alg": "ES256", "kid": "tpp-kid", obHeaderIat: time.Now().Add(time.Hour).Unix(), "crit": []string{obHeaderIat}},
+			wantErr: true,
+		},
+		{
+			name:    "disallowed algorithm",
+			header:  map[string]interface{}{"alg": "RS256", "kid": "tpp-kid"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown key",
+			header:  map[string]interface{}{"alg": "ES256", "kid": "other-kid"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature := signTestJWS(t, tppKey, tt.header, payload)
+			err := verifier.verifyDetachedJWS(signature, payload, "tpp-client")
+			if tt.wantErr && err == nil {
+				t.Error("Expected verification to fail")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Expected verification to succeed, got: %v", err)
+			}
+		})
+	}
+}
+
+// TestJWSVerifyJWKSURI tests resolving keys from a registered JWKS URI using the Open Banking issuer header
+func TestJWSVerifyJWKSURI(t *testing.T) {
+	tppKey, _ := generateTestKey(t)
+
+	jwksServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(JWKS{Keys: []JWK{testECJWK(tppKey, "tpp-kid")}})
+	}))
+	defer jwksServer.Close()
+
+	registryPath := filepath.Join(t.TempDir(), "registry.json")
+	registry := map[string]string{"org-id/software-id": jwksServer.URL}
+	registryBytes, _ := json.Marshal(registry)
+	if err := os.WriteFile(registryPath, registryBytes, 0o600); err != nil {
+		t.Fatalf("Failed to write registry: %v", err)
+	}
+
+	config := defaultJWSVerifyConfig
+	config.JWKSRegistryPath = registryPath
+	resolver, err := newKeyResolver(config)
+	if err != nil {
+		t.Fatalf("Failed to create key resolver: %v", err)
+	}
+	verifier := &DPoPHandler{jwsVerifyConfig: config, keyResolver: resolver}
+
+	payload := []byte(`{"Data":{}}`)
+	signature := signTestJWS(t, tppKey, map[string]interface{}{
+		"alg": "ES256", "kid": "tpp-kid", obHeaderIss: "org-id/software-id", "crit": []string{obHeaderIss},
+	}, payload)
+
+	// No authenticated client, so the signer is taken from the issuer header
+	if err := verifier.verifyDetachedJWS(signature, payload, ""); err != nil {
+		t.Errorf("Expected verification to succeed, got: %v", err)
+	}
+}
+
+// TestJWSVerifyIssuers tests identifying the TPP from the Open Banking issuer header
+func TestJWSVerifyIssuers(t *testing.T) {
+	tppKey, _ := generateTestKey(t)
+	verifier := newVerifyTestHandler(t, "tpp-client", testECJWK(tppKey, "tpp-kid"))
+	payload := []byte(`{"Data":{}}`)
+	signature := signTestJWS(t, tppKey, map[string]interface{}{
+		"alg": "ES256", "kid": "tpp-kid", obHeaderIss: "org-id/software-id", "crit": []string{obHeaderIss},
+	}, payload)
+
+	// Without a registered issuer the header of an authenticated client is not checked
+	if err := verifier.verifyDetachedJWS(signature, payload, "tpp-client"); err != nil {
+		t.Errorf("Expected verification to succeed, got: %v", err)
+	}
+
+	// Before authentication the registered issuer selects the client's keys
+	verifier.jwsVerifyConfig.Issuers = map[string]string{"tpp-client": "org-id/software-id"}
+	if err := verifier.verifyDetachedJWS(signature, payload, ""); err != nil {
+		t.Errorf("Expected verification to succeed, got: %v", err)
+	}
+
+	// A client signing as another TPP is refused
+	verifier.jwsVerifyConfig.Issuers = map[string]string{"tpp-client": "org-id/other-software-id"}
+	if err := verifier.verifyDetachedJWS(signature, payload, "tpp-client"); err == nil {
+		t.Error("Expected the issuer of another TPP to be refused")
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// SigningKey is a private key used for JWS signing
+type SigningKey struct {
+	// Key ID used in the JWS header
+	KeyID      string
+	PrivateKey crypto.Signer
+	// JWS algorithm the key signs with
+	Algorithm string
+	// Start of the validity period (zero means no start)
+	NotBefore time.Time
+	// End of the validity period (zero means no end)
+	NotAfter time.Time
+}
+
+// ValidAt reports whether the key may be used for signing at the given time
+func (k *SigningKey) ValidAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && !t.Before(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// KeyConfig describes a signing key in the key ring configuration
+type KeyConfig struct {
+	// Key ID used in the JWS header
+	KeyID string `json:"kid"`
+	// Path to the private key file (PEM format)
+	Path string `json:"path,omitempty"`
+	// URL of the signing service holding the key, used instead of a key file
+	SignerURL string `json:"signer_url,omitempty"`
+	// Algorithm to sign with (default: derived from the key type and curve)
+	Algorithm string `json:"alg,omitempty"`
+	// Start of the validity period
+	NotBefore time.Time `json:"not_before,omitempty"`
+	// End of the validity period
+	NotAfter time.Time `json:"not_after,omitempty"`
+}
+
+// KeyRingConfig contains configuration for the signing key ring
+type KeyRingConfig struct {
+	// Directory of PEM private keys named <kid>.pem, with optional <kid>.json
+	// validity metadata and an optional "active" file naming the active key
+	Directory string
+	// Keys listed explicitly, in addition to those in the directory
+	Keys []KeyConfig
+	// Key ID of the key to sign with (default: newest valid key)
+	ActiveKeyID string
+	// How often key files are checked for changes (default: 30 seconds, 0 disables)
+	ReloadInterval time.Duration
+	// Token and timeout used for keys held by a signing service
+	Signer RemoteSignerConfig
+}
+
+// Default key ring configuration values
+var defaultKeyRingConfig = KeyRingConfig{
+	ReloadInterval: 30 * time.Second,
+	Signer:         defaultRemoteSignerConfig,
+}
+
+// keyRingSnapshot is an immutable set of loaded keys
+type keyRingSnapshot struct {
+	// Keys ordered by start of validity, newest first
+	keys        []*SigningKey
+	activeKeyID string
+}
+
+// KeyRing holds the signing keys, reloaded when the key files change
+type KeyRing struct {
+	config KeyRingConfig
+	files  fileReloader[*keyRingSnapshot]
+}
+
+// activeKeyFile is the file in the key directory naming the active key
+const activeKeyFile = "active"
+
+// NewKeyRing creates a key ring and loads its keys
+func NewKeyRing(config KeyRingConfig) (*KeyRing, error) {
+	ring := &KeyRing{config: config}
+	ring.files = fileReloader[*keyRingSnapshot]{
+		name:        "JWS signing key",
+		interval:    config.ReloadInterval,
+		fingerprint: ring.fingerprint,
+		load:        ring.load,
+		loaded: func(snapshot *keyRingSnapshot) {
+			keyIDs := make([]string, 0, len(snapshot.keys))
+			for _, key := range snapshot.keys {
+				keyIDs = append(keyIDs, key.KeyID)
+			}
+			log.Infof("Loaded %d JWS signing keys: %s", len(keyIDs), strings.Join(keyIDs, ", "))
+		},
+	}
+	if err := ring.Reload(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// Reload reads the keys from disk and swaps them in
+func (r *KeyRing) Reload() error {
+	return r.files.Reload()
+}
+
+// load reads every configured key into a new snapshot
+func (r *KeyRing) load() (*keyRingSnapshot, error) {
+	configs := append([]KeyConfig{}, r.config.Keys...)
+	activeKeyID := r.config.ActiveKeyID
+
+	if r.config.Directory != "" {
+		dirConfigs, dirActiveKeyID, err := readKeyDirectory(r.config.Directory)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, dirConfigs...)
+		if dirActiveKeyID != "" {
+			activeKeyID = dirActiveKeyID
+		}
+	}
+
+	snapshot := &keyRingSnapshot{activeKeyID: activeKeyID}
+	seen := map[string]bool{}
+	for _, config := range configs {
+		if config.KeyID == "" {
+			return nil, fmt.Errorf("key %s has no key ID", config.Path)
+		}
+		if seen[config.KeyID] {
+			return nil, fmt.Errorf("duplicate key ID: %s", config.KeyID)
+		}
+		seen[config.KeyID] = true
+
+		if !config.NotBefore.IsZero() && !config.NotAfter.IsZero() && !config.NotAfter.After(config.NotBefore) {
+			return nil, fmt.Errorf("key %s: not_after must be after not_before", config.KeyID)
+		}
+
+		privateKey, err := r.loadSigner(config)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key %s: %w", config.KeyID, err)
+		}
+		algorithm, err := resolveKeyAlgorithm(privateKey, config.Algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", config.KeyID, err)
+		}
+
+		snapshot.keys = append(snapshot.keys, &SigningKey{
+			KeyID:      config.KeyID,
+			PrivateKey: privateKey,
+			Algorithm:  algorithm,
+			NotBefore:  config.NotBefore,
+			NotAfter:   config.NotAfter,
+		})
+	}
+
+	if len(snapshot.keys) == 0 {
+		return nil, errors.New("no signing keys found")
+	}
+	if activeKeyID != "" && !seen[activeKeyID] {
+		return nil, fmt.Errorf("active key %s not found", activeKeyID)
+	}
+
+	// Newest keys first, so the default active key is the most recent valid one
+	sort.SliceStable(snapshot.keys, func(i, j int) bool {
+		return snapshot.keys[i].NotBefore.After(snapshot.keys[j].NotBefore)
+	})
+
+	return snapshot, nil
+}
+
+// loadSigner returns the signer of a key, either read from its key file or
+// held by a signing service
+func (r *KeyRing) loadSigner(config KeyConfig) (crypto.Signer, error) {
+	if config.SignerURL != "" {
+		signerConfig := r.config.Signer
+		signerConfig.URL = config.SignerURL
+		signerConfig.KeyID = config.KeyID
+		return NewRemoteSigner(signerConfig)
+	}
+
+	keyData, err := os.ReadFile(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKeyPEM(keyData)
+}
+
+// readKeyDirectory lists the keys stored in a key directory
+func readKeyDirectory(directory string) ([]KeyConfig, string, error) {
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read key directory: %w", err)
+	}
+
+	var configs []KeyConfig
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+
+		keyID := strings.TrimSuffix(entry.Name(), ".pem")
+		config := KeyConfig{KeyID: keyID}
+
+		// Validity periods are read from an optional <kid>.json file
+		metadata, err := os.ReadFile(filepath.Join(directory, keyID+".json"))
+		if err == nil {
+			if err := json.Unmarshal(metadata, &config); err != nil {
+				return nil, "", fmt.Errorf("failed to parse metadata of key %s: %w", keyID, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, "", fmt.Errorf("failed to read metadata of key %s: %w", keyID, err)
+		}
+
+		// The file name always wins over the metadata
+		config.KeyID = keyID
+		config.Path = filepath.Join(directory, entry.Name())
+		configs = append(configs, config)
+	}
+
+	activeKeyID := ""
+	active, err := os.ReadFile(filepath.Join(directory, activeKeyFile))
+	if err == nil {
+		activeKeyID = strings.TrimSpace(string(active))
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, "", fmt.Errorf("failed to read active key file: %w", err)
+	}
+
+	return configs, activeKeyID, nil
+}
+
+// fingerprint summarises the size and modification time of every key file
+func (r *KeyRing) fingerprint() (string, error) {
+	var paths []string
+	for _, config := range r.config.Keys {
+		if config.SignerURL == "" {
+			paths = append(paths, config.Path)
+		}
+	}
+
+	if r.config.Directory != "" {
+		entries, err := os.ReadDir(r.config.Directory)
+		if err != nil {
+			return "", fmt.Errorf("failed to read key directory: %w", err)
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				paths = append(paths, filepath.Join(r.config.Directory, entry.Name()))
+			}
+		}
+	}
+
+	return fileFingerprint(paths...), nil
+}
+
+// Watch reloads the keys whenever the key files change, until the context is cancelled
+func (r *KeyRing) Watch(ctx context.Context) {
+	r.files.Watch(ctx)
+}
+
+// Active returns the key to sign with at the given time
+func (r *KeyRing) Active(now time.Time) (*SigningKey, error) {
+	snapshot := r.files.Load()
+
+	if snapshot.activeKeyID != "" {
+		return r.Key(snapshot.activeKeyID, now)
+	}
+
+	for _, key := range snapshot.keys {
+		if key.ValidAt(now) {
+			return key, nil
+		}
+	}
+	return nil, errors.New("no signing key is currently valid")
+}
+
+// Key returns the key with the given key ID if it is valid at the given time
+func (r *KeyRing) Key(keyID string, now time.Time) (*SigningKey, error) {
+	for _, key := range r.files.Load().keys {
+		if key.KeyID != keyID {
+			continue
+		}
+		if !key.ValidAt(now) {
+			return nil, fmt.Errorf("signing key %s is not valid at %s", keyID, now.Format(time.RFC3339))
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("signing key %s not found", keyID)
+}
+
+// Keys returns every loaded key, newest first
+func (r *KeyRing) Keys() []*SigningKey {
+	return append([]*SigningKey{}, r.files.Load().keys...)
+}
+
+// defaultSigningKey returns the key used when an API does not choose one
+func (d *DPoPHandler) defaultSigningKey() (*SigningKey, error) {
+	if d.keyRing != nil {
+		return d.keyRing.Active(time.Now())
+	}
+	if d.privateKey != nil {
+		algorithm, err := resolveKeyAlgorithm(d.privateKey, d.jwsConfig.Algorithm)
+		if err != nil {
+			return nil, err
+		}
+		return &SigningKey{KeyID: d.jwsConfig.KeyID, PrivateKey: d.privateKey, Algorithm: algorithm}, nil
+	}
+	return nil, errors.New("no signing key loaded")
+}
+
+// resolveKeyAlgorithm returns the configured algorithm after checking it suits
+// the key, or the algorithm derived from the key when none is configured
+func resolveKeyAlgorithm(signer crypto.Signer, configured string) (string, error) {
+	if configured == "" {
+		return jwsAlgorithmForKey(signer.Public())
+	}
+	if err := checkKeyAlgorithm(signer.Public(), configured); err != nil {
+		return "", err
+	}
+	return configured, nil
+}
+
+// apiSigningKey returns the signing key selected by the API config data,
+// falling back to the default key
+func (d *DPoPHandler) apiSigningKey(ctx context.Context, object *pb.Object) (*SigningKey, error) {
+	config, err := d.apiConfig(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	if config.JWSKeyID == "" {
+		return d.defaultSigningKey()
+	}
+	if d.keyRing == nil {
+		return nil, fmt.Errorf("signing key %s requested but no key ring is configured", config.JWSKeyID)
+	}
+	return d.keyRing.Key(config.JWSKeyID, time.Now())
+}
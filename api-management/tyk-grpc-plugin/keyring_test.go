@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// writeTestKey writes a new PEM key, and optional validity metadata, to the key directory
+func writeTestKey(t *testing.T, dir, keyID string, metadata *KeyConfig) {
+	_, keyPEM := generateTestKey(t)
+	if err := os.WriteFile(filepath.Join(dir, keyID+".pem"), []byte(keyPEM), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	if metadata != nil {
+		metadataBytes, err := json.Marshal(metadata)
+		if err != nil {
+			t.Fatalf("Failed to marshal metadata: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, keyID+".json"), metadataBytes, 0o600); err != nil {
+			t.Fatalf("Failed to write metadata: %v", err)
+		}
+	}
+}
+
+// TestKeyRingActiveKey tests the selection of the active key from overlapping validity periods
+func TestKeyRingActiveKey(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+
+	// An expired key, the current key, and its successor
+	writeTestKey(t, dir, "key-2023", &KeyConfig{NotBefore: now.Add(-48 * time.Hour), NotAfter: now.Add(-time.Hour)})
+	writeTestKey(t, dir, "key-2024", &KeyConfig{NotBefore: now.Add(-24 * time.Hour), NotAfter: now.Add(24 * time.Hour)})
+	writeTestKey(t, dir, "key-2025", &KeyConfig{NotBefore: now.Add(time.Hour)})
+
+	ring, err := NewKeyRing(KeyRingConfig{Directory: dir})
+	if err != nil {
+		t.Fatalf("NewKeyRing returned an error: %v", err)
+	}
+
+	if len(ring.Keys()) != 3 {
+		t.Fatalf("Expected 3 keys, got %d", len(ring.Keys()))
+	}
+
+	// The newest valid key is active now
+	active, err := ring.Active(now)
+	if err != nil {
+		t.Fatalf("Active returned an error: %v", err)
+	}
+	if active.KeyID != "key-2024" {
+		t.Errorf("Expected key-2024 to be active, got %s", active.KeyID)
+	}
+
+	// The successor takes over once it becomes valid
+	active, err = ring.Active(now.Add(2 * time.Hour))
+	if err != nil {
+		t.Fatalf("Active returned an error: %v", err)
+	}
+	if active.KeyID != "key-2025" {
+		t.Errorf("Expected key-2025 to be active, got %s", active.KeyID)
+	}
+
+	// Expired keys cannot be selected explicitly
+	if _, err := ring.Key("key-2023", now); err == nil {
+		t.Error("Expected an error selecting an expired key")
+	}
+}
+
+// TestKeyRingActiveKeyFile tests that the active file pins the active key
+func TestKeyRingActiveKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "old", &KeyConfig{NotBefore: time.Now().Add(-time.Hour)})
+	writeTestKey(t, dir, "new", &KeyConfig{NotBefore: time.Now().Add(-time.Minute)})
+	if err := os.WriteFile(filepath.Join(dir, activeKeyFile), []byte("old\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write active file: %v", err)
+	}
+
+	ring, err := NewKeyRing(KeyRingConfig{Directory: dir})
+	if err != nil {
+		t.Fatalf("NewKeyRing returned an error: %v", err)
+	}
+
+	active, err := ring.Active(time.Now())
+	if err != nil {
+		t.Fatalf("Active returned an error: %v", err)
+	}
+	if active.KeyID != "old" {
+		t.Errorf("Expected old to be active, got %s", active.KeyID)
+	}
+
+	// An active file naming an unknown key is refused
+	if err := os.WriteFile(filepath.Join(dir, activeKeyFile), []byte("missing"), 0o600); err != nil {
+		t.Fatalf("Failed to write active file: %v", err)
+	}
+	if err := ring.Reload(); err == nil {
+		t.Error("Expected an error reloading with an unknown active key")
+	}
+
+	// The previous keys stay in use after a failed reload
+	active, err = ring.Active(time.Now())
+	if err != nil || active.KeyID != "old" {
+		t.Errorf("Expected old to remain active after a failed reload, got %v, %v", active, err)
+	}
+}
+
+// TestKeyRingWatch tests that key file changes are picked up without a restart
+func TestKeyRingWatch(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "key-1", &KeyConfig{NotBefore: time.Now().Add(-time.Hour)})
+
+	ring, err := NewKeyRing(KeyRingConfig{Directory: dir, ReloadInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewKeyRing returned an error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ring.Watch(ctx)
+
+	// Signing keeps working with the key obtained before the rotation
+	before, err := ring.Active(time.Now())
+	if err != nil {
+		t.Fatalf("Active returned an error: %v", err)
+	}
+
+	writeTestKey(t, dir, "key-2", &KeyConfig{NotBefore: time.Now().Add(-time.Minute)})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if active, _ := ring.Active(time.Now()); active != nil && active.KeyID == "key-2" {
+			if before.KeyID != "key-1" || before.PrivateKey == nil {
+				t.Error("The key obtained before the rotation was modified")
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("The new key was not picked up")
+}
+
+// TestJWSSignPerAPIKey tests that the API config data selects the signing key
+func TestJWSSignPerAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "payments-key", nil)
+	writeTestKey(t, dir, "events-key", nil)
+
+	ring, err := NewKeyRing(KeyRingConfig{Directory: dir, ActiveKeyID: "payments-key"})
+	if err != nil {
+		t.Fatalf("NewKeyRing returned an error: %v", err)
+	}
+	handler := &DPoPHandler{keyRing: ring}
+
+	tests := []struct {
+		configData  string
+		expectedKid string
+	}{
+		{"", "payments-key"},
+		{`{"jws_key_id":"events-key"}`, "events-key"},
+	}
+
+	for _, tt := range tests {
+		object := &pb.Object{
+			HookName: "JWSSign",
+			Request: &pb.MiniRequestObject{
+				Body:   `{"test":"payload"}`,
+				Method: "POST",
+			},
+			Spec: map[string]string{"config_data": tt.configData},
+		}
+
+		result, err := handler.JWSSign(context.Background(), object)
+		if err != nil {
+			t.Fatalf("JWSSign returned an error: %v", err)
+		}
+
+		header := decodeJWSHeader(t, result.Request.SetHeaders["x-jws-signature"])
+		if header["kid"] != tt.expectedKid {
+			t.Errorf("Expected kid %s, got %v", tt.expectedKid, header["kid"])
+		}
+	}
+}
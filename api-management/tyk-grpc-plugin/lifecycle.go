@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// defaultDrainTimeout leaves room within Kubernetes' default 30 second grace period
+const defaultDrainTimeout = 25 * time.Second
+
+// httpShutdownTimeout bounds how long the HTTP endpoints wait for their requests on exit
+const httpShutdownTimeout = 5 * time.Second
+
+// serveHTTP serves HTTP until the context is cancelled, then lets the requests
+// in progress finish. Closing the server is not reported as an error.
+func serveHTTP(ctx context.Context, server *http.Server) error {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+		return nil
+	}
+	return err
+}
+
+// collectGarbage removes expired idempotency entries at the interval of the
+// current handler, which a reload may replace, until the context is cancelled
+func (s *pluginServer) collectGarbage(ctx context.Context) {
+	handler := s.Handler()
+	log.Infof("Starting idempotency garbage collector (interval: %v, expiration: %v)",
+		handler.config.GCInterval, handler.config.ExpirationTime)
+
+	for {
+		timer := time.NewTimer(s.Handler().config.GCInterval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+			s.Handler().runGarbageCollector()
+		}
+	}
+}
+
+// run serves Tyk's gRPC calls on the listener, with the background workers and
+// HTTP endpoints, until the context is cancelled. It then drains: the health
+// service reports NOT_SERVING, in-flight calls and deliveries get the drain
+// timeout to finish, queued requests are dead-lettered and the stores flushed.
+func (s *pluginServer) run(ctx context.Context, lis net.Listener) error {
+	handler := s.Handler()
+	config := handler.settings
+
+	// The workers and endpoints outlive the gRPC drain, so calls finishing
+	// late can still forward requests and the last metrics can be scraped
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	var wg sync.WaitGroup
+	start := func(name string, work func(context.Context) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := work(workers); err != nil {
+				log.Errorf("%s stopped: %v", name, err)
+			}
+		}()
+	}
+
+	// Watch the key and certificate files for changes
+	if handler.keyRing != nil {
+		start("Key ring watcher", func(ctx context.Context) error { handler.keyRing.Watch(ctx); return nil })
+	}
+	if handler.serverTLS != nil {
+		start("gRPC server TLS watcher", func(ctx context.Context) error { handler.serverTLS.Watch(ctx); return nil })
+	}
+	if handler.outboundTLS != nil {
+		start("Outbound TLS watcher", func(ctx context.Context) error { handler.outboundTLS.Watch(ctx); return nil })
+	}
+	if handler.deliveryQueue != nil {
+		handler.deliveryQueue.Start(workers)
+	}
+	start("Garbage collector", func(ctx context.Context) error { s.collectGarbage(ctx); return nil })
+
+	// Publish the public signing keys if configured
+	if handler.jwksConfig.ListenAddr != "" {
+		start("JWKS listener", handler.serveJWKS)
+	}
+
+	// Start the admin API if configured
+	if config.Admin.ListenAddress != "" {
+		adminConfig := AdminConfig{ListenAddr: config.Admin.ListenAddress, Token: config.Admin.Token}
+		start("Admin API", NewAdminServer(s, adminConfig).ListenAndServe)
+	}
+
+	// Start the Prometheus endpoint if configured
+	if config.Metrics.ListenAddress != "" {
+		metricsConfig := MetricsConfig{ListenAddr: config.Metrics.ListenAddress}
+		start("Metrics endpoint", func(ctx context.Context) error { return handler.serveMetrics(ctx, metricsConfig) })
+	}
+
+	// Report the capabilities of the current handler to Tyk and Kubernetes
+	healthReporter := NewHealthReporter(s, HealthConfig{
+		ListenAddr:    config.Health.ListenAddress,
+		CheckInterval: time.Duration(config.Health.CheckInterval),
+	})
+	start("Health checker", func(ctx context.Context) error { healthReporter.Run(ctx); return nil })
+	if config.Health.ListenAddress != "" {
+		start("Health endpoint", healthReporter.ListenAndServe)
+	}
+
+	if handler.serverTLS != nil {
+		log.Infof("Starting FAPI gRPC server on %s with TLS", lis.Addr())
+	} else {
+		log.Infof("Starting FAPI gRPC server on %s", lis.Addr())
+	}
+	grpcServer := newGRPCServer(grpcServerOptions(config.Listener, handler.serverTLS)...)
+	pb.RegisterDispatcherServer(grpcServer, s)
+	healthReporter.Register(grpcServer)
+
+	served := make(chan error, 1)
+	go func() { served <- grpcServer.Serve(lis) }()
+	select {
+	case err := <-served:
+		healthReporter.Shutdown()
+		return err
+	case <-ctx.Done():
+	}
+
+	drainTimeout := time.Duration(config.Listener.DrainTimeout)
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	log.Infof("Shutting down, draining in-flight calls (timeout: %v)", drainTimeout)
+	drainCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	// Stop Tyk and Kubernetes from sending new calls, then let the calls in progress finish
+	healthReporter.Shutdown()
+	drainGRPC(drainCtx, grpcServer)
+
+	stopWorkers()
+	deadLettered := handler.deliveryQueue.Drain(drainCtx)
+	wg.Wait()
+
+	// Dead letters are written on every change; retry a write that failed
+	current := s.Handler()
+	if err := current.deadLetters.Flush(); err != nil {
+		log.Errorf("Failed to flush dead letters: %v", err)
+	}
+
+	metrics := current.GetMetrics()
+	log.WithFields(logrus.Fields{
+		"idempotency_entries": metrics.CurrentEntries,
+		"gc_runs":             metrics.Runs,
+		"dead_lettered":       deadLettered,
+	}).Info("FAPI gRPC server stopped")
+	return nil
+}
+
+// drainGRPC stops the server once the calls in progress finish, cancelling
+// them when the context is done first. Hooks that do not return once cancelled
+// are left to end with the process.
+func drainGRPC(ctx context.Context, server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		log.Warn("Drain timeout reached, cancelling in-flight calls")
+		// Stop closes the connections first, then waits for the handlers too
+		go server.Stop()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// newLifecycleTestServer creates a plugin server with a Slow hook that blocks
+// until released, and a client connected to it over the returned listener
+func newLifecycleTestServer(t *testing.T, release <-chan struct{}) (*pluginServer, *bufconn.Listener, pb.DispatcherClient, <-chan struct{}) {
+	server, err := newPluginServer("", testEnv(nil))
+	if err != nil {
+		t.Fatalf("newPluginServer returned an error: %v", err)
+	}
+
+	started := make(chan struct{}, 1)
+	handler := server.Handler()
+	handler.hooks = newBuiltinHookRegistry()
+	handler.hooks.Register(HookDefinition{
+		Name:  "Slow",
+		Types: []pb.HookType{pb.HookType_Pre},
+		Run: func(d *DPoPHandler, ctx context.Context, object *pb.Object) (*pb.Object, error) {
+			started <- struct{}{}
+			<-release
+			return object, nil
+		},
+	})
+
+	listener := bufconn.Listen(1 << 20)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return server, listener, pb.NewDispatcherClient(conn), started
+}
+
+// TestRunDrainsInFlightCalls tests that shutting down lets the calls in progress finish
+func TestRunDrainsInFlightCalls(t *testing.T) {
+	release := make(chan struct{})
+	server, listener, client, started := newLifecycleTestServer(t, release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.run(ctx, listener) }()
+
+	dispatched := make(chan error, 1)
+	go func() {
+		_, err := client.Dispatch(context.Background(), newHookTestObject("Slow", pb.HookType_Pre))
+		dispatched <- err
+	}()
+	<-started
+	cancel()
+
+	select {
+	case <-stopped:
+		t.Fatal("Expected the server to wait for the call in progress")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-dispatched; err != nil {
+		t.Errorf("Expected the call in progress to succeed, got %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("run returned an error: %v", err)
+	}
+}
+
+// TestRunDrainTimeout tests that calls still running after the drain timeout are cancelled
+func TestRunDrainTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	server, listener, client, started := newLifecycleTestServer(t, release)
+	server.Handler().settings.Listener.DrainTimeout = Duration(50 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- server.run(ctx, listener) }()
+
+	dispatched := make(chan error, 1)
+	go func() {
+		_, err := client.Dispatch(context.Background(), newHookTestObject("Slow", pb.HookType_Pre))
+		dispatched <- err
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("run returned an error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the server to stop after the drain timeout")
+	}
+	if err := <-dispatched; err == nil {
+		t.Error("Expected the call in progress to be cancelled")
+	}
+}
+
+// TestServeHTTPShutdown tests that HTTP endpoints stop without an error when the context is cancelled
+func TestServeHTTPShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- serveHTTP(ctx, &http.Server{Addr: "127.0.0.1:0"}) }()
+	cancel()
+
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the HTTP server to stop")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+)
+
+// defaultSocketMode lets the plugin's user and group connect to its Unix socket
+const defaultSocketMode = "0660"
+
+// parseListenAddress splits a listener address into a network and an address.
+// Addresses use the form of Tyk's coprocess_grpc_server, tcp://host:port or
+// unix:///path/to/socket; a bare host:port listens on TCP.
+func parseListenAddress(address string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(address, "unix://"):
+		path := strings.TrimPrefix(address, "unix://")
+		if path == "" {
+			return "", "", errors.New("missing socket path")
+		}
+		return "unix", path, nil
+	case strings.HasPrefix(address, "tcp://"):
+		address = strings.TrimPrefix(address, "tcp://")
+	case strings.Contains(address, "://"):
+		return "", "", fmt.Errorf("unsupported scheme in %q, expected tcp:// or unix://", address)
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return "", "", err
+	}
+	return "tcp", address, nil
+}
+
+// parseSocketMode parses the octal permissions of the Unix socket, e.g. 0660
+func parseSocketMode(mode string) (os.FileMode, error) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if value > 0o777 {
+		return 0, fmt.Errorf("%s has bits beyond the permission bits", mode)
+	}
+	return os.FileMode(value), nil
+}
+
+// listen opens the gRPC listener. A socket file left behind by a plugin that
+// did not shut down cleanly is removed first, and the new socket gets the
+// given permissions; the socket is removed on close.
+func listen(address string, socketMode os.FileMode) (net.Listener, error) {
+	network, addr, err := parseListenAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if network == "unix" {
+		if info, err := os.Stat(addr); err == nil && info.Mode().Type() == fs.ModeSocket {
+			if err := os.Remove(addr); err != nil {
+				return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+			}
+		}
+	}
+
+	lis, err := net.Listen(network, addr)
+	if err != nil || network != "unix" {
+		return lis, err
+	}
+	if err := os.Chmod(addr, socketMode); err != nil {
+		lis.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return lis, nil
+}
+
+// grpcServerOptions returns the options of the gRPC server: TLS when
+// configured, keepalive and the message and stream limits. Zero values keep
+// the gRPC defaults.
+func grpcServerOptions(settings ListenerSettings, serverTLS *ServerTLS) []grpc.ServerOption {
+	var options []grpc.ServerOption
+	if serverTLS != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(serverTLS.TLSConfig())))
+	}
+
+	if settings.MaxRecvMessageSize > 0 {
+		options = append(options, grpc.MaxRecvMsgSize(settings.MaxRecvMessageSize))
+	}
+	if settings.MaxSendMessageSize > 0 {
+		options = append(options, grpc.MaxSendMsgSize(settings.MaxSendMessageSize))
+	}
+	if settings.MaxConcurrentStreams > 0 {
+		options = append(options, grpc.MaxConcurrentStreams(uint32(settings.MaxConcurrentStreams)))
+	}
+
+	ka := settings.Keepalive
+	if ka.Time > 0 || ka.Timeout > 0 {
+		options = append(options, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    time.Duration(ka.Time),
+			Timeout: time.Duration(ka.Timeout),
+		}))
+	}
+	if ka.MinTime > 0 || ka.PermitWithoutStream {
+		options = append(options, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             time.Duration(ka.MinTime),
+			PermitWithoutStream: ka.PermitWithoutStream,
+		}))
+	}
+	return options
+}
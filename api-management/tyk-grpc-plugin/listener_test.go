@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// TestParseListenAddress tests the TCP and Unix socket address forms
+func TestParseListenAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		network string
+		addr    string
+		valid   bool
+	}{
+		{":5555", "tcp", ":5555", true},
+		{"tcp://127.0.0.1:5555", "tcp", "127.0.0.1:5555", true},
+		{"unix:///var/run/tyk/plugin.sock", "unix", "/var/run/tyk/plugin.sock", true},
+		{"unix://", "", "", false},
+		{"http://localhost:5555", "", "", false},
+		{"5555", "", "", false},
+	}
+	for _, tt := range tests {
+		network, addr, err := parseListenAddress(tt.address)
+		if tt.valid && (err != nil || network != tt.network || addr != tt.addr) {
+			t.Errorf("parseListenAddress(%q) = %q, %q, %v; expected %q, %q", tt.address, network, addr, err, tt.network, tt.addr)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Expected parseListenAddress(%q) to fail", tt.address)
+		}
+	}
+}
+
+// TestParseSocketMode tests the octal socket permissions
+func TestParseSocketMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected os.FileMode
+		valid    bool
+	}{
+		{"0660", 0o660, true},
+		{"600", 0o600, true},
+		{"0777", 0o777, true},
+		{"01777", 0, false},
+		{"0680", 0, false},
+		{"rw-rw----", 0, false},
+	}
+	for _, tt := range tests {
+		mode, err := parseSocketMode(tt.mode)
+		if tt.valid && (err != nil || mode != tt.expected) {
+			t.Errorf("parseSocketMode(%q) = %#o, %v; expected %#o", tt.mode, mode, err, tt.expected)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("Expected parseSocketMode(%q) to fail", tt.mode)
+		}
+	}
+}
+
+// dialUnix connects a gRPC client to a Unix socket
+func dialUnix(t *testing.T, path string) pb.DispatcherClient {
+	t.Helper()
+	conn, err := grpc.NewClient("unix://"+path, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewDispatcherClient(conn)
+}
+
+// TestListenUnixSocket tests that the plugin serves on a Unix socket, replacing a stale one
+func TestListenUnixSocket(t *testing.T) {
+	// Socket paths are limited to about 100 bytes, too short for some test directories
+	dir, err := os.MkdirTemp("", "plugin")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "plugin.sock")
+
+	// Leave a socket file behind, as a plugin killed without shutting down would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen("unix://"+path, 0o660)
+	if err != nil {
+		t.Fatalf("listen returned an error: %v", err)
+	}
+	server := newGRPCServer()
+	pb.RegisterDispatcherServer(server, &DPoPHandler{})
+	go server.Serve(listener)
+
+	// The socket gets the configured permissions whatever the umask
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Failed to stat the socket: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o660 {
+		t.Errorf("Expected socket permissions 0660, got %#o", mode)
+	}
+
+	if _, err := dialUnix(t, path).Dispatch(context.Background(), newHookTestObject("Missing", pb.HookType_Pre)); err != nil {
+		t.Errorf("Dispatch over the Unix socket returned an error: %v", err)
+	}
+
+	server.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed on close, got %v", err)
+	}
+}
+
+// TestGRPCServerMessageLimit tests that requests above the maximum message size are refused
+func TestGRPCServerMessageLimit(t *testing.T) {
+	dir, err := os.MkdirTemp("", "plugin")
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "plugin.sock")
+
+	listener, err := listen("unix://"+path, 0o600)
+	if err != nil {
+		t.Fatalf("listen returned an error: %v", err)
+	}
+	server := newGRPCServer(grpcServerOptions(ListenerSettings{MaxRecvMessageSize: 1024, MaxConcurrentStreams: 4}, nil)...)
+	pb.RegisterDispatcherServer(server, &DPoPHandler{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	client := dialUnix(t, path)
+
+	object := newHookTestObject("Missing", pb.HookType_Pre)
+	if _, err := client.Dispatch(context.Background(), object); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+
+	object.Request.Body = strings.Repeat("x", 2048)
+	if _, err := client.Dispatch(context.Background(), object); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected a large request to be refused with ResourceExhausted, got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// redactedValue replaces masked header values and JSON fields in logs
+const redactedValue = "[REDACTED]"
+
+// loggerKey is the context key of the request-scoped logger
+type loggerKey struct{}
+
+// withLogger returns a context carrying the logger
+func withLogger(ctx context.Context, entry *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, entry)
+}
+
+// logger returns the request-scoped logger of the context, or the plugin
+// logger outside of requests
+func logger(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry
+	}
+	return logrus.NewEntry(log)
+}
+
+// requestFields identifies a hook call in every line it logs
+func requestFields(ctx context.Context, hook string, object *pb.Object) logrus.Fields {
+	fields := logrus.Fields{"hook": hook, "hook_type": object.HookType.String()}
+	if apiID := object.Spec["APIID"]; apiID != "" {
+		fields["api_id"] = apiID
+	}
+	if id := interactionID(object); id != "" {
+		fields["interaction_id"] = id
+	}
+	if object.Session != nil && object.Session.OauthClientId != "" {
+		fields["client_id"] = object.Session.OauthClientId
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		fields["trace_id"] = span.TraceID().String()
+	}
+	return fields
+}
+
+// LogRedactionConfig lists the values masked when requests and responses are logged
+type LogRedactionConfig struct {
+	// Headers whose values are masked, case-insensitive
+	Headers []string
+	// Dotted paths of the JSON body fields whose values are masked; "*" matches
+	// any key or array element
+	JSONPaths []string
+}
+
+// Default log redaction configuration values: credentials and the account
+// details of Open Banking payment and consent requests
+var defaultLogRedactionConfig = LogRedactionConfig{
+	Headers: []string{"Authorization", "DPoP", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Api-Key"},
+	JSONPaths: []string{
+		"Data.Initiation.DebtorAccount",
+		"Data.Initiation.CreditorAccount",
+		"Data.DebtorAccount",
+		"Data.CreditorAccount",
+		"Risk.DeliveryAddress",
+	},
+}
+
+// Redactor masks sensitive headers and JSON fields before they are logged
+type Redactor struct {
+	headers map[string]bool
+	paths   [][]string
+}
+
+// defaultRedactor masks the default headers and fields for handlers built without a configuration
+var defaultRedactor = NewRedactor(defaultLogRedactionConfig)
+
+// NewRedactor creates a redactor for the configured headers and JSON paths
+func NewRedactor(config LogRedactionConfig) *Redactor {
+	r := &Redactor{headers: make(map[string]bool, len(config.Headers))}
+	for _, header := range config.Headers {
+		r.headers[strings.ToLower(header)] = true
+	}
+	for _, path := range config.JSONPaths {
+		r.paths = append(r.paths, strings.Split(path, "."))
+	}
+	return r
+}
+
+// logRedactor returns the handler's redactor, or the default one
+func (d *DPoPHandler) logRedactor() *Redactor {
+	if d.redactor != nil {
+		return d.redactor
+	}
+	return defaultRedactor
+}
+
+// Headers returns a copy of the headers with the sensitive values masked
+func (r *Redactor) Headers(headers map[string]string) map[string]string {
+	masked := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if r.headers[strings.ToLower(name)] {
+			value = redactedValue
+		}
+		masked[name] = value
+	}
+	return masked
+}
+
+// SensitiveHeaders returns a copy of only the sensitive headers
+func (r *Redactor) SensitiveHeaders(headers map[string]string) map[string]string {
+	sensitive := make(map[string]string)
+	for name, value := range headers {
+		if r.headers[strings.ToLower(name)] {
+			sensitive[name] = value
+		}
+	}
+	return sensitive
+}
+
+// StripHeaders returns a copy of the headers without the sensitive ones
+func (r *Redactor) StripHeaders(headers map[string]string) map[string]string {
+	stripped := make(map[string]string, len(headers))
+	for name, value := range headers {
+		if !r.headers[strings.ToLower(name)] {
+			stripped[name] = value
+		}
+	}
+	return stripped
+}
+
+// Body returns the JSON body with the sensitive fields masked. Bodies that are
+// not JSON may hold anything, so only their size is logged.
+func (r *Redactor) Body(body string) string {
+	if body == "" {
+		return ""
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(body))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil || decoder.More() {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+	}
+	for _, path := range r.paths {
+		document = redactPath(document, path)
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(document); err != nil {
+		return fmt.Sprintf("[%d bytes]", len(body))
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// redactPath masks the value at the path within a decoded JSON value
+func redactPath(value interface{}, path []string) interface{} {
+	if len(path) == 0 {
+		return redactedValue
+	}
+
+	switch node := value.(type) {
+	case map[string]interface{}:
+		for key, child := range node {
+			if path[0] == "*" || key == path[0] {
+				node[key] = redactPath(child, path[1:])
+			}
+		}
+	case []interface{}:
+		for i, child := range node {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				node[i] = redactPath(child, path[1:])
+			}
+		}
+	}
+	return value
+}
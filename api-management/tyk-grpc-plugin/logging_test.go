@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// captureLogs writes the plugin log as JSON at the given level into the
+// returned buffer for the duration of the test
+func captureLogs(t *testing.T, level logrus.Level) *bytes.Buffer {
+	var buf bytes.Buffer
+	out, formatter, previous := log.Out, log.Formatter, log.GetLevel()
+	log.SetOutput(&buf)
+	log.SetFormatter(&logrus.JSONFormatter{})
+	log.SetLevel(level)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFormatter(formatter)
+		log.SetLevel(previous)
+	})
+	return &buf
+}
+
+// logLines decodes the captured JSON log lines
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("Expected a JSON log line, got %q", line)
+		}
+		lines = append(lines, fields)
+	}
+	return lines
+}
+
+// TestRedactorHeaders tests that sensitive headers are masked case-insensitively
+func TestRedactorHeaders(t *testing.T) {
+	headers := map[string]string{"authorization": "DPoP eyJhbGciOi", "Dpop": "eyJ0eXAiOi", "Content-Type": "application/json"}
+	masked := defaultRedactor.Headers(headers)
+
+	if masked["authorization"] != redactedValue || masked["Dpop"] != redactedValue {
+		t.Errorf("Expected the credentials to be masked, got %v", masked)
+	}
+	if masked["Content-Type"] != "application/json" {
+		t.Errorf("Expected other headers to be kept, got %v", masked)
+	}
+	if headers["authorization"] != "DPoP eyJhbGciOi" {
+		t.Error("Expected the request headers to be left unchanged")
+	}
+}
+
+// TestRedactorBody tests that configured JSON paths are masked and other bodies only logged by size
+func TestRedactorBody(t *testing.T) {
+	redactor := NewRedactor(LogRedactionConfig{JSONPaths: []string{"Data.Initiation.DebtorAccount", "Data.Accounts.*.Identification"}})
+
+	tests := []struct {
+		name     string
+		body     string
+		expected string
+	}{
+		{
+			"nested field",
+			`{"Data":{"Initiation":{"InstructedAmount":{"Amount":10.50},"DebtorAccount":{"Identification":"08080021325698"}}}}`,
+			`{"Data":{"Initiation":{"DebtorAccount":"[REDACTED]","InstructedAmount":{"Amount":10.50}}}}`,
+		},
+		{
+			"array elements",
+			`{"Data":{"Accounts":[{"Identification":"1","Name":"a"},{"Identification":"2","Name":"b"}]}}`,
+			`{"Data":{"Accounts":[{"Identification":"[REDACTED]","Name":"a"},{"Identification":"[REDACTED]","Name":"b"}]}}`,
+		},
+		{"missing path", `{"Risk":{}}`, `{"Risk":{}}`},
+		{"not JSON", "iban=GB29NWBK60161331926819", "[27 bytes, not JSON]"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if masked := redactor.Body(tt.body); masked != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, masked)
+		}
+	}
+}
+
+// TestDispatchLogFields tests that every line logged by a hook identifies the
+// request and that credentials are never logged
+func TestDispatchLogFields(t *testing.T) {
+	buf := captureLogs(t, logrus.DebugLevel)
+	handler := &DPoPHandler{apiConfigs: NewAPIConfigCache()}
+
+	object := newAPITestObject("payments", "")
+	object.HookName, object.HookType = "DPoPCheck", pb.HookType_Pre
+	object.Request.Headers["Authorization"] = "DPoP secret-access-token"
+	object.Request.Headers["DPoP"] = "secret-proof"
+	object.Request.Headers["X-Fapi-Interaction-Id"] = "93bac548-d2de-4546-b106-880a5018460d"
+	if _, err := handler.Dispatch(context.Background(), object); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+
+	if strings.Contains(buf.String(), "secret-") {
+		t.Errorf("Expected the credentials to be masked, got %s", buf.String())
+	}
+	for _, line := range logLines(t, buf) {
+		for key, expected := range map[string]string{
+			"hook":           "DPoPCheck",
+			"api_id":         "payments",
+			"client_id":      "client-a",
+			"interaction_id": "93bac548-d2de-4546-b106-880a5018460d",
+		} {
+			if line[key] != expected {
+				t.Errorf("Expected %s %q on %q, got %v", key, expected, line["msg"], line[key])
+			}
+		}
+	}
+}
+
+// TestIdempotencyCheckLogsMaskedBody tests that request bodies are only logged at debug level, masked
+func TestIdempotencyCheckLogsMaskedBody(t *testing.T) {
+	handler := &DPoPHandler{apiConfigs: NewAPIConfigCache(), config: defaultConfig, metrics: &IdempotencyMetrics{}}
+	object := newAPITestObject("payments", "")
+	object.Request.Body = `{"Data":{"Initiation":{"DebtorAccount":{"Identification":"08080021325698"}}}}`
+	object.Request.Headers["Authorization"] = "Bearer secret-access-token"
+
+	buf := captureLogs(t, logrus.InfoLevel)
+	if _, err := handler.IdempotencyCheck(context.Background(), object); err != nil {
+		t.Fatalf("IdempotencyCheck returned an error: %v", err)
+	}
+	if strings.Contains(buf.String(), "Received request") {
+		t.Errorf("Expected no request dump at info level, got %s", buf.String())
+	}
+
+	buf = captureLogs(t, logrus.DebugLevel)
+	if _, err := handler.IdempotencyCheck(context.Background(), object); err != nil {
+		t.Fatalf("IdempotencyCheck returned an error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "Received request") {
+		t.Errorf("Expected a request dump at debug level, got %s", buf.String())
+	}
+	if strings.Contains(buf.String(), "08080021325698") || strings.Contains(buf.String(), "secret-access-token") {
+		t.Errorf("Expected the account and token to be masked, got %s", buf.String())
+	}
+}
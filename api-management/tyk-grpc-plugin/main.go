@@ -2,28 +2,28 @@ package main
 
 import (
 	"context"
-	"crypto/ecdsa"
-	"crypto/rand"
+	"crypto"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
+	"flag"
 	"fmt"
-	"io"
-	"net"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
 	"github.com/golang-jwt/jwt"
 	"github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -47,21 +47,44 @@ var defaultConfig = IdempotencyConfig{
 
 // IdempotencyMetrics tracks metrics related to the idempotency store
 type IdempotencyMetrics struct {
-	// Total number of entries removed by the garbage collector
-	EntriesRemoved int
+	// Total number of expired entries removed
+	EntriesRemoved int `json:"entries_removed"`
+	// Number of garbage collector runs
+	Runs int `json:"gc_runs"`
 	// Last time the garbage collector ran
-	LastRun time.Time
+	LastRun time.Time `json:"last_run"`
 	// Number of entries in the store
-	CurrentEntries int
+	CurrentEntries int `json:"current_entries"`
 	// Mutex to protect metrics
 	mu sync.Mutex
 }
 
 // IdempotencyEntry represents an entry in the idempotency store
 type IdempotencyEntry struct {
-	RequestHash string
-	Response    *pb.Object
-	CreatedAt   time.Time
+	// Client and idempotency key the entry was stored under
+	ClientID       string
+	IdempotencyKey string
+	RequestHash    string
+	// Status code of the cached upstream response
+	StatusCode int32
+	Response   *pb.Object
+	CreatedAt  time.Time
+	// When the entry stops being replayed, from the API's idempotency TTL
+	// (zero: CreatedAt plus the plugin-wide expiration time)
+	ExpiresAt time.Time
+}
+
+// expiresAt returns when the entry expires, given the plugin-wide expiration time
+func (e IdempotencyEntry) expiresAt(expirationTime time.Duration) time.Time {
+	if !e.ExpiresAt.IsZero() {
+		return e.ExpiresAt
+	}
+	return e.CreatedAt.Add(expirationTime)
+}
+
+// idempotencyCacheKey builds the store key for a client's idempotency key
+func idempotencyCacheKey(clientID, idempotencyKey string) string {
+	return fmt.Sprintf("idempotency:%s:%s", clientID, idempotencyKey)
 }
 
 func init() {
@@ -81,32 +104,95 @@ type JWSConfig struct {
 	KeyID string
 	// Issuer to use in the JWS header
 	Issuer string
+	// Algorithm to sign with (default: derived from the key type and curve)
+	Algorithm string
+	// Header profile used when the API does not choose one (default: rfc7797)
+	Profile JWSProfile
+	// Trust anchor to use in the OB UK header (default: openbanking.org.uk)
+	TrustAnchor string
 }
 
 // DPoPHandler implements the gRPC server for Tyk
 type DPoPHandler struct {
 	pb.UnimplementedDispatcherServer
+	// Hooks Dispatch can run (default: the built-in hooks)
+	hooks *HookRegistry
+	// Configuration the handler was built from (nil for handlers built directly)
+	settings *PluginConfig
+	// Parsed per-API settings from the config data (parsed per request when nil)
+	apiConfigs *APIConfigCache
 	metrics    *IdempotencyMetrics
 	config     IdempotencyConfig
 	jwsConfig  JWSConfig
-	privateKey *ecdsa.PrivateKey
+	privateKey crypto.Signer
+	// Signing keys with rotation support; takes precedence over privateKey
+	keyRing *KeyRing
+	// Configuration for publishing the public signing keys
+	jwksConfig JWKSConfig
+	// Configuration for signing upstream responses
+	jwsResponseConfig JWSResponseConfig
+	// Configuration and key resolver for verifying TPP signatures
+	jwsVerifyConfig JWSVerifyConfig
+	keyResolver     KeyResolver
+	// Prometheus metrics of the hooks, stores and forwarded requests (disabled when nil)
+	pluginMetrics *PluginMetrics
+	// Configuration for generating Security Event Tokens
+	setConfig SETConfig
+	// Configuration for encrypting outbound notifications
+	jweConfig JWEConfig
+	// Restrictions on the URLs requests are forwarded to
+	targetPolicy TargetPolicyConfig
+	// Transport of forwarded requests, reused until the outbound TLS configuration changes
+	targetTransport targetTransport
+	// Headers forwarded to and returned from targets
+	headerPolicy HeaderPolicyConfig
+	// Client certificate, CA bundle and pins for forwarded requests
+	outboundTLS *OutboundTLS
+	// Certificates of the gRPC listener, when TLS is configured
+	serverTLS *ServerTLS
+	// Masks headers and body fields in logged requests (default: defaultRedactor)
+	redactor *Redactor
+	// Background delivery of forwarded requests (synchronous when nil)
+	deliveryQueue *DeliveryQueue
+	// Circuit breakers of the target hosts (disabled when nil)
+	breakers *CircuitBreakers
+	// Retries of forwarded requests and the requests that exhausted them
+	retryConfig RetryConfig
+	deadLetters *DeadLetterStore
+	// Waits between delivery attempts (default: time.Sleep)
+	sleepFunc func(time.Duration)
 }
 
-// Dispatch handles the gRPC request from Tyk
+// Dispatch handles the gRPC request from Tyk, running the hook registered under the hook name
 func (d *DPoPHandler) Dispatch(ctx context.Context, object *pb.Object) (*pb.Object, error) {
-	switch object.HookName {
-	case "DPoPCheck":
-		return d.DPoPCheck(object)
-	case "IdempotencyCheck":
-		return d.IdempotencyCheck(object)
-	case "IdempotencyResponse":
-		return d.IdempotencyResponse(object)
-	case "JWSSign":
-		return d.JWSSign(object)
-	default:
-		log.Warnf("Unknown hook: %s", object.HookName)
+	hook, ok := d.hookRegistry().Lookup(object.HookName)
+	if !ok {
+		log.WithFields(requestFields(ctx, object.HookName, object)).Warnf("Unknown hook: %s", object.HookName)
 		return object, nil
 	}
+
+	if !hook.supports(object.HookType) {
+		// A hook running at the wrong stage would not protect the API, so fail closed
+		log.WithFields(requestFields(ctx, hook.Name, object)).Errorf("Hook %s cannot run as a %s hook", hook.Name, object.HookType)
+		if object.HookType == pb.HookType_Response && object.Response != nil {
+			return d.respondWithResponseError(object, "Plugin misconfigured", http.StatusInternalServerError)
+		}
+		return d.respondWithError(object, "Plugin misconfigured", http.StatusInternalServerError)
+	}
+
+	ctx, span := startHookSpan(ctx, hook, object)
+	// Every line the hook logs identifies the request
+	ctx = withLogger(ctx, log.WithFields(requestFields(ctx, hook.Name, object)))
+	start := time.Now()
+	upstream := object.Response
+	result, err := hook.Run(d, ctx, object)
+	statusCode := 0
+	if result != nil {
+		statusCode = answeredStatus(result, upstream)
+	}
+	d.pluginMetrics.observeHook(hook.Name, statusCode, err, time.Since(start))
+	endHookSpan(span, statusCode, err)
+	return result, err
 }
 
 // runGarbageCollector scans the idempotency store and removes expired entries
@@ -120,7 +206,7 @@ func (d *DPoPHandler) runGarbageCollector() {
 		entry := value.(IdempotencyEntry)
 
 		// Check if the entry has expired
-		if now.Sub(entry.CreatedAt) > d.config.ExpirationTime {
+		if now.After(entry.expiresAt(d.config.ExpirationTime)) {
 			keysToDelete = append(keysToDelete, key)
 			removedCount++
 		}
@@ -130,12 +216,13 @@ func (d *DPoPHandler) runGarbageCollector() {
 	// Delete expired entries
 	for _, key := range keysToDelete {
 		idempotencyStore.Delete(key)
-		log.Infof("GC: Removed expired idempotency entry: %v", key)
+		log.Debugf("GC: Removed expired idempotency entry: %v", key)
 	}
 
 	// Update metrics
 	d.metrics.mu.Lock()
 	d.metrics.EntriesRemoved += removedCount
+	d.metrics.Runs++
 	d.metrics.LastRun = now
 	d.metrics.mu.Unlock()
 
@@ -158,12 +245,14 @@ func (d *DPoPHandler) GetMetrics() IdempotencyMetrics {
 
 	// Create a copy of the metrics with mutex protection
 	d.metrics.mu.Lock()
-	metrics := *d.metrics
-	d.metrics.mu.Unlock()
+	defer d.metrics.mu.Unlock()
 
-	metrics.CurrentEntries = currentEntries
-
-	return metrics
+	return IdempotencyMetrics{
+		EntriesRemoved: d.metrics.EntriesRemoved,
+		Runs:           d.metrics.Runs,
+		LastRun:        d.metrics.LastRun,
+		CurrentEntries: currentEntries,
+	}
 }
 
 // DispatchEvent handles events from Tyk
@@ -173,7 +262,7 @@ func (d *DPoPHandler) DispatchEvent(ctx context.Context, event *pb.Event) (*pb.E
 }
 
 // loadPrivateKey loads the private key from file or environment variable
-func (d *DPoPHandler) loadPrivateKey() (*ecdsa.PrivateKey, error) {
+func (d *DPoPHandler) loadPrivateKey() (crypto.Signer, error) {
 	var keyData []byte
 	var err error
 
@@ -190,30 +279,37 @@ func (d *DPoPHandler) loadPrivateKey() (*ecdsa.PrivateKey, error) {
 		return nil, errors.New("no private key provided")
 	}
 
-	// Parse PEM encoded private key
-	block, _ := pem.Decode(keyData)
-	if block == nil {
-		return nil, errors.New("failed to parse PEM block containing private key")
-	}
+	return parsePrivateKeyPEM(keyData)
+}
 
-	// Parse the key
-	privateKey, err := x509.ParseECPrivateKey(block.Bytes)
+// createDetachedJWS creates a detached JWS signature for the given payload
+// using the plugin-wide header profile
+func (d *DPoPHandler) createDetachedJWS(payload []byte) (string, error) {
+	return d.createDetachedJWSWithProfile(payload, d.jwsConfig.Profile)
+}
+
+// createDetachedJWSWithProfile creates a detached JWS signature for the given payload
+// using the default signing key
+func (d *DPoPHandler) createDetachedJWSWithProfile(payload []byte, profile JWSProfile) (string, error) {
+	key, err := d.defaultSigningKey()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse private key: %w", err)
+		return "", err
 	}
-
-	return privateKey, nil
+	return d.signDetachedJWS(context.Background(), payload, key, profile)
 }
 
-// createDetachedJWS creates a detached JWS signature for the given payload
-func (d *DPoPHandler) createDetachedJWS(payload []byte) (string, error) {
+// signDetachedJWS creates a detached JWS signature for the given payload,
+// giving up when ctx is done if the key is held by a signing service
+func (d *DPoPHandler) signDetachedJWS(ctx context.Context, payload []byte, key *SigningKey, profile JWSProfile) (string, error) {
+	// Refuse algorithms that are unsafe under the profile
+	if err := checkProfileAlgorithm(profile, key.Algorithm); err != nil {
+		return "", err
+	}
+
 	// Create the JWS header
-	header := map[string]interface{}{
-		"alg":  "ES256",
-		"typ":  "JOSE",
-		"kid":  d.jwsConfig.KeyID,
-		"crit": []string{"b64"},
-		"b64":  false,
+	header, err := d.buildJWSHeader(profile, key.Algorithm, key.KeyID, time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to build header: %w", err)
 	}
 
 	// Encode the header
@@ -226,50 +322,72 @@ func (d *DPoPHandler) createDetachedJWS(payload []byte) (string, error) {
 
 	// Create the signing input (header + . + payload)
 	// For detached JWS, we don't base64 encode the payload
-	hasher := sha256.New()
-	hasher.Write([]byte(headerEncoded + "."))
-	hasher.Write(payload)
-	hash := hasher.Sum(nil)
+	signingInput := append([]byte(headerEncoded+"."), payload...)
 
-	// Sign the hash
-	r, s, err := ecdsa.Sign(rand.Reader, d.privateKey, hash)
+	// Sign the signing input
+	signature, err := d.sign(ctx, key, signingInput)
 	if err != nil {
 		return "", fmt.Errorf("failed to sign payload: %w", err)
 	}
 
-	// Encode the signature
-	curveBits := d.privateKey.Curve.Params().BitSize
-	keyBytes := curveBits / 8
-	if curveBits%8 > 0 {
-		keyBytes++
-	}
-
-	// Serialize r and s into signature
-	signature := make([]byte, keyBytes*2)
-	r.FillBytes(signature[:keyBytes])
-	s.FillBytes(signature[keyBytes:])
-
 	signatureEncoded := base64.RawURLEncoding.EncodeToString(signature)
 
 	// Create the detached JWS (header..signature)
 	return headerEncoded + ".." + signatureEncoded, nil
 }
 
+// signCompactJWS creates a compact JWS with an attached, base64url-encoded payload
+func (d *DPoPHandler) signCompactJWS(ctx context.Context, header map[string]interface{}, payload []byte, key *SigningKey) (string, error) {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal header: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := d.sign(ctx, key, []byte(signingInput))
+	if err != nil {
+		return "", fmt.Errorf("failed to sign payload: %w", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// sign signs the JWS signing input with the key, recording the signer latency and outcome
+func (d *DPoPHandler) sign(ctx context.Context, key *SigningKey, signingInput []byte) ([]byte, error) {
+	start := time.Now()
+	signature, err := signJWS(ctx, key.PrivateKey, key.Algorithm, signingInput)
+	d.pluginMetrics.observeSign(time.Since(start), err)
+	return signature, err
+}
+
 // JWSSign implements the JWS signing hook
-func (d *DPoPHandler) JWSSign(object *pb.Object) (*pb.Object, error) {
-	log.Info("Running JWSSign hook")
+func (d *DPoPHandler) JWSSign(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running JWSSign hook")
 
-	// Check if we have a private key
-	if d.privateKey == nil {
-		log.Error("Private key not loaded")
+	// Select the signing key chosen by the API
+	key, err := d.apiSigningKey(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("No JWS signing key available: %v", err)
 		return d.respondWithError(object, "JWS signing not configured", http.StatusInternalServerError)
 	}
 
+	// Use the header profile chosen by the API
+	profile, err := d.apiJWSProfile(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("Invalid JWS profile configuration: %v", err)
+		return d.respondWithError(object, "JWS signing misconfigured", http.StatusInternalServerError)
+	}
+
+	// Sign and encrypt the body for TPPs that receive their notifications encrypted
+	if recipient, ok := d.jweRecipient(object); ok {
+		return d.signAndEncrypt(ctx, object, key, profile, recipient)
+	}
+
 	// Create JWS signature for the request body
-	signature, err := d.createDetachedJWS([]byte(object.Request.Body))
+	signature, err := d.signDetachedJWS(ctx, []byte(object.Request.Body), key, profile)
 	if err != nil {
-		log.Errorf("Failed to create JWS signature: %v", err)
-		return d.respondWithError(object, "Failed to create JWS signature", http.StatusInternalServerError)
+		logger(ctx).Errorf("Failed to create JWS signature: %v", err)
+		return d.respondWithError(object, "Failed to create JWS signature", signErrorStatus(err))
 	}
 
 	// Initialize SetHeaders map if nil
@@ -280,6 +398,14 @@ func (d *DPoPHandler) JWSSign(object *pb.Object) (*pb.Object, error) {
 	// Add the JWS signature header
 	object.Request.SetHeaders["x-jws-signature"] = signature
 
+	return d.forwardToRewriteTarget(ctx, object, "")
+}
+
+// forwardToRewriteTarget sends the request to the URL in the x-rewrite-target
+// header and returns the target's response, or queues it under the event ID
+// when delivery is asynchronous. Requests without the header continue to the
+// upstream unchanged.
+func (d *DPoPHandler) forwardToRewriteTarget(ctx context.Context, object *pb.Object, eventID string) (*pb.Object, error) {
 	// Get the rewrite target URL from the header
 	rewriteTarget := ""
 	for k, v := range object.Request.Headers {
@@ -291,7 +417,20 @@ func (d *DPoPHandler) JWSSign(object *pb.Object) (*pb.Object, error) {
 
 	// If rewrite target URL is present, make the API call and return the response
 	if rewriteTarget != "" {
-		log.Infof("Rewrite target URL found: %s. Making API call...", rewriteTarget)
+		// Refuse targets outside the target policy before sending anything
+		target, err := url.Parse(rewriteTarget)
+		if err != nil {
+			logger(ctx).Warn("Invalid rewrite target URL")
+			logger(ctx).Debugf("Invalid rewrite target URL: %v", err)
+			return d.reject(object, reasonInvalidTarget, "Invalid rewrite target", http.StatusBadRequest)
+		}
+		// Callback URLs can carry tokens in the path or query, so only the host is logged by default
+		logger(ctx).Infof("Rewrite target found for %s. Making API call...", target.Host)
+		logger(ctx).Debugf("Rewrite target URL: %s", rewriteTarget)
+		if err := d.targetPolicy.checkTarget(target, getHeader(object.Request.Headers, subscriptionIDHeader)); err != nil {
+			logger(ctx).Warnf("Refusing rewrite target: %v", err)
+			return d.reject(object, reasonTargetNotAllowed, "Rewrite target not allowed", http.StatusForbidden)
+		}
 
 		// Delete the x-rewrite-target header
 		if object.Request.DeleteHeaders == nil {
@@ -299,98 +438,84 @@ func (d *DPoPHandler) JWSSign(object *pb.Object) (*pb.Object, error) {
 		}
 		object.Request.DeleteHeaders = append(object.Request.DeleteHeaders, "x-rewrite-target")
 
+		// Queue the request and answer immediately when delivery is asynchronous
+		if d.deliveryQueue != nil {
+			return d.enqueueTargetRequest(ctx, rewriteTarget, object, eventID)
+		}
+
 		// Make the API call to the target URL
-		response, err := d.makeTargetRequest(rewriteTarget, object)
+		response, err := d.makeTargetRequest(ctx, rewriteTarget, object)
+		if errors.Is(err, errTargetNotAllowed) {
+			logger(ctx).Warnf("Refusing rewrite target: %v", err)
+			return d.reject(object, reasonTargetNotAllowed, "Rewrite target not allowed", http.StatusForbidden)
+		}
+		if errors.Is(err, errCircuitOpen) {
+			logger(ctx).Warnf("Failing fast: %v", err)
+			response, _ := d.reject(object, reasonTargetUnavailable, "Rewrite target unavailable", http.StatusServiceUnavailable)
+			if retryAfter := d.breakers.retryAfter(target.Host); retryAfter > 0 {
+				response.Request.ReturnOverrides.Headers["Retry-After"] = strconv.Itoa(int(math.Ceil(retryAfter.Seconds())))
+			}
+			return response, nil
+		}
 		if err != nil {
-			log.Errorf("Failed to make target request: %v", err)
+			logger(ctx).Errorf("Failed to make target request: %v", err)
 			return d.respondWithError(object, fmt.Sprintf("Failed to make target request: %v", err), http.StatusInternalServerError)
 		}
 
-		log.Info("Target request successful. Returning response.")
+		logger(ctx).Info("Target request successful. Returning response.")
 		return response, nil
 	}
 
-	// If no rewrite target URL, just sign the request and continue
-	log.Info("No rewrite target URL found. Continuing with signed request.")
+	// If no rewrite target URL, continue with the signed request
+	logger(ctx).Info("No rewrite target URL found. Continuing with signed request.")
 	return object, nil
 }
 
-// makeTargetRequest makes an HTTP request to the target URL and returns the response
-func (d *DPoPHandler) makeTargetRequest(targetURL string, object *pb.Object) (*pb.Object, error) {
-	// Create a new HTTP client
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
-
-	// Create a new HTTP request
-	req, err := http.NewRequest(object.Request.Method, targetURL, strings.NewReader(object.Request.Body))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
-	// Copy headers from the original request
-	for k, v := range object.Request.Headers {
-		// Skip the x-rewrite-target header
-		if strings.ToLower(k) == "x-rewrite-target" {
-			continue
-		}
-		req.Header.Set(k, v)
-	}
-
-	// Add the JWS signature header
-	req.Header.Set("x-jws-signature", object.Request.SetHeaders["x-jws-signature"])
-
-	// Make the request
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
+// makeTargetRequest delivers the request to the target URL, retrying temporary
+// failures, and returns the response. Requests still failing after the last
+// attempt are dead-lettered for replay.
+func (d *DPoPHandler) makeTargetRequest(ctx context.Context, targetURL string, object *pb.Object) (*pb.Object, error) {
+	ctx, span := tracer().Start(ctx, "makeTargetRequest", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrServerAddress.String(targetHost(targetURL))))
+	defer span.End()
+
+	request := newOutboundRequest(targetURL, object, &d.headerPolicy)
+	injectTraceContext(ctx, request.Headers)
+	resp, attempts, deadLetterID, err := d.deliverOrDeadLetter(ctx, request)
+	span.SetAttributes(attrAttempts.Int(len(attempts)))
+	if deadLetterID != "" {
+		span.SetAttributes(attrDeadLetterID.String(deadLetterID))
 	}
-	defer resp.Body.Close()
-
-	// Read the response body
-	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-	}
-
-	// Create a return override with the response
-	if object.Request.ReturnOverrides == nil {
-		object.Request.ReturnOverrides = &pb.ReturnOverrides{}
-	}
-
-	// Set the response code and body
-	object.Request.ReturnOverrides.ResponseCode = int32(resp.StatusCode)
-	object.Request.ReturnOverrides.ResponseBody = string(respBody)
-
-	// Copy response headers
-	if object.Request.ReturnOverrides.Headers == nil {
-		object.Request.ReturnOverrides.Headers = make(map[string]string)
-	}
-	for k, v := range resp.Header {
-		if len(v) > 0 {
-			object.Request.ReturnOverrides.Headers[k] = v[0]
-		}
+		failSpan(span, err)
+		return nil, err
 	}
+	span.SetAttributes(attrStatusCode.Int(resp.StatusCode))
 
+	setTargetResponse(ctx, object, resp.StatusCode, d.headerPolicy.responseHeaders(resp.Header), resp.Body)
 	return object, nil
 }
 
 // DPoPCheck implements the pre-auth hook
 // It validates DPoP proof and claims
-func (d *DPoPHandler) DPoPCheck(object *pb.Object) (*pb.Object, error) {
-	log.Info("Running DPoPCheck hook")
+func (d *DPoPHandler) DPoPCheck(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running DPoPCheck hook")
 
-	// Print all headers for debugging
-	log.Info("Received headers:")
-	for k, v := range object.Request.Headers {
-		log.Infof("  %s: %s", k, v)
+	// Credentials are masked even at debug level
+	logger(ctx).WithField("headers", d.logRedactor().Headers(object.Request.Headers)).Debug("Received headers")
+
+	// Use the DPoP and scope policy chosen by the API
+	apiConfig, err := d.apiConfig(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("Invalid API config data: %v", err)
+		return d.respondWithError(object, "Plugin misconfigured", http.StatusInternalServerError)
 	}
 
 	// Get Authorization header
 	authHeader := object.Request.Headers["Authorization"]
 	if authHeader == "" {
-		log.Error("Authorization header is missing")
-		return d.respondWithError(object, "Authorization header is required", http.StatusUnauthorized)
+		logger(ctx).Error("Authorization header is missing")
+		return d.reject(object, reasonMissingAuthorization, "Authorization header is required", http.StatusUnauthorized)
 	}
 
 	// Get DPoP header - try different cases
@@ -401,9 +526,10 @@ func (d *DPoPHandler) DPoPCheck(object *pb.Object) (*pb.Object, error) {
 	if dpopHeader == "" {
 		dpopHeader = object.Request.Headers["Dpop"]
 	}
-	if dpopHeader == "" {
-		log.Error("DPoP header is missing")
-		return d.respondWithError(object, "DPoP header is required", http.StatusUnauthorized)
+	// APIs that do not require DPoP accept plain Bearer tokens
+	if dpopHeader == "" && (apiConfig.DPoPRequired || !strings.HasPrefix(authHeader, "Bearer ")) {
+		logger(ctx).Error("DPoP header is missing")
+		return d.reject(object, reasonMissingDPoPProof, "DPoP header is required", http.StatusUnauthorized)
 	}
 
 	// Check if Authorization header starts with DPoP
@@ -415,44 +541,63 @@ func (d *DPoPHandler) DPoPCheck(object *pb.Object) (*pb.Object, error) {
 			object.Request.SetHeaders = map[string]string{}
 		}
 		object.Request.SetHeaders["Authorization"] = "Bearer " + token
-		log.Info("Rewrote DPoP token to Bearer token")
+		logger(ctx).Info("Rewrote DPoP token to Bearer token")
 	} else if strings.HasPrefix(authHeader, "Bearer ") {
 		token = strings.TrimPrefix(authHeader, "Bearer ")
 	} else {
-		log.Error("Authorization header must start with DPoP or Bearer")
-		return d.respondWithError(object, "Invalid Authorization header format", http.StatusUnauthorized)
+		logger(ctx).Error("Authorization header must start with DPoP or Bearer")
+		return d.reject(object, reasonInvalidAuthScheme, "Invalid Authorization header format", http.StatusUnauthorized)
 	}
 
 	// Parse and validate the access token
 	accessTokenClaims, err := d.parseAndValidateAccessToken(token)
 	if err != nil {
-		log.Errorf("Failed to parse access token: %v", err)
-		return d.respondWithError(object, "Invalid access token", http.StatusUnauthorized)
+		logger(ctx).Errorf("Failed to parse access token: %v", err)
+		return d.reject(object, reasonInvalidAccessToken, "Invalid access token", http.StatusUnauthorized)
 	}
 
 	// Log all claims for debugging
-	log.Debug("Access token claims:")
+	logger(ctx).Debug("Access token claims:")
 	for k, v := range accessTokenClaims {
-		log.Debugf("  %s: %v", k, v)
+		logger(ctx).Debugf("  %s: %v", k, v)
+	}
+
+	// A token bound to a DPoP key must come with a proof, even on APIs that
+	// accept Bearer tokens (RFC 9449 section 7.1)
+	if dpopHeader == "" && boundKeyThumbprint(accessTokenClaims) != "" {
+		logger(ctx).Error("DPoP-bound access token presented without a DPoP proof")
+		return d.reject(object, reasonUnboundAccessToken, "DPoP-bound access token requires a DPoP proof", http.StatusUnauthorized)
+	}
+
+	// Check the scopes the API requires
+	scope, _ := accessTokenClaims["scope"].(string)
+	if missing := apiConfig.missingScopes(scope); len(missing) > 0 {
+		logger(ctx).Errorf("Access token is missing required scopes: %s", strings.Join(missing, " "))
+		return d.reject(object, reasonInsufficientScope, "Insufficient scope", http.StatusForbidden)
+	}
+
+	if dpopHeader == "" {
+		logger(ctx).Info("DPoP not required for this API, accepting Bearer token")
+		return object, nil
 	}
 
 	// Get the DPoP fingerprint from the access token
 	cnfClaim, ok := accessTokenClaims["cnf"].(map[string]interface{})
 	if !ok {
-		log.Error("cnf claim is missing or invalid in access token")
-		return d.respondWithError(object, "Invalid access token: missing cnf claim", http.StatusUnauthorized)
+		logger(ctx).Error("cnf claim is missing or invalid in access token")
+		return d.reject(object, reasonUnboundAccessToken, "Invalid access token: missing cnf claim", http.StatusUnauthorized)
 	}
 
 	jkt, ok := cnfClaim["jkt"].(string)
 	if !ok {
-		log.Error("jkt claim is missing or invalid in cnf claim")
-		return d.respondWithError(object, "Invalid access token: missing jkt claim", http.StatusUnauthorized)
+		logger(ctx).Error("jkt claim is missing or invalid in cnf claim")
+		return d.reject(object, reasonUnboundAccessToken, "Invalid access token: missing jkt claim", http.StatusUnauthorized)
 	}
 
 	// Parse and validate the DPoP proof
-	if err := d.validateDPoPProof(dpopHeader, jkt, object.Request.Method, object.Request.Url); err != nil {
-		log.Errorf("DPoP proof validation failed: %v", err)
-		return d.respondWithError(object, err.Error(), http.StatusUnauthorized)
+	if err := d.validateDPoPProof(dpopHeader, jkt, object.Request.Method, object.Request.Url, apiConfig.DPoPProofMaxAge); err != nil {
+		logger(ctx).Errorf("DPoP proof validation failed: %v", err)
+		return d.reject(object, reasonInvalidDPoPProof, err.Error(), http.StatusUnauthorized)
 	}
 
 	// Delete the DPoP header
@@ -460,12 +605,20 @@ func (d *DPoPHandler) DPoPCheck(object *pb.Object) (*pb.Object, error) {
 		object.Request.DeleteHeaders = []string{}
 	}
 	object.Request.DeleteHeaders = append(object.Request.DeleteHeaders, "DPoP")
-	log.Info("Added DPoP to DeleteHeaders")
+	logger(ctx).Info("Added DPoP to DeleteHeaders")
 
-	log.Info("DPoP validation successful")
+	logger(ctx).Info("DPoP validation successful")
 	return object, nil
 }
 
+// boundKeyThumbprint returns the cnf.jkt thumbprint of the key an access
+// token is bound to, or "" for unbound tokens
+func boundKeyThumbprint(claims jwt.MapClaims) string {
+	cnf, _ := claims["cnf"].(map[string]interface{})
+	jkt, _ := cnf["jkt"].(string)
+	return jkt
+}
+
 // parseAndValidateAccessToken parses and validates the JWT access token
 func (d *DPoPHandler) parseAndValidateAccessToken(tokenString string) (jwt.MapClaims, error) {
 	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
@@ -481,9 +634,8 @@ func (d *DPoPHandler) parseAndValidateAccessToken(tokenString string) (jwt.MapCl
 	return claims, nil
 }
 
-// validateDPoPProof validates the DPoP proof
-// validateDPoPProof validates the DPoP proof
-func (d *DPoPHandler) validateDPoPProof(dpopProof, expectedJkt, method, requestURL string) error {
+// validateDPoPProof validates the DPoP proof, rejecting proofs older than maxAge when it is set
+func (d *DPoPHandler) validateDPoPProof(dpopProof, expectedJkt, method, requestURL string, maxAge time.Duration) error {
 	// Parse the DPoP proof
 	token, _, err := new(jwt.Parser).ParseUnverified(dpopProof, jwt.MapClaims{})
 	if err != nil {
@@ -541,10 +693,13 @@ func (d *DPoPHandler) validateDPoPProof(dpopProof, expectedJkt, method, requestU
 	}
 
 	// Check iat (Issued At) - should be recent
-	_, ok = claims["iat"].(float64)
+	iat, ok := claims["iat"].(float64)
 	if !ok {
 		return errors.New("missing or invalid iat claim")
 	}
+	if maxAge > 0 && time.Since(time.Unix(int64(iat), 0)) > maxAge {
+		return fmt.Errorf("DPoP proof is older than %s", maxAge)
+	}
 
 	// Get the JWK from the header
 	jwk, ok := token.Header["jwk"].(map[string]interface{})
@@ -616,30 +771,29 @@ func (d *DPoPHandler) respondWithError(object *pb.Object, message string, status
 	return object, nil
 }
 
-func (d *DPoPHandler) IdempotencyCheck(object *pb.Object) (*pb.Object, error) {
-	log.Info("Running IdempotencyCheck hook")
+func (d *DPoPHandler) IdempotencyCheck(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running IdempotencyCheck hook")
 
-	// Log all headers for debugging
-	log.Info("Request headers:")
-	for k, v := range object.Request.Headers {
-		log.Infof("  %s: %s", k, v)
+	// Request bodies carry account details, so they are masked even at debug level
+	if logger(ctx).Logger.IsLevelEnabled(logrus.DebugLevel) {
+		logger(ctx).WithFields(logrus.Fields{
+			"method":  object.Request.Method,
+			"url":     object.Request.Url,
+			"headers": d.logRedactor().Headers(object.Request.Headers),
+			"body":    d.logRedactor().Body(object.Request.Body),
+		}).Debug("Received request")
 	}
 
-	// Log request method and URL
-	log.Infof("Request method: %s", object.Request.Method)
-	log.Infof("Request URL: %s", object.Request.Url)
-
-	// Log request body
-	log.Infof("Request body: %s", object.Request.Body)
-
-	// Log session info
-	log.Infof("Session OauthClientId: %s", object.Session.OauthClientId)
-
 	if strings.ToUpper(object.Request.Method) != http.MethodPost {
-		log.Info("Skipping idempotency check for non-POST request")
+		logger(ctx).Info("Skipping idempotency check for non-POST request")
 		return object, nil
 	}
 
+	if _, err := d.apiConfig(ctx, object); err != nil {
+		logger(ctx).Errorf("Invalid API config data: %v", err)
+		return d.respondWithError(object, "Plugin misconfigured", http.StatusInternalServerError)
+	}
+
 	idempotencyKey := ""
 	for k, v := range object.Request.Headers {
 		if strings.ToLower(k) == "x-idempotency-key" {
@@ -648,44 +802,52 @@ func (d *DPoPHandler) IdempotencyCheck(object *pb.Object) (*pb.Object, error) {
 		}
 	}
 	if idempotencyKey == "" {
-		log.Info("No X-Idempotency-Key header present, continuing")
+		logger(ctx).Info("No X-Idempotency-Key header present, continuing")
 		return object, nil
 	}
 
-	log.Infof("Found idempotency key: %s", idempotencyKey)
+	logger(ctx).Infof("Found idempotency key: %s", idempotencyKey)
 
 	clientID := object.Session.OauthClientId
 	if clientID == "" {
-		log.Warn("Missing OauthClientId; cannot scope idempotency key")
-		return d.respondWithError(object, "Missing OauthClientId", http.StatusBadRequest)
+		logger(ctx).Warn("Missing OauthClientId; cannot scope idempotency key")
+		return d.reject(object, reasonMissingClientID, "Missing OauthClientId", http.StatusBadRequest)
 	}
 
 	hash := sha256.Sum256([]byte(object.Request.Body))
 	hashHex := fmt.Sprintf("%x", hash[:])
-	log.Infof("Request body hash: %s", hashHex)
+	logger(ctx).Debugf("Request body hash: %s", hashHex)
 
-	cacheKey := fmt.Sprintf("idempotency:%s:%s", clientID, idempotencyKey)
-	log.Infof("Cache key: %s", cacheKey)
-
-	// Log all entries in the idempotency store
-	log.Info("Current idempotency store entries:")
-	idempotencyStore.Range(func(key, value interface{}) bool {
-		log.Infof("  %s", key)
-		return true
-	})
+	cacheKey := idempotencyCacheKey(clientID, idempotencyKey)
+	logger(ctx).Debugf("Cache key: %s", cacheKey)
+	logIdempotencyStore(ctx, "Current idempotency store entries")
 
+	_, span := tracer().Start(ctx, "idempotency.lookup")
 	val, found := idempotencyStore.Load(cacheKey)
+	if found && time.Now().After(val.(IdempotencyEntry).expiresAt(d.config.ExpirationTime)) {
+		// The API's TTL may be shorter than the garbage collection interval
+		logger(ctx).Infof("Cached entry for key %s has expired", cacheKey)
+		idempotencyStore.Delete(cacheKey)
+		if d.metrics != nil {
+			d.metrics.mu.Lock()
+			d.metrics.EntriesRemoved++
+			d.metrics.mu.Unlock()
+		}
+		found = false
+	}
+	span.SetAttributes(attrCacheHit.Bool(found))
+	span.End()
 	if found {
-		log.Infof("Found cached entry for key %s", cacheKey)
+		logger(ctx).Infof("Found cached entry for key %s", cacheKey)
 		entry := val.(IdempotencyEntry)
-		log.Infof("Cached request hash: %s", entry.RequestHash)
+		logger(ctx).Debugf("Cached request hash: %s", entry.RequestHash)
 
 		if entry.RequestHash != hashHex {
-			log.Warn("Idempotency key reused with different payload")
-			return d.respondWithError(object, "Idempotency key conflict", http.StatusUnprocessableEntity)
+			logger(ctx).Warn("Idempotency key reused with different payload")
+			return d.reject(object, reasonIdempotencyConflict, "Idempotency key conflict", http.StatusUnprocessableEntity)
 		}
 
-		log.Info("Returning cached idempotent response")
+		logger(ctx).Info("Returning cached idempotent response")
 
 		// Create a simple response with minimal overrides
 		response := &pb.Object{
@@ -705,37 +867,37 @@ func (d *DPoPHandler) IdempotencyCheck(object *pb.Object) (*pb.Object, error) {
 			Session: object.Session,
 		}
 
-		// Print the full response object for debugging
-		log.Infof("Full response object: %+v", response)
-		log.Infof("Return overrides: %+v", response.Request.ReturnOverrides)
+		if logger(ctx).Logger.IsLevelEnabled(logrus.DebugLevel) {
+			overrides := response.Request.ReturnOverrides
+			logger(ctx).WithFields(logrus.Fields{
+				"status_code": overrides.ResponseCode,
+				"headers":     d.logRedactor().Headers(overrides.Headers),
+				"body":        d.logRedactor().Body(overrides.ResponseBody),
+			}).Debug("Cached response")
+		}
 
 		return response, nil
 	}
 
-	log.Infof("No prior request found for key %s — continuing", cacheKey)
+	logger(ctx).Infof("No prior request found for key %s — continuing", cacheKey)
 	// Proceed, and assume a later hook will store the result
 	return object, nil
 }
 
-func (d *DPoPHandler) IdempotencyResponse(object *pb.Object) (*pb.Object, error) {
-	log.Info("Running IdempotencyResponse hook")
+func (d *DPoPHandler) IdempotencyResponse(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running IdempotencyResponse hook")
 
-	// Log all headers for debugging
-	log.Info("Response headers:")
-	if object.Request != nil && object.Request.ReturnOverrides != nil && object.Request.ReturnOverrides.Headers != nil {
-		for k, v := range object.Request.ReturnOverrides.Headers {
-			log.Infof("  %s: %s", k, v)
-		}
-	}
-
-	// Log response code
 	if object.Request != nil && object.Request.ReturnOverrides != nil {
-		log.Infof("Response code: %d", object.Request.ReturnOverrides.ResponseCode)
+		overrides := object.Request.ReturnOverrides
+		logger(ctx).WithFields(logrus.Fields{
+			"status_code": overrides.ResponseCode,
+			"headers":     d.logRedactor().Headers(overrides.Headers),
+		}).Debug("Received response")
 	}
 
 	// Only handle POST requests
 	if strings.ToUpper(object.Request.Method) != "POST" {
-		log.Info("Skipping non-POST request")
+		logger(ctx).Info("Skipping non-POST request")
 		return object, nil
 	}
 
@@ -747,55 +909,95 @@ func (d *DPoPHandler) IdempotencyResponse(object *pb.Object) (*pb.Object, error)
 		}
 	}
 	if idempotencyKey == "" {
-		log.Info("No X-Idempotency-Key header present, skipping response caching")
+		logger(ctx).Info("No X-Idempotency-Key header present, skipping response caching")
 		return object, nil
 	}
 
-	log.Infof("Found idempotency key: %s", idempotencyKey)
+	logger(ctx).Infof("Found idempotency key: %s", idempotencyKey)
 
 	clientID := object.Session.OauthClientId
 	if clientID == "" {
-		log.Warn("Missing OauthClientId, cannot store idempotent response")
+		logger(ctx).Warn("Missing OauthClientId, cannot store idempotent response")
 		return object, nil
 	}
 
-	log.Infof("Client ID: %s", clientID)
+	apiConfig, err := d.apiConfig(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("Invalid API config data, not caching response: %v", err)
+		return object, nil
+	}
 
 	requestHash := sha256.Sum256([]byte(object.Request.Body))
 	hashHex := fmt.Sprintf("%x", requestHash[:])
-	log.Infof("Request body hash: %s", hashHex)
+	logger(ctx).Debugf("Request body hash: %s", hashHex)
 
-	cacheKey := fmt.Sprintf("idempotency:%s:%s", clientID, idempotencyKey)
-	log.Infof("Cache key: %s", cacheKey)
+	cacheKey := idempotencyCacheKey(clientID, idempotencyKey)
+	logger(ctx).Debugf("Cache key: %s", cacheKey)
 
 	// Only store if not already cached (to avoid overwriting on retries)
-	_, found := idempotencyStore.Load(cacheKey)
-	if found {
-		log.Infof("Response for key %s already cached", cacheKey)
+	_, span := tracer().Start(ctx, "idempotency.store")
+	defer span.End()
+	now := time.Now()
+	val, found := idempotencyStore.Load(cacheKey)
+	if found && !now.After(val.(IdempotencyEntry).expiresAt(d.config.ExpirationTime)) {
+		logger(ctx).Infof("Response for key %s already cached", cacheKey)
+		span.SetAttributes(attrCacheHit.Bool(true))
 		return object, nil
 	}
+	span.SetAttributes(attrCacheHit.Bool(false))
 
-	log.Infof("Caching response for idempotency key %s", cacheKey)
+	logger(ctx).Infof("Caching response for idempotency key %s", cacheKey)
 	// Store the response object and hash
 	entry := IdempotencyEntry{
-		RequestHash: hashHex,
-		Response:    cloneObject(object), // Make a deep copy to prevent mutation issues
-		CreatedAt:   time.Now(),
+		ClientID:       clientID,
+		IdempotencyKey: idempotencyKey,
+		RequestHash:    hashHex,
+		StatusCode:     responseStatusCode(object),
+		Response:       cloneObject(object), // Make a deep copy to prevent mutation issues
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(apiConfig.IdempotencyTTL),
 	}
 	idempotencyStore.Store(cacheKey, entry)
 
-	// Log all entries in the idempotency store after adding
-	log.Info("Updated idempotency store entries:")
+	logIdempotencyStore(ctx, "Updated idempotency store entries")
+
+	return object, nil
+}
+
+// logIdempotencyStore lists the keys of the idempotency store at debug level
+func logIdempotencyStore(ctx context.Context, message string) {
+	if !logger(ctx).Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
+	keys := []string{}
 	idempotencyStore.Range(func(key, value interface{}) bool {
-		log.Infof("  %s", key)
+		keys = append(keys, fmt.Sprint(key))
 		return true
 	})
+	logger(ctx).WithField("keys", keys).Debug(message)
+}
 
-	return object, nil
+// responseStatusCode returns the status code of the response carried by a response hook object
+func responseStatusCode(object *pb.Object) int32 {
+	if object.Response != nil && object.Response.StatusCode != 0 {
+		return object.Response.StatusCode
+	}
+	if object.Request != nil && object.Request.ReturnOverrides != nil {
+		return object.Request.ReturnOverrides.ResponseCode
+	}
+	return 0
 }
 
 func cloneObject(obj *pb.Object) *pb.Object {
-	copy := *obj
+	copy := pb.Object{
+		HookType: obj.HookType,
+		HookName: obj.HookName,
+		Request:  obj.Request,
+		Session:  obj.Session,
+		Metadata: obj.Metadata,
+		Spec:     obj.Spec,
+		Response: obj.Response,
+	}
 
 	// Deep copy the request object
 	if obj.Request != nil {
@@ -840,55 +1042,58 @@ func copyMap(m map[string]string) map[string]string {
 }
 
 func main() {
-	log.Info("Starting FAPI gRPC server on :5555")
-
-	// Initialize the DPoPHandler with metrics and config
-	handler := &DPoPHandler{
-		metrics: &IdempotencyMetrics{
-			LastRun: time.Now(),
-		},
-		config: defaultConfig,
-		jwsConfig: JWSConfig{
-			PrivateKeyPath:   os.Getenv("JWS_PRIVATE_KEY_PATH"),
-			PrivateKeyString: os.Getenv("JWS_PRIVATE_KEY"),
-			KeyID:            os.Getenv("JWS_KEY_ID"),
-			Issuer:           os.Getenv("JWS_ISSUER"),
-		},
-	}
-
-	// Load the private key if JWS signing is configured
-	if handler.jwsConfig.PrivateKeyPath != "" || handler.jwsConfig.PrivateKeyString != "" {
-		privateKey, err := handler.loadPrivateKey()
-		if err != nil {
-			log.Warnf("Failed to load JWS private key: %v", err)
-			log.Warn("JWS signing will be disabled")
-		} else {
-			handler.privateKey = privateKey
-			log.Info("JWS private key loaded successfully")
-		}
-	} else {
-		log.Warn("JWS signing not configured (JWS_PRIVATE_KEY_PATH or JWS_PRIVATE_KEY not set)")
+	configPath := flag.String("config", os.Getenv("PLUGIN_CONFIG"), "Path to the YAML or JSON config file")
+	flag.Parse()
+
+	// Fail fast on invalid settings, listing every problem found
+	server, err := newPluginServer(*configPath, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %s", strings.ReplaceAll(err.Error(), "\n", "; "))
 	}
+	config := server.Handler().settings
 
-	// Start the garbage collector in a goroutine
-	go func() {
-		log.Infof("Starting idempotency garbage collector (interval: %v, expiration: %v)",
-			handler.config.GCInterval, handler.config.ExpirationTime)
+	// Trace the hooks before serving the first request
+	shutdownTracing, err := setUpTracing(config.tracingConfig())
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
 
-		for {
-			time.Sleep(handler.config.GCInterval)
-			handler.runGarbageCollector()
+	// Reload the keys, certificates and configuration on SIGHUP
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			log.Info("Received SIGHUP, reloading configuration")
+			if err := server.Reload(); err != nil {
+				log.Errorf("Failed to reload configuration, keeping the current configuration: %s", strings.ReplaceAll(err.Error(), "\n", "; "))
+			}
 		}
 	}()
 
-	lis, err := net.Listen("tcp", ":5555")
+	// Drain on SIGTERM or SIGINT; a second signal exits immediately
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	socketMode, err := parseSocketMode(config.Listener.SocketMode)
+	if err != nil {
+		log.Fatalf("Invalid socket mode: %v", err)
+	}
+	lis, err := listen(config.Listener.Address, socketMode)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
+	serveErr := server.run(ctx, lis)
 
-	s := grpc.NewServer()
-	pb.RegisterDispatcherServer(s, handler)
-	if err := s.Serve(lis); err != nil {
-		log.Fatalf("Failed to serve: %v", err)
+	// Send the spans of the last calls before exiting
+	flushCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		log.Errorf("Failed to flush traces: %v", err)
+	}
+	if serveErr != nil {
+		log.Fatalf("Failed to serve: %v", serveErr)
 	}
 }
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// metricsNamespace prefixes every metric name. Names and labels are part of
+// the plugin's interface, as dashboards and alerts depend on them.
+const metricsNamespace = "tyk_fapi_plugin"
+
+// Reasons a hook rejects a request, used as the reason label of the rejection counter
+const (
+	reasonMissingAuthorization = "missing_authorization"
+	reasonInvalidAuthScheme    = "invalid_authorization_scheme"
+	reasonMissingDPoPProof     = "missing_dpop_proof"
+	reasonInvalidDPoPProof     = "invalid_dpop_proof"
+	reasonInvalidAccessToken   = "invalid_access_token"
+	reasonUnboundAccessToken   = "unbound_access_token"
+	reasonInsufficientScope    = "insufficient_scope"
+	reasonMissingClientID      = "missing_client_id"
+	reasonIdempotencyConflict  = "idempotency_conflict"
+	reasonMissingSignature     = "missing_signature"
+	reasonInvalidSignature     = "invalid_signature"
+	reasonInvalidEvent         = "invalid_event"
+	reasonInvalidTarget        = "invalid_target"
+	reasonTargetNotAllowed     = "target_not_allowed"
+	reasonTargetUnavailable    = "target_unavailable"
+	reasonDeliveryPending      = "delivery_pending"
+	reasonQueueFull            = "queue_full"
+	reasonSigningFailed        = "signing_failed"
+)
+
+// MetricsConfig configures the Prometheus endpoint
+type MetricsConfig struct {
+	// Address the metrics HTTP listener binds to (the listener is disabled when empty)
+	ListenAddr string
+}
+
+// PluginMetrics holds the Prometheus metrics of the hooks, stores and
+// forwarded requests, in a registry of its own
+type PluginMetrics struct {
+	registry      *prometheus.Registry
+	hookRequests  *prometheus.CounterVec
+	hookDuration  *prometheus.HistogramVec
+	rejections    *prometheus.CounterVec
+	signDuration  *prometheus.HistogramVec
+	forwards      *prometheus.CounterVec
+	forwardTiming *prometheus.HistogramVec
+}
+
+// NewPluginMetrics creates the metrics. Store sizes are read from the handler
+// currently serving requests when scraped.
+func NewPluginMetrics(source handlerSource) *PluginMetrics {
+	m := &PluginMetrics{
+		registry: prometheus.NewRegistry(),
+		hookRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "hook_requests_total",
+			Help:      "Hook calls by hook and the status the hook answered with (\"passthrough\" when it let the request continue).",
+		}, []string{"hook", "status"}),
+		hookDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "hook_duration_seconds",
+			Help:      "Time taken by each hook call, including forwarding.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 16),
+		}, []string{"hook"}),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rejections_total",
+			Help:      "Requests rejected by a hook, by hook and reason.",
+		}, []string{"hook", "reason"}),
+		signDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "jws_sign_duration_seconds",
+			Help:      "Time taken by JWS signing operations, by outcome.",
+			Buckets:   prometheus.ExponentialBuckets(0.0001, 2, 16),
+		}, []string{"outcome"}),
+		forwards: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "forward_attempts_total",
+			Help:      "Attempts to deliver forwarded requests, by target host and status code or failure.",
+		}, []string{"host", "status"}),
+		forwardTiming: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "forward_duration_seconds",
+			Help:      "Time taken by attempts that reached the target host.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"host"}),
+	}
+
+	m.registry.MustRegister(
+		m.hookRequests, m.hookDuration, m.rejections, m.signDuration, m.forwards, m.forwardTiming,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "idempotency_entries",
+			Help:      "Entries in the idempotency store.",
+		}, func() float64 { return float64(source.Handler().GetMetrics().CurrentEntries) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "idempotency_evictions_total",
+			Help:      "Expired entries removed from the idempotency store.",
+		}, func() float64 { return float64(source.Handler().GetMetrics().EntriesRemoved) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "idempotency_gc_runs_total",
+			Help:      "Runs of the idempotency garbage collector.",
+		}, func() float64 { return float64(source.Handler().GetMetrics().Runs) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "idempotency_gc_last_run_timestamp_seconds",
+			Help:      "Unix time of the last idempotency garbage collection.",
+		}, func() float64 { return float64(source.Handler().GetMetrics().LastRun.Unix()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "dead_letters",
+			Help:      "Requests in the dead-letter store.",
+		}, func() float64 { return float64(source.Handler().deadLetters.Len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "delivery_queue_length",
+			Help:      "Forwarded requests waiting in the delivery queue.",
+		}, func() float64 { return float64(source.Handler().deliveryQueue.Len()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_configs",
+			Help:      "APIs with cached config data.",
+		}, func() float64 { return float64(source.Handler().apiConfigs.Len()) }),
+	)
+	return m
+}
+
+// Handler returns the HTTP handler serving the metrics
+func (m *PluginMetrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeHook records a hook call and the status it answered with (0 when the request continued)
+func (m *PluginMetrics) observeHook(hook string, statusCode int, err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	status := "passthrough"
+	switch {
+	case err != nil:
+		status = "error"
+	case statusCode != 0:
+		status = strconv.Itoa(statusCode)
+	}
+	m.hookRequests.WithLabelValues(hook, status).Inc()
+	m.hookDuration.WithLabelValues(hook).Observe(duration.Seconds())
+}
+
+// observeRejection records a request rejected by a hook
+func (m *PluginMetrics) observeRejection(hook, reason string) {
+	if m == nil {
+		return
+	}
+	m.rejections.WithLabelValues(hook, reason).Inc()
+}
+
+// observeSign records a signing operation
+func (m *PluginMetrics) observeSign(duration time.Duration, err error) {
+	if m == nil {
+		return
+	}
+
+	outcome := "success"
+	switch {
+	case err == nil:
+	case errors.Is(err, errSignerTimeout):
+		outcome = "timeout"
+	case errors.Is(err, errSignerUnavailable):
+		outcome = "unavailable"
+	case errors.Is(err, errSignerRejected):
+		outcome = "rejected"
+	default:
+		outcome = "error"
+	}
+	m.signDuration.WithLabelValues(outcome).Observe(duration.Seconds())
+}
+
+// observeForward records an attempt to deliver a forwarded request under the
+// host label of the target policy
+func (m *PluginMetrics) observeForward(host string, resp *targetResponse, err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	var status string
+	switch {
+	case err == nil:
+		status = strconv.Itoa(resp.StatusCode)
+	case errors.Is(err, errCircuitOpen):
+		status = "circuit_open"
+	case errors.Is(err, errTargetNotAllowed):
+		status = "not_allowed"
+	default:
+		status = "error"
+	}
+	m.forwards.WithLabelValues(host, status).Inc()
+	// Refused attempts never reached the host
+	if status != "circuit_open" && status != "not_allowed" {
+		m.forwardTiming.WithLabelValues(host).Observe(duration.Seconds())
+	}
+}
+
+// reject answers the request with an error and counts the rejection by reason
+func (d *DPoPHandler) reject(object *pb.Object, reason, message string, statusCode int) (*pb.Object, error) {
+	d.pluginMetrics.observeRejection(object.HookName, reason)
+	return d.respondWithError(object, message, statusCode)
+}
+
+// rejectResponse replaces the upstream response with an error and counts the rejection by reason
+func (d *DPoPHandler) rejectResponse(object *pb.Object, reason, message string, statusCode int) (*pb.Object, error) {
+	d.pluginMetrics.observeRejection(object.HookName, reason)
+	return d.respondWithResponseError(object, message, statusCode)
+}
+
+// serveMetrics serves the Prometheus metrics until the context is cancelled
+func (d *DPoPHandler) serveMetrics(ctx context.Context, config MetricsConfig) error {
+	log.Infof("Serving metrics on %s/metrics", config.ListenAddr)
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", d.pluginMetrics.Handler())
+	server := &http.Server{
+		Addr:              config.ListenAddr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return serveHTTP(ctx, server)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// newMetricsTestHandler creates a handler exporting metrics about itself
+func newMetricsTestHandler() *DPoPHandler {
+	handler := &DPoPHandler{
+		apiConfigs: NewAPIConfigCache(),
+		metrics:    &IdempotencyMetrics{LastRun: time.Now()},
+		breakers:   NewCircuitBreakers(defaultCircuitBreakerConfig),
+	}
+	handler.pluginMetrics = NewPluginMetrics(handler)
+	return handler
+}
+
+// signCount returns the number of signing operations recorded with the outcome
+func signCount(metrics *PluginMetrics, outcome string) uint64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(metrics.signDuration)
+	families, _ := registry.Gather()
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if metric.GetLabel()[0].GetValue() == outcome {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+// TestHookMetrics tests that hook calls and rejections are counted by hook, status and reason
+func TestHookMetrics(t *testing.T) {
+	handler := newMetricsTestHandler()
+	metrics := handler.pluginMetrics
+
+	object := newHookTestObject("DPoPCheck", pb.HookType_Pre)
+	object.Spec = map[string]string{"APIID": "payments"}
+	if _, err := handler.Dispatch(context.Background(), object); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	if count := testutil.ToFloat64(metrics.hookRequests.WithLabelValues("DPoPCheck", "401")); count != 1 {
+		t.Errorf("Expected 1 rejected DPoPCheck call, got %v", count)
+	}
+	if count := testutil.ToFloat64(metrics.rejections.WithLabelValues("DPoPCheck", reasonMissingAuthorization)); count != 1 {
+		t.Errorf("Expected 1 rejection for a missing Authorization header, got %v", count)
+	}
+
+	// Requests without an idempotency key continue to the upstream
+	object = newAPITestObject("payments", "")
+	object.HookName, object.HookType = "IdempotencyCheck", pb.HookType_PostKeyAuth
+	if _, err := handler.Dispatch(context.Background(), object); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	if count := testutil.ToFloat64(metrics.hookRequests.WithLabelValues("IdempotencyCheck", "passthrough")); count != 1 {
+		t.Errorf("Expected 1 passthrough call, got %v", count)
+	}
+	if count := testutil.CollectAndCount(metrics.hookDuration); count != 2 {
+		t.Errorf("Expected latencies for 2 hooks, got %d", count)
+	}
+}
+
+// TestResponseHookMetrics tests that response hooks replacing the upstream
+// response are counted by status and rejection reason
+func TestResponseHookMetrics(t *testing.T) {
+	handler := newMetricsTestHandler()
+	metrics := handler.pluginMetrics
+
+	// Without a signing key the upstream response is replaced by an error
+	result, err := handler.Dispatch(context.Background(), newResponseTestObject(http.StatusOK, "application/json", `{"Data":{}}`))
+	if err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	if result.Response.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("Expected the response to be replaced with %d, got %d", http.StatusInternalServerError, result.Response.StatusCode)
+	}
+	if count := testutil.ToFloat64(metrics.hookRequests.WithLabelValues("JWSSignResponse", "500")); count != 1 {
+		t.Errorf("Expected 1 failed JWSSignResponse call, got %v", count)
+	}
+	if count := testutil.ToFloat64(metrics.rejections.WithLabelValues("JWSSignResponse", reasonSigningFailed)); count != 1 {
+		t.Errorf("Expected 1 rejection for a failed signing, got %v", count)
+	}
+
+	// A signed response continues to the client
+	handler.privateKey, _ = generateTestKey(t)
+	if _, err := handler.Dispatch(context.Background(), newResponseTestObject(http.StatusOK, "application/json", `{"Data":{}}`)); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	if count := testutil.ToFloat64(metrics.hookRequests.WithLabelValues("JWSSignResponse", "passthrough")); count != 1 {
+		t.Errorf("Expected 1 passthrough JWSSignResponse call, got %v", count)
+	}
+}
+
+// TestForwardMetrics tests that forwarding attempts are counted by target host and status
+func TestForwardMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	handler := newMetricsTestHandler()
+	handler.targetPolicy.AllowedHosts = []string{"127.0.0.1"}
+	object := newHookTestObject("DPoPCheck", pb.HookType_Pre)
+	if _, err := handler.send(context.Background(), newOutboundRequest(server.URL, object, &handler.headerPolicy)); err != nil {
+		t.Fatalf("send returned an error: %v", err)
+	}
+
+	host := "127.0.0.1"
+	metrics := handler.pluginMetrics
+	if count := testutil.ToFloat64(metrics.forwards.WithLabelValues(host, "202")); count != 1 {
+		t.Errorf("Expected 1 attempt answered with 202, got %v", count)
+	}
+
+	// Refused attempts are counted without a latency
+	metrics.observeForward(host, nil, errCircuitOpen, 0)
+	if count := testutil.ToFloat64(metrics.forwards.WithLabelValues(host, "circuit_open")); count != 1 {
+		t.Errorf("Expected 1 attempt refused by the circuit breaker, got %v", count)
+	}
+	if count := testutil.CollectAndCount(metrics.forwardTiming); count != 1 {
+		t.Errorf("Expected latencies for 1 host, got %d", count)
+	}
+
+	// Hosts the policy does not name share one label
+	handler.targetPolicy.AllowedHosts = nil
+	if _, err := handler.send(context.Background(), newOutboundRequest(server.URL, object, &handler.headerPolicy)); err != nil {
+		t.Fatalf("send returned an error: %v", err)
+	}
+	if count := testutil.ToFloat64(metrics.forwards.WithLabelValues(otherHostLabel, "202")); count != 1 {
+		t.Errorf("Expected 1 attempt under the other host label, got %v", count)
+	}
+}
+
+// TestMetricsEndpoint tests that store sizes are read from the current handler when scraped
+func TestMetricsEndpoint(t *testing.T) {
+	handler := newMetricsTestHandler()
+	handler.metrics.EntriesRemoved = 3
+	handler.metrics.Runs = 2
+	handler.apiConfigs.Get(context.Background(), "payments", "")
+
+	server := httptest.NewServer(handler.pluginMetrics.Handler())
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	for _, line := range []string{
+		"tyk_fapi_plugin_idempotency_evictions_total 3",
+		"tyk_fapi_plugin_idempotency_gc_runs_total 2",
+		"tyk_fapi_plugin_api_configs 1",
+		"tyk_fapi_plugin_dead_letters 0",
+		"tyk_fapi_plugin_delivery_queue_length 0",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("Expected %q in the scraped metrics", line)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// errCertificateNotPinned is returned when a target presents none of the pinned keys
+var errCertificateNotPinned = errors.New("target certificate does not match any pinned key")
+
+// fapiCipherSuites are the TLS 1.2 cipher suites allowed by FAPI, for RSA
+// and ECDSA certificates. The DHE suites of the FAPI list are not implemented
+// by Go; TLS 1.3 suites are not configurable and always allowed.
+var fapiCipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+}
+
+// OutboundTLSConfig contains configuration for TLS on requests forwarded to targets
+type OutboundTLSConfig struct {
+	// Client (transport) certificate and private key presented to targets (PEM format)
+	CertPath string
+	KeyPath  string
+	// CA bundle used to verify targets (default: the system roots)
+	CAPath string
+	// Base64 SHA-256 hashes of the subject public keys targets may present,
+	// optionally prefixed with "sha256/" (any key is accepted when empty)
+	PinnedKeys []string
+	// How often the certificate files are checked for changes (default: 1 minute, 0 disables)
+	ReloadInterval time.Duration
+}
+
+// Default outbound TLS configuration values
+var defaultOutboundTLSConfig = OutboundTLSConfig{
+	ReloadInterval: time.Minute,
+}
+
+// outboundTLSSnapshot is an immutable set of loaded certificates
+type outboundTLSSnapshot struct {
+	certificate *tls.Certificate
+	roots       *x509.CertPool
+	// Client configuration built from the certificates
+	tlsConfig *tls.Config
+}
+
+// OutboundTLS holds the client certificate and CA bundle used for forwarded requests
+type OutboundTLS struct {
+	config OutboundTLSConfig
+	pins   [][]byte
+	files  fileReloader[*outboundTLSSnapshot]
+}
+
+// NewOutboundTLS creates the outbound TLS settings and loads the certificates
+func NewOutboundTLS(config OutboundTLSConfig) (*OutboundTLS, error) {
+	if (config.CertPath == "") != (config.KeyPath == "") {
+		return nil, errors.New("client certificate and key must be configured together")
+	}
+
+	o := &OutboundTLS{config: config}
+	for _, pin := range config.PinnedKeys {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(strings.TrimSpace(pin), "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid pinned key %q: expected a base64 SHA-256 hash", pin)
+		}
+		o.pins = append(o.pins, hash)
+	}
+
+	o.files = fileReloader[*outboundTLSSnapshot]{
+		name:     "Outbound TLS certificate",
+		interval: config.ReloadInterval,
+		fingerprint: func() (string, error) {
+			return fileFingerprint(config.CertPath, config.KeyPath, config.CAPath), nil
+		},
+		load: o.load,
+		loaded: func(snapshot *outboundTLSSnapshot) {
+			if snapshot.certificate != nil {
+				leaf := snapshot.certificate.Leaf
+				log.Infof("Loaded outbound client certificate %s (expires %s)", leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+			}
+		},
+	}
+	if err := o.Reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Reload reads the certificates from disk and swaps them in
+func (o *OutboundTLS) Reload() error {
+	return o.files.Reload()
+}
+
+// load reads the configured certificates into a new snapshot
+func (o *OutboundTLS) load() (*outboundTLSSnapshot, error) {
+	snapshot := &outboundTLSSnapshot{}
+
+	var err error
+	if o.config.CertPath != "" {
+		if snapshot.certificate, err = loadCertificate(o.config.CertPath, o.config.KeyPath, "client certificate"); err != nil {
+			return nil, err
+		}
+	}
+	if o.config.CAPath != "" {
+		if snapshot.roots, err = loadCertPool(o.config.CAPath, "CA bundle"); err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot.tlsConfig = o.newTLSConfig(snapshot)
+	return snapshot, nil
+}
+
+// Watch reloads the certificates whenever the files change, until the context is cancelled
+func (o *OutboundTLS) Watch(ctx context.Context) {
+	o.files.Watch(ctx)
+}
+
+// TLSConfig returns the client TLS configuration of the loaded certificates.
+// It stays the same until the certificates are reloaded, so transports can be
+// kept per configuration. A nil OutboundTLS returns nil, leaving the transport
+// defaults in place.
+func (o *OutboundTLS) TLSConfig() *tls.Config {
+	if o == nil {
+		return nil
+	}
+	return o.files.Load().tlsConfig
+}
+
+// newTLSConfig builds the client TLS configuration of a snapshot
+func (o *OutboundTLS) newTLSConfig(snapshot *outboundTLSSnapshot) *tls.Config {
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		CipherSuites: fapiCipherSuites,
+		RootCAs:      snapshot.roots,
+	}
+	if snapshot.certificate != nil {
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return snapshot.certificate, nil
+		}
+	}
+	if len(o.pins) > 0 {
+		config.VerifyConnection = o.verifyPins
+	}
+	return config
+}
+
+// verifyPins accepts the connection when any certificate of the verified chain
+// carries a pinned public key, so both leaf and CA keys can be pinned
+func (o *OutboundTLS) verifyPins(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		for _, certificate := range chain {
+			hash := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+			for _, pin := range o.pins {
+				if subtle.ConstantTimeCompare(hash[:], pin) == 1 {
+					return nil
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", errCertificateNotPinned, state.ServerName)
+}
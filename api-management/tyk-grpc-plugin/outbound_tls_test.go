@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testCertificate is a certificate issued by a test CA
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issueTestCertificate issues a certificate signed by the parent, or a self-signed CA when parent is nil
+func issueTestCertificate(t *testing.T, commonName string, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCertificate{cert: cert, key: key}
+}
+
+// writePEM writes the certificate and key of a test certificate and returns their paths
+func (c *testCertificate) writePEM(t *testing.T, dir string) (string, string) {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	certPath := filepath.Join(dir, "client.crt")
+	keyPath := filepath.Join(dir, "client.key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	return certPath, keyPath
+}
+
+// tlsCertificate returns the test certificate as a server certificate
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// newMTLSTestServer starts a TPP endpoint requiring client certificates issued by the CA.
+// It reports the common name of the client certificate of each request.
+func newMTLSTestServer(t *testing.T, ca *testCertificate) (*httptest.Server, chan string) {
+	clients := make(chan string, 10)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clients <- r.TLS.PeerCertificates[0].Subject.CommonName
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{issueTestCertificate(t, "tpp.example.com", ca).tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, clients
+}
+
+// writeCABundle writes the CA certificate as a PEM bundle and returns its path
+func writeCABundle(t *testing.T, dir string, ca *testCertificate) string {
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0o600); err != nil {
+		t.Fatalf("Failed to write CA bundle: %v", err)
+	}
+	return path
+}
+
+// TestOutboundMTLS tests that forwarded requests present the client certificate and verify the target
+func TestOutboundMTLS(t *testing.T) {
+	ca := issueTestCertificate(t, "Test CA", nil)
+	server, clients := newMTLSTestServer(t, ca)
+	dir := t.TempDir()
+	certPath, keyPath := issueTestCertificate(t, "aspsp-transport", ca).writePEM(t, dir)
+
+	outboundTLS, err := NewOutboundTLS(OutboundTLSConfig{CertPath: certPath, KeyPath: keyPath, CAPath: writeCABundle(t, dir, ca)})
+	if err != nil {
+		t.Fatalf("NewOutboundTLS returned an error: %v", err)
+	}
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{privateKey: privateKey, outboundTLS: outboundTLS}
+
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, result.Request.ReturnOverrides.ResponseCode)
+	}
+	if client := <-clients; client != "aspsp-transport" {
+		t.Errorf("Expected the transport certificate, got %s", client)
+	}
+
+	// Without the client certificate the target refuses the connection
+	withoutCert, err := NewOutboundTLS(OutboundTLSConfig{CAPath: writeCABundle(t, dir, ca)})
+	if err != nil {
+		t.Fatalf("NewOutboundTLS returned an error: %v", err)
+	}
+	handler.outboundTLS = withoutCert
+	result, _ = handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, result.Request.ReturnOverrides.ResponseCode)
+	}
+}
+
+// TestOutboundTLSConfig tests the protocol version and cipher suites offered to targets
+func TestOutboundTLSConfig(t *testing.T) {
+	outboundTLS, err := NewOutboundTLS(OutboundTLSConfig{})
+	if err != nil {
+		t.Fatalf("NewOutboundTLS returned an error: %v", err)
+	}
+
+	config := outboundTLS.TLSConfig()
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("Expected minimum TLS 1.2, got %x", config.MinVersion)
+	}
+	allowed := []uint16{
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	}
+	for _, suite := range config.CipherSuites {
+		if !slices.Contains(allowed, suite) {
+			t.Errorf("Unexpected cipher suite %s", tls.CipherSuiteName(suite))
+		}
+	}
+
+	// A nil OutboundTLS keeps the transport defaults
+	var unset *OutboundTLS
+	if unset.TLSConfig() != nil {
+		t.Error("Expected no TLS configuration")
+	}
+
+	// The certificate and key must be configured together
+	if _, err := NewOutboundTLS(OutboundTLSConfig{CertPath: "client.crt"}); err == nil {
+		t.Error("Expected an error for a certificate without a key")
+	}
+	if _, err := NewOutboundTLS(OutboundTLSConfig{PinnedKeys: []string{"not-a-hash"}}); err == nil {
+		t.Error("Expected an error for an invalid pin")
+	}
+}
+
+// TestOutboundTLS12 tests that targets limited to TLS 1.2 with an ECDSA
+// certificate can be reached
+func TestOutboundTLS12(t *testing.T) {
+	ca := issueTestCertificate(t, "Test CA", nil)
+	server, clients := newMTLSTestServer(t, ca)
+	server.TLS.MaxVersion = tls.VersionTLS12
+	dir := t.TempDir()
+	certPath, keyPath := issueTestCertificate(t, "aspsp-transport", ca).writePEM(t, dir)
+
+	outboundTLS, err := NewOutboundTLS(OutboundTLSConfig{CertPath: certPath, KeyPath: keyPath, CAPath: writeCABundle(t, dir, ca)})
+	if err != nil {
+		t.Fatalf("NewOutboundTLS returned an error: %v", err)
+	}
+	privateKey, _ := generateTestKey(t)
+	handler := &DPoPHandler{privateKey: privateKey, outboundTLS: outboundTLS}
+
+	result, err := handler.JWSSign(context.Background(), newTargetTestObject(server.URL))
+	if err != nil {
+		t.Fatalf("JWSSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides.ResponseCode != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, result.Request.ReturnOverrides.ResponseCode)
+	}
+	if client := <-clients; client != "aspsp-transport" {
+		t.Errorf("Expected client certificate aspsp-transport, got %s", client)
+	}
+}
+
+// TestOutboundTLSPinning tests that targets must present a pinned key
+func TestOutboundTLSPinning(t *testing.T) {
+	ca := issueTestCertificate(t, "Test CA", nil)
+	server, _ := newMTLSTestServer(t, ca)
+	dir := t.TempDir()
+	certPath, keyPath := issueTestCertificate(t, "aspsp-transport", ca).writePEM(t, dir)
+	caPath := writeCABundle(t, dir, ca)
+
+	caPin := sha256.Sum256(ca.cert.RawSubjectPublicKeyInfo)
+	otherPin := sha256.Sum256([]byte("another key"))
+
+	tests := []struct {
+		name       string
+		pins       []string
+		expectPass bool
+	}{
+		{"pinned CA key", []string{"sha256/" + base64.StdEncoding.EncodeToString(caPin[:])}, true},
+		{"other key", []string{base64.StdEncoding.EncodeToString(otherPin[:])}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outboundTLS, err := NewOutboundTLS(OutboundTLSConfig{CertPath: certPath, KeyPath: keyPath, CAPath: caPath, PinnedKeys: tt.pins})
+			if err != nil {
+				t.Fatalf("NewOutboundTLS returned an error: %v", err)
+			}
+			handler := &DPoPHandler{outboundTLS: outboundTLS}
+
+			_, _, err = handler.deliver(context.Background(), &outboundRequest{Method: "POST", URL: server.URL})
+			if tt.expectPass && err != nil {
+				t.Errorf("Expected the delivery to succeed, got %v", err)
+			}
+			if !tt.expectPass && !errors.Is(err, errCertificateNotPinned) {
+				t.Errorf("Expected errCertificateNotPinned, got %v", err)
+			}
+		})
+	}
+}
+
+// TestOutboundTLSReload tests that a renewed certificate is used without a restart
+func TestOutboundTLSReload(t *testing.T) {
+	ca := issueTestCertificate(t, "Test CA", nil)
+	server, clients := newMTLSTestServer(t, ca)
+	dir := t.TempDir()
+	certPath, keyPath := issueTestCertificate(t, "transport-2024", ca).writePEM(t, dir)
+
+	outboundTLS, err := NewOutboundTLS(OutboundTLSConfig{CertPath: certPath, KeyPath: keyPath, CAPath: writeCABundle(t, dir, ca)})
+	if err != nil {
+		t.Fatalf("NewOutboundTLS returned an error: %v", err)
+	}
+	handler := &DPoPHandler{outboundTLS: outboundTLS}
+
+	request := &outboundRequest{Method: "POST", URL: server.URL}
+	if _, _, err := handler.deliver(context.Background(), request); err != nil {
+		t.Fatalf("deliver returned an error: %v", err)
+	}
+	if client := <-clients; client != "transport-2024" {
+		t.Errorf("Expected the first certificate, got %s", client)
+	}
+
+	// A broken certificate file keeps the current certificate in use
+	os.WriteFile(certPath, []byte("not a certificate"), 0o600)
+	if err := outboundTLS.Reload(); err == nil {
+		t.Error("Expected the reload of a broken certificate to fail")
+	}
+
+	issueTestCertificate(t, "transport-2025", ca).writePEM(t, dir)
+	if err := outboundTLS.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %v", err)
+	}
+	if _, _, err := handler.deliver(context.Background(), request); err != nil {
+		t.Fatalf("deliver returned an error: %v", err)
+	}
+	if client := <-clients; client != "transport-2025" {
+		t.Errorf("Expected the renewed certificate, got %s", client)
+	}
+}
@@ -0,0 +1,791 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a time.Duration written as a string such as "30s" in the config file
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("expected a duration string such as \"30s\", got %s", data)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// PluginConfig is the plugin configuration read from the config file, with
+// environment variables overriding the file
+type PluginConfig struct {
+	Listener ListenerSettings `json:"listener"`
+	Logging  LoggingSettings  `json:"logging"`
+	TLS      TLSSettings      `json:"tls"`
+	Stores   StoreSettings    `json:"stores"`
+	Keys     KeySettings      `json:"keys"`
+	Hooks    HookSettings     `json:"hooks"`
+	JWKS     JWKSSettings     `json:"jwks"`
+	Admin    AdminSettings    `json:"admin"`
+	Metrics  MetricsSettings  `json:"metrics"`
+	Tracing  TracingSettings  `json:"tracing"`
+	Health   HealthSettings   `json:"health"`
+}
+
+// ListenerSettings configure the gRPC listener Tyk connects to
+type ListenerSettings struct {
+	// host:port, tcp://host:port or unix:///path/to/socket
+	Address string `json:"address"`
+	// Octal permissions of the Unix socket, so only the gateway's user or group can connect
+	SocketMode string `json:"socket_mode"`
+	// How long in-flight calls and deliveries may take to finish on SIGTERM or SIGINT
+	DrainTimeout Duration `json:"drain_timeout"`
+	// Largest request accepted, in bytes (0: the gRPC default of 4 MiB)
+	MaxRecvMessageSize int `json:"max_recv_message_size"`
+	// Largest response sent, in bytes (0: unlimited)
+	MaxSendMessageSize int `json:"max_send_message_size"`
+	// Calls served at the same time on one connection (0: unlimited)
+	MaxConcurrentStreams int               `json:"max_concurrent_streams"`
+	Keepalive            KeepaliveSettings `json:"keepalive"`
+}
+
+// KeepaliveSettings configure the keepalive pings of gateway connections
+type KeepaliveSettings struct {
+	// Idle time after which the plugin pings the gateway (0: the gRPC default of 2 hours)
+	Time Duration `json:"time"`
+	// How long the plugin waits for the ping's answer before closing the connection (0: 20 seconds)
+	Timeout Duration `json:"timeout"`
+	// Shortest interval gateways may ping at; faster pings close the connection (0: 5 minutes)
+	MinTime Duration `json:"min_time"`
+	// Allow gateways to ping while no call is in progress
+	PermitWithoutStream bool `json:"permit_without_stream"`
+}
+
+// LoggingSettings configure the plugin log
+type LoggingSettings struct {
+	// panic, fatal, error, warn, info, debug or trace
+	Level string `json:"level"`
+	// text or json
+	Format string `json:"format"`
+	// Headers and JSON body fields masked in logged requests and responses
+	RedactHeaders   []string `json:"redact_headers"`
+	RedactJSONPaths []string `json:"redact_json_paths"`
+}
+
+// TLSSettings configure the TLS connections of the plugin
+type TLSSettings struct {
+	Server   ServerTLSSettings   `json:"server"`
+	Outbound OutboundTLSSettings `json:"outbound"`
+}
+
+// ServerTLSSettings configure TLS on the gRPC listener Tyk connects to
+type ServerTLSSettings struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+	// Gateways must present a certificate issued by this CA when set
+	ClientCA       string   `json:"client_ca"`
+	ClientNames    []string `json:"client_names"`
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// OutboundTLSSettings configure TLS on requests forwarded to targets
+type OutboundTLSSettings struct {
+	Cert           string   `json:"cert"`
+	Key            string   `json:"key"`
+	CA             string   `json:"ca"`
+	PinnedKeys     []string `json:"pinned_keys"`
+	ReloadInterval Duration `json:"reload_interval"`
+}
+
+// StoreSettings configure the plugin's stores
+type StoreSettings struct {
+	Idempotency   IdempotencySettings   `json:"idempotency"`
+	DeadLetters   DeadLetterSettings    `json:"dead_letters"`
+	DeliveryQueue DeliveryQueueSettings `json:"delivery_queue"`
+}
+
+// IdempotencySettings configure the idempotency store
+type IdempotencySettings struct {
+	ExpirationTime Duration `json:"expiration_time"`
+	GCInterval     Duration `json:"gc_interval"`
+}
+
+// DeadLetterSettings configure the dead-letter store
+type DeadLetterSettings struct {
+	Path           string `json:"path"`
+	MaxEntries     int    `json:"max_entries"`
+	CredentialsKey string `json:"credentials_key"`
+}
+
+// DeliveryQueueSettings configure background delivery of forwarded requests
+type DeliveryQueueSettings struct {
+	Enabled            bool     `json:"enabled"`
+	Workers            int      `json:"workers"`
+	PerHostConcurrency int      `json:"per_host_concurrency"`
+	QueueSize          int      `json:"queue_size"`
+	StatusRetention    Duration `json:"status_retention"`
+}
+
+// KeySettings configure the signing keys
+type KeySettings struct {
+	PrivateKeyPath string         `json:"private_key_path"`
+	PrivateKey     string         `json:"private_key"`
+	KeyID          string         `json:"key_id"`
+	Algorithm      string         `json:"algorithm"`
+	Directory      string         `json:"directory"`
+	Keys           []KeyConfig    `json:"keys"`
+	ActiveKeyID    string         `json:"active_key_id"`
+	ReloadInterval Duration       `json:"reload_interval"`
+	Signer         SignerSettings `json:"signer"`
+	// Fail startup when a configured key, key ring or signer cannot be loaded,
+	// instead of signing without it
+	Required bool `json:"required"`
+}
+
+// SignerSettings configure the remote signing service
+type SignerSettings struct {
+	URL     string   `json:"url"`
+	Token   string   `json:"token"`
+	Timeout Duration `json:"timeout"`
+}
+
+// HookSettings configure the policies applied by the hooks
+type HookSettings struct {
+	// Path to the composite hook definitions
+	Composites      string                  `json:"composites"`
+	Signing         SigningSettings         `json:"signing"`
+	ResponseSigning ResponseSigningSettings `json:"response_signing"`
+	Verification    VerificationSettings    `json:"verification"`
+	SET             SETSettings             `json:"set"`
+	JWE             JWESettings             `json:"jwe"`
+	Targets         TargetSettings          `json:"targets"`
+	Headers         HeaderSettings          `json:"headers"`
+	Retry           RetrySettings           `json:"retry"`
+	CircuitBreaker  CircuitBreakerSettings  `json:"circuit_breaker"`
+}
+
+// SigningSettings configure the JWS header of signatures
+type SigningSettings struct {
+	Profile     string `json:"profile"`
+	Issuer      string `json:"issuer"`
+	TrustAnchor string `json:"trust_anchor"`
+}
+
+// ResponseSigningSettings select the upstream responses JWSSignResponse signs
+type ResponseSigningSettings struct {
+	ExcludeContentTypes []string `json:"exclude_content_types"`
+	ExcludeStatusCodes  []string `json:"exclude_status_codes"`
+}
+
+// VerificationSettings configure JWS verification of TPP requests
+type VerificationSettings struct {
+	JWKSRegistry string   `json:"jwks_registry"`
+	JWKSDir      string   `json:"jwks_dir"`
+	Algorithms   []string `json:"algorithms"`
+	Issuers      string   `json:"issuers"`
+}
+
+// SETSettings configure Security Event Token generation
+type SETSettings struct {
+	Issuer              string `json:"issuer"`
+	ResourceLinkBase    string `json:"resource_link_base"`
+	ResourceLinkVersion string `json:"resource_link_version"`
+}
+
+// JWESettings configure encryption of outbound notifications
+type JWESettings struct {
+	Recipients string `json:"recipients"`
+}
+
+// TargetSettings restrict the URLs requests are forwarded to
+type TargetSettings struct {
+	AllowedSchemes       []string `json:"allowed_schemes"`
+	AllowedHosts         []string `json:"allowed_hosts"`
+	Callbacks            string   `json:"callbacks"`
+	AllowPrivateNetworks bool     `json:"allow_private_networks"`
+	MaxRedirects         int      `json:"max_redirects"`
+}
+
+// HeaderSettings choose the headers forwarded to and returned from targets
+type HeaderSettings struct {
+	AllowedRequestHeaders  []string `json:"allowed_request_headers"`
+	AllowedResponseHeaders []string `json:"allowed_response_headers"`
+	StripForwardedHeaders  bool     `json:"strip_forwarded_headers"`
+}
+
+// RetrySettings configure retries of forwarded requests
+type RetrySettings struct {
+	MaxAttempts    int      `json:"max_attempts"`
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+	AttemptTimeout Duration `json:"attempt_timeout"`
+	MaxRetryAfter  Duration `json:"max_retry_after"`
+}
+
+// CircuitBreakerSettings configure the circuit breakers of target hosts
+type CircuitBreakerSettings struct {
+	Enabled          bool     `json:"enabled"`
+	Window           Duration `json:"window"`
+	MinRequests      int      `json:"min_requests"`
+	FailureRatio     float64  `json:"failure_ratio"`
+	SlowCall         Duration `json:"slow_call"`
+	OpenDuration     Duration `json:"open_duration"`
+	HalfOpenRequests int      `json:"half_open_requests"`
+}
+
+// JWKSSettings configure publishing of the public signing keys
+type JWKSSettings struct {
+	ListenAddress string   `json:"listen_address"`
+	CacheMaxAge   Duration `json:"cache_max_age"`
+}
+
+// AdminSettings configure the admin API
+type AdminSettings struct {
+	ListenAddress string `json:"listen_address"`
+	Token         string `json:"token"`
+}
+
+// MetricsSettings configure the Prometheus endpoint
+type MetricsSettings struct {
+	ListenAddress string `json:"listen_address"`
+}
+
+// TracingSettings configure the export of OpenTelemetry traces
+type TracingSettings struct {
+	Exporter    string  `json:"exporter"`
+	Endpoint    string  `json:"endpoint"`
+	Insecure    bool    `json:"insecure"`
+	SampleRatio float64 `json:"sample_ratio"`
+	ServiceName string  `json:"service_name"`
+}
+
+// HealthSettings configure the health checks
+type HealthSettings struct {
+	ListenAddress string   `json:"listen_address"`
+	CheckInterval Duration `json:"check_interval"`
+}
+
+// defaultPluginConfig returns the configuration used for settings left out of
+// the config file and the environment. Lists are copied, as decoding the file
+// reuses their backing arrays.
+func defaultPluginConfig() *PluginConfig {
+	return &PluginConfig{
+		Listener: ListenerSettings{Address: ":5555", SocketMode: defaultSocketMode, DrainTimeout: Duration(defaultDrainTimeout)},
+		Logging: LoggingSettings{
+			Level:           "info",
+			Format:          "text",
+			RedactHeaders:   slices.Clone(defaultLogRedactionConfig.Headers),
+			RedactJSONPaths: slices.Clone(defaultLogRedactionConfig.JSONPaths),
+		},
+		TLS: TLSSettings{
+			Server: ServerTLSSettings{ReloadInterval: Duration(defaultOutboundTLSConfig.ReloadInterval)},
+			Outbound: OutboundTLSSettings{
+				ReloadInterval: Duration(defaultOutboundTLSConfig.ReloadInterval),
+			},
+		},
+		Stores: StoreSettings{
+			Idempotency: IdempotencySettings{
+				ExpirationTime: Duration(defaultConfig.ExpirationTime),
+				GCInterval:     Duration(defaultConfig.GCInterval),
+			},
+			DeadLetters: DeadLetterSettings{MaxEntries: defaultDeadLetterConfig.MaxEntries},
+			DeliveryQueue: DeliveryQueueSettings{
+				Workers:            defaultDeliveryQueueConfig.Workers,
+				PerHostConcurrency: defaultDeliveryQueueConfig.PerHostConcurrency,
+				QueueSize:          defaultDeliveryQueueConfig.QueueSize,
+				StatusRetention:    Duration(defaultDeliveryQueueConfig.StatusRetention),
+			},
+		},
+		Keys: KeySettings{
+			ReloadInterval: Duration(defaultKeyRingConfig.ReloadInterval),
+			Signer:         SignerSettings{Timeout: Duration(defaultRemoteSignerConfig.Timeout)},
+		},
+		Hooks: HookSettings{
+			ResponseSigning: ResponseSigningSettings{
+				ExcludeContentTypes: slices.Clone(defaultJWSResponseConfig.ExcludedContentTypes),
+				ExcludeStatusCodes:  slices.Clone(defaultJWSResponseConfig.ExcludedStatusCodes),
+			},
+			Verification: VerificationSettings{Algorithms: slices.Clone(defaultJWSVerifyConfig.AllowedAlgorithms)},
+			SET:          SETSettings{ResourceLinkVersion: defaultSETConfig.ResourceLinkVersion},
+			Targets: TargetSettings{
+				AllowedSchemes:       slices.Clone(defaultTargetPolicyConfig.AllowedSchemes),
+				AllowPrivateNetworks: !defaultTargetPolicyConfig.BlockPrivateNetworks,
+				MaxRedirects:         defaultTargetPolicyConfig.MaxRedirects,
+			},
+			Retry: RetrySettings{
+				MaxAttempts:    defaultRetryConfig.MaxAttempts,
+				InitialBackoff: Duration(defaultRetryConfig.InitialBackoff),
+				MaxBackoff:     Duration(defaultRetryConfig.MaxBackoff),
+				AttemptTimeout: Duration(defaultRetryConfig.AttemptTimeout),
+				MaxRetryAfter:  Duration(defaultRetryConfig.MaxRetryAfter),
+			},
+			CircuitBreaker: CircuitBreakerSettings{
+				Enabled:          true,
+				Window:           Duration(defaultCircuitBreakerConfig.Window),
+				MinRequests:      defaultCircuitBreakerConfig.MinRequests,
+				FailureRatio:     defaultCircuitBreakerConfig.FailureRatio,
+				SlowCall:         Duration(defaultCircuitBreakerConfig.SlowCallThreshold),
+				OpenDuration:     Duration(defaultCircuitBreakerConfig.OpenDuration),
+				HalfOpenRequests: defaultCircuitBreakerConfig.HalfOpenRequests,
+			},
+		},
+		JWKS: JWKSSettings{CacheMaxAge: Duration(defaultJWKSConfig.CacheMaxAge)},
+		Tracing: TracingSettings{
+			Exporter:    defaultTracingConfig.Exporter,
+			SampleRatio: defaultTracingConfig.SampleRatio,
+			ServiceName: defaultTracingConfig.ServiceName,
+		},
+		Health: HealthSettings{CheckInterval: Duration(defaultHealthConfig.CheckInterval)},
+	}
+}
+
+// loadPluginConfig reads the config file, if any, applies the environment
+// overrides and validates the result. Every problem found is reported at once.
+func loadPluginConfig(path string, lookupEnv func(string) (string, bool)) (*PluginConfig, error) {
+	config := defaultPluginConfig()
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := config.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// readFile decodes a YAML or JSON config file over the current settings.
+// Unknown fields are refused, so a misspelt setting is not silently ignored.
+func (c *PluginConfig) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		// YAML is converted to JSON so both formats share the field names and checks
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+		if document == nil {
+			return nil
+		}
+		if data, err = json.Marshal(document); err != nil {
+			return fmt.Errorf("config file %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config file %s: unsupported format, expected .yaml, .yml or .json", path)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return fmt.Errorf("config file %s: %s: expected %s, got %s", path, typeErr.Field, typeErr.Type, typeErr.Value)
+		}
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// envOverrides applies environment variables over config settings, collecting
+// the values that cannot be parsed
+type envOverrides struct {
+	lookup func(string) (string, bool)
+	errs   []error
+}
+
+// get returns the value of a set, non-empty environment variable
+func (e *envOverrides) get(name string) (string, bool) {
+	value, ok := e.lookup(name)
+	return value, ok && value != ""
+}
+
+func (e *envOverrides) str(name string, target *string) {
+	if value, ok := e.get(name); ok {
+		*target = value
+	}
+}
+
+// list reads a comma-separated list, trimming the spaces around each item
+func (e *envOverrides) list(name string, target *[]string) {
+	if value, ok := e.get(name); ok {
+		items := strings.Split(value, ",")
+		for i := range items {
+			items[i] = strings.TrimSpace(items[i])
+		}
+		*target = items
+	}
+}
+
+func (e *envOverrides) boolean(name string, target *bool) {
+	if value, ok := e.get(name); ok {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: expected true or false, got %q", name, value))
+			return
+		}
+		*target = parsed
+	}
+}
+
+func (e *envOverrides) integer(name string, target *int) {
+	if value, ok := e.get(name); ok {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: expected a whole number, got %q", name, value))
+			return
+		}
+		*target = parsed
+	}
+}
+
+func (e *envOverrides) float(name string, target *float64) {
+	if value, ok := e.get(name); ok {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: expected a number, got %q", name, value))
+			return
+		}
+		*target = parsed
+	}
+}
+
+func (e *envOverrides) duration(name string, target *Duration) {
+	if value, ok := e.get(name); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: expected a duration such as \"30s\", got %q", name, value))
+			return
+		}
+		*target = Duration(parsed)
+	}
+}
+
+// applyEnv overrides the settings with the environment variables that are set
+func (c *PluginConfig) applyEnv(lookupEnv func(string) (string, bool)) error {
+	e := &envOverrides{lookup: lookupEnv}
+
+	e.str("GRPC_LISTEN_ADDR", &c.Listener.Address)
+	e.str("GRPC_SOCKET_MODE", &c.Listener.SocketMode)
+	e.duration("GRPC_DRAIN_TIMEOUT", &c.Listener.DrainTimeout)
+	e.integer("GRPC_MAX_RECV_MSG_SIZE", &c.Listener.MaxRecvMessageSize)
+	e.integer("GRPC_MAX_SEND_MSG_SIZE", &c.Listener.MaxSendMessageSize)
+	e.integer("GRPC_MAX_CONCURRENT_STREAMS", &c.Listener.MaxConcurrentStreams)
+	e.duration("GRPC_KEEPALIVE_TIME", &c.Listener.Keepalive.Time)
+	e.duration("GRPC_KEEPALIVE_TIMEOUT", &c.Listener.Keepalive.Timeout)
+	e.duration("GRPC_KEEPALIVE_MIN_TIME", &c.Listener.Keepalive.MinTime)
+	e.boolean("GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM", &c.Listener.Keepalive.PermitWithoutStream)
+	e.str("LOG_LEVEL", &c.Logging.Level)
+	e.str("LOG_FORMAT", &c.Logging.Format)
+	e.list("LOG_REDACT_HEADERS", &c.Logging.RedactHeaders)
+	e.list("LOG_REDACT_JSON_PATHS", &c.Logging.RedactJSONPaths)
+
+	e.str("GRPC_TLS_CERT", &c.TLS.Server.Cert)
+	e.str("GRPC_TLS_KEY", &c.TLS.Server.Key)
+	e.str("GRPC_TLS_CLIENT_CA", &c.TLS.Server.ClientCA)
+	e.list("GRPC_TLS_CLIENT_NAMES", &c.TLS.Server.ClientNames)
+	e.duration("GRPC_TLS_RELOAD_INTERVAL", &c.TLS.Server.ReloadInterval)
+
+	e.str("OUTBOUND_TLS_CERT", &c.TLS.Outbound.Cert)
+	e.str("OUTBOUND_TLS_KEY", &c.TLS.Outbound.Key)
+	e.str("OUTBOUND_TLS_CA", &c.TLS.Outbound.CA)
+	e.list("OUTBOUND_TLS_PINNED_KEYS", &c.TLS.Outbound.PinnedKeys)
+	e.duration("OUTBOUND_TLS_RELOAD_INTERVAL", &c.TLS.Outbound.ReloadInterval)
+
+	e.duration("IDEMPOTENCY_EXPIRATION_TIME", &c.Stores.Idempotency.ExpirationTime)
+	e.duration("IDEMPOTENCY_GC_INTERVAL", &c.Stores.Idempotency.GCInterval)
+	e.str("DEAD_LETTER_FILE", &c.Stores.DeadLetters.Path)
+	e.integer("DEAD_LETTER_MAX_ENTRIES", &c.Stores.DeadLetters.MaxEntries)
+	e.str("DEAD_LETTER_CREDENTIALS_KEY", &c.Stores.DeadLetters.CredentialsKey)
+	e.boolean("DELIVERY_ASYNC", &c.Stores.DeliveryQueue.Enabled)
+	e.integer("DELIVERY_WORKERS", &c.Stores.DeliveryQueue.Workers)
+	e.integer("DELIVERY_PER_HOST_CONCURRENCY", &c.Stores.DeliveryQueue.PerHostConcurrency)
+	e.integer("DELIVERY_QUEUE_SIZE", &c.Stores.DeliveryQueue.QueueSize)
+	e.duration("DELIVERY_STATUS_RETENTION", &c.Stores.DeliveryQueue.StatusRetention)
+
+	e.str("JWS_PRIVATE_KEY_PATH", &c.Keys.PrivateKeyPath)
+	e.str("JWS_PRIVATE_KEY", &c.Keys.PrivateKey)
+	e.str("JWS_KEY_ID", &c.Keys.KeyID)
+	e.str("JWS_ALGORITHM", &c.Keys.Algorithm)
+	e.str("JWS_KEYS_DIR", &c.Keys.Directory)
+	e.str("JWS_ACTIVE_KEY_ID", &c.Keys.ActiveKeyID)
+	e.duration("JWS_KEYS_RELOAD_INTERVAL", &c.Keys.ReloadInterval)
+	e.boolean("JWS_KEYS_REQUIRED", &c.Keys.Required)
+	if keys, ok := e.get("JWS_KEYS"); ok {
+		if err := json.Unmarshal([]byte(keys), &c.Keys.Keys); err != nil {
+			e.errs = append(e.errs, fmt.Errorf("JWS_KEYS: expected a JSON array of keys: %w", err))
+		}
+	}
+	e.str("JWS_SIGNER_URL", &c.Keys.Signer.URL)
+	e.str("JWS_SIGNER_TOKEN", &c.Keys.Signer.Token)
+	e.duration("JWS_SIGNER_TIMEOUT", &c.Keys.Signer.Timeout)
+
+	e.str("HOOK_COMPOSITES", &c.Hooks.Composites)
+	e.str("JWS_PROFILE", &c.Hooks.Signing.Profile)
+	e.str("JWS_ISSUER", &c.Hooks.Signing.Issuer)
+	e.str("JWS_TRUST_ANCHOR", &c.Hooks.Signing.TrustAnchor)
+	e.list("JWS_RESPONSE_EXCLUDE_CONTENT_TYPES", &c.Hooks.ResponseSigning.ExcludeContentTypes)
+	e.list("JWS_RESPONSE_EXCLUDE_STATUS_CODES", &c.Hooks.ResponseSigning.ExcludeStatusCodes)
+	e.str("JWS_VERIFY_JWKS_REGISTRY", &c.Hooks.Verification.JWKSRegistry)
+	e.str("JWS_VERIFY_JWKS_DIR", &c.Hooks.Verification.JWKSDir)
+	e.list("JWS_VERIFY_ALGORITHMS", &c.Hooks.Verification.Algorithms)
+	e.str("JWS_VERIFY_ISSUERS", &c.Hooks.Verification.Issuers)
+	e.str("SET_ISSUER", &c.Hooks.SET.Issuer)
+	e.str("SET_RESOURCE_LINK_BASE", &c.Hooks.SET.ResourceLinkBase)
+	e.str("SET_RESOURCE_LINK_VERSION", &c.Hooks.SET.ResourceLinkVersion)
+	e.str("JWE_RECIPIENTS", &c.Hooks.JWE.Recipients)
+
+	e.list("TARGET_ALLOWED_SCHEMES", &c.Hooks.Targets.AllowedSchemes)
+	e.list("TARGET_ALLOWED_HOSTS", &c.Hooks.Targets.AllowedHosts)
+	e.str("TARGET_CALLBACKS", &c.Hooks.Targets.Callbacks)
+	e.boolean("TARGET_ALLOW_PRIVATE_NETWORKS", &c.Hooks.Targets.AllowPrivateNetworks)
+	e.integer("TARGET_MAX_REDIRECTS", &c.Hooks.Targets.MaxRedirects)
+	e.list("FORWARD_ALLOWED_REQUEST_HEADERS", &c.Hooks.Headers.AllowedRequestHeaders)
+	e.list("FORWARD_ALLOWED_RESPONSE_HEADERS", &c.Hooks.Headers.AllowedResponseHeaders)
+	e.boolean("FORWARD_STRIP_FORWARDED_HEADERS", &c.Hooks.Headers.StripForwardedHeaders)
+
+	e.integer("DELIVERY_MAX_ATTEMPTS", &c.Hooks.Retry.MaxAttempts)
+	e.duration("DELIVERY_INITIAL_BACKOFF", &c.Hooks.Retry.InitialBackoff)
+	e.duration("DELIVERY_MAX_BACKOFF", &c.Hooks.Retry.MaxBackoff)
+	e.duration("DELIVERY_ATTEMPT_TIMEOUT", &c.Hooks.Retry.AttemptTimeout)
+	e.duration("DELIVERY_MAX_RETRY_AFTER", &c.Hooks.Retry.MaxRetryAfter)
+
+	e.boolean("CIRCUIT_BREAKER_ENABLED", &c.Hooks.CircuitBreaker.Enabled)
+	e.duration("CIRCUIT_BREAKER_WINDOW", &c.Hooks.CircuitBreaker.Window)
+	e.integer("CIRCUIT_BREAKER_MIN_REQUESTS", &c.Hooks.CircuitBreaker.MinRequests)
+	e.float("CIRCUIT_BREAKER_FAILURE_RATIO", &c.Hooks.CircuitBreaker.FailureRatio)
+	e.duration("CIRCUIT_BREAKER_SLOW_CALL", &c.Hooks.CircuitBreaker.SlowCall)
+	e.duration("CIRCUIT_BREAKER_OPEN_DURATION", &c.Hooks.CircuitBreaker.OpenDuration)
+	e.integer("CIRCUIT_BREAKER_HALF_OPEN_REQUESTS", &c.Hooks.CircuitBreaker.HalfOpenRequests)
+
+	e.str("JWKS_LISTEN_ADDR", &c.JWKS.ListenAddress)
+	e.duration("JWKS_CACHE_MAX_AGE", &c.JWKS.CacheMaxAge)
+	e.str("ADMIN_LISTEN_ADDR", &c.Admin.ListenAddress)
+	e.str("ADMIN_API_TOKEN", &c.Admin.Token)
+	e.str("METRICS_LISTEN_ADDR", &c.Metrics.ListenAddress)
+	e.str("TRACING_EXPORTER", &c.Tracing.Exporter)
+	e.str("TRACING_OTLP_ENDPOINT", &c.Tracing.Endpoint)
+	e.boolean("TRACING_OTLP_INSECURE", &c.Tracing.Insecure)
+	e.float("TRACING_SAMPLE_RATIO", &c.Tracing.SampleRatio)
+	e.str("TRACING_SERVICE_NAME", &c.Tracing.ServiceName)
+	e.str("HEALTH_LISTEN_ADDR", &c.Health.ListenAddress)
+	e.duration("HEALTH_CHECK_INTERVAL", &c.Health.CheckInterval)
+
+	return errors.Join(e.errs...)
+}
+
+// configProblems collects the settings that fail validation, naming each by
+// its config file path and environment variable
+type configProblems []error
+
+func (p *configProblems) add(field, env, format string, args ...interface{}) {
+	*p = append(*p, fmt.Errorf("%s (%s): %s", field, env, fmt.Sprintf(format, args...)))
+}
+
+func (p *configProblems) atLeast(field, env string, value, minimum int) {
+	if value < minimum {
+		p.add(field, env, "must be at least %d, got %d", minimum, value)
+	}
+}
+
+func (p *configProblems) positive(field, env string, value Duration) {
+	if value <= 0 {
+		p.add(field, env, "must be a positive duration, got %s", time.Duration(value))
+	}
+}
+
+func (p *configProblems) notNegative(field, env string, value Duration) {
+	if value < 0 {
+		p.add(field, env, "must not be negative, got %s", time.Duration(value))
+	}
+}
+
+// validate checks the settings that can be checked without loading files
+func (c *PluginConfig) validate() error {
+	var p configProblems
+
+	listener := c.Listener
+	if listener.Address == "" {
+		p.add("listener.address", "GRPC_LISTEN_ADDR", "must be set, e.g. \":5555\"")
+	} else if _, _, err := parseListenAddress(listener.Address); err != nil {
+		p.add("listener.address", "GRPC_LISTEN_ADDR", "must be host:port, tcp://host:port or unix:///path: %v", err)
+	}
+	if _, err := parseSocketMode(listener.SocketMode); err != nil {
+		p.add("listener.socket_mode", "GRPC_SOCKET_MODE", "must be octal permissions such as 0660: %v", err)
+	}
+	p.positive("listener.drain_timeout", "GRPC_DRAIN_TIMEOUT", listener.DrainTimeout)
+	p.atLeast("listener.max_recv_message_size", "GRPC_MAX_RECV_MSG_SIZE", listener.MaxRecvMessageSize, 0)
+	p.atLeast("listener.max_send_message_size", "GRPC_MAX_SEND_MSG_SIZE", listener.MaxSendMessageSize, 0)
+	if listener.MaxConcurrentStreams < 0 || listener.MaxConcurrentStreams > math.MaxUint32 {
+		p.add("listener.max_concurrent_streams", "GRPC_MAX_CONCURRENT_STREAMS", "must be between 0 and %d, got %d", uint32(math.MaxUint32), listener.MaxConcurrentStreams)
+	}
+	p.notNegative("listener.keepalive.time", "GRPC_KEEPALIVE_TIME", listener.Keepalive.Time)
+	p.notNegative("listener.keepalive.timeout", "GRPC_KEEPALIVE_TIMEOUT", listener.Keepalive.Timeout)
+	p.notNegative("listener.keepalive.min_time", "GRPC_KEEPALIVE_MIN_TIME", listener.Keepalive.MinTime)
+	if _, err := logrus.ParseLevel(c.Logging.Level); err != nil {
+		p.add("logging.level", "LOG_LEVEL", "must be one of panic, fatal, error, warn, info, debug or trace, got %q", c.Logging.Level)
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		p.add("logging.format", "LOG_FORMAT", "must be text or json, got %q", c.Logging.Format)
+	}
+	for _, path := range c.Logging.RedactJSONPaths {
+		if slices.Contains(strings.Split(path, "."), "") {
+			p.add("logging.redact_json_paths", "LOG_REDACT_JSON_PATHS", "must be dotted paths such as Data.Initiation.DebtorAccount, got %q", path)
+		}
+	}
+
+	server := c.TLS.Server
+	if (server.Cert == "") != (server.Key == "") {
+		p.add("tls.server.cert", "GRPC_TLS_CERT", "must be set together with tls.server.key (GRPC_TLS_KEY)")
+	}
+	if server.ClientCA != "" && server.Cert == "" {
+		p.add("tls.server.client_ca", "GRPC_TLS_CLIENT_CA", "requires tls.server.cert (GRPC_TLS_CERT)")
+	}
+	if len(server.ClientNames) > 0 && server.ClientCA == "" {
+		p.add("tls.server.client_names", "GRPC_TLS_CLIENT_NAMES", "requires tls.server.client_ca (GRPC_TLS_CLIENT_CA)")
+	}
+	p.notNegative("tls.server.reload_interval", "GRPC_TLS_RELOAD_INTERVAL", server.ReloadInterval)
+
+	outbound := c.TLS.Outbound
+	if (outbound.Cert == "") != (outbound.Key == "") {
+		p.add("tls.outbound.cert", "OUTBOUND_TLS_CERT", "must be set together with tls.outbound.key (OUTBOUND_TLS_KEY)")
+	}
+	p.notNegative("tls.outbound.reload_interval", "OUTBOUND_TLS_RELOAD_INTERVAL", outbound.ReloadInterval)
+
+	p.positive("stores.idempotency.expiration_time", "IDEMPOTENCY_EXPIRATION_TIME", c.Stores.Idempotency.ExpirationTime)
+	p.positive("stores.idempotency.gc_interval", "IDEMPOTENCY_GC_INTERVAL", c.Stores.Idempotency.GCInterval)
+	p.atLeast("stores.dead_letters.max_entries", "DEAD_LETTER_MAX_ENTRIES", c.Stores.DeadLetters.MaxEntries, 1)
+	queue := c.Stores.DeliveryQueue
+	p.atLeast("stores.delivery_queue.workers", "DELIVERY_WORKERS", queue.Workers, 1)
+	p.atLeast("stores.delivery_queue.per_host_concurrency", "DELIVERY_PER_HOST_CONCURRENCY", queue.PerHostConcurrency, 1)
+	p.atLeast("stores.delivery_queue.queue_size", "DELIVERY_QUEUE_SIZE", queue.QueueSize, 1)
+	p.positive("stores.delivery_queue.status_retention", "DELIVERY_STATUS_RETENTION", queue.StatusRetention)
+
+	p.notNegative("keys.reload_interval", "JWS_KEYS_RELOAD_INTERVAL", c.Keys.ReloadInterval)
+	p.positive("keys.signer.timeout", "JWS_SIGNER_TIMEOUT", c.Keys.Signer.Timeout)
+
+	if _, err := parseJWSProfile(c.Hooks.Signing.Profile); err != nil {
+		p.add("hooks.signing.profile", "JWS_PROFILE", "must be rfc7797, obuk or fapi, got %q", c.Hooks.Signing.Profile)
+	}
+	if err := validateStatusPatterns(c.Hooks.ResponseSigning.ExcludeStatusCodes); err != nil {
+		p.add("hooks.response_signing.exclude_status_codes", "JWS_RESPONSE_EXCLUDE_STATUS_CODES", "%v", err)
+	}
+	p.atLeast("hooks.targets.max_redirects", "TARGET_MAX_REDIRECTS", c.Hooks.Targets.MaxRedirects, 0)
+
+	retry := c.Hooks.Retry
+	p.atLeast("hooks.retry.max_attempts", "DELIVERY_MAX_ATTEMPTS", retry.MaxAttempts, 1)
+	p.notNegative("hooks.retry.initial_backoff", "DELIVERY_INITIAL_BACKOFF", retry.InitialBackoff)
+	p.notNegative("hooks.retry.max_backoff", "DELIVERY_MAX_BACKOFF", retry.MaxBackoff)
+	p.notNegative("hooks.retry.attempt_timeout", "DELIVERY_ATTEMPT_TIMEOUT", retry.AttemptTimeout)
+	p.notNegative("hooks.retry.max_retry_after", "DELIVERY_MAX_RETRY_AFTER", retry.MaxRetryAfter)
+
+	if breaker := c.Hooks.CircuitBreaker; breaker.Enabled {
+		p.notNegative("hooks.circuit_breaker.window", "CIRCUIT_BREAKER_WINDOW", breaker.Window)
+		p.notNegative("hooks.circuit_breaker.slow_call", "CIRCUIT_BREAKER_SLOW_CALL", breaker.SlowCall)
+		p.notNegative("hooks.circuit_breaker.open_duration", "CIRCUIT_BREAKER_OPEN_DURATION", breaker.OpenDuration)
+		p.atLeast("hooks.circuit_breaker.min_requests", "CIRCUIT_BREAKER_MIN_REQUESTS", breaker.MinRequests, 1)
+		p.atLeast("hooks.circuit_breaker.half_open_requests", "CIRCUIT_BREAKER_HALF_OPEN_REQUESTS", breaker.HalfOpenRequests, 1)
+		if breaker.FailureRatio <= 0 || breaker.FailureRatio > 1 {
+			p.add("hooks.circuit_breaker.failure_ratio", "CIRCUIT_BREAKER_FAILURE_RATIO", "must be above 0 and at most 1, got %g", breaker.FailureRatio)
+		}
+	}
+
+	p.notNegative("jwks.cache_max_age", "JWKS_CACHE_MAX_AGE", c.JWKS.CacheMaxAge)
+	if c.Admin.ListenAddress != "" && c.Admin.Token == "" {
+		p.add("admin.token", "ADMIN_API_TOKEN", "must be set when admin.listen_address (ADMIN_LISTEN_ADDR) is set")
+	}
+	if c.Tracing.Exporter != "none" && c.Tracing.Exporter != "otlp" {
+		p.add("tracing.exporter", "TRACING_EXPORTER", "must be none or otlp, got %q", c.Tracing.Exporter)
+	}
+	p.positive("health.check_interval", "HEALTH_CHECK_INTERVAL", c.Health.CheckInterval)
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		p.add("tracing.sample_ratio", "TRACING_SAMPLE_RATIO", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+
+	return errors.Join(p...)
+}
+
+// tracingConfig returns the tracing configuration
+func (c *PluginConfig) tracingConfig() TracingConfig {
+	return TracingConfig{
+		Exporter:    c.Tracing.Exporter,
+		Endpoint:    c.Tracing.Endpoint,
+		Insecure:    c.Tracing.Insecure,
+		SampleRatio: c.Tracing.SampleRatio,
+		ServiceName: c.Tracing.ServiceName,
+	}
+}
+
+// applyLogging sets the level and format of the plugin log
+func (c *PluginConfig) applyLogging() {
+	level, err := logrus.ParseLevel(c.Logging.Level)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	log.SetLevel(level)
+	if c.Logging.Format == "json" {
+		log.SetFormatter(&logrus.JSONFormatter{})
+	} else {
+		log.SetFormatter(&logrus.TextFormatter{})
+	}
+}
+
+// restartRequired returns the sections whose changes only take effect after a
+// restart, as they configure listeners, stores or key sources in use
+func (c *PluginConfig) restartRequired(next *PluginConfig) []string {
+	var sections []string
+	for _, section := range []struct {
+		name          string
+		current, next interface{}
+	}{
+		{"listener", c.Listener, next.Listener},
+		{"tls", c.TLS, next.TLS},
+		{"stores.dead_letters", c.Stores.DeadLetters, next.Stores.DeadLetters},
+		{"stores.delivery_queue", c.Stores.DeliveryQueue, next.Stores.DeliveryQueue},
+		{"keys", c.Keys, next.Keys},
+		{"hooks.circuit_breaker", c.Hooks.CircuitBreaker, next.Hooks.CircuitBreaker},
+		{"jwks", c.JWKS, next.JWKS},
+		{"admin", c.Admin, next.Admin},
+		{"metrics", c.Metrics, next.Metrics},
+		{"tracing", c.Tracing, next.Tracing},
+		{"health", c.Health, next.Health},
+	} {
+		currentJSON, _ := json.Marshal(section.current)
+		nextJSON, _ := json.Marshal(section.next)
+		if !bytes.Equal(currentJSON, nextJSON) {
+			sections = append(sections, section.name)
+		}
+	}
+	return sections
+}
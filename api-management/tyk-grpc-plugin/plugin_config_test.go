@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEnv returns an environment lookup reading the given variables
+func testEnv(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+// writeConfigFile writes a config file with the given name to a temporary directory
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	return path
+}
+
+// TestLoadPluginConfigFile tests reading YAML and JSON config files over the defaults
+func TestLoadPluginConfigFile(t *testing.T) {
+	files := map[string]string{
+		"plugin.yaml": `
+listener:
+  address: ":6666"
+hooks:
+  signing:
+    profile: obuk
+    issuer: bank
+  retry:
+    max_attempts: 5
+    initial_backoff: 250ms
+keys:
+  keys:
+    - kid: key-1
+      path: /keys/key-1.pem
+`,
+		"plugin.json": `{
+  "listener": {"address": ":6666"},
+  "hooks": {"signing": {"profile": "obuk", "issuer": "bank"}, "retry": {"max_attempts": 5, "initial_backoff": "250ms"}},
+  "keys": {"keys": [{"kid": "key-1", "path": "/keys/key-1.pem"}]}
+}`,
+	}
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			config, err := loadPluginConfig(writeConfigFile(t, name, content), testEnv(nil))
+			if err != nil {
+				t.Fatalf("loadPluginConfig returned an error: %v", err)
+			}
+			if config.Listener.Address != ":6666" || config.Hooks.Signing.Profile != "obuk" || config.Hooks.Signing.Issuer != "bank" {
+				t.Errorf("Expected the file settings, got %+v", config)
+			}
+			if config.Hooks.Retry.MaxAttempts != 5 || config.Hooks.Retry.InitialBackoff != Duration(250*time.Millisecond) {
+				t.Errorf("Expected the retry settings, got %+v", config.Hooks.Retry)
+			}
+			if len(config.Keys.Keys) != 1 || config.Keys.Keys[0].KeyID != "key-1" {
+				t.Errorf("Expected the listed key, got %+v", config.Keys.Keys)
+			}
+			// Settings left out keep their defaults
+			if config.Hooks.Retry.MaxBackoff != Duration(defaultRetryConfig.MaxBackoff) || !config.Hooks.CircuitBreaker.Enabled {
+				t.Errorf("Expected the defaults for unset settings, got %+v", config.Hooks)
+			}
+		})
+	}
+}
+
+// TestLoadPluginConfigEnvOverrides tests that environment variables override the file
+func TestLoadPluginConfigEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, "plugin.yaml", "hooks:\n  targets:\n    allowed_hosts: [a.example.com]\n    max_redirects: 1\n")
+	config, err := loadPluginConfig(path, testEnv(map[string]string{
+		"TARGET_ALLOWED_HOSTS":    "b.example.com, c.example.com",
+		"JWS_VERIFY_ALGORITHMS":   "PS256, ES256",
+		"CIRCUIT_BREAKER_ENABLED": "false",
+		"JWS_SIGNER_TIMEOUT":      "5s",
+		"TARGET_MAX_REDIRECTS":    "",
+	}))
+	if err != nil {
+		t.Fatalf("loadPluginConfig returned an error: %v", err)
+	}
+	if strings.Join(config.Hooks.Targets.AllowedHosts, ",") != "b.example.com,c.example.com" {
+		t.Errorf("Expected the environment hosts, got %v", config.Hooks.Targets.AllowedHosts)
+	}
+	if !slices.Equal(config.Hooks.Verification.Algorithms, []string{"PS256", "ES256"}) {
+		t.Errorf("Expected the trimmed algorithms, got %q", config.Hooks.Verification.Algorithms)
+	}
+	if config.Hooks.CircuitBreaker.Enabled || config.Keys.Signer.Timeout != Duration(5*time.Second) {
+		t.Errorf("Expected the environment overrides, got %+v", config)
+	}
+	// Empty variables leave the file setting
+	if config.Hooks.Targets.MaxRedirects != 1 {
+		t.Errorf("Expected the file setting, got %d", config.Hooks.Targets.MaxRedirects)
+	}
+}
+
+// TestLoadPluginConfigErrors tests that invalid settings are reported with their names
+func TestLoadPluginConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		content  string
+		env      map[string]string
+		expected []string
+	}{
+		{"unknown field", "plugin.yaml", "hooks:\n  retries: 3\n", nil, []string{`unknown field "retries"`}},
+		{"wrong type", "plugin.json", `{"hooks": {"retry": {"max_attempts": "three"}}}`, nil, []string{"hooks.retry.max_attempts", "int"}},
+		{"bad duration", "plugin.yaml", "stores:\n  idempotency:\n    gc_interval: often\n", nil, []string{"often"}},
+		{"unsupported format", "plugin.toml", "", nil, []string{"unsupported format"}},
+		{"bad environment", "plugin.yaml", "", map[string]string{"DELIVERY_MAX_ATTEMPTS": "many", "DELIVERY_ASYNC": "maybe"}, []string{"DELIVERY_MAX_ATTEMPTS", "DELIVERY_ASYNC"}},
+		{"bad listener", "plugin.yaml", "listener:\n  address: http://localhost:5555\n  max_recv_message_size: -1\n", map[string]string{"GRPC_KEEPALIVE_TIME": "-1s", "GRPC_SOCKET_MODE": "rw-rw----"}, []string{"listener.address (GRPC_LISTEN_ADDR)", "listener.socket_mode (GRPC_SOCKET_MODE)", "listener.max_recv_message_size (GRPC_MAX_RECV_MSG_SIZE)", "listener.keepalive.time (GRPC_KEEPALIVE_TIME)"}},
+		{"bad server tls", "plugin.yaml", "tls:\n  server:\n    key: /certs/plugin.key\n    client_names: [gateway]\n", nil, []string{"tls.server.cert (GRPC_TLS_CERT)", "tls.server.client_names (GRPC_TLS_CLIENT_NAMES)"}},
+		{"bad redaction path", "plugin.yaml", "", map[string]string{"LOG_REDACT_JSON_PATHS": "Data..DebtorAccount"}, []string{"logging.redact_json_paths (LOG_REDACT_JSON_PATHS)"}},
+		{"bad drain timeout", "plugin.yaml", "", map[string]string{"GRPC_DRAIN_TIMEOUT": "0s"}, []string{"listener.drain_timeout (GRPC_DRAIN_TIMEOUT)"}},
+		{"bad tracing", "plugin.yaml", "tracing:\n  exporter: zipkin\n", map[string]string{"TRACING_SAMPLE_RATIO": "1.5"}, []string{"tracing.exporter (TRACING_EXPORTER)", "tracing.sample_ratio (TRACING_SAMPLE_RATIO)"}},
+		{
+			"every problem listed", "plugin.yaml",
+			"logging:\n  level: loud\nhooks:\n  signing:\n    profile: jades\n  circuit_breaker:\n    failure_ratio: 2\nadmin:\n  listen_address: \":8080\"\n",
+			nil,
+			[]string{"logging.level (LOG_LEVEL)", "hooks.signing.profile (JWS_PROFILE)", "hooks.circuit_breaker.failure_ratio", "admin.token (ADMIN_API_TOKEN)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadPluginConfig(writeConfigFile(t, tt.file, tt.content), testEnv(tt.env))
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			for _, expected := range tt.expected {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected the error to mention %q, got: %v", expected, err)
+				}
+			}
+		})
+	}
+}
+
+// TestRestartRequired tests detecting changes that need a restart
+func TestRestartRequired(t *testing.T) {
+	current := defaultPluginConfig()
+	next := defaultPluginConfig()
+	next.Hooks.Retry.MaxAttempts = 7
+	if sections := current.restartRequired(next); len(sections) != 0 {
+		t.Errorf("Expected hook policies to reload, got %v", sections)
+	}
+
+	next.Listener.Address = ":7777"
+	next.Keys.Directory = "/keys"
+	if sections := current.restartRequired(next); strings.Join(sections, ",") != "listener,keys" {
+		t.Errorf("Expected listener and keys to need a restart, got %v", sections)
+	}
+}
+
+// TestLoadPluginConfigKeepsDefaultLists tests that lists from one file do not
+// leak into the defaults of the next load
+func TestLoadPluginConfigKeepsDefaultLists(t *testing.T) {
+	path := writeConfigFile(t, "plugin.yaml", "logging:\n  redact_headers: [X-Custom]\n  redact_json_paths: [Data.Custom]\n")
+	if _, err := loadPluginConfig(path, testEnv(nil)); err != nil {
+		t.Fatalf("loadPluginConfig returned an error: %v", err)
+	}
+
+	config, err := loadPluginConfig(writeConfigFile(t, "plugin.yaml", "listener:\n  address: \":6666\"\n"), testEnv(nil))
+	if err != nil {
+		t.Fatalf("loadPluginConfig returned an error: %v", err)
+	}
+	if config.Logging.RedactHeaders[0] != "Authorization" || config.Logging.RedactJSONPaths[0] != "Data.Initiation.DebtorAccount" {
+		t.Errorf("Expected the default redaction lists, got %v and %v", config.Logging.RedactHeaders, config.Logging.RedactJSONPaths)
+	}
+	if defaultLogRedactionConfig.Headers[0] != "Authorization" {
+		t.Errorf("Expected the defaults to be left unchanged, got %v", defaultLogRedactionConfig.Headers)
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"google.golang.org/grpc"
+)
+
+// handlerSource provides the handler currently serving requests
+type handlerSource interface {
+	Handler() *DPoPHandler
+}
+
+// Handler returns the handler itself, for components used without reloads
+func (d *DPoPHandler) Handler() *DPoPHandler {
+	return d
+}
+
+// pluginServer serves Tyk's gRPC requests with the current handler. Reloading
+// the configuration builds a new handler and swaps it in atomically, so each
+// request runs with either the old or the new settings, never a mix.
+type pluginServer struct {
+	pb.UnimplementedDispatcherServer
+	configPath string
+	lookupEnv  func(string) (string, bool)
+	current    atomic.Pointer[DPoPHandler]
+	// Serialises reloads
+	reloadMu sync.Mutex
+}
+
+// newPluginServer loads the configuration and builds the first handler
+func newPluginServer(configPath string, lookupEnv func(string) (string, bool)) (*pluginServer, error) {
+	config, err := loadPluginConfig(configPath, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	config.applyLogging()
+
+	server := &pluginServer{configPath: configPath, lookupEnv: lookupEnv}
+	handler, err := newHandler(config, nil, server)
+	if err != nil {
+		return nil, err
+	}
+	server.current.Store(handler)
+	return server, nil
+}
+
+// Handler returns the handler currently serving requests
+func (s *pluginServer) Handler() *DPoPHandler {
+	return s.current.Load()
+}
+
+// newGRPCServer creates the server of the Dispatcher service. Every call is
+// traced, joining the trace of the gateway when it propagates one.
+func newGRPCServer(options ...grpc.ServerOption) *grpc.Server {
+	return grpc.NewServer(append([]grpc.ServerOption{grpc.StatsHandler(otelgrpc.NewServerHandler())}, options...)...)
+}
+
+// Dispatch runs the hook with the current handler
+func (s *pluginServer) Dispatch(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	return s.Handler().Dispatch(ctx, object)
+}
+
+// Reload reloads the signing keys and certificates, then the config file and
+// environment. An invalid configuration is refused and the current handler
+// keeps serving.
+func (s *pluginServer) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	current := s.Handler()
+	if current.keyRing != nil {
+		if err := current.keyRing.Reload(); err != nil {
+			log.Errorf("Failed to reload JWS signing keys, keeping the current keys: %v", err)
+		}
+	}
+	if current.serverTLS != nil {
+		if err := current.serverTLS.Reload(); err != nil {
+			log.Errorf("Failed to reload gRPC server certificates, keeping the current certificates: %v", err)
+		}
+	}
+	if current.outboundTLS != nil {
+		if err := current.outboundTLS.Reload(); err != nil {
+			log.Errorf("Failed to reload outbound TLS certificates, keeping the current certificates: %v", err)
+		}
+	}
+
+	config, err := loadPluginConfig(s.configPath, s.lookupEnv)
+	if err != nil {
+		return err
+	}
+	handler, err := newHandler(config, current, s)
+	if err != nil {
+		return err
+	}
+
+	if sections := current.settings.restartRequired(config); len(sections) > 0 {
+		log.Warnf("Changes to %s take effect after a restart", strings.Join(sections, ", "))
+	}
+	config.applyLogging()
+	s.current.Store(handler)
+	// The new handler opens its own connections to the targets
+	current.targetTransport.close()
+	log.Info("Configuration reloaded")
+	return nil
+}
+
+// newHandler builds a handler from the configuration. When reloading, the
+// stores, keys, certificates, circuit breakers and delivery queue of the
+// previous handler are kept, so their state survives the swap; the hook
+// policies are built afresh.
+func newHandler(config *PluginConfig, previous *DPoPHandler, source handlerSource) (*DPoPHandler, error) {
+	handler := &DPoPHandler{
+		settings: config,
+		config: IdempotencyConfig{
+			ExpirationTime: time.Duration(config.Stores.Idempotency.ExpirationTime),
+			GCInterval:     time.Duration(config.Stores.Idempotency.GCInterval),
+		},
+		jwsConfig: JWSConfig{
+			PrivateKeyPath:   config.Keys.PrivateKeyPath,
+			PrivateKeyString: config.Keys.PrivateKey,
+			KeyID:            config.Keys.KeyID,
+			Issuer:           config.Hooks.Signing.Issuer,
+			TrustAnchor:      config.Hooks.Signing.TrustAnchor,
+			Algorithm:        config.Keys.Algorithm,
+		},
+		jwsResponseConfig: JWSResponseConfig{
+			ExcludedContentTypes: config.Hooks.ResponseSigning.ExcludeContentTypes,
+			ExcludedStatusCodes:  config.Hooks.ResponseSigning.ExcludeStatusCodes,
+		},
+		setConfig: SETConfig{
+			Issuer:              config.Hooks.SET.Issuer,
+			ResourceLinkBase:    config.Hooks.SET.ResourceLinkBase,
+			ResourceLinkVersion: config.Hooks.SET.ResourceLinkVersion,
+		},
+		targetPolicy: TargetPolicyConfig{
+			AllowedSchemes:       config.Hooks.Targets.AllowedSchemes,
+			AllowedHosts:         config.Hooks.Targets.AllowedHosts,
+			BlockPrivateNetworks: !config.Hooks.Targets.AllowPrivateNetworks,
+			MaxRedirects:         config.Hooks.Targets.MaxRedirects,
+		},
+		headerPolicy: HeaderPolicyConfig{
+			AllowedRequestHeaders:  config.Hooks.Headers.AllowedRequestHeaders,
+			AllowedResponseHeaders: config.Hooks.Headers.AllowedResponseHeaders,
+			StripForwardedHeaders:  config.Hooks.Headers.StripForwardedHeaders,
+		},
+		retryConfig: RetryConfig{
+			MaxAttempts:    config.Hooks.Retry.MaxAttempts,
+			InitialBackoff: time.Duration(config.Hooks.Retry.InitialBackoff),
+			MaxBackoff:     time.Duration(config.Hooks.Retry.MaxBackoff),
+			AttemptTimeout: time.Duration(config.Hooks.Retry.AttemptTimeout),
+			MaxRetryAfter:  time.Duration(config.Hooks.Retry.MaxRetryAfter),
+		},
+		jwksConfig: defaultJWKSConfig,
+	}
+	handler.redactor = NewRedactor(LogRedactionConfig{
+		Headers:   config.Logging.RedactHeaders,
+		JSONPaths: config.Logging.RedactJSONPaths,
+	})
+	handler.jwksConfig.ListenAddr = config.JWKS.ListenAddress
+	handler.jwksConfig.CacheMaxAge = time.Duration(config.JWKS.CacheMaxAge)
+
+	// Validated with the rest of the configuration
+	handler.jwsConfig.Profile, _ = parseJWSProfile(config.Hooks.Signing.Profile)
+
+	// Register composite hooks running several hooks in one call
+	if config.Hooks.Composites != "" {
+		handler.hooks = newBuiltinHookRegistry()
+		if err := handler.hooks.loadCompositeHooks(config.Hooks.Composites); err != nil {
+			return nil, fmt.Errorf("hooks.composites (HOOK_COMPOSITES): %w", err)
+		}
+	}
+
+	// Restrict the URLs requests can be forwarded to with x-rewrite-target
+	if config.Hooks.Targets.Callbacks != "" {
+		callbacks, err := loadTargetCallbacks(config.Hooks.Targets.Callbacks)
+		if err != nil {
+			return nil, fmt.Errorf("hooks.targets.callbacks (TARGET_CALLBACKS): %w", err)
+		}
+		handler.targetPolicy.Callbacks = callbacks
+	}
+
+	// Load the TPPs that receive their notifications encrypted
+	if config.Hooks.JWE.Recipients != "" {
+		recipients, err := loadJWERecipients(config.Hooks.JWE.Recipients)
+		if err != nil {
+			return nil, fmt.Errorf("hooks.jwe.recipients (JWE_RECIPIENTS): %w", err)
+		}
+		handler.jweConfig.Recipients = recipients
+		log.Infof("Loaded %d JWE recipients", len(recipients))
+	}
+
+	// Set up the key resolver if JWS verification is configured
+	handler.jwsVerifyConfig = defaultJWSVerifyConfig
+	handler.jwsVerifyConfig.JWKSRegistryPath = config.Hooks.Verification.JWKSRegistry
+	handler.jwsVerifyConfig.JWKSDirectory = config.Hooks.Verification.JWKSDir
+	handler.jwsVerifyConfig.AllowedAlgorithms = config.Hooks.Verification.Algorithms
+	if config.Hooks.Verification.Issuers != "" {
+		issuers, err := loadTPPIssuers(config.Hooks.Verification.Issuers)
+		if err != nil {
+			return nil, fmt.Errorf("hooks.verification.issuers (JWS_VERIFY_ISSUERS): %w", err)
+		}
+		handler.jwsVerifyConfig.Issuers = issuers
+	}
+	if handler.jwsVerifyConfig.JWKSRegistryPath != "" || handler.jwsVerifyConfig.JWKSDirectory != "" {
+		keyResolver, err := newKeyResolver(handler.jwsVerifyConfig)
+		if err != nil {
+			log.Warnf("Failed to set up JWS verification: %v", err)
+			log.Warn("JWS verification will be disabled")
+		} else {
+			handler.keyResolver = keyResolver
+			log.Info("JWS verification key resolver configured")
+		}
+	} else {
+		log.Warn("JWS verification not configured (JWS_VERIFY_JWKS_REGISTRY or JWS_VERIFY_JWKS_DIR not set)")
+	}
+
+	if previous != nil {
+		// Keep the state built at startup
+		handler.metrics = previous.metrics
+		handler.pluginMetrics = previous.pluginMetrics
+		handler.apiConfigs = previous.apiConfigs
+		handler.outboundTLS = previous.outboundTLS
+		handler.serverTLS = previous.serverTLS
+		handler.breakers = previous.breakers
+		handler.deadLetters = previous.deadLetters
+		handler.deliveryQueue = previous.deliveryQueue
+
+		if err := handler.reloadSigningKeys(config, previous); err != nil {
+			return nil, err
+		}
+		return handler, nil
+	}
+
+	handler.metrics = &IdempotencyMetrics{LastRun: time.Now()}
+	handler.pluginMetrics = NewPluginMetrics(source)
+	handler.apiConfigs = NewAPIConfigCache()
+
+	if err := handler.setUpSigningKeys(config); err != nil {
+		return nil, err
+	}
+
+	// Serve the gateways over TLS, verifying their client certificates if configured
+	if server := config.TLS.Server; server.Cert != "" {
+		serverTLS, err := NewServerTLS(ServerTLSConfig{
+			CertPath:       server.Cert,
+			KeyPath:        server.Key,
+			ClientCAPath:   server.ClientCA,
+			ClientNames:    server.ClientNames,
+			ReloadInterval: time.Duration(server.ReloadInterval),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tls.server: %w", err)
+		}
+		handler.serverTLS = serverTLS
+	}
+
+	// Present the transport certificate to targets and verify them with the configured CAs and pins
+	outbound := config.TLS.Outbound
+	if outbound.Cert != "" || outbound.Key != "" || outbound.CA != "" || len(outbound.PinnedKeys) > 0 {
+		outboundTLS, err := NewOutboundTLS(OutboundTLSConfig{
+			CertPath:       outbound.Cert,
+			KeyPath:        outbound.Key,
+			CAPath:         outbound.CA,
+			PinnedKeys:     outbound.PinnedKeys,
+			ReloadInterval: time.Duration(outbound.ReloadInterval),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("tls.outbound: %w", err)
+		}
+		handler.outboundTLS = outboundTLS
+	}
+
+	// Fail fast for target hosts that keep failing
+	if breaker := config.Hooks.CircuitBreaker; breaker.Enabled {
+		handler.breakers = NewCircuitBreakers(CircuitBreakerConfig{
+			Window:            time.Duration(breaker.Window),
+			MinRequests:       breaker.MinRequests,
+			FailureRatio:      breaker.FailureRatio,
+			SlowCallThreshold: time.Duration(breaker.SlowCall),
+			OpenDuration:      time.Duration(breaker.OpenDuration),
+			HalfOpenRequests:  breaker.HalfOpenRequests,
+		})
+	}
+
+	// Keep the requests that exhaust the retries
+	credentialsKey, err := decodeCredentialsKey(config.Stores.DeadLetters.CredentialsKey)
+	if err != nil {
+		return nil, fmt.Errorf("stores.dead_letters.credentials_key (DEAD_LETTER_CREDENTIALS_KEY): %w", err)
+	}
+	deadLetters, err := NewDeadLetterStore(DeadLetterConfig{
+		MaxEntries:     config.Stores.DeadLetters.MaxEntries,
+		Path:           config.Stores.DeadLetters.Path,
+		CredentialsKey: credentialsKey,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("stores.dead_letters.path (DEAD_LETTER_FILE): %w", err)
+	}
+	handler.deadLetters = deadLetters
+
+	// Deliver forwarded requests in the background if configured
+	if queue := config.Stores.DeliveryQueue; queue.Enabled {
+		handler.deliveryQueue = NewDeliveryQueue(source, DeliveryQueueConfig{
+			Workers:            queue.Workers,
+			PerHostConcurrency: queue.PerHostConcurrency,
+			QueueSize:          queue.QueueSize,
+			StatusRetention:    time.Duration(queue.StatusRetention),
+		})
+	}
+
+	return handler, nil
+}
+
+// setUpSigningKeys loads the signing key, remote signer and key ring. Keys
+// that cannot be loaded disable signing with a warning, as before the config
+// file, unless keys.required is set; keys that do not suit the default
+// profile fail startup.
+func (d *DPoPHandler) setUpSigningKeys(config *PluginConfig) error {
+	// Load the private key if JWS signing is configured
+	if d.jwsConfig.PrivateKeyPath != "" || d.jwsConfig.PrivateKeyString != "" {
+		privateKey, err := d.loadPrivateKey()
+		if err != nil && config.Keys.Required {
+			return fmt.Errorf("keys.private_key_path (JWS_PRIVATE_KEY_PATH): failed to load JWS private key: %w", err)
+		}
+		if err != nil {
+			log.Warnf("Failed to load JWS private key: %v", err)
+			log.Warn("JWS signing will be disabled")
+		} else {
+			d.privateKey = privateKey
+			if err := d.checkDefaultKeyProfile(); err != nil {
+				return err
+			}
+			log.Info("JWS private key loaded successfully")
+		}
+	} else if config.Keys.Signer.URL == "" && config.Keys.Directory == "" && len(config.Keys.Keys) == 0 {
+		log.Warn("JWS signing not configured (JWS_PRIVATE_KEY_PATH, JWS_PRIVATE_KEY, JWS_SIGNER_URL, JWS_KEYS_DIR or JWS_KEYS not set)")
+	}
+
+	// Sign through a remote signing service if the key is held by a KMS or HSM
+	if config.Keys.Signer.URL != "" {
+		remoteConfig := d.remoteSignerConfig(config)
+		signer, err := NewRemoteSigner(remoteConfig)
+		if err != nil && config.Keys.Required {
+			return fmt.Errorf("keys.signer.url (JWS_SIGNER_URL): failed to set up the remote JWS signer: %w", err)
+		}
+		if err != nil {
+			log.Warnf("Failed to set up the remote JWS signer: %v", err)
+			log.Warn("JWS signing will use JWS_PRIVATE_KEY_PATH or JWS_PRIVATE_KEY if set")
+		} else {
+			d.privateKey = signer
+			if err := d.checkDefaultKeyProfile(); err != nil {
+				return err
+			}
+			log.Infof("JWS signing through the signing service at %s", remoteConfig.URL)
+		}
+	}
+
+	// Load the signing key ring if key rotation is configured
+	if config.Keys.Directory != "" || len(config.Keys.Keys) > 0 {
+		keyRing, err := NewKeyRing(keyRingConfig(config))
+		if err != nil && config.Keys.Required {
+			return fmt.Errorf("keys.directory (JWS_KEYS_DIR): failed to load JWS signing keys: %w", err)
+		}
+		if err != nil {
+			log.Warnf("Failed to load JWS signing keys: %v", err)
+			log.Warn("JWS signing will use JWS_PRIVATE_KEY_PATH or JWS_PRIVATE_KEY if set")
+		} else {
+			d.keyRing = keyRing
+		}
+	}
+	return nil
+}
+
+// reloadSigningKeys loads the signing key and remote signer again, so a
+// replaced key file is picked up and a key that failed to load before is
+// retried. A key that cannot be loaded now leaves the previous one in use. The
+// key ring is reloaded by the server and kept, or built if it failed before.
+func (d *DPoPHandler) reloadSigningKeys(config *PluginConfig, previous *DPoPHandler) error {
+	d.privateKey = previous.privateKey
+	if d.jwsConfig.PrivateKeyPath != "" || d.jwsConfig.PrivateKeyString != "" {
+		privateKey, err := d.loadPrivateKey()
+		if err != nil {
+			log.Errorf("Failed to reload JWS private key, keeping the current key: %v", err)
+		} else {
+			d.privateKey = privateKey
+		}
+	}
+	if config.Keys.Signer.URL != "" {
+		signer, err := NewRemoteSigner(d.remoteSignerConfig(config))
+		if err != nil {
+			log.Errorf("Failed to set up the remote JWS signer, keeping the current key: %v", err)
+		} else {
+			d.privateKey = signer
+		}
+	}
+
+	d.keyRing = previous.keyRing
+	if d.keyRing == nil && (config.Keys.Directory != "" || len(config.Keys.Keys) > 0) {
+		keyRing, err := NewKeyRing(keyRingConfig(config))
+		if err != nil {
+			log.Errorf("Failed to load JWS signing keys: %v", err)
+		} else {
+			d.keyRing = keyRing
+		}
+	}
+
+	if d.privateKey == nil && d.keyRing == nil {
+		if config.Keys.PrivateKeyPath != "" || config.Keys.PrivateKey != "" || config.Keys.Signer.URL != "" || config.Keys.Directory != "" || len(config.Keys.Keys) > 0 {
+			log.Warn("No JWS signing key loaded, JWS signing stays disabled")
+		}
+		return nil
+	}
+
+	// The keys must suit the default profile. A key ring with no key valid
+	// right now does not fail the reload: signing fails until one is.
+	key, err := d.defaultSigningKey()
+	if err != nil && d.keyRing != nil {
+		log.Warnf("No JWS signing key usable right now: %v", err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("keys.algorithm (JWS_ALGORITHM): %w", err)
+	}
+	if err := checkProfileAlgorithm(d.jwsConfig.Profile, key.Algorithm); err != nil {
+		return fmt.Errorf("hooks.signing.profile (JWS_PROFILE): %w", err)
+	}
+	return nil
+}
+
+// remoteSignerConfig returns the configuration of the remote signer holding the default key
+func (d *DPoPHandler) remoteSignerConfig(config *PluginConfig) RemoteSignerConfig {
+	signerConfig := keyRingConfig(config).Signer
+	signerConfig.URL = config.Keys.Signer.URL
+	signerConfig.KeyID = d.jwsConfig.KeyID
+	return signerConfig
+}
+
+// keyRingConfig returns the configuration of the signing key ring
+func keyRingConfig(config *PluginConfig) KeyRingConfig {
+	return KeyRingConfig{
+		Directory:      config.Keys.Directory,
+		Keys:           config.Keys.Keys,
+		ActiveKeyID:    config.Keys.ActiveKeyID,
+		ReloadInterval: time.Duration(config.Keys.ReloadInterval),
+		Signer: RemoteSignerConfig{
+			Token:   config.Keys.Signer.Token,
+			Timeout: time.Duration(config.Keys.Signer.Timeout),
+		},
+	}
+}
+
+// checkDefaultKeyProfile fails fast on an algorithm the key or the default profile cannot use
+func (d *DPoPHandler) checkDefaultKeyProfile() error {
+	key, err := d.defaultSigningKey()
+	if err == nil {
+		err = checkProfileAlgorithm(d.jwsConfig.Profile, key.Algorithm)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid JWS signing configuration: %w", err)
+	}
+	return nil
+}
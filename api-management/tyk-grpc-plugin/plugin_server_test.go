@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// TestPluginServerReload tests that a reload swaps in new policies and keeps the stores
+func TestPluginServerReload(t *testing.T) {
+	path := writeConfigFile(t, "plugin.yaml", "hooks:\n  retry:\n    max_attempts: 2\n")
+	server, err := newPluginServer(path, testEnv(nil))
+	if err != nil {
+		t.Fatalf("newPluginServer returned an error: %v", err)
+	}
+	first := server.Handler()
+	if first.retryConfig.MaxAttempts != 2 {
+		t.Fatalf("Expected 2 attempts, got %d", first.retryConfig.MaxAttempts)
+	}
+
+	if err := os.WriteFile(path, []byte("hooks:\n  retry:\n    max_attempts: 5\n  headers:\n    strip_forwarded_headers: true\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %v", err)
+	}
+
+	second := server.Handler()
+	if second == first {
+		t.Fatal("Expected a new handler")
+	}
+	if second.retryConfig.MaxAttempts != 5 || !second.headerPolicy.StripForwardedHeaders {
+		t.Errorf("Expected the reloaded policies, got %+v, %+v", second.retryConfig, second.headerPolicy)
+	}
+	if second.deadLetters != first.deadLetters || second.breakers != first.breakers || second.metrics != first.metrics {
+		t.Error("Expected the stores to be kept")
+	}
+	// The first handler keeps its settings for requests still using it
+	if first.retryConfig.MaxAttempts != 2 {
+		t.Errorf("Expected the previous handler to be unchanged, got %d", first.retryConfig.MaxAttempts)
+	}
+
+	// An invalid configuration is refused and the current handler keeps serving
+	if err := os.WriteFile(path, []byte("hooks:\n  retry:\n    max_attempts: 0\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write config file: %v", err)
+	}
+	if err := server.Reload(); err == nil {
+		t.Error("Expected the reload to fail")
+	}
+	if server.Handler() != second {
+		t.Error("Expected the current handler to be kept")
+	}
+
+	// Requests are dispatched to the current handler
+	result, err := server.Dispatch(context.Background(), &pb.Object{HookName: "Missing", Request: &pb.MiniRequestObject{}})
+	if err != nil || result.Request.ReturnOverrides != nil {
+		t.Errorf("Expected the request to pass through, got %+v, %v", result, err)
+	}
+}
+
+// TestPluginServerRequiredKeys tests that keys failing to load only fail startup when required
+func TestPluginServerRequiredKeys(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.pem")
+	tests := []struct {
+		name string
+		env  map[string]string
+	}{
+		{"private key", map[string]string{"JWS_PRIVATE_KEY_PATH": missing}},
+		{"key ring", map[string]string{"JWS_KEYS_DIR": filepath.Join(t.TempDir(), "missing")}},
+		{"remote signer", map[string]string{"JWS_SIGNER_URL": "http://signer.example.com/sign"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, err := newPluginServer("", testEnv(tt.env))
+			if err != nil {
+				t.Fatalf("Expected the plugin to start without the key, got %v", err)
+			}
+			if handler := server.Handler(); handler.privateKey != nil || handler.keyRing != nil {
+				t.Error("Expected no signing key to be loaded")
+			}
+
+			tt.env["JWS_KEYS_REQUIRED"] = "true"
+			if _, err := newPluginServer("", testEnv(tt.env)); err == nil {
+				t.Error("Expected startup to fail when keys are required")
+			}
+		})
+	}
+}
+
+// TestPluginServerReloadSigningKeys tests that a reload reads the signing key again
+func TestPluginServerReloadSigningKeys(t *testing.T) {
+	keyPath := filepath.Join(t.TempDir(), "signing.pem")
+	server, err := newPluginServer("", testEnv(map[string]string{"JWS_PRIVATE_KEY_PATH": keyPath}))
+	if err != nil {
+		t.Fatalf("newPluginServer returned an error: %v", err)
+	}
+	if server.Handler().privateKey != nil {
+		t.Fatal("Expected no signing key before the key file exists")
+	}
+
+	// A key that failed to load at startup is loaded by the reload
+	first, firstPEM := generateTestKey(t)
+	if err := os.WriteFile(keyPath, []byte(firstPEM), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %v", err)
+	}
+	if key := server.Handler().privateKey; key == nil || !first.PublicKey.Equal(key.Public()) {
+		t.Fatal("Expected the key to be loaded")
+	}
+
+	// A replaced key file is read again
+	second, secondPEM := generateTestKey(t)
+	if err := os.WriteFile(keyPath, []byte(secondPEM), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %v", err)
+	}
+	if key := server.Handler().privateKey; key == nil || !second.PublicKey.Equal(key.Public()) {
+		t.Fatal("Expected the replaced key to be loaded")
+	}
+
+	// A key file that cannot be read keeps the loaded key
+	if err := os.WriteFile(keyPath, []byte("not a key"), 0o600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %v", err)
+	}
+	if key := server.Handler().privateKey; key == nil || !second.PublicKey.Equal(key.Public()) {
+		t.Error("Expected the loaded key to be kept")
+	}
+}
+
+// TestPluginServerReloadNoValidKey tests that a key ring with no key valid right now does not fail the reload
+func TestPluginServerReloadNoValidKey(t *testing.T) {
+	dir := t.TempDir()
+	writeTestKey(t, dir, "key-2023", &KeyConfig{NotBefore: time.Now().Add(-48 * time.Hour), NotAfter: time.Now().Add(-time.Hour)})
+
+	server, err := newPluginServer("", testEnv(map[string]string{"JWS_KEYS_DIR": dir}))
+	if err != nil {
+		t.Fatalf("newPluginServer returned an error: %v", err)
+	}
+	if err := server.Reload(); err != nil {
+		t.Errorf("Expected the reload to succeed, got %v", err)
+	}
+	if server.Handler().keyRing == nil {
+		t.Error("Expected the key ring to be kept")
+	}
+}
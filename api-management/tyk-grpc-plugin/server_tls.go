@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"slices"
+	"time"
+)
+
+// errClientNotAllowed is returned when a gateway presents a certificate issued to another name
+var errClientNotAllowed = errors.New("client certificate not issued to an allowed name")
+
+// ServerTLSConfig contains configuration for TLS on the gRPC listener
+type ServerTLSConfig struct {
+	// Server certificate and private key presented to the gateways (PEM format)
+	CertPath string
+	KeyPath  string
+	// CA bundle client certificates are verified with; when set, gateways must
+	// present a certificate issued by it
+	ClientCAPath string
+	// Common names or DNS names client certificates must be issued to (any when empty)
+	ClientNames []string
+	// How often the certificate files are checked for changes (default: 1 minute, 0 disables)
+	ReloadInterval time.Duration
+}
+
+// serverTLSSnapshot is an immutable set of loaded certificates
+type serverTLSSnapshot struct {
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// ServerTLS holds the certificates of the gRPC listener, applied to new connections
+type ServerTLS struct {
+	config ServerTLSConfig
+	files  fileReloader[*serverTLSSnapshot]
+}
+
+// NewServerTLS creates the listener TLS settings and loads the certificates
+func NewServerTLS(config ServerTLSConfig) (*ServerTLS, error) {
+	if config.CertPath == "" || config.KeyPath == "" {
+		return nil, errors.New("server certificate and key must be configured together")
+	}
+
+	s := &ServerTLS{config: config}
+	s.files = fileReloader[*serverTLSSnapshot]{
+		name:     "gRPC server certificate",
+		interval: config.ReloadInterval,
+		fingerprint: func() (string, error) {
+			return fileFingerprint(config.CertPath, config.KeyPath, config.ClientCAPath), nil
+		},
+		load: s.load,
+		loaded: func(snapshot *serverTLSSnapshot) {
+			leaf := snapshot.certificate.Leaf
+			log.Infof("Loaded gRPC server certificate %s (expires %s)", leaf.Subject, leaf.NotAfter.Format(time.RFC3339))
+		},
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload reads the certificates from disk and swaps them in
+func (s *ServerTLS) Reload() error {
+	return s.files.Reload()
+}
+
+// load reads the configured certificates into a new snapshot
+func (s *ServerTLS) load() (*serverTLSSnapshot, error) {
+	certificate, err := loadCertificate(s.config.CertPath, s.config.KeyPath, "server certificate")
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &serverTLSSnapshot{certificate: certificate}
+
+	if s.config.ClientCAPath != "" {
+		if snapshot.clientCAs, err = loadCertPool(s.config.ClientCAPath, "client CA bundle"); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshot, nil
+}
+
+// Watch reloads the certificates whenever the files change, until the context is cancelled
+func (s *ServerTLS) Watch(ctx context.Context) {
+	s.files.Watch(ctx)
+}
+
+// TLSConfig returns the server TLS configuration. Each handshake uses the
+// certificates loaded at the time, so reloads need no restart.
+func (s *ServerTLS) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			snapshot := s.files.Load()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				CipherSuites: fapiCipherSuites,
+				Certificates: []tls.Certificate{*snapshot.certificate},
+				NextProtos:   []string{"h2"},
+			}
+			if snapshot.clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = snapshot.clientCAs
+				if len(s.config.ClientNames) > 0 {
+					config.VerifyConnection = s.verifyClientName
+				}
+			}
+			return config, nil
+		},
+	}
+}
+
+// verifyClientName accepts the connection when the verified client
+// certificate is issued to one of the allowed names
+func (s *ServerTLS) verifyClientName(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errClientNotAllowed
+	}
+	leaf := state.PeerCertificates[0]
+	if slices.Contains(s.config.ClientNames, leaf.Subject.CommonName) {
+		return nil
+	}
+	for _, name := range leaf.DNSNames {
+		if slices.Contains(s.config.ClientNames, name) {
+			return nil
+		}
+	}
+	log.Warnf("Refused gRPC client certificate %s: not issued to an allowed name", leaf.Subject)
+	return errClientNotAllowed
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// newServerTLSTestServer serves the Dispatcher over TLS with the given settings
+func newServerTLSTestServer(t *testing.T, serverTLS *ServerTLS) *bufconn.Listener {
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer(grpcServerOptions(ListenerSettings{}, serverTLS)...)
+	pb.RegisterDispatcherServer(server, &DPoPHandler{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+	return listener
+}
+
+// dispatchOverTLS calls the Dispatcher with the client TLS configuration and
+// returns the common name of the server certificate
+func dispatchOverTLS(t *testing.T, listener *bufconn.Listener, config *tls.Config) (string, error) {
+	t.Helper()
+	config.ServerName = "127.0.0.1"
+	var serverName string
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		serverName = state.PeerCertificates[0].Subject.CommonName
+		return nil
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(credentials.NewTLS(config)))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	_, err = pb.NewDispatcherClient(conn).Dispatch(context.Background(), newHookTestObject("Missing", pb.HookType_Pre))
+	return serverName, err
+}
+
+// TestServerTLSClientCertificates tests that only gateways with an allowed client certificate can call Dispatch
+func TestServerTLSClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueTestCertificate(t, "Plugin CA", nil)
+	certPath, keyPath := issueTestCertificate(t, "plugin.example.com", ca).writePEM(t, dir)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	serverTLS, err := NewServerTLS(ServerTLSConfig{
+		CertPath:     certPath,
+		KeyPath:      keyPath,
+		ClientCAPath: writeCABundle(t, dir, ca),
+		ClientNames:  []string{"gateway.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("NewServerTLS returned an error: %v", err)
+	}
+	listener := newServerTLSTestServer(t, serverTLS)
+
+	otherCA := issueTestCertificate(t, "Other CA", nil)
+	tests := []struct {
+		name        string
+		certificate *testCertificate
+		maxVersion  uint16
+		allowed     bool
+	}{
+		{"allowed gateway", issueTestCertificate(t, "gateway.example.com", ca), 0, true},
+		{"allowed gateway over TLS 1.2", issueTestCertificate(t, "gateway.example.com", ca), tls.VersionTLS12, true},
+		{"no client certificate", nil, 0, false},
+		{"other CA", issueTestCertificate(t, "gateway.example.com", otherCA), 0, false},
+		{"other name", issueTestCertificate(t, "client.example.com", ca), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &tls.Config{RootCAs: roots, MaxVersion: tt.maxVersion}
+			if tt.certificate != nil {
+				config.Certificates = []tls.Certificate{tt.certificate.tlsCertificate()}
+			}
+			_, err := dispatchOverTLS(t, listener, config)
+			if tt.allowed && err != nil {
+				t.Errorf("Expected the call to succeed, got %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Error("Expected the call to be refused")
+			}
+		})
+	}
+}
+
+// TestServerTLSReload tests that new connections use the reloaded certificate
+func TestServerTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueTestCertificate(t, "Plugin CA", nil)
+	certPath, keyPath := issueTestCertificate(t, "plugin-1.example.com", ca).writePEM(t, dir)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	serverTLS, err := NewServerTLS(ServerTLSConfig{CertPath: certPath, KeyPath: keyPath})
+	if err != nil {
+		t.Fatalf("NewServerTLS returned an error: %v", err)
+	}
+	listener := newServerTLSTestServer(t, serverTLS)
+
+	if name, err := dispatchOverTLS(t, listener, &tls.Config{RootCAs: roots}); err != nil || name != "plugin-1.example.com" {
+		t.Fatalf("Expected plugin-1.example.com, got %q, %v", name, err)
+	}
+
+	issueTestCertificate(t, "plugin-2.example.com", ca).writePEM(t, dir)
+	if err := serverTLS.Reload(); err != nil {
+		t.Fatalf("Reload returned an error: %v", err)
+	}
+	if name, err := dispatchOverTLS(t, listener, &tls.Config{RootCAs: roots}); err != nil || name != "plugin-2.example.com" {
+		t.Errorf("Expected plugin-2.example.com after the reload, got %q, %v", name, err)
+	}
+
+	// A broken certificate keeps the current one in use
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := serverTLS.Reload(); err == nil {
+		t.Error("Expected the reload of a broken certificate to fail")
+	}
+	if name, err := dispatchOverTLS(t, listener, &tls.Config{RootCAs: roots}); err != nil || name != "plugin-2.example.com" {
+		t.Errorf("Expected plugin-2.example.com to stay in use, got %q, %v", name, err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// Open Banking event notification URIs and subject claims
+const (
+	obEventURIPrefix = "urn:uk:org:openbanking:events:"
+	obSubjectRID     = "http://openbanking.org.uk/rid"
+	obSubjectRTY     = "http://openbanking.org.uk/rty"
+	obSubjectRLK     = "http://openbanking.org.uk/rlk"
+	// Subject type of every Open Banking event: a resource identified by its ID and type
+	obSubjectType     = obSubjectRID + "_" + obSubjectRTY
+	setAudienceHeader = "x-set-audience"
+)
+
+// setEventTypePattern matches the event types that can follow the Open Banking event URI prefix
+var setEventTypePattern = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+
+// SETConfig contains configuration for generating Security Event Tokens
+type SETConfig struct {
+	// Issuer of the SETs (default: the JWS issuer)
+	Issuer string
+	// Base URL of the resources the events are about, e.g.
+	// https://bank.example.com/open-banking/v3.1/pisp (required to build SETs)
+	ResourceLinkBase string
+	// Version of the linked resource API (default: 3.1)
+	ResourceLinkVersion string
+}
+
+// Default SET configuration values
+var defaultSETConfig = SETConfig{
+	ResourceLinkVersion: "3.1",
+}
+
+// bankEvent is an event published by the bank
+type bankEvent struct {
+	ID           string          `json:"id"`
+	Type         string          `json:"type"`
+	ResourceID   string          `json:"resourceId"`
+	ResourceType string          `json:"resourceType"`
+	Timestamp    json.RawMessage `json:"timestamp"`
+}
+
+// SecurityEventToken holds the claims of an RFC 8417 Security Event Token
+type SecurityEventToken struct {
+	Issuer        string                 `json:"iss"`
+	IssuedAt      int64                  `json:"iat"`
+	JWTID         string                 `json:"jti"`
+	Audience      string                 `json:"aud"`
+	Subject       string                 `json:"sub"`
+	TransactionID string                 `json:"txn"`
+	TimeOfEvent   int64                  `json:"toe"`
+	Events        map[string]interface{} `json:"events"`
+}
+
+// setIssuer returns the issuer of the SETs
+func (d *DPoPHandler) setIssuer() string {
+	if d.setConfig.Issuer != "" {
+		return d.setConfig.Issuer
+	}
+	return d.jwsConfig.Issuer
+}
+
+// buildSecurityEventToken turns a bank event into the SET notifying the
+// audience, the client ID of the subscribing TPP
+func (d *DPoPHandler) buildSecurityEventToken(event bankEvent, audience, transactionID string, now time.Time) (*SecurityEventToken, error) {
+	issuer := d.setIssuer()
+	if issuer == "" {
+		return nil, errors.New("SET issuer not configured")
+	}
+	if d.setConfig.ResourceLinkBase == "" {
+		return nil, errors.New("SET resource link base not configured")
+	}
+	if audience == "" {
+		return nil, errors.New("SET audience missing")
+	}
+	if event.ResourceID == "" || event.ResourceType == "" {
+		return nil, errors.New("event has no resource")
+	}
+
+	eventType := strings.TrimPrefix(event.Type, obEventURIPrefix)
+	if !setEventTypePattern.MatchString(eventType) {
+		return nil, fmt.Errorf("invalid event type %q", event.Type)
+	}
+
+	timeOfEvent, err := parseEventTimestamp(event.Timestamp, now)
+	if err != nil {
+		return nil, err
+	}
+
+	jti := event.ID
+	if jti == "" {
+		if jti, err = newUUID(); err != nil {
+			return nil, err
+		}
+	}
+	if transactionID == "" {
+		if transactionID, err = newUUID(); err != nil {
+			return nil, err
+		}
+	}
+
+	// The subject is the resource, by its URL and in the event by its ID, type and link
+	resourceURL := strings.TrimSuffix(d.setConfig.ResourceLinkBase, "/") + "/" + event.ResourceType + "s/" + event.ResourceID
+	subject := map[string]interface{}{
+		"subject_type": obSubjectType,
+		obSubjectRID:   event.ResourceID,
+		obSubjectRTY:   event.ResourceType,
+		obSubjectRLK: []map[string]string{{
+			"version": d.setConfig.ResourceLinkVersion,
+			"link":    resourceURL,
+		}},
+	}
+
+	return &SecurityEventToken{
+		Issuer:        issuer,
+		IssuedAt:      now.Unix(),
+		JWTID:         jti,
+		Audience:      audience,
+		Subject:       resourceURL,
+		TransactionID: transactionID,
+		TimeOfEvent:   timeOfEvent,
+		Events: map[string]interface{}{
+			obEventURIPrefix + eventType: map[string]interface{}{"subject": subject},
+		},
+	}, nil
+}
+
+// parseEventTimestamp reads an event timestamp given as RFC 3339 or Unix
+// seconds, defaulting to now when the event has none
+func parseEventTimestamp(raw json.RawMessage, now time.Time) (int64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return now.Unix(), nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		seconds, err := strconv.ParseInt(string(raw), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid event timestamp: %s", raw)
+		}
+		return seconds, nil
+	}
+
+	timestamp, err := time.Parse(time.RFC3339, text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid event timestamp: %w", err)
+	}
+	return timestamp.Unix(), nil
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate UUID: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// signSecurityEventToken signs the SET as a compact JWS
+func (d *DPoPHandler) signSecurityEventToken(ctx context.Context, set *SecurityEventToken, key *SigningKey) (string, error) {
+	claims, err := json.Marshal(set)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal claims: %w", err)
+	}
+
+	header := map[string]interface{}{
+		"alg": key.Algorithm,
+		"kid": key.KeyID,
+		"typ": "secevent+jwt",
+	}
+	return d.signCompactJWS(ctx, header, claims, key)
+}
+
+// SETSign implements the hook turning a bank event into a signed Security
+// Event Token addressed to the subscribing TPP, whose client ID is taken from
+// the x-set-audience header.
+func (d *DPoPHandler) SETSign(ctx context.Context, object *pb.Object) (*pb.Object, error) {
+	logger(ctx).Info("Running SETSign hook")
+
+	if d.setIssuer() == "" || d.setConfig.ResourceLinkBase == "" {
+		logger(ctx).Error("SET issuer or resource link base not configured")
+		return d.respondWithError(object, "SET signing not configured", http.StatusInternalServerError)
+	}
+
+	key, err := d.apiSigningKey(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("No JWS signing key available: %v", err)
+		return d.respondWithError(object, "JWS signing not configured", http.StatusInternalServerError)
+	}
+
+	// The SET is signed with the algorithms allowed for the API's profile
+	profile, err := d.apiJWSProfile(ctx, object)
+	if err != nil {
+		logger(ctx).Errorf("Invalid JWS profile configuration: %v", err)
+		return d.respondWithError(object, "JWS signing misconfigured", http.StatusInternalServerError)
+	}
+	if err := checkProfileAlgorithm(profile, key.Algorithm); err != nil {
+		logger(ctx).Errorf("Invalid JWS signing configuration: %v", err)
+		return d.respondWithError(object, "JWS signing misconfigured", http.StatusInternalServerError)
+	}
+
+	body := object.Request.RawBody
+	if len(body) == 0 {
+		body = []byte(object.Request.Body)
+	}
+	var event bankEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		logger(ctx).Warnf("Invalid event payload: %v", err)
+		return d.reject(object, reasonInvalidEvent, "Invalid event payload", http.StatusBadRequest)
+	}
+
+	set, err := d.buildSecurityEventToken(event, getHeader(object.Request.Headers, setAudienceHeader), getHeader(object.Request.Headers, "x-fapi-interaction-id"), time.Now())
+	if err != nil {
+		logger(ctx).Warnf("Failed to build SET: %v", err)
+		return d.reject(object, reasonInvalidEvent, fmt.Sprintf("Failed to build SET: %v", err), http.StatusBadRequest)
+	}
+
+	token, err := d.signSecurityEventToken(ctx, set, key)
+	if err != nil {
+		logger(ctx).Errorf("Failed to sign SET: %v", err)
+		return d.respondWithError(object, "Failed to sign SET", signErrorStatus(err))
+	}
+
+	// Replace the event with the signed SET
+	object.Request.Body = token
+	object.Request.RawBody = []byte(token)
+	if object.Request.SetHeaders == nil {
+		object.Request.SetHeaders = map[string]string{}
+	}
+	object.Request.SetHeaders["Content-Type"] = "application/jwt"
+	object.Request.DeleteHeaders = append(object.Request.DeleteHeaders, setAudienceHeader)
+
+	logger(ctx).Infof("Built SET %s for event type %s", set.JWTID, event.Type)
+
+	// Encrypt the SET for TPPs that receive their notifications encrypted
+	if recipient, ok := d.jweRecipient(object); ok {
+		return d.encryptRequestBody(ctx, object, token, recipient, set.JWTID)
+	}
+
+	return d.forwardToRewriteTarget(ctx, object, set.JWTID)
+}
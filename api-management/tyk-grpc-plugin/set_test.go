@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// testBankEvent is an event as published by the bank on Kafka
+const testBankEvent = `{"id":"evt-123","type":"resource-update","resourceId":"pmt-1","resourceType":"domestic-payment","timestamp":"2025-01-02T03:04:05Z","data":{"status":"AcceptedSettlementCompleted"}}`
+
+// newSETTestHandler creates a handler signing SETs with a test key
+func newSETTestHandler(t *testing.T) *DPoPHandler {
+	privateKey, _ := generateTestKey(t)
+	return &DPoPHandler{
+		privateKey: privateKey,
+		jwsConfig:  JWSConfig{KeyID: "bank-kid", Issuer: "https://bank.example.com"},
+		setConfig:  SETConfig{ResourceLinkBase: "https://bank.example.com/pisp", ResourceLinkVersion: "3.1"},
+	}
+}
+
+// decodeSETClaims verifies a compact SET and returns its header and claims
+func decodeSETClaims(t *testing.T, handler *DPoPHandler, token string) (map[string]interface{}, map[string]interface{}) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[1] == "" {
+		t.Fatalf("Expected a compact JWS with an attached payload, got %q", token)
+	}
+
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if err := verifyJWSSignature("ES256", handler.privateKey.Public(), []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		t.Fatalf("SET signature did not verify: %v", err)
+	}
+
+	var header, claims map[string]interface{}
+	headerBytes, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	claimsBytes, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		t.Fatalf("Failed to decode header: %v", err)
+	}
+	if err := json.Unmarshal(claimsBytes, &claims); err != nil {
+		t.Fatalf("Failed to decode claims: %v", err)
+	}
+	return header, claims
+}
+
+// TestSETSignForwardsToCallback tests that the event is delivered to the TPP callback as a signed SET
+func TestSETSignForwardsToCallback(t *testing.T) {
+	handler := newSETTestHandler(t)
+
+	var received *http.Request
+	var receivedBody []byte
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer callback.Close()
+
+	object := &pb.Object{
+		HookName: "SETSign",
+		Request: &pb.MiniRequestObject{
+			Headers: map[string]string{
+				"Content-Type":          "application/json",
+				"X-Rewrite-Target":      callback.URL + "/event-notifications",
+				"X-Set-Audience":        "tpp-client",
+				"X-Fapi-Interaction-Id": "interaction-1",
+			},
+			Body:   testBankEvent,
+			Method: "POST",
+		},
+	}
+
+	result, err := handler.SETSign(context.Background(), object)
+	if err != nil {
+		t.Fatalf("SETSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides == nil || result.Request.ReturnOverrides.ResponseCode != http.StatusAccepted {
+		t.Fatalf("Expected the callback response to be returned, got %+v", result.Request.ReturnOverrides)
+	}
+
+	if received.Header.Get("Content-Type") != "application/jwt" {
+		t.Errorf("Expected Content-Type application/jwt, got %s", received.Header.Get("Content-Type"))
+	}
+	if received.Header.Get("X-Set-Audience") != "" || received.Header.Get("X-Rewrite-Target") != "" {
+		t.Error("Expected the routing headers to be removed")
+	}
+
+	header, claims := decodeSETClaims(t, handler, string(receivedBody))
+	if header["typ"] != "secevent+jwt" || header["kid"] != "bank-kid" {
+		t.Errorf("Unexpected SET header: %v", header)
+	}
+
+	expected := map[string]interface{}{
+		"iss": "https://bank.example.com",
+		"jti": "evt-123",
+		"aud": "tpp-client",
+		"sub": "https://bank.example.com/pisp/domestic-payments/pmt-1",
+		"txn": "interaction-1",
+		"toe": float64(time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC).Unix()),
+	}
+	for claim, value := range expected {
+		if claims[claim] != value {
+			t.Errorf("Expected %s %v, got %v", claim, value, claims[claim])
+		}
+	}
+
+	events, _ := claims["events"].(map[string]interface{})
+	event, ok := events["urn:uk:org:openbanking:events:resource-update"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("Expected a resource-update event, got %v", claims["events"])
+	}
+	subject := event["subject"].(map[string]interface{})
+	if subject["subject_type"] != "http://openbanking.org.uk/rid_http://openbanking.org.uk/rty" {
+		t.Errorf("Expected the Open Banking subject type, got %v", subject["subject_type"])
+	}
+	if subject[obSubjectRID] != "pmt-1" || subject[obSubjectRTY] != "domestic-payment" {
+		t.Errorf("Unexpected event subject: %v", subject)
+	}
+	links, _ := subject[obSubjectRLK].([]interface{})
+	if len(links) != 1 || links[0].(map[string]interface{})["link"] != "https://bank.example.com/pisp/domestic-payments/pmt-1" {
+		t.Errorf("Unexpected resource links: %v", subject[obSubjectRLK])
+	}
+}
+
+// TestSETSignWithoutTarget tests that the SET replaces the body when the request continues upstream
+func TestSETSignWithoutTarget(t *testing.T) {
+	handler := newSETTestHandler(t)
+	object := &pb.Object{
+		HookName: "SETSign",
+		Request: &pb.MiniRequestObject{
+			Headers: map[string]string{"X-Set-Audience": "tpp-client"},
+			Body:    `{"type":"consent-authorization-revoked","resourceId":"c-1","resourceType":"account-access-consent"}`,
+			Method:  "POST",
+		},
+	}
+
+	result, err := handler.SETSign(context.Background(), object)
+	if err != nil {
+		t.Fatalf("SETSign returned an error: %v", err)
+	}
+	if result.Request.SetHeaders["Content-Type"] != "application/jwt" {
+		t.Errorf("Expected Content-Type application/jwt, got %s", result.Request.SetHeaders["Content-Type"])
+	}
+
+	_, claims := decodeSETClaims(t, handler, result.Request.Body)
+	if claims["jti"] == "" || claims["txn"] == "" {
+		t.Error("Expected jti and txn to be generated")
+	}
+	if _, ok := claims["events"].(map[string]interface{})["urn:uk:org:openbanking:events:consent-authorization-revoked"]; !ok {
+		t.Errorf("Expected a consent-authorization-revoked event, got %v", claims["events"])
+	}
+}
+
+// TestSETSignRejectsInvalidEvents tests the rejection of events that cannot become a SET
+func TestSETSignRejectsInvalidEvents(t *testing.T) {
+	handler := newSETTestHandler(t)
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+	}{
+		{"not JSON", map[string]string{"X-Set-Audience": "tpp"}, "not json"},
+		{"missing audience", map[string]string{}, testBankEvent},
+		{"callback URL but no audience", map[string]string{"X-Rewrite-Target": "https://tpp.example.com/events"}, testBankEvent},
+		{"missing resource", map[string]string{"X-Set-Audience": "tpp"}, `{"type":"resource-update"}`},
+		{"invalid event type", map[string]string{"X-Set-Audience": "tpp"}, `{"type":"Resource Update","resourceId":"1","resourceType":"x"}`},
+		{"invalid timestamp", map[string]string{"X-Set-Audience": "tpp"}, `{"type":"resource-update","resourceId":"1","resourceType":"x","timestamp":"yesterday"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			object := &pb.Object{
+				HookName: "SETSign",
+				Request:  &pb.MiniRequestObject{Headers: tt.headers, Body: tt.body, Method: "POST"},
+			}
+			result, err := handler.SETSign(context.Background(), object)
+			if err != nil {
+				t.Fatalf("SETSign returned an error: %v", err)
+			}
+			if result.Request.ReturnOverrides == nil || result.Request.ReturnOverrides.ResponseCode != http.StatusBadRequest {
+				t.Errorf("Expected the event to be rejected with %d", http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+// TestSETSignNotConfigured tests that SETs are not built without a resource link base
+func TestSETSignNotConfigured(t *testing.T) {
+	handler := newSETTestHandler(t)
+	handler.setConfig.ResourceLinkBase = ""
+	object := &pb.Object{
+		HookName: "SETSign",
+		Request:  &pb.MiniRequestObject{Headers: map[string]string{"X-Set-Audience": "tpp-client"}, Body: testBankEvent, Method: "POST"},
+	}
+
+	result, err := handler.SETSign(context.Background(), object)
+	if err != nil {
+		t.Fatalf("SETSign returned an error: %v", err)
+	}
+	if result.Request.ReturnOverrides == nil || result.Request.ReturnOverrides.ResponseCode != http.StatusInternalServerError {
+		t.Errorf("Expected the event to be refused with %d", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Errors returned by remote signers, so callers can tell a slow signing
+// service from an unreachable one or one that refused the request
+var (
+	errSignerTimeout     = errors.New("signing service timed out")
+	errSignerUnavailable = errors.New("signing service unavailable")
+	errSignerRejected    = errors.New("signing service rejected the request")
+)
+
+// contextSigner is a crypto.Signer whose signing can be cancelled, such as one
+// calling a remote signing service
+type contextSigner interface {
+	crypto.Signer
+	SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error)
+}
+
+// RemoteSignerConfig contains configuration for a remote signing service
+type RemoteSignerConfig struct {
+	// Base URL of the signing service
+	URL string
+	// Identifier of the key held by the signing service
+	KeyID string
+	// Bearer token sent to the signing service (optional)
+	Token string
+	// Time allowed for a single signing request (default: 2 seconds)
+	Timeout time.Duration
+}
+
+// Default remote signer configuration values
+var defaultRemoteSignerConfig = RemoteSignerConfig{
+	Timeout: 2 * time.Second,
+}
+
+// RemoteSigner is a crypto.Signer whose private key is held by a KMS or HSM
+// fronted by a signing service. The service exposes two endpoints:
+//
+//	GET  <url>/keys/<kid>       returns the public key as a JWK
+//	POST <url>/keys/<kid>/sign  signs {"algorithm", "digest"} and returns {"signature"}
+//
+// Digests and signatures are base64url-encoded. ECDSA signatures are ASN.1
+// encoded, as returned by every crypto.Signer. For Ed25519 the digest is the
+// message itself.
+type RemoteSigner struct {
+	config    RemoteSignerConfig
+	client    *http.Client
+	publicKey crypto.PublicKey
+}
+
+// remoteSignRequest is the body of a signing request
+type remoteSignRequest struct {
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+}
+
+// remoteSignResponse is the body of a signing response
+type remoteSignResponse struct {
+	Signature string `json:"signature"`
+}
+
+// NewRemoteSigner creates a remote signer and fetches its public key
+func NewRemoteSigner(config RemoteSignerConfig) (*RemoteSigner, error) {
+	if config.URL == "" || config.KeyID == "" {
+		return nil, errors.New("remote signer requires a URL and a key ID")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultRemoteSignerConfig.Timeout
+	}
+
+	signer := &RemoteSigner{
+		config: config,
+		client: &http.Client{Timeout: config.Timeout},
+	}
+
+	body, err := signer.do(context.Background(), http.MethodGet, signer.keyURL(""), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch public key %s: %w", config.KeyID, err)
+	}
+	var jwk JWK
+	if err := json.Unmarshal(body, &jwk); err != nil {
+		return nil, fmt.Errorf("failed to parse public key %s: %w", config.KeyID, err)
+	}
+	signer.publicKey, err = jwk.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key %s: %w", config.KeyID, err)
+	}
+
+	return signer, nil
+}
+
+// Public returns the public key of the remote key
+func (s *RemoteSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign asks the signing service to sign the digest
+func (s *RemoteSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.SignContext(context.Background(), digest, opts)
+}
+
+// SignContext asks the signing service to sign the digest, giving up when the
+// context is done or the signer timeout passes, whichever comes first
+func (s *RemoteSigner) SignContext(ctx context.Context, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	algorithm, err := remoteSignAlgorithm(s.publicKey, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := json.Marshal(remoteSignRequest{
+		Algorithm: algorithm,
+		Digest:    base64.RawURLEncoding.EncodeToString(digest),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signing request: %w", err)
+	}
+
+	body, err := s.do(ctx, http.MethodPost, s.keyURL("/sign"), request)
+	if err != nil {
+		return nil, err
+	}
+
+	var response remoteSignResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return nil, fmt.Errorf("%w: invalid response: %v", errSignerUnavailable, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(response.Signature)
+	if err != nil || len(signature) == 0 {
+		return nil, fmt.Errorf("%w: invalid signature encoding", errSignerUnavailable)
+	}
+	return signature, nil
+}
+
+// keyURL builds the URL of the key resource, or one of its sub-resources
+func (s *RemoteSigner) keyURL(suffix string) string {
+	return s.config.URL + "/keys/" + url.PathEscape(s.config.KeyID) + suffix
+}
+
+// do sends a request to the signing service and classifies its failures
+func (s *RemoteSigner) do(ctx context.Context, method, target string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create signing request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if s.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.config.Token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("signing request cancelled: %w", ctx.Err())
+		}
+		var netErr net.Error
+		if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+			return nil, fmt.Errorf("%w after %s", errSignerTimeout, s.config.Timeout)
+		}
+		return nil, fmt.Errorf("%w: %v", errSignerUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read response: %v", errSignerUnavailable, err)
+	}
+
+	switch {
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return nil, fmt.Errorf("%w: status %d", errSignerUnavailable, resp.StatusCode)
+	case resp.StatusCode >= 400:
+		return nil, fmt.Errorf("%w: status %d: %s", errSignerRejected, resp.StatusCode, bytes.TrimSpace(respBody))
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%w: unexpected status %d", errSignerUnavailable, resp.StatusCode)
+	}
+	return respBody, nil
+}
+
+// remoteSignAlgorithm names the signing algorithm for the signing service,
+// following the naming used by cloud KMS APIs
+func remoteSignAlgorithm(publicKey crypto.PublicKey, opts crypto.SignerOpts) (string, error) {
+	hashNames := map[crypto.Hash]string{
+		crypto.SHA256: "SHA_256",
+		crypto.SHA384: "SHA_384",
+		crypto.SHA512: "SHA_512",
+	}
+
+	switch publicKey.(type) {
+	case ed25519.PublicKey:
+		return "ED25519", nil
+	case *ecdsa.PublicKey, *rsa.PublicKey:
+	default:
+		return "", fmt.Errorf("unsupported key type %T", publicKey)
+	}
+
+	hashName, ok := hashNames[opts.HashFunc()]
+	if !ok {
+		return "", fmt.Errorf("unsupported hash function %v", opts.HashFunc())
+	}
+
+	switch publicKey.(type) {
+	case *ecdsa.PublicKey:
+		return "ECDSA_" + hashName, nil
+	default:
+		if _, pss := opts.(*rsa.PSSOptions); pss {
+			return "RSASSA_PSS_" + hashName, nil
+		}
+		return "RSASSA_PKCS1_V1_5_" + hashName, nil
+	}
+}
+
+// signErrorStatus maps a signing failure to the status code returned to the caller
+func signErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, errSignerTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, errSignerUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// testSigningService is a local stand-in for a KMS or HSM signing service
+type testSigningService struct {
+	keys map[string]crypto.Signer
+	// Delay before answering signing requests
+	delay time.Duration
+	// Status code returned instead of signing (0 signs normally)
+	failStatus int
+}
+
+// ServeHTTP implements the signing service protocol expected by RemoteSigner
+func (s *testSigningService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/keys/"), "/")
+	key, ok := s.keys[parts[0]]
+	if !ok {
+		http.Error(w, "unknown key", http.StatusNotFound)
+		return
+	}
+
+	if r.Method == http.MethodGet && len(parts) == 1 {
+		jwk, _ := NewJWK(key.Public(), parts[0], "")
+		json.NewEncoder(w).Encode(jwk)
+		return
+	}
+
+	time.Sleep(s.delay)
+	if s.failStatus != 0 {
+		http.Error(w, "signing failed", s.failStatus)
+		return
+	}
+
+	var request remoteSignRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	digest, _ := base64.RawURLEncoding.DecodeString(request.Digest)
+
+	// Map the algorithm name back to the signer options
+	var opts crypto.SignerOpts
+	switch request.Algorithm {
+	case "ECDSA_SHA_256", "RSASSA_PKCS1_V1_5_SHA_256":
+		opts = crypto.SHA256
+	case "ECDSA_SHA_384":
+		opts = crypto.SHA384
+	case "RSASSA_PSS_SHA_256":
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	case "ED25519":
+		opts = crypto.Hash(0)
+	default:
+		http.Error(w, "unsupported algorithm", http.StatusBadRequest)
+		return
+	}
+
+	signature, err := key.Sign(rand.Reader, digest, opts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(remoteSignResponse{Signature: base64.RawURLEncoding.EncodeToString(signature)})
+}
+
+// TestRemoteSignerAlgorithms tests signing through the signing service with every key type
+func TestRemoteSignerAlgorithms(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate RSA key: %v", err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	service := &testSigningService{keys: map[string]crypto.Signer{
+		"ec-key": p256, "ec384-key": p384, "rsa-key": rsaKey, "ed-key": edKey,
+	}}
+	server := httptest.NewServer(service)
+	defer server.Close()
+
+	tests := []struct {
+		keyID       string
+		expectedAlg string
+	}{
+		{"ec-key", "ES256"},
+		{"ec384-key", "ES384"},
+		{"rsa-key", "PS256"},
+		{"ed-key", "EdDSA"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.keyID, func(t *testing.T) {
+			signer, err := NewRemoteSigner(RemoteSignerConfig{URL: server.URL, KeyID: tt.keyID})
+			if err != nil {
+				t.Fatalf("NewRemoteSigner returned an error: %v", err)
+			}
+
+			handler := &DPoPHandler{privateKey: signer, jwsConfig: JWSConfig{KeyID: tt.keyID}}
+			handler.pluginMetrics = NewPluginMetrics(handler)
+			payload := []byte(`{"test":"payload"}`)
+			jws, err := handler.createDetachedJWS(payload)
+			if err != nil {
+				t.Fatalf("createDetachedJWS returned an error: %v", err)
+			}
+
+			header := decodeJWSHeader(t, jws)
+			if header["alg"] != tt.expectedAlg {
+				t.Errorf("Expected alg %s, got %v", tt.expectedAlg, header["alg"])
+			}
+
+			// The signature verifies with the key held by the service
+			parts := strings.Split(jws, ".")
+			signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+			signingInput := append([]byte(parts[0]+"."), payload...)
+			if err := verifyJWSSignature(tt.expectedAlg, service.keys[tt.keyID].Public(), signingInput, signature); err != nil {
+				t.Errorf("Signature did not verify: %v", err)
+			}
+
+			if count := signCount(handler.pluginMetrics, "success"); count != 1 {
+				t.Errorf("Expected 1 signature in the metrics, got %d", count)
+			}
+		})
+	}
+}
+
+// TestRemoteSignerFailures tests that signer failures surface as distinct errors, metrics and status codes
+func TestRemoteSignerFailures(t *testing.T) {
+	key, _ := generateTestKey(t)
+
+	tests := []struct {
+		name           string
+		service        *testSigningService
+		expectedErr    error
+		expectedStatus int32
+		outcome        string
+	}{
+		{
+			name:           "timeout",
+			service:        &testSigningService{delay: 200 * time.Millisecond},
+			expectedErr:    errSignerTimeout,
+			expectedStatus: http.StatusGatewayTimeout,
+			outcome:        "timeout",
+		},
+		{
+			name:           "unavailable",
+			service:        &testSigningService{failStatus: http.StatusServiceUnavailable},
+			expectedErr:    errSignerUnavailable,
+			expectedStatus: http.StatusServiceUnavailable,
+			outcome:        "unavailable",
+		},
+		{
+			name:           "rejected",
+			service:        &testSigningService{failStatus: http.StatusForbidden},
+			expectedErr:    errSignerRejected,
+			expectedStatus: http.StatusInternalServerError,
+			outcome:        "rejected",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.service.keys = map[string]crypto.Signer{"hsm-key": key}
+			server := httptest.NewServer(tt.service)
+			defer server.Close()
+
+			signer, err := NewRemoteSigner(RemoteSignerConfig{URL: server.URL, KeyID: "hsm-key", Timeout: 50 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("NewRemoteSigner returned an error: %v", err)
+			}
+
+			handler := &DPoPHandler{privateKey: signer, jwsConfig: JWSConfig{KeyID: "hsm-key"}}
+			handler.pluginMetrics = NewPluginMetrics(handler)
+
+			if _, err := handler.createDetachedJWS([]byte("{}")); !errors.Is(err, tt.expectedErr) {
+				t.Errorf("Expected %v, got %v", tt.expectedErr, err)
+			}
+			if count := signCount(handler.pluginMetrics, tt.outcome); count != 1 {
+				t.Errorf("Expected the failure to be counted once, got %d", count)
+			}
+
+			// The hook reports the failure with a matching status code
+			object := &pb.Object{
+				HookName: "JWSSign",
+				Request:  &pb.MiniRequestObject{Body: "{}", Method: "POST"},
+			}
+			result, err := handler.JWSSign(context.Background(), object)
+			if err != nil {
+				t.Fatalf("JWSSign returned an error: %v", err)
+			}
+			if result.Request.ReturnOverrides == nil || result.Request.ReturnOverrides.ResponseCode != tt.expectedStatus {
+				t.Errorf("Expected status %d", tt.expectedStatus)
+			}
+		})
+	}
+}
+
+// TestRemoteSignerContext tests that a cancelled hook stops a slow signing request
+func TestRemoteSignerContext(t *testing.T) {
+	key, _ := generateTestKey(t)
+	server := httptest.NewServer(&testSigningService{keys: map[string]crypto.Signer{"hsm-key": key}, delay: 500 * time.Millisecond})
+	defer server.Close()
+
+	signer, err := NewRemoteSigner(RemoteSignerConfig{URL: server.URL, KeyID: "hsm-key", Timeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("NewRemoteSigner returned an error: %v", err)
+	}
+	handler := &DPoPHandler{privateKey: signer, jwsConfig: JWSConfig{KeyID: "hsm-key"}}
+	handler.pluginMetrics = NewPluginMetrics(handler)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	signingKey, err := handler.defaultSigningKey()
+	if err != nil {
+		t.Fatalf("defaultSigningKey returned an error: %v", err)
+	}
+	if _, err := handler.signDetachedJWS(ctx, []byte("{}"), signingKey, handler.jwsConfig.Profile); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the signing request to stop with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 400*time.Millisecond {
+		t.Errorf("Expected signing to stop with the context, took %s", elapsed)
+	}
+}
+
+// TestKeyRingRemoteKey tests key ring entries held by a signing service
+func TestKeyRingRemoteKey(t *testing.T) {
+	key, _ := generateTestKey(t)
+	server := httptest.NewServer(&testSigningService{keys: map[string]crypto.Signer{"hsm-key": key}})
+	defer server.Close()
+
+	ring, err := NewKeyRing(KeyRingConfig{Keys: []KeyConfig{{KeyID: "hsm-key", SignerURL: server.URL}}})
+	if err != nil {
+		t.Fatalf("NewKeyRing returned an error: %v", err)
+	}
+
+	active, err := ring.Active(time.Now())
+	if err != nil {
+		t.Fatalf("Active returned an error: %v", err)
+	}
+	if _, ok := active.PrivateKey.(*RemoteSigner); !ok {
+		t.Errorf("Expected a remote signer, got %T", active.PrivateKey)
+	}
+	if active.Algorithm != "ES256" {
+		t.Errorf("Expected ES256, got %s", active.Algorithm)
+	}
+
+	// Unknown keys are refused when the ring is loaded
+	if _, err := NewKeyRing(KeyRingConfig{Keys: []KeyConfig{{KeyID: "missing", SignerURL: server.URL}}}); !errors.Is(err, errSignerRejected) {
+		t.Errorf("Expected the unknown key to be rejected, got %v", err)
+	}
+}
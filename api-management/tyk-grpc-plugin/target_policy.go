@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errTargetNotAllowed is returned when a rewrite target violates the target policy
+var errTargetNotAllowed = errors.New("rewrite target not allowed")
+
+// blockedPrefixes lists address ranges that are not covered by the net.IP
+// classification helpers but must not be reachable either
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"), // Carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),  // IETF protocol assignments
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("64:ff9b::/96"),  // NAT64, may map to internal IPv4 addresses
+}
+
+// TargetPolicyConfig restricts the URLs requests can be forwarded to with x-rewrite-target
+type TargetPolicyConfig struct {
+	// URL schemes targets may use (default: https; empty allows any)
+	AllowedSchemes []string
+	// Hosts targets may use, either exact names or "*.example.com" wildcards
+	AllowedHosts []string
+	// Registered callback URL per subscription ID. A target matching the
+	// callback of the request's subscription is allowed.
+	Callbacks map[string]string
+	// Refuse targets resolving to private, loopback, link-local and other
+	// internal addresses (default: true)
+	BlockPrivateNetworks bool
+	// Number of redirects followed, each checked against the policy (default: 3)
+	MaxRedirects int
+}
+
+// Default target policy values
+var defaultTargetPolicyConfig = TargetPolicyConfig{
+	AllowedSchemes:       []string{"https"},
+	BlockPrivateNetworks: true,
+	MaxRedirects:         3,
+}
+
+// loadTargetCallbacks reads the registered callback URL per subscription ID from a JSON file
+func loadTargetCallbacks(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read callbacks: %w", err)
+	}
+
+	callbacks := map[string]string{}
+	if err := json.Unmarshal(data, &callbacks); err != nil {
+		return nil, fmt.Errorf("failed to parse callbacks: %w", err)
+	}
+	for subscriptionID, callback := range callbacks {
+		if _, err := url.Parse(callback); err != nil {
+			return nil, fmt.Errorf("invalid callback for subscription %s: %w", subscriptionID, err)
+		}
+	}
+	return callbacks, nil
+}
+
+// checkTarget checks a rewrite target against the scheme and host rules.
+// Addresses are checked when connecting, after DNS resolution.
+func (p *TargetPolicyConfig) checkTarget(target *url.URL, subscriptionID string) error {
+	if len(p.AllowedSchemes) > 0 && !containsFold(p.AllowedSchemes, target.Scheme) {
+		return fmt.Errorf("%w: scheme %q", errTargetNotAllowed, target.Scheme)
+	}
+	if target.Hostname() == "" {
+		return fmt.Errorf("%w: missing host", errTargetNotAllowed)
+	}
+	if target.User != nil {
+		return fmt.Errorf("%w: credentials in URL", errTargetNotAllowed)
+	}
+
+	// Without a host allow-list or callback registry any host passes
+	if len(p.AllowedHosts) == 0 && len(p.Callbacks) == 0 {
+		return nil
+	}
+	if p.hostAllowed(target.Hostname()) {
+		return nil
+	}
+	if callback, ok := p.Callbacks[subscriptionID]; ok && subscriptionID != "" && sameURL(target, callback) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is neither an allowed host nor the registered callback", errTargetNotAllowed, target.Host)
+}
+
+// hostAllowed reports whether the host matches the allow-list
+func (p *TargetPolicyConfig) hostAllowed(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(host, "."+suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// otherHostLabel is the metrics label of target hosts the policy does not name
+const otherHostLabel = "other"
+
+// hostLabel returns the metrics label of a target host: the allowed host or
+// wildcard it matches, or the registered callback host. Other hosts come from
+// clients and share one label, so they cannot add series without bound.
+func (p *TargetPolicyConfig) hostLabel(host string) string {
+	hostname := strings.ToLower(strings.TrimSuffix(host, "."))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = strings.ToLower(strings.TrimSuffix(h, "."))
+	}
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if suffix, ok := strings.CutPrefix(allowed, "*."); ok {
+			if strings.HasSuffix(hostname, "."+suffix) {
+				return allowed
+			}
+		} else if hostname == allowed {
+			return allowed
+		}
+	}
+	for _, callback := range p.Callbacks {
+		if target, err := url.Parse(callback); err == nil && strings.EqualFold(target.Host, host) {
+			return strings.ToLower(target.Host)
+		}
+	}
+	return otherHostLabel
+}
+
+// sameURL reports whether the target is the registered callback URL, comparing
+// scheme and host case-insensitively
+func sameURL(target *url.URL, registered string) bool {
+	callback, err := url.Parse(registered)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(target.Scheme, callback.Scheme) &&
+		strings.EqualFold(target.Host, callback.Host) &&
+		target.EscapedPath() == callback.EscapedPath() &&
+		target.RawQuery == callback.RawQuery
+}
+
+// containsFold reports whether the list contains the value, ignoring case
+func containsFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBlockedAddress reports whether an address is internal and must not be reached
+func isBlockedAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialControl refuses connections to internal addresses. It runs after DNS
+// resolution, for every address tried, so a host cannot pass a check and then
+// resolve to an internal address.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: invalid address %s", errTargetNotAllowed, address)
+	}
+	if isBlockedAddress(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s is an internal address", errTargetNotAllowed, addrPort.Addr())
+	}
+	return nil
+}
+
+// newTransport returns a transport refusing connections to internal addresses
+// when the policy blocks them. A nil TLS configuration keeps the transport defaults.
+func (p *TargetPolicyConfig) newTransport(tlsConfig *tls.Config) *http.Transport {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if p.BlockPrivateNetworks {
+		dialer.Control = dialControl
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	// A proxy would resolve the target itself and bypass the address checks
+	transport.Proxy = nil
+	return transport
+}
+
+// httpClient returns an HTTP client sending requests through the transport
+// and checking redirects against the policy
+func (p *TargetPolicyConfig) httpClient(timeout time.Duration, subscriptionID string, transport http.RoundTripper) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > p.MaxRedirects {
+				return fmt.Errorf("%w: more than %d redirects", errTargetNotAllowed, p.MaxRedirects)
+			}
+			return p.checkTarget(req.URL, subscriptionID)
+		},
+	}
+}
+
+// targetTransport keeps the transport of forwarded requests, so connections to
+// targets are reused instead of repeating the TLS handshake on every attempt
+type targetTransport struct {
+	mu        sync.Mutex
+	tlsConfig *tls.Config
+	transport *http.Transport
+}
+
+// get returns the transport for the TLS configuration, replacing the current
+// one and closing its idle connections when the configuration changed
+func (t *targetTransport) get(policy *TargetPolicyConfig, tlsConfig *tls.Config) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.transport != nil && t.tlsConfig == tlsConfig {
+		return t.transport
+	}
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+	t.transport = policy.newTransport(tlsConfig)
+	t.tlsConfig = tlsConfig
+	return t.transport
+}
+
+// close closes the idle connections of the current transport
+func (t *targetTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.transport != nil {
+		t.transport.CloseIdleConnections()
+	}
+}
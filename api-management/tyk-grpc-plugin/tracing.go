@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// tracerName identifies the spans created by the plugin
+const tracerName = "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin"
+
+// interactionIDHeader carries the FAPI interaction ID of a request
+const interactionIDHeader = "x-fapi-interaction-id"
+
+// Span attribute keys
+const (
+	attrHookName      = attribute.Key("tyk.hook.name")
+	attrHookType      = attribute.Key("tyk.hook.type")
+	attrAPIID         = attribute.Key("tyk.api_id")
+	attrInteractionID = attribute.Key("fapi.interaction_id")
+	attrStatusCode    = attribute.Key("http.response.status_code")
+	attrServerAddress = attribute.Key("server.address")
+	attrAttempts      = attribute.Key("tyk.delivery.attempts")
+	attrDeadLetterID  = attribute.Key("tyk.dead_letter_id")
+	attrCacheHit      = attribute.Key("tyk.idempotency.hit")
+	attrEventID       = attribute.Key("tyk.event_id")
+)
+
+// TracingConfig configures the export of OpenTelemetry traces
+type TracingConfig struct {
+	// Exporter spans are sent with: "otlp" or "none" (default: "none")
+	Exporter string
+	// OTLP/gRPC endpoint of the collector, host:port (default: OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4317)
+	Endpoint string
+	// Connect to the collector without TLS
+	Insecure bool
+	// Fraction of new traces sampled; traces started by the caller follow its decision (default: 1)
+	SampleRatio float64
+	// Service name reported with the spans (default: tyk-grpc-plugin)
+	ServiceName string
+}
+
+// Default tracing configuration values
+var defaultTracingConfig = TracingConfig{
+	Exporter:    "none",
+	SampleRatio: 1,
+	ServiceName: "tyk-grpc-plugin",
+}
+
+// setUpTracing installs the W3C trace context propagator and, when an exporter
+// is configured, a tracer provider exporting the plugin's spans. The returned
+// function flushes and stops the exporter.
+func setUpTracing(config TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	switch config.Exporter {
+	case "", "none":
+		log.Info("Tracing disabled (TRACING_EXPORTER not set); trace context is still propagated")
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unknown tracing exporter %q", config.Exporter)
+	}
+
+	var options []otlptracegrpc.Option
+	if config.Endpoint != "" {
+		options = append(options, otlptracegrpc.WithEndpoint(config.Endpoint))
+	}
+	if config.Insecure {
+		options = append(options, otlptracegrpc.WithInsecure())
+	}
+	// The exporter connects lazily, so an unreachable collector does not stop the plugin
+	exporter, err := otlptracegrpc.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	provider := newTracerProvider(sdktrace.NewBatchSpanProcessor(exporter), config)
+	otel.SetTracerProvider(provider)
+	log.Infof("Exporting traces over OTLP (endpoint: %s, sample ratio: %v)", config.Endpoint, config.SampleRatio)
+	return provider.Shutdown, nil
+}
+
+// newTracerProvider creates a tracer provider sending the sampled spans to the processor
+func newTracerProvider(processor sdktrace.SpanProcessor, config TracingConfig) *sdktrace.TracerProvider {
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultTracingConfig.ServiceName
+	}
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithSpanProcessor(processor),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+}
+
+// tracer returns the tracer of the plugin from the global tracer provider
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// interactionID returns the FAPI interaction ID of the request, or of the
+// response in response hooks
+func interactionID(object *pb.Object) string {
+	if object.Request != nil {
+		if id := getHeader(object.Request.Headers, interactionIDHeader); id != "" {
+			return id
+		}
+	}
+	if object.Response != nil {
+		return getHeader(object.Response.Headers, interactionIDHeader)
+	}
+	return ""
+}
+
+// requestTraceContext returns the trace context sent in the request headers,
+// which is invalid when there is none
+func requestTraceContext(object *pb.Object) trace.SpanContext {
+	if object.Request == nil {
+		return trace.SpanContext{}
+	}
+	carrier := propagation.HeaderCarrier(http.Header{})
+	for key, value := range object.Request.Headers {
+		carrier.Set(key, value)
+	}
+	return trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), carrier))
+}
+
+// startHookSpan starts the span of a hook call as a child of the gRPC call,
+// whose trace context comes from the gateway's metadata. The request headers
+// come from the client, who must not choose the parent or the sampling of the
+// span, so a trace context found there is only linked.
+func startHookSpan(ctx context.Context, hook *HookDefinition, object *pb.Object) (context.Context, trace.Span) {
+	attributes := []attribute.KeyValue{
+		attrHookName.String(hook.Name),
+		attrHookType.String(object.HookType.String()),
+		attrAPIID.String(object.Spec["APIID"]),
+	}
+	if id := interactionID(object); id != "" {
+		attributes = append(attributes, attrInteractionID.String(id))
+	}
+	options := []trace.SpanStartOption{trace.WithAttributes(attributes...)}
+
+	if client := requestTraceContext(object); client.IsValid() && client.TraceID() != trace.SpanContextFromContext(ctx).TraceID() {
+		options = append(options, trace.WithLinks(trace.Link{SpanContext: client}))
+	}
+	return tracer().Start(ctx, "hook "+hook.Name, options...)
+}
+
+// endHookSpan records the outcome of a hook call and ends its span
+func endHookSpan(span trace.Span, statusCode int, err error) {
+	switch {
+	case err != nil:
+		failSpan(span, err)
+	case statusCode != 0:
+		span.SetAttributes(attrStatusCode.Int(statusCode))
+		if statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(statusCode))
+		}
+	}
+	span.End()
+}
+
+// injectTraceContext adds the trace context of ctx to the headers of a
+// forwarded request, replacing any sent by the client
+func injectTraceContext(ctx context.Context, headers map[string]string) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	for key, value := range carrier {
+		for existing := range headers {
+			if strings.EqualFold(existing, key) {
+				delete(headers, existing)
+			}
+		}
+		headers[key] = value
+	}
+}
+
+// failSpan records an error on the span
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "github.com/TykTechnologies/tyk-fapi/api-management/tyk-grpc-plugin/proto/gen"
+)
+
+// newTestTracing records the spans of the test in memory
+func newTestTracing(t *testing.T) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := newTracerProvider(sdktrace.NewSimpleSpanProcessor(exporter), defaultTracingConfig)
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagator)
+		provider.Shutdown(context.Background())
+	})
+	return exporter
+}
+
+// findSpan returns the recorded span with the given name
+func findSpan(t *testing.T, exporter *tracetest.InMemoryExporter, name string) tracetest.SpanStub {
+	t.Helper()
+	for _, span := range exporter.GetSpans() {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("Expected a %q span, got %d other spans", name, len(exporter.GetSpans()))
+	return tracetest.SpanStub{}
+}
+
+// spanAttribute returns the value of a span attribute
+func spanAttribute(span tracetest.SpanStub, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+// TestHookSpans tests that each hook call is traced with the request's identifiers and outcome
+func TestHookSpans(t *testing.T) {
+	exporter := newTestTracing(t)
+	handler := &DPoPHandler{apiConfigs: NewAPIConfigCache()}
+
+	object := newAPITestObject("payments", "")
+	object.HookName, object.HookType = "DPoPCheck", pb.HookType_Pre
+	object.Request.Headers["X-Fapi-Interaction-Id"] = "93bac548-d2de-4546-b106-880a5018460d"
+	if _, err := handler.Dispatch(context.Background(), object); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+
+	span := findSpan(t, exporter, "hook DPoPCheck")
+	for key, expected := range map[attribute.Key]attribute.Value{
+		attrHookName:      attribute.StringValue("DPoPCheck"),
+		attrAPIID:         attribute.StringValue("payments"),
+		attrInteractionID: attribute.StringValue("93bac548-d2de-4546-b106-880a5018460d"),
+		attrStatusCode:    attribute.IntValue(http.StatusUnauthorized),
+	} {
+		if value := spanAttribute(span, key); value != expected {
+			t.Errorf("Expected %s to be %v, got %v", key, expected.Emit(), value.Emit())
+		}
+	}
+}
+
+// TestHookSpanLinksRequestTrace tests that hooks only link to the trace the
+// client sent, without joining it or taking its sampling decision
+func TestHookSpanLinksRequestTrace(t *testing.T) {
+	exporter := newTestTracing(t)
+	handler := &DPoPHandler{apiConfigs: NewAPIConfigCache()}
+
+	object := newAPITestObject("payments", "")
+	object.HookName, object.HookType = "DPoPCheck", pb.HookType_Pre
+	object.Request.Headers["Traceparent"] = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if _, err := handler.Dispatch(context.Background(), object); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+
+	span := findSpan(t, exporter, "hook DPoPCheck")
+	if traceID := span.SpanContext.TraceID().String(); traceID == "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("Expected the hook not to join the client's trace")
+	}
+	if span.Parent.IsValid() {
+		t.Errorf("Expected the hook to have no parent outside a gRPC call, got %s", span.Parent.SpanID())
+	}
+	if len(span.Links) != 1 || span.Links[0].SpanContext.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected a link to the client's span, got %+v", span.Links)
+	}
+}
+
+// TestIdempotencyStoreSpans tests that idempotency store operations are traced
+func TestIdempotencyStoreSpans(t *testing.T) {
+	exporter := newTestTracing(t)
+	handler := &DPoPHandler{apiConfigs: NewAPIConfigCache(), config: defaultConfig, metrics: &IdempotencyMetrics{}}
+	t.Cleanup(func() { idempotencyStore.Delete(idempotencyCacheKey("client-a", "span-key")) })
+
+	object := newAPITestObject("payments", "")
+	object.Request.Headers["X-Idempotency-Key"] = "span-key"
+	object.Request.ReturnOverrides = &pb.ReturnOverrides{ResponseCode: http.StatusCreated}
+	if _, err := handler.IdempotencyResponse(context.Background(), object); err != nil {
+		t.Fatalf("IdempotencyResponse returned an error: %v", err)
+	}
+	if hit := spanAttribute(findSpan(t, exporter, "idempotency.store"), attrCacheHit); hit.AsBool() {
+		t.Error("Expected the store to miss before the response was cached")
+	}
+
+	check := newAPITestObject("payments", "")
+	check.Request.Headers["X-Idempotency-Key"] = "span-key"
+	if _, err := handler.IdempotencyCheck(context.Background(), check); err != nil {
+		t.Fatalf("IdempotencyCheck returned an error: %v", err)
+	}
+	if hit := spanAttribute(findSpan(t, exporter, "idempotency.lookup"), attrCacheHit); !hit.AsBool() {
+		t.Error("Expected the lookup to find the cached response")
+	}
+}
+
+// TestTargetRequestPropagatesTraceContext tests that the target receives the
+// trace context of the forwarding span instead of the client's
+func TestTargetRequestPropagatesTraceContext(t *testing.T) {
+	exporter := newTestTracing(t)
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	handler, _ := newDeliveryTestHandler(t, RetryConfig{MaxAttempts: 1})
+	object := newHookTestObject("JWSSign", pb.HookType_Pre)
+	object.Request.Method = http.MethodPost
+	object.Request.Headers["Traceparent"] = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	ctx, parent := tracer().Start(context.Background(), "hook JWSSign")
+	if _, err := handler.makeTargetRequest(ctx, server.URL, object); err != nil {
+		t.Fatalf("makeTargetRequest returned an error: %v", err)
+	}
+	parent.End()
+
+	span := findSpan(t, exporter, "makeTargetRequest")
+	if span.SpanKind != trace.SpanKindClient || span.Parent.SpanID() != parent.SpanContext().SpanID() {
+		t.Errorf("Expected a client span within the hook span, got kind %v and parent %s", span.SpanKind, span.Parent.SpanID())
+	}
+	if status := spanAttribute(span, attrStatusCode); status.AsInt64() != http.StatusAccepted {
+		t.Errorf("Expected status 202 on the span, got %v", status.Emit())
+	}
+	expected := "00-" + span.SpanContext.TraceID().String() + "-" + span.SpanContext.SpanID().String() + "-01"
+	if traceparent != expected {
+		t.Errorf("Expected the target to receive traceparent %s, got %s", expected, traceparent)
+	}
+}
+
+// TestGRPCServerSpans tests that hook spans are children of the traced gRPC call
+func TestGRPCServerSpans(t *testing.T) {
+	exporter := newTestTracing(t)
+	listener := bufconn.Listen(1 << 20)
+	server := newGRPCServer()
+	pb.RegisterDispatcherServer(server, &DPoPHandler{apiConfigs: NewAPIConfigCache()})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	object := newAPITestObject("payments", "")
+	object.HookName, object.HookType = "DPoPCheck", pb.HookType_Pre
+	if _, err := pb.NewDispatcherClient(conn).Dispatch(context.Background(), object); err != nil {
+		t.Fatalf("Dispatch returned an error: %v", err)
+	}
+	// The server span ends once the response has been sent
+	server.GracefulStop()
+
+	hook := findSpan(t, exporter, "hook DPoPCheck")
+	for _, span := range exporter.GetSpans() {
+		if span.SpanKind == trace.SpanKindServer {
+			if hook.Parent.SpanID() != span.SpanContext.SpanID() {
+				t.Errorf("Expected the hook span within the %s span", span.Name)
+			}
+			return
+		}
+	}
+	t.Error("Expected a server span for the gRPC call")
+}